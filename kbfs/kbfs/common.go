@@ -11,12 +11,6 @@ import (
 	"github.com/keybase/kbfs/libkbfs"
 )
 
-const (
-	topName     = "keybase"
-	publicName  = "public"
-	privateName = "private"
-)
-
 const publicSuffix = libkbfs.ReaderSep + libkbfs.PublicUIDName
 
 func byteCountStr(n int) string {
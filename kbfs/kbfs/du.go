@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func duTlf(ctx context.Context, config libkbfs.Config, tlfPathStr string, showWriters bool) error {
+	folderBranch, tlfPath, relPath, err :=
+		libfs.NewFS(config).Folder(ctx, tlfPathStr)
+	if err != nil {
+		return err
+	}
+
+	if relPath != "" {
+		return notTlfPathErr{tlfPathStr}
+	}
+
+	usage, err := config.KBFSOps().GetTLFUsage(ctx, folderBranch)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d\t%d\t%s\n", usage.LiveBytes, usage.ArchivedBytes, tlfPath)
+	if showWriters {
+		writers := make([]string, 0, len(usage.Writers))
+		for writer := range usage.Writers {
+			writers = append(writers, writer)
+		}
+		sort.Strings(writers)
+		for _, writer := range writers {
+			wu := usage.Writers[writer]
+			fmt.Printf("\t%s: +%d -%d\n", writer, wu.RefBytes, wu.UnrefBytes)
+		}
+	}
+
+	return nil
+}
+
+func du(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs du", flag.ContinueOnError)
+	showWriters := flags.Bool("w", false, "Show the bytes referenced and unreferenced by each writer.")
+	flags.Parse(args)
+
+	tlfPaths := flags.Args()
+	if len(tlfPaths) == 0 {
+		printError("du", errAtLeastOnePath)
+		exitStatus = 1
+		return
+	}
+
+	fmt.Printf("LIVE\tARCHIVED\tFOLDER\n")
+	for _, tlfPath := range tlfPaths {
+		err := duTlf(ctx, config, tlfPath, *showWriters)
+		if err != nil {
+			printError("du", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func printErrorRecord(rec libkbfs.ErrorRecord, verbose bool) {
+	tlf := "-"
+	if rec.Tlf != "" {
+		tlf = rec.Tlf
+		if rec.Public {
+			tlf += publicSuffix
+		}
+	}
+	fmt.Printf("%s\t%s\t%s\t%s\t%s\n", rec.Time.Format(time.RFC3339),
+		rec.Mode, tlf, rec.Type, rec.Error)
+	if !verbose {
+		return
+	}
+	tags := make([]string, 0, len(rec.Tags))
+	for tag := range rec.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		fmt.Printf("\t%s=%s\n", tag, rec.Tags[tag])
+	}
+	for _, frame := range rec.Stack {
+		fmt.Printf("\t\t%s.%s %s:%d\n", frame.Package, frame.Name,
+			frame.File, frame.LineNumber)
+	}
+}
+
+func errorHistory(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs errors", flag.ContinueOnError)
+	tlfPath := flags.String("tlf", "", "Only show errors in the given top-level folder.")
+	since := flags.String("since", "", "Only show errors since the given time, either a duration before now (e.g. 2h) or an RFC 3339 time.")
+	until := flags.String("until", "", "Only show errors until the given time, in the same format as -since.")
+	errType := flags.String("type", "", "Only show errors of the given type (e.g. NoSuchNameError).")
+	limit := flags.Int("n", 0, "Only show the given number of most recent errors.")
+	verbose := flags.Bool("v", false, "Also show the debug tags and stack of each error.")
+	jsonOut := flags.Bool("json", false, "Print the errors as JSON.")
+	flags.Parse(args)
+
+	if len(flags.Args()) > 0 {
+		printError("errors", fmt.Errorf("unexpected arguments %v", flags.Args()))
+		return 1
+	}
+
+	params := make(map[string]string)
+	if *since != "" {
+		params["since"] = *since
+	}
+	if *until != "" {
+		params["until"] = *until
+	}
+	if *errType != "" {
+		params["type"] = *errType
+	}
+	q, err := libfs.ErrorQueryFromParams(params, config.Clock().Now())
+	if err != nil {
+		printError("errors", err)
+		return 1
+	}
+	q.Limit = *limit
+
+	if *tlfPath != "" {
+		h, relPath, err := libfs.NewFS(config).FolderHandle(ctx, *tlfPath)
+		if err != nil {
+			printError("errors", err)
+			return 1
+		}
+		if relPath != "" {
+			printError("errors", notTlfPathErr{*tlfPath})
+			return 1
+		}
+		q.Tlf, q.Public = h.GetCanonicalName(), h.IsPublic()
+	}
+
+	recs, err := config.Reporter().QueryErrors(q)
+	if err != nil {
+		printError("errors", err)
+		return 1
+	}
+
+	if *jsonOut {
+		if recs == nil {
+			recs = []libkbfs.ErrorRecord{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(recs); err != nil {
+			printError("errors", err)
+			return 1
+		}
+		return 0
+	}
+
+	for _, rec := range recs {
+		printErrorRecord(rec, *verbose)
+	}
+	return 0
+}
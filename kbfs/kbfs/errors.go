@@ -11,33 +11,32 @@ import (
 
 var errExactlyOnePath = errors.New("exactly one path must be specified")
 var errAtLeastOnePath = errors.New("at least one path must be specified")
-var errCannotSplit = errors.New("cannot split path")
+var errExactlyTwoPaths = errors.New("exactly two paths must be specified")
 
-type invalidKbfsPathErr struct {
+type cannotWriteErr struct {
 	pathStr string
+	err     error
 }
 
-func (e invalidKbfsPathErr) Error() string {
-	return fmt.Sprintf("invalid kbfs path %s", e.pathStr)
+func (e cannotWriteErr) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("cannot write to %s: %v", e.pathStr, e.err)
+	}
+	return fmt.Sprintf("cannot write to %s", e.pathStr)
 }
 
-type cannotJoinErr struct {
-	p    kbfsPath
-	name string
+type notTlfPathErr struct {
+	pathStr string
 }
 
-func (e cannotJoinErr) Error() string {
-	return fmt.Sprintf("cannot join %s to %s", e.p, e.name)
+func (e notTlfPathErr) Error() string {
+	return fmt.Sprintf("%s is not a top-level folder", e.pathStr)
 }
 
-type cannotWriteErr struct {
+type notTrashEntryErr struct {
 	pathStr string
-	err     error
 }
 
-func (e cannotWriteErr) Error() string {
-	if e.err != nil {
-		return fmt.Sprintf("cannot write to %s: %v", e.pathStr, e.err)
-	}
-	return fmt.Sprintf("cannot write to %s", e.pathStr)
+func (e notTrashEntryErr) Error() string {
+	return fmt.Sprintf("%s is not an entry in a folder's trash", e.pathStr)
 }
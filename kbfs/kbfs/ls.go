@@ -7,17 +7,19 @@ package main
 import (
 	"flag"
 	"fmt"
-	"time"
+	"os"
+	"path"
 
+	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
-func printHeader(p kbfsPath) {
+func printHeader(p string) {
 	fmt.Printf("%s:\n", p)
 }
 
-func computeModeStr(entryType libkbfs.EntryType) string {
+func computeModeStr(entryType libkbfs.EntryType, mode os.FileMode) string {
 	var typeStr string
 	switch entryType {
 	case libkbfs.File:
@@ -32,30 +34,15 @@ func computeModeStr(entryType libkbfs.EntryType) string {
 		typeStr = "?"
 	}
 
-	// TODO: Figure out whether the current user is just a reader,
-	// and omit w below if so.
-	var modeStr string
-	switch entryType {
-	case libkbfs.File:
-		modeStr = "rw-"
-	case libkbfs.Exec:
-		modeStr = "rwx"
-	case libkbfs.Dir:
-		modeStr = "rwx"
-	case libkbfs.Sym:
-		modeStr = "rwx"
-	default:
-		modeStr = "rw-"
-	}
-
-	// TODO: Figure out whether this is a public directory.
-	return fmt.Sprintf("%s%s%s%s", typeStr, modeStr, modeStr, "---")
+	// Drop the type character that FileMode.String() starts with.
+	return typeStr + mode.Perm().String()[1:]
 }
 
-func printEntry(ctx context.Context, config libkbfs.Config, dir kbfsPath, name string, entryType libkbfs.EntryType, longFormat, useSigil bool) {
+func printEntry(fi os.FileInfo, longFormat, useSigil bool) {
+	ei := fi.Sys().(libkbfs.EntryInfo)
 	var sigil string
 	if useSigil {
-		switch entryType {
+		switch ei.Type {
 		case libkbfs.File:
 		case libkbfs.Exec:
 			sigil = "*"
@@ -68,111 +55,52 @@ func printEntry(ctx context.Context, config libkbfs.Config, dir kbfsPath, name s
 		}
 	}
 	if longFormat {
-		p, err := dir.join(name)
-		if err != nil {
-			printError("ls", err)
-		}
-		_, de, err := p.getNode(ctx, config)
-		if err != nil {
-			printError("ls", err)
-		}
-
-		modeStr := computeModeStr(entryType)
-		mtimeStr := time.Unix(0, de.Mtime).Format("Jan 02 15:04")
+		modeStr := computeModeStr(ei.Type, fi.Mode())
+		mtimeStr := fi.ModTime().Format("Jan 02 15:04")
 		var symPathStr string
-		if entryType == libkbfs.Sym {
-			symPathStr = fmt.Sprintf(" -> %s", de.SymPath)
+		if ei.Type == libkbfs.Sym {
+			symPathStr = fmt.Sprintf(" -> %s", ei.SymPath)
 		}
-		fmt.Printf("%s\t%d\t%s\t%s%s%s\n", modeStr, de.Size, mtimeStr, name, sigil, symPathStr)
+		fmt.Printf("%s\t%d\t%s\t%s%s%s\n", modeStr, ei.Size, mtimeStr, fi.Name(), sigil, symPathStr)
 	} else {
-		fmt.Printf("%s%s\n", name, sigil)
+		fmt.Printf("%s%s\n", fi.Name(), sigil)
 	}
 }
 
-func lsHelper(ctx context.Context, config libkbfs.Config, p kbfsPath, hasMultiple bool, handleEntry func(string, libkbfs.EntryType)) error {
-	kbfsOps := config.KBFSOps()
-
-	switch p.pathType {
-	case rootPath:
-		if hasMultiple {
-			printHeader(p)
-		}
-		handleEntry(topName, libkbfs.Dir)
-		return nil
-
-	case keybasePath:
-		if hasMultiple {
-			printHeader(p)
-		}
-		handleEntry(publicName, libkbfs.Dir)
-		handleEntry(privateName, libkbfs.Dir)
-		return nil
-
-	case keybaseChildPath:
-		favs, err := kbfsOps.GetFavorites(ctx)
-		if err != nil {
-			return err
-		}
-
-		if hasMultiple {
-			printHeader(p)
-		}
-		for _, fav := range favs {
-			if p.public == fav.Public {
-				handleEntry(fav.Name, libkbfs.Dir)
-			}
-		}
-		return nil
-
-	case tlfPath:
-		n, de, err := p.getNode(ctx, config)
-		if err != nil {
-			return err
-		}
+func lsHelper(ctx context.Context, fs *libfs.FS, p string, hasMultiple bool, handleEntry func(os.FileInfo)) error {
+	fi, err := fs.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
 
-		if de.Type == libkbfs.Dir {
-			// GetDirChildren doesn't verify the dir-ness
-			// of the node correctly (since it ends up
-			// creating a new DirBlock if the node isn't
-			// in the cache already).
-			//
-			// TODO: Fix the above.
-			children, err := kbfsOps.GetDirChildren(ctx, n)
-			if err != nil {
-				return err
-			}
-
-			if hasMultiple {
-				printHeader(p)
-			}
-			for name, entryInfo := range children {
-				handleEntry(name, entryInfo.Type)
-			}
-		} else {
-			_, name, err := p.dirAndBasename()
-			if err != nil {
-				return err
-			}
-			handleEntry(name, de.Type)
-		}
+	if !fi.IsDir() {
+		handleEntry(fi)
 		return nil
+	}
 
-	default:
-		break
+	fis, err := fs.ReadDir(ctx, p)
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("invalid KBFS path %s", p)
+	if hasMultiple {
+		printHeader(p)
+	}
+	for _, fi := range fis {
+		handleEntry(fi)
+	}
+	return nil
 }
 
-func lsOne(ctx context.Context, config libkbfs.Config, p kbfsPath, longFormat, useSigil, recursive, hasMultiple bool, errorFn func(error)) {
+func lsOne(ctx context.Context, fs *libfs.FS, p string, longFormat, useSigil, recursive, hasMultiple bool, errorFn func(error)) {
 	var children []string
-	handleEntry := func(name string, entryType libkbfs.EntryType) {
-		if recursive && entryType == libkbfs.Dir {
-			children = append(children, name)
+	handleEntry := func(fi os.FileInfo) {
+		if recursive && fi.IsDir() {
+			children = append(children, fi.Name())
 		}
-		printEntry(ctx, config, p, name, entryType, longFormat, useSigil)
+		printEntry(fi, longFormat, useSigil)
 	}
-	err := lsHelper(ctx, config, p, hasMultiple || recursive, handleEntry)
+	err := lsHelper(ctx, fs, p, hasMultiple || recursive, handleEntry)
 	if err != nil {
 		errorFn(err)
 		// Fall-through.
@@ -180,14 +108,8 @@ func lsOne(ctx context.Context, config libkbfs.Config, p kbfsPath, longFormat, u
 
 	if recursive {
 		for _, name := range children {
-			childPath, err := p.join(name)
-			if err != nil {
-				errorFn(err)
-				continue
-			}
-
 			fmt.Print("\n")
-			lsOne(ctx, config, childPath, longFormat, useSigil, true, true, errorFn)
+			lsOne(ctx, fs, path.Join(p, name), longFormat, useSigil, true, true, errorFn)
 		}
 	}
 }
@@ -206,20 +128,14 @@ func ls(ctx context.Context, config libkbfs.Config, args []string) (exitStatus i
 		return
 	}
 
+	fs := libfs.NewFS(config)
 	hasMultiple := len(nodePathStrs) > 1
 	for i, nodePathStr := range nodePathStrs {
-		p, err := makeKbfsPath(nodePathStr)
-		if err != nil {
-			printError("ls", err)
-			exitStatus = 1
-			continue
-		}
-
 		if i > 0 {
 			fmt.Print("\n")
 		}
 
-		lsOne(ctx, config, p, *longFormat, *useSigil, *recursive, hasMultiple, func(err error) {
+		lsOne(ctx, fs, path.Clean(nodePathStr), *longFormat, *useSigil, *recursive, hasMultiple, func(err error) {
 			printError("ls", err)
 			exitStatus = 1
 		})
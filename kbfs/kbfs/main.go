@@ -35,6 +35,12 @@ The possible commands are:
   mkdir		Make directories
   read		Dump file to stdout
   write		Write stdin to file
+  du		Display folder storage usage
+  restore	Restore removed entries from a folder's trash
+  errors	Display the history of reported errors
+  merge-conflicted-tlf
+		Merge conflicted copies of folders into their canonical folders
+  reshare	Copy a folder into a folder shared with different users
 
 `
 
@@ -96,6 +102,16 @@ func realMain() (exitStatus int) {
 		return read(ctx, config, args)
 	case "write":
 		return write(ctx, config, args)
+	case "du":
+		return du(ctx, config, args)
+	case "restore":
+		return restore(ctx, config, args)
+	case "errors":
+		return errorHistory(ctx, config, args)
+	case "merge-conflicted-tlf":
+		return mergeConflictedTlfs(ctx, config, args)
+	case "reshare":
+		return reshare(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
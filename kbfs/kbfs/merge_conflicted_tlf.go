@@ -0,0 +1,73 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func mergeConflictedTlf(ctx context.Context, config libkbfs.Config, tlfPathStr string, verbose bool) error {
+	h, relPath, err := libfs.NewFS(config).FolderHandle(ctx, tlfPathStr)
+	if err != nil {
+		return err
+	}
+
+	if relPath != "" {
+		return notTlfPathErr{tlfPathStr}
+	}
+
+	target, err := libkbfs.CanonicalHandleForConflicted(ctx, config, h)
+	if err != nil {
+		return err
+	}
+
+	result, err := config.KBFSOps().MergeConflictedTLF(ctx, h)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s -> %s (%d copied)\n",
+		h.GetCanonicalPath(), target.GetCanonicalPath(), result.Copied)
+	if verbose {
+		paths := make([]string, 0, len(result.Renamed))
+		for p := range result.Renamed {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			fmt.Printf("\t%s -> %s\n", p, result.Renamed[p])
+		}
+	}
+
+	return nil
+}
+
+func mergeConflictedTlfs(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs merge-conflicted-tlf", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print the new names of entries that collided with different ones.")
+	flags.Parse(args)
+
+	tlfPaths := flags.Args()
+	if len(tlfPaths) == 0 {
+		printError("merge-conflicted-tlf", errAtLeastOnePath)
+		exitStatus = 1
+		return
+	}
+
+	for _, tlfPath := range tlfPaths {
+		err := mergeConflictedTlf(ctx, config, tlfPath, *verbose)
+		if err != nil {
+			printError("merge-conflicted-tlf", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -8,94 +8,49 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
+	"strings"
 
+	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
+// tlfPathLen is the number of components in the path of a top-level
+// folder: "keybase", "public" or "private", and the folder name.
+const tlfPathLen = 3
+
 func maybePrintPath(path string, err error, verbose bool) {
 	if err == nil && verbose {
 		fmt.Fprintf(os.Stderr, "mkdir: created directory '%s'\n", path)
 	}
 }
 
-func createDir(ctx context.Context, kbfsOps libkbfs.KBFSOps, parentNode libkbfs.Node, dirname, path string, verbose bool) (libkbfs.Node, error) {
-	childNode, _, err := kbfsOps.CreateDir(ctx, parentNode, dirname)
-	maybePrintPath(path, err, verbose)
-	return childNode, err
-}
-
-func mkdirOne(ctx context.Context, config libkbfs.Config, dirPathStr string, createIntermediate, verbose bool) error {
-	p, err := makeKbfsPath(dirPathStr)
-	if err != nil {
+func mkdirOne(ctx context.Context, fs *libfs.FS, dirPathStr string, createIntermediate, verbose bool) error {
+	if !createIntermediate {
+		err := fs.Mkdir(ctx, dirPathStr)
+		maybePrintPath(dirPathStr, err, verbose)
 		return err
 	}
 
-	kbfsOps := config.KBFSOps()
-
-	if createIntermediate {
-		if p.pathType != tlfPath || len(p.tlfComponents) == 0 {
-			// Nothing to do.
-			return nil
-		}
-
-		tlfRoot := kbfsPath{
-			pathType: tlfPath,
-			public:   p.public,
-			tlfName:  p.tlfName,
-		}
-		tlfNode, err := tlfRoot.getDirNode(ctx, config)
-		if err != nil {
-			return err
-		}
-
-		currP := tlfRoot
-		currNode := tlfNode
-		for i := 0; i < len(p.tlfComponents); i++ {
-			dirname := p.tlfComponents[i]
-			currP, err = currP.join(dirname)
-			if err != nil {
-				return err
-			}
-
-			nextNode, err := createDir(ctx, kbfsOps, currNode, dirname, currP.String(), verbose)
-			if err == (libkbfs.NameExistsError{Name: dirname}) {
-				nextNode, _, err = kbfsOps.Lookup(ctx, currNode, dirname)
-			}
-			if err != nil {
-				return err
-			}
-			currNode = nextNode
-		}
-	} else {
-		if p.pathType != tlfPath {
-			return libkbfs.NameExistsError{Name: p.String()}
-		}
-
-		parentDir, dirname, err := p.dirAndBasename()
-		if err != nil {
-			return err
-		}
-
-		if parentDir.pathType != tlfPath {
-			// TODO: Ideally, this would error out if
-			// p already existed.
-			_, err := p.getDirNode(ctx, config)
-			maybePrintPath(p.String(), err, verbose)
-			return err
-		}
-
-		parentNode, err := parentDir.getDirNode(ctx, config)
-		if err != nil {
-			return err
+	cleanPath := path.Clean(dirPathStr)
+	if !path.IsAbs(cleanPath) {
+		return libfs.InvalidPathError{Path: dirPathStr}
+	}
+	components := strings.Split(strings.TrimPrefix(cleanPath, "/"), "/")
+	// Nothing above a top-level folder can be made, so start with
+	// the folder itself.
+	for i := tlfPathLen; i <= len(components); i++ {
+		currPath := "/" + strings.Join(components[:i], "/")
+		err := fs.Mkdir(ctx, currPath)
+		if _, ok := err.(libkbfs.NameExistsError); ok {
+			continue
 		}
-
-		_, err = createDir(ctx, kbfsOps, parentNode, dirname, p.String(), verbose)
+		maybePrintPath(currPath, err, verbose)
 		if err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
@@ -112,8 +67,9 @@ func mkdir(ctx context.Context, config libkbfs.Config, args []string) (exitStatu
 		return
 	}
 
+	fs := libfs.NewFS(config)
 	for _, nodePath := range nodePaths {
-		err := mkdirOne(ctx, config, nodePath, *createIntermediate, *verbose)
+		err := mkdirOne(ctx, fs, nodePath, *createIntermediate, *verbose)
 		if err != nil {
 			printError("mkdir", err)
 			exitStatus = 1
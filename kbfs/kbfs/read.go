@@ -10,14 +10,13 @@ import (
 	"io"
 	"os"
 
+	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
 type nodeReader struct {
-	ctx     context.Context
-	kbfsOps libkbfs.KBFSOps
-	node    libkbfs.Node
+	file    *libfs.File
 	off     int64
 	verbose bool
 }
@@ -29,14 +28,12 @@ func (nr *nodeReader) Read(p []byte) (n int, err error) {
 		fmt.Fprintf(os.Stderr, "Reading up to %s at offset %d\n", byteCountStr(len(p)), nr.off)
 	}
 
-	n64, err := nr.kbfsOps.Read(nr.ctx, nr.node, p, nr.off)
-	nr.off += n64
-	n = int(n64)
-	if n64 == 0 && err == nil {
+	n, err = nr.file.Read(p)
+	nr.off += int64(n)
+	if err == io.EOF {
 		if nr.verbose {
 			fmt.Fprintf(os.Stderr, "EOF encountered\n")
 		}
-		err = io.EOF
 	} else {
 		if nr.verbose {
 			fmt.Fprintf(os.Stderr, "Read %s\n", byteCountStr(n))
@@ -55,29 +52,19 @@ func readHelper(ctx context.Context, config libkbfs.Config, args []string) error
 	}
 
 	filePathStr := flags.Arg(0)
-	p, err := makeKbfsPath(filePathStr)
-	if err != nil {
-		return err
-	}
-
-	if p.pathType != tlfPath {
-		return fmt.Errorf("Cannot read %s", p)
-	}
 
 	if *verbose {
-		fmt.Fprintf(os.Stderr, "Looking up %s\n", p)
+		fmt.Fprintf(os.Stderr, "Looking up %s\n", filePathStr)
 	}
 
-	fileNode, err := p.getFileNode(ctx, config)
+	f, err := libfs.NewFS(config).Open(ctx, filePathStr)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	nr := nodeReader{
-		ctx:     ctx,
-		kbfsOps: config.KBFSOps(),
-		node:    fileNode,
-		off:     0,
+		file:    f,
 		verbose: *verbose,
 	}
 
@@ -0,0 +1,69 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func printCloneProgress(p libkbfs.TLFCloneProgress) {
+	fmt.Printf("%d/%d files, %d/%d bytes copied\n",
+		p.CopiedFiles, p.Files, p.CopiedBytes, p.Bytes)
+}
+
+func reshareTlf(ctx context.Context, config libkbfs.Config, srcPathStr, dstPathStr string, quiet bool) error {
+	fs := libfs.NewFS(config)
+	src, relPath, err := fs.FolderHandle(ctx, srcPathStr)
+	if err != nil {
+		return err
+	}
+	if relPath != "" {
+		return notTlfPathErr{srcPathStr}
+	}
+	dst, relPath, err := fs.FolderHandle(ctx, dstPathStr)
+	if err != nil {
+		return err
+	}
+	if relPath != "" {
+		return notTlfPathErr{dstPathStr}
+	}
+
+	var onProgress func(libkbfs.TLFCloneProgress)
+	if !quiet {
+		onProgress = printCloneProgress
+	}
+	progress, err := config.KBFSOps().CloneTLF(ctx, src, dst, onProgress)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s -> %s (%d copied, %d already copied)\n",
+		src.GetCanonicalPath(), dst.GetCanonicalPath(),
+		progress.CopiedFiles, progress.SkippedFiles)
+	return nil
+}
+
+func reshare(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs reshare", flag.ContinueOnError)
+	quiet := flags.Bool("q", false, "Don't print progress while copying.")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		printError("reshare", errExactlyTwoPaths)
+		return 1
+	}
+
+	err := reshareTlf(ctx, config, flags.Arg(0), flags.Arg(1), *quiet)
+	if err != nil {
+		printError("reshare", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func restoreOne(ctx context.Context, config libkbfs.Config, trashPathStr string, verbose bool) error {
+	folderBranch, tlfPath, relPath, err :=
+		libfs.NewFS(config).Folder(ctx, trashPathStr)
+	if err != nil {
+		return err
+	}
+
+	// The path must look like <tlf>/.kbfs_trash/<date>/<name>.
+	components := strings.Split(relPath, "/")
+	if len(components) != 3 || components[0] != libkbfs.TrashDirName {
+		return notTrashEntryErr{trashPathStr}
+	}
+
+	origPath, err := config.KBFSOps().RestoreFromTrash(
+		ctx, folderBranch, components[1], components[2])
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Printf("%s -> %s/%s\n", path.Clean(trashPathStr), tlfPath, origPath)
+	}
+
+	return nil
+}
+
+func restore(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs restore", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print where each entry was restored to.")
+	flags.Parse(args)
+
+	trashPaths := flags.Args()
+	if len(trashPaths) == 0 {
+		printError("restore", errAtLeastOnePath)
+		exitStatus = 1
+		return
+	}
+
+	for _, trashPath := range trashPaths {
+		err := restoreOne(ctx, config, trashPath, *verbose)
+		if err != nil {
+			printError("restore", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -9,31 +9,17 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
-func statNode(ctx context.Context, config libkbfs.Config, nodePathStr string) error {
-	p, err := makeKbfsPath(nodePathStr)
+func statNode(ctx context.Context, fs *libfs.FS, nodePathStr string) error {
+	fi, err := fs.Stat(ctx, nodePathStr)
 	if err != nil {
 		return err
 	}
-
-	n, ei, err := p.getNode(ctx, config)
-	if err != nil {
-		return err
-	}
-
-	// If n is non-nil, ignore the EntryInfo returned by
-	// p.getNode() so we can exercise the Stat() codepath. We
-	// can't compare the two, since they might legitimately differ
-	// due to races.
-	if n != nil {
-		ei, err = config.KBFSOps().Stat(ctx, n)
-		if err != nil {
-			return err
-		}
-	}
+	ei := fi.Sys().(libkbfs.EntryInfo)
 
 	var symPathStr string
 	if ei.Type == libkbfs.Sym {
@@ -43,7 +29,7 @@ func statNode(ctx context.Context, config libkbfs.Config, nodePathStr string) er
 	mtimeStr := time.Unix(0, ei.Mtime).String()
 	ctimeStr := time.Unix(0, ei.Ctime).String()
 
-	fmt.Printf("{Type: %s, Size: %d, %sMtime: %s, Ctime: %s}\n", ei.Type, ei.Size, symPathStr, mtimeStr, ctimeStr)
+	fmt.Printf("{Type: %s, Mode: %s, Size: %d, %sMtime: %s, Ctime: %s}\n", ei.Type, fi.Mode(), ei.Size, symPathStr, mtimeStr, ctimeStr)
 
 	return nil
 }
@@ -59,8 +45,9 @@ func stat(ctx context.Context, config libkbfs.Config, args []string) (exitStatus
 		return
 	}
 
+	fs := libfs.NewFS(config)
 	for _, nodePath := range nodePaths {
-		err := statNode(ctx, config, nodePath)
+		err := statNode(ctx, fs, nodePath)
 		if err != nil {
 			printError("stat", err)
 			exitStatus = 1
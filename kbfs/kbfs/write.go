@@ -10,14 +10,13 @@ import (
 	"io"
 	"os"
 
+	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
 type nodeWriter struct {
-	ctx     context.Context
-	kbfsOps libkbfs.KBFSOps
-	node    libkbfs.Node
+	file    *libfs.File
 	off     int64
 	verbose bool
 }
@@ -28,11 +27,8 @@ func (nw *nodeWriter) Write(p []byte) (n int, err error) {
 	if nw.verbose {
 		fmt.Fprintf(os.Stderr, "Writing %s at offset %d\n", byteCountStr(len(p)), nw.off)
 	}
-	err = nw.kbfsOps.Write(nw.ctx, nw.node, p, nw.off)
-	if err == nil {
-		n = len(p)
-		nw.off += int64(n)
-	}
+	n, err = nw.file.Write(p)
+	nw.off += int64(n)
 	return
 }
 
@@ -56,102 +52,64 @@ func writeHelper(ctx context.Context, config libkbfs.Config, args []string) (err
 		}
 	}()
 
-	p, err := makeKbfsPath(filePathStr)
-	if err != nil {
-		return
-	}
-
-	if p.pathType != tlfPath {
-		err = cannotWriteErr{filePathStr, nil}
-		return
-	}
-
-	dir, filename, err := p.dirAndBasename()
-	if err != nil {
-		return
-	}
-
-	if dir.pathType != tlfPath {
-		err = cannotWriteErr{filePathStr, nil}
-		return
-	}
-
-	parentNode, err := dir.getDirNode(ctx, config)
-	if err != nil {
-		return err
-	}
-
-	kbfsOps := config.KBFSOps()
-
-	noSuchFileErr := libkbfs.NoSuchNameError{Name: filename}
+	fs := libfs.NewFS(config)
 
 	// The operations below are racy, but that is inherent to a
 	// distributed FS.
 
-	fileNode, de, err := kbfsOps.Lookup(ctx, parentNode, filename)
-	if err != nil && err != noSuchFileErr {
-		return err
-	}
-
-	needSync := false
+	f, err := fs.Open(ctx, filePathStr)
 	var off int64
-
-	if err == noSuchFileErr {
-		if *verbose {
-			fmt.Fprintf(os.Stderr, "Creating %s\n", p)
-		}
-		fileNode, _, err = kbfsOps.CreateFile(ctx, parentNode, filename, false)
-		if err != nil {
-			return err
-		}
-	} else {
+	switch err.(type) {
+	case nil:
 		if *append {
 			if *verbose {
-				fmt.Fprintf(os.Stderr, "Appending to %s\n", p)
+				fmt.Fprintf(os.Stderr, "Appending to %s\n", f.Name())
+			}
+			off, err = f.Seek(0, io.SeekEnd)
+			if err != nil {
+				f.Close()
+				return err
 			}
-
-			off = int64(de.Size)
 		} else {
 			if *verbose {
-				fmt.Fprintf(os.Stderr, "Truncating %s\n", p)
+				fmt.Fprintf(os.Stderr, "Truncating %s\n", f.Name())
 			}
-			err = kbfsOps.Truncate(ctx, fileNode, 0)
+			f.Close()
+			f, err = fs.Create(ctx, filePathStr)
 			if err != nil {
 				return err
 			}
+		}
 
-			needSync = true
+	case libkbfs.NoSuchNameError:
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "Creating %s\n", filePathStr)
+		}
+		f, err = fs.Create(ctx, filePathStr)
+		if err != nil {
+			return err
 		}
+
+	default:
+		return err
 	}
 
 	nw := nodeWriter{
-		ctx:     ctx,
-		kbfsOps: kbfsOps,
-		node:    fileNode,
+		file:    f,
 		off:     off,
 		verbose: *verbose,
 	}
 
-	written, err := io.Copy(&nw, os.Stdin)
+	_, err = io.Copy(&nw, os.Stdin)
 	if err != nil {
+		f.Close()
 		return err
 	}
 
-	if written > 0 {
-		needSync = true
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "Syncing %s\n", f.Name())
 	}
-
-	if needSync {
-		if *verbose {
-			fmt.Fprintf(os.Stderr, "Syncing %s\n", p)
-		}
-		err := kbfsOps.Sync(ctx, fileNode)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return f.Close()
 }
 
 func write(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
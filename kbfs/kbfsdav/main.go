@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system, served over WebDAV
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libdav"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "runtime directory")
+var label = flag.String("label", os.Getenv("KEYBASE_LABEL"), "label to help identify if running as a service")
+var version = flag.Bool("version", false, "Print version")
+
+const usageFormatStr = `Usage:
+  kbfsdav -version
+
+To run against remote KBFS servers:
+  kbfsdav [-debug] [-cpuprofile=path/to/dir]
+    [-bserver=%s] [-mdserver=%s]
+    [-runtime-dir=path/to/dir] [-label=label]
+    [-log-to-file] [-log-file=path/to/file]]
+    localhost:port
+
+To run in a local testing environment:
+  kbfsdav [-debug] [-cpuprofile=path/to/dir]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-runtime-dir=path/to/dir] [-label=label]
+    [-log-to-file] [-log-file=path/to/file]]
+    localhost:port
+
+`
+
+func getUsageStr() string {
+	defaultBServer := libkbfs.GetDefaultBServer()
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer()
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+func start() *libfs.Error {
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if len(flag.Args()) < 1 {
+		fmt.Print(getUsageStr())
+		return libfs.InitError("no listen address specified")
+	}
+
+	if len(flag.Args()) > 1 {
+		fmt.Print(getUsageStr())
+		return libfs.InitError("extra arguments specified (flags go before the first argument)")
+	}
+
+	options := libdav.StartOptions{
+		KbfsParams: *kbfsParams,
+		RuntimeDir: *runtimeDir,
+		Label:      *label,
+		ListenAddr: flag.Arg(0),
+	}
+
+	return libdav.Start(options)
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfsdav error: (%d) %s\n", err.Code, err.Message)
+
+		os.Exit(err.Code)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func (s *Server) mkcol(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	if r.ContentLength > 0 {
+		return httpError{http.StatusUnsupportedMediaType,
+			"MKCOL requests can't have a body"}
+	}
+	dir, name, err := s.lookupParent(ctx, components)
+	if err != nil {
+		return err
+	}
+	if _, _, err := s.config.KBFSOps().CreateDir(ctx, dir, name); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// removeAll removes the given entry, along with everything in it if
+// it's a directory.
+func (s *Server) removeAll(ctx context.Context, dir libkbfs.Node,
+	name string) error {
+	kbfsOps := s.config.KBFSOps()
+	n, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	if ei.Type != libkbfs.Dir {
+		return kbfsOps.RemoveEntry(ctx, dir, name)
+	}
+
+	children, err := kbfsOps.GetDirChildren(ctx, n)
+	if err != nil {
+		return err
+	}
+	for childName := range children {
+		if err := s.removeAll(ctx, n, childName); err != nil {
+			return err
+		}
+	}
+	return kbfsOps.RemoveDir(ctx, dir, name)
+}
+
+// delete removes the entry, and everything in it for directories, as
+// WebDAV requires.
+func (s *Server) delete(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	dir, name, err := s.lookupParent(ctx, components)
+	if err != nil {
+		return err
+	}
+	n, ei, err := s.config.KBFSOps().Lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	if ei.Type == libkbfs.File || ei.Type == libkbfs.Exec {
+		if err := s.checkUnlocked(ctx, r, n); err != nil {
+			return err
+		}
+	}
+	if err := s.removeAll(ctx, dir, name); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// move renames the entry to the path given by the Destination
+// header, within the same top-level folder.  An existing destination
+// is replaced unless "Overwrite: F" is given.
+func (s *Server) move(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		return httpError{http.StatusBadRequest,
+			"MOVE requests need a valid Destination"}
+	}
+	destComponents, err := splitPath(dest.Path)
+	if err != nil {
+		return err
+	}
+	overwrite := r.Header.Get("Overwrite") != "F"
+
+	kbfsOps := s.config.KBFSOps()
+	srcDir, srcName, err := s.lookupParent(ctx, components)
+	if err != nil {
+		return err
+	}
+	n, ei, err := kbfsOps.Lookup(ctx, srcDir, srcName)
+	if err != nil {
+		return err
+	}
+	if ei.Type == libkbfs.File || ei.Type == libkbfs.Exec {
+		if err := s.checkUnlocked(ctx, r, n); err != nil {
+			return err
+		}
+	}
+	destDir, destName, err := s.lookupParent(ctx, destComponents)
+	if err != nil {
+		return err
+	}
+	if srcDir.GetFolderBranch() != destDir.GetFolderBranch() {
+		return libkbfs.RenameAcrossDirsError{}
+	}
+
+	destNode, destEI, err := kbfsOps.Lookup(ctx, destDir, destName)
+	exists := false
+	switch err.(type) {
+	case nil:
+		exists = true
+	case libkbfs.NoSuchNameError:
+	default:
+		return err
+	}
+	if exists {
+		if destNode != nil && destNode.GetID() == n.GetID() {
+			return httpError{http.StatusForbidden,
+				"The source and destination are the same"}
+		}
+		if !overwrite {
+			return httpError{http.StatusPreconditionFailed,
+				"The destination already exists"}
+		}
+		// Rename only replaces files with files, so clear the way
+		// for anything else.
+		if ei.Type == libkbfs.Dir || destEI.Type == libkbfs.Dir {
+			if err := s.removeAll(ctx, destDir, destName); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := kbfsOps.Rename(ctx, srcDir, srcName, destDir, destName); err != nil {
+		return err
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
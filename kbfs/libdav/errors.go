@@ -0,0 +1,56 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"net/http"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// httpError is an error in the request itself, rather than in the
+// KBFS operation it asked for, with the status to reply with.
+type httpError struct {
+	code int
+	msg  string
+}
+
+// Error implements the error interface for httpError.
+func (e httpError) Error() string {
+	return e.msg
+}
+
+// statusForError returns the HTTP status to reply with when a
+// request fails with the given error.
+func statusForError(err error) int {
+	switch err := err.(type) {
+	case httpError:
+		return err.code
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError, libkbfs.NoSuchFolderListError:
+		return http.StatusNotFound
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.MDServerErrorWriteAccess, libkbfs.DisallowedPrefixError,
+		libkbfs.NeedSelfRekeyError, libkbfs.NeedOtherRekeyError:
+		return http.StatusForbidden
+	case libkbfs.NameExistsError:
+		return http.StatusMethodNotAllowed
+	case libkbfs.DirNotEmptyError, libkbfs.NotDirError:
+		return http.StatusConflict
+	case libkbfs.RenameAcrossDirsError:
+		// The other folder is as good as another server.
+		return http.StatusBadGateway
+	case libkbfs.FileLockedError:
+		return http.StatusLocked
+	case libkbfs.NameTooLongError:
+		return http.StatusRequestURITooLong
+	case libkbfs.FileTooBigError:
+		return http.StatusRequestEntityTooLarge
+	case libkbfs.DirTooBigError:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
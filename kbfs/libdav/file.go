@@ -0,0 +1,162 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// How much of a PUT body is written to KBFS at a time.
+const putChunkSize = 64 * 1024
+
+// fileReader reads a KBFS file, so it can be served by
+// http.ServeContent.
+type fileReader struct {
+	ctx  context.Context
+	ops  libkbfs.KBFSOps
+	node libkbfs.Node
+	size int64
+	off  int64
+}
+
+var _ io.ReadSeeker = (*fileReader)(nil)
+
+// Read implements the io.Reader interface for fileReader.
+func (f *fileReader) Read(p []byte) (int, error) {
+	n, err := f.ops.Read(f.ctx, f.node, p, f.off)
+	if err != nil {
+		return int(n), err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	f.off += n
+	return int(n), nil
+}
+
+// Seek implements the io.Seeker interface for fileReader.
+func (f *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return f.off, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return f.off, errors.New("negative offset")
+	}
+	f.off = offset
+	return f.off, nil
+}
+
+func (s *Server) get(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	res, err := s.resolve(ctx, components)
+	if err != nil {
+		return err
+	}
+	if res.special != nil {
+		read := res.special
+		if wait := r.URL.Query().Get("wait"); wait != "" {
+			read, err = s.statusWaitFile(components, wait)
+			if err != nil {
+				return err
+			}
+		}
+		data, t, err := read(ctx)
+		if err != nil {
+			return err
+		}
+		http.ServeContent(
+			w, r, components[len(components)-1], t, bytes.NewReader(data))
+		return nil
+	}
+	if res.isDir() {
+		return httpError{http.StatusMethodNotAllowed,
+			"Directories can only be listed with PROPFIND"}
+	}
+
+	// Any read error after this point can only cut the reply short.
+	http.ServeContent(w, r, components[len(components)-1],
+		time.Unix(0, res.ei.Mtime), &fileReader{
+			ctx:  ctx,
+			ops:  s.config.KBFSOps(),
+			node: res.node,
+			size: int64(res.ei.Size),
+		})
+	return nil
+}
+
+// put replaces the contents of a file with the request body, creating
+// the file if needed.  The new contents are synced before replying.
+func (s *Server) put(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	dir, name, err := s.lookupParent(ctx, components)
+	if err != nil {
+		return err
+	}
+
+	kbfsOps := s.config.KBFSOps()
+	created := false
+	n, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	switch err.(type) {
+	case nil:
+		if ei.Type == libkbfs.Dir || ei.Type == libkbfs.Sym {
+			return httpError{http.StatusMethodNotAllowed,
+				"Only files can be written with PUT"}
+		}
+		if err := s.checkUnlocked(ctx, r, n); err != nil {
+			return err
+		}
+		if err := kbfsOps.Truncate(ctx, n, 0); err != nil {
+			return err
+		}
+	case libkbfs.NoSuchNameError:
+		n, _, err = kbfsOps.CreateFile(ctx, dir, name, false)
+		if err != nil {
+			return err
+		}
+		created = true
+	default:
+		return err
+	}
+
+	buf := make([]byte, putChunkSize)
+	var off int64
+	for {
+		k, readErr := io.ReadFull(r.Body, buf)
+		if k > 0 {
+			if err := kbfsOps.Write(ctx, n, buf[:k], off); err != nil {
+				return err
+			}
+			off += int64(k)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+	if err := kbfsOps.Sync(ctx, n); err != nil {
+		return err
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// WebDAV locks map onto KBFS advisory file locks (see
+// KBFSOps.LockFile).  Each lock token is a random UUID whose first 8
+// bytes are the KBFS lock owner.  KBFS keeps a lock until it's
+// released, so the server releases each lock itself once it times
+// out, unless the client refreshes it first; that way a crashed
+// client can't keep a file locked forever.  KBFS locks are only
+// respected within this process, so they don't keep other devices,
+// or the FUSE mount, from writing to a locked file.  Only the tokens
+// of locks the server currently holds are honored, so that a stale
+// token can't take a KBFS lock that would never expire.
+
+const lockTokenPrefix = "opaquelocktoken:"
+
+// maxLockTimeout is the longest a WebDAV lock lasts without being
+// refreshed, and the timeout given to clients that don't ask for a
+// shorter one.
+const maxLockTimeout = 10 * time.Minute
+
+var lockTokenRegexp = regexp.MustCompile(`<(` + lockTokenPrefix + `[^>]*)>`)
+
+func makeLockToken() (token string, owner uint64, err error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", 0, err
+	}
+	// Make it a valid version 4 UUID.
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	token = fmt.Sprintf("%s%x-%x-%x-%x-%x",
+		lockTokenPrefix, b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	return token, binary.BigEndian.Uint64(b[:8]), nil
+}
+
+// heldLock is a WebDAV lock held by the server, which is released
+// when its timer fires.
+type heldLock struct {
+	file  libkbfs.Node
+	owner uint64
+	timer *time.Timer
+}
+
+// getLockLocked returns the lock with the given token, if the server
+// holds it on the given file.  s.locksLock must be taken by the
+// caller.  As long as it stays taken, the lock can't be released.
+func (s *Server) getLockLocked(token string, file libkbfs.Node) (
+	*heldLock, bool) {
+	l, ok := s.locks[token]
+	if !ok || l.file.GetID() != file.GetID() {
+		return nil, false
+	}
+	return l, true
+}
+
+// ifLockToken returns the first lock token submitted in the request's
+// If header, if any.
+func ifLockToken(r *http.Request) (string, bool) {
+	m := lockTokenRegexp.FindStringSubmatch(r.Header.Get("If"))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// checkUnlocked returns FileLockedError if the given file is locked
+// by anyone but the sender of the request.  A lock token in the If
+// header must be that of a lock the server holds on the file.
+func (s *Server) checkUnlocked(ctx context.Context, r *http.Request,
+	file libkbfs.Node) error {
+	kbfsOps := s.config.KBFSOps()
+	if token, ok := ifLockToken(r); ok {
+		s.locksLock.Lock()
+		defer s.locksLock.Unlock()
+		l, ok := s.getLockLocked(token, file)
+		if !ok {
+			return httpError{http.StatusPreconditionFailed,
+				"No lock is held on the file with the given token"}
+		}
+		// The lock can't expire while s.locksLock is taken, so
+		// this just checks that KBFS still has it.
+		return kbfsOps.LockFile(ctx, file, l.owner)
+	}
+
+	// Briefly take the lock, to see whether anyone else has it.
+	_, owner, err := makeLockToken()
+	if err != nil {
+		return err
+	}
+	if err := kbfsOps.LockFile(ctx, file, owner); err != nil {
+		return err
+	}
+	return kbfsOps.UnlockFile(ctx, file, owner)
+}
+
+// lockTimeout returns how long a lock requested by r should last,
+// based on its Timeout header.
+func lockTimeout(r *http.Request) time.Duration {
+	for _, t := range strings.Split(r.Header.Get("Timeout"), ",") {
+		t = strings.TrimSpace(t)
+		if !strings.HasPrefix(t, "Second-") {
+			// Including "Infinite", which isn't allowed.
+			continue
+		}
+		secs, err := strconv.ParseUint(
+			strings.TrimPrefix(t, "Second-"), 10, 32)
+		if err != nil || secs == 0 {
+			continue
+		}
+		timeout := time.Duration(secs) * time.Second
+		if timeout < maxLockTimeout {
+			return timeout
+		}
+		break
+	}
+	return maxLockTimeout
+}
+
+// setLockExpiryLocked (re)starts the timer that releases the lock
+// with the given token on file after timeout.  s.locksLock must be
+// taken by the caller.
+func (s *Server) setLockExpiryLocked(token string, file libkbfs.Node,
+	owner uint64, timeout time.Duration) {
+	if l, ok := s.locks[token]; ok {
+		l.timer.Stop()
+	}
+	l := &heldLock{file: file, owner: owner}
+	l.timer = time.AfterFunc(timeout, func() {
+		s.locksLock.Lock()
+		if s.locks[token] != l {
+			// Refreshed, released or shut down in the meantime.
+			s.locksLock.Unlock()
+			return
+		}
+		delete(s.locks, token)
+		s.locksLock.Unlock()
+
+		ctx := s.withContext(context.Background())
+		s.log.CDebugf(ctx, "Lock %s expired", token)
+		err := s.config.KBFSOps().UnlockFile(ctx, file, owner)
+		if err != nil {
+			s.log.CDebugf(ctx, "Couldn't release expired lock %s: %v",
+				token, err)
+		}
+	})
+	s.locks[token] = l
+}
+
+type davOwner struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+type davLockInfo struct {
+	Scope struct {
+		Exclusive *struct{} `xml:"exclusive"`
+	} `xml:"lockscope"`
+	Type struct {
+		Write *struct{} `xml:"write"`
+	} `xml:"locktype"`
+	Owner davOwner `xml:"owner"`
+}
+
+type davActiveLock struct {
+	Exclusive struct{}  `xml:"D:lockscope>D:exclusive"`
+	Write     struct{}  `xml:"D:locktype>D:write"`
+	Depth     string    `xml:"D:depth"`
+	Owner     *davOwner `xml:"D:owner,omitempty"`
+	Timeout   string    `xml:"D:timeout"`
+	LockToken string    `xml:"D:locktoken>D:href"`
+	LockRoot  string    `xml:"D:lockroot>D:href"`
+}
+
+type davLockProp struct {
+	XMLName    xml.Name      `xml:"D:prop"`
+	NS         string        `xml:"xmlns:D,attr"`
+	ActiveLock davActiveLock `xml:"D:lockdiscovery>D:activelock"`
+}
+
+// lock takes an exclusive write lock on a file, creating it if
+// needed, or refreshes a lock given in the If header when there's no
+// request body.  Either way, the lock expires after the timeout in
+// the reply unless it's refreshed again.
+func (s *Server) lock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	var info davLockInfo
+	err := xml.NewDecoder(r.Body).Decode(&info)
+	refresh := err == io.EOF
+	if err != nil && !refresh {
+		return httpError{http.StatusBadRequest, "Invalid lockinfo: " +
+			err.Error()}
+	}
+	if !refresh && (info.Scope.Exclusive == nil || info.Type.Write == nil) {
+		return httpError{http.StatusPreconditionFailed,
+			"Only exclusive write locks are supported"}
+	}
+
+	var token string
+	var owner uint64
+	if refresh {
+		var ok bool
+		token, ok = ifLockToken(r)
+		if !ok {
+			return httpError{http.StatusBadRequest,
+				"Refreshing a lock needs a valid lock token"}
+		}
+	} else {
+		token, owner, err = makeLockToken()
+		if err != nil {
+			return err
+		}
+	}
+
+	kbfsOps := s.config.KBFSOps()
+	created := false
+	res, err := s.resolve(ctx, components)
+	switch err.(type) {
+	case nil:
+		if res.node == nil || res.isDir() {
+			return httpError{http.StatusMethodNotAllowed,
+				"Only files can be locked"}
+		}
+	case libkbfs.NoSuchNameError:
+		if refresh {
+			return err
+		}
+		// Locking a new path reserves it with an empty file.
+		dir, name, err := s.lookupParent(ctx, components)
+		if err != nil {
+			return err
+		}
+		res.node, _, err = kbfsOps.CreateFile(ctx, dir, name, false)
+		if err != nil {
+			return err
+		}
+		created = true
+	default:
+		return err
+	}
+
+	timeout := lockTimeout(r)
+	err = func() error {
+		s.locksLock.Lock()
+		defer s.locksLock.Unlock()
+		if refresh {
+			l, ok := s.getLockLocked(token, res.node)
+			if !ok {
+				return httpError{http.StatusPreconditionFailed,
+					"No lock is held on the file with the given token"}
+			}
+			owner = l.owner
+		}
+		// For a refresh, this just checks that KBFS still has
+		// the lock.
+		if err := kbfsOps.LockFile(ctx, res.node, owner); err != nil {
+			return err
+		}
+		s.setLockExpiryLocked(token, res.node, owner, timeout)
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	prop := davLockProp{
+		NS: "DAV:",
+		ActiveLock: davActiveLock{
+			Depth:     "0",
+			Timeout:   fmt.Sprintf("Second-%d", timeout/time.Second),
+			LockToken: token,
+			LockRoot:  hrefForComponents(components, false),
+		},
+	}
+	if info.Owner.InnerXML != "" {
+		prop.ActiveLock.Owner = &davOwner{info.Owner.InnerXML}
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	if !refresh {
+		w.Header().Set("Lock-Token", "<"+token+">")
+	}
+	return writeXML(w, code, prop)
+}
+
+// unlock releases the lock named by the Lock-Token header.
+func (s *Server) unlock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	token := strings.TrimSuffix(
+		strings.TrimPrefix(r.Header.Get("Lock-Token"), "<"), ">")
+	if !strings.HasPrefix(token, lockTokenPrefix) {
+		return httpError{http.StatusBadRequest,
+			"UNLOCK requests need a valid Lock-Token"}
+	}
+	res, err := s.resolve(ctx, components)
+	if err != nil {
+		return err
+	}
+	if res.node == nil || res.isDir() {
+		return httpError{http.StatusConflict, "Only files can be locked"}
+	}
+	s.locksLock.Lock()
+	defer s.locksLock.Unlock()
+	l, ok := s.getLockLocked(token, res.node)
+	if !ok {
+		return httpError{http.StatusConflict,
+			"No lock is held on the file with the given token"}
+	}
+	if err := s.config.KBFSOps().UnlockFile(ctx, res.node, l.owner); err != nil {
+		return err
+	}
+	l.timer.Stop()
+	delete(s.locks, token)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
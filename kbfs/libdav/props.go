@@ -0,0 +1,212 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The XML below is written with an explicit "D:" prefix for the
+// "DAV:" namespace, since some clients can't cope with the default
+// namespace declarations encoding/xml would otherwise produce.
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davLockEntry struct {
+	Exclusive struct{} `xml:"D:lockscope>D:exclusive"`
+	Write     struct{} `xml:"D:locktype>D:write"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *uint64         `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	SupportedLock []davLockEntry  `xml:"D:supportedlock>D:lockentry,omitempty"`
+}
+
+type davPropStat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	PropStat davPropStat `xml:"D:propstat"`
+}
+
+type davMultiStatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	NS        string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+// davEntry is a single entry in a PROPFIND reply.
+type davEntry struct {
+	components []string
+	ei         libkbfs.EntryInfo
+}
+
+func (e davEntry) response() davResponse {
+	isDir := e.ei.Type == libkbfs.Dir
+	prop := davProp{}
+	if len(e.components) > 0 {
+		prop.DisplayName = e.components[len(e.components)-1]
+	}
+	if isDir {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := e.ei.Size
+		prop.ContentLength = &size
+		prop.ContentType = mime.TypeByExtension(path.Ext(prop.DisplayName))
+		if prop.ContentType == "" {
+			prop.ContentType = "application/octet-stream"
+		}
+		prop.SupportedLock = []davLockEntry{{}}
+	}
+	if e.ei.Mtime != 0 {
+		prop.LastModified =
+			time.Unix(0, e.ei.Mtime).UTC().Format(http.TimeFormat)
+	}
+	return davResponse{
+		Href: hrefForComponents(e.components, isDir),
+		PropStat: davPropStat{
+			Prop:   prop,
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+func childComponents(components []string, name string) []string {
+	return append(append([]string(nil), components...), name)
+}
+
+// children returns the entries within the given directory.
+func (s *Server) children(ctx context.Context, res resource) (
+	[]davEntry, error) {
+	var entries []davEntry
+	switch {
+	case len(res.components) == 0:
+		for _, name := range []string{PrivateName, PublicName} {
+			entries = append(entries, davEntry{
+				components: []string{name},
+				ei:         libkbfs.EntryInfo{Type: libkbfs.Dir},
+			})
+		}
+
+	case len(res.components) == 1:
+		favs, err := s.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		public := res.components[0] == PublicName
+		for _, fav := range favs {
+			if fav.Public != public {
+				continue
+			}
+			entries = append(entries, davEntry{
+				components: childComponents(res.components, fav.Name),
+				ei:         libkbfs.EntryInfo{Type: libkbfs.Dir},
+			})
+		}
+
+	case res.node != nil:
+		children, err := s.config.KBFSOps().GetDirChildren(ctx, res.node)
+		if err != nil {
+			return nil, err
+		}
+		for name, ei := range children {
+			if ei.Type == libkbfs.Sym {
+				continue
+			}
+			entries = append(entries, davEntry{
+				components: childComponents(res.components, name),
+				ei:         ei,
+			})
+		}
+	}
+	sort.Sort(davEntriesByName(entries))
+	return entries, nil
+}
+
+type davEntriesByName []davEntry
+
+func (e davEntriesByName) Len() int      { return len(e) }
+func (e davEntriesByName) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e davEntriesByName) Less(i, j int) bool {
+	return e[i].components[len(e[i].components)-1] <
+		e[j].components[len(e[j].components)-1]
+}
+
+// propfind replies with all the properties of the resource, and of
+// its children for "Depth: 1".  The requested properties are
+// ignored, which clients have to cope with anyway.  "Depth: infinity"
+// isn't supported, since it could mean fetching a whole folder.
+func (s *Server) propfind(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		return httpError{http.StatusForbidden,
+			"Only PROPFIND requests with a depth of 0 or 1 are supported"}
+	}
+
+	res, err := s.resolve(ctx, components)
+	if err != nil {
+		return err
+	}
+	entry := davEntry{components: components, ei: res.ei}
+	if res.special != nil {
+		data, t, err := res.special(ctx)
+		if err != nil {
+			return err
+		}
+		entry.ei = libkbfs.EntryInfo{
+			Type: libkbfs.File,
+			Size: uint64(len(data)),
+		}
+		if !t.IsZero() {
+			entry.ei.Mtime = t.UnixNano()
+		}
+	}
+	entries := []davEntry{entry}
+	if depth == "1" && res.isDir() {
+		children, err := s.children(ctx, res)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, children...)
+	}
+
+	ms := davMultiStatus{NS: "DAV:"}
+	for _, e := range entries {
+		ms.Responses = append(ms.Responses, e.response())
+	}
+	return writeXML(w, http.StatusMultiStatus, ms)
+}
+
+// writeXML replies with the given value as XML.
+func writeXML(w http.ResponseWriter, code int, v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(code)
+	// The reply has started, so there's no way to report a failure
+	// to write the rest of it.
+	w.Write(append([]byte(xml.Header), data...))
+	return nil
+}
@@ -0,0 +1,435 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// allowedMethods lists the HTTP methods Server implements.
+const allowedMethods = "OPTIONS, PROPFIND, GET, HEAD, PUT, MKCOL, MOVE, " +
+	"DELETE, LOCK, UNLOCK"
+
+// Server serves KBFS over WebDAV, on top of KBFSOps.  Its URL space
+// mirrors a KBFS mount: /private/<folder>/... and /public/<folder>/...
+// hold the top-level folders, and /private and /public themselves
+// list the logged-in user's favorites.
+//
+// Every request must use HTTP basic auth with the server's password
+// (the user name is ignored), and must be addressed to the server's
+// own listen address, so that neither other local users nor web
+// pages (e.g. through DNS rebinding) can get at the user's files.
+//
+// Symlinks aren't served, since WebDAV has no way to represent them.
+type Server struct {
+	config   libkbfs.Config
+	log      logger.Logger
+	errLog   logger.Logger
+	hosts    map[string]bool
+	password string
+
+	// locksLock protects locks, the WebDAV locks that are
+	// currently held, by lock token.
+	locksLock sync.Mutex
+	locks     map[string]*heldLock
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// NewServer creates a Server that serves requests sent to addr, the
+// host:port it listens on, with the given password.
+func NewServer(config libkbfs.Config, debug bool, addr string,
+	password string) *Server {
+	log := config.MakeLogger("kbfsdav")
+	// We need extra depth for errors, so that we can report the line
+	// number for the caller of reportErr, not reportErr itself.
+	errLog := log.CloneWithAddedDepth(1)
+	if debug {
+		// Turn on debugging.  TODO: allow a proper log file and
+		// style to be specified.
+		log.Configure("", true, "")
+		errLog.Configure("", true, "")
+	}
+	hosts := map[string]bool{addr: true}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		hosts[net.JoinHostPort("localhost", port)] = true
+	}
+	return &Server{
+		config:   config,
+		log:      log,
+		errLog:   errLog,
+		hosts:    hosts,
+		password: password,
+		locks:    make(map[string]*heldLock),
+	}
+}
+
+// Shutdown stops the server from expiring any more locks.
+func (s *Server) Shutdown() {
+	s.locksLock.Lock()
+	defer s.locksLock.Unlock()
+	for token, l := range s.locks {
+		l.timer.Stop()
+		delete(s.locks, token)
+	}
+}
+
+// checkAccess returns an error unless r was sent to this server, with
+// its password.
+func (s *Server) checkAccess(r *http.Request) error {
+	if !s.hosts[r.Host] {
+		return httpError{http.StatusForbidden,
+			fmt.Sprintf("Unexpected host %q", r.Host)}
+	}
+	_, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare(
+		[]byte(password), []byte(s.password)) != 1 {
+		return httpError{http.StatusUnauthorized, "Invalid password"}
+	}
+	return nil
+}
+
+// withContext adds request-specific values to the context.
+func (s *Server) withContext(ctx context.Context) context.Context {
+	logTags := make(logger.CtxLogTags)
+	logTags[CtxIDKey] = CtxOpID
+	ctx = logger.NewContextWithLogTags(ctx, logTags)
+
+	// Add a unique ID to this context, identifying a particular
+	// request.
+	id, err := libkbfs.MakeRandomRequestID()
+	if err != nil {
+		s.log.Errorf("Couldn't make request ID: %v", err)
+	} else {
+		ctx = context.WithValue(ctx, CtxIDKey, id)
+	}
+	return ctx
+}
+
+func (s *Server) reportErr(ctx context.Context,
+	mode libkbfs.ErrorModeType, components []string, err error) {
+	if err == nil {
+		s.errLog.CDebugf(ctx, "Request complete")
+		return
+	}
+
+	// Malformed requests are the client's problem, not the user's.
+	if _, ok := err.(httpError); !ok {
+		var tlfName libkbfs.CanonicalTlfName
+		public := false
+		if len(components) >= 2 {
+			tlfName = libkbfs.CanonicalTlfName(components[1])
+			public = components[0] == PublicName
+		}
+		s.config.Reporter().ReportErr(ctx, tlfName, public, mode, err)
+	}
+	// We just log the error as debug, rather than error, because it
+	// might just indicate an expected error such as a 404.
+	s.errLog.CDebugf(ctx, err.Error())
+}
+
+type handlerFunc func(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error
+
+// ServeHTTP implements the http.Handler interface for Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := s.withContext(context.Background())
+	s.log.CDebugf(ctx, "%s %s", r.Method, r.URL.Path)
+
+	if err := s.checkAccess(r); err != nil {
+		s.log.CDebugf(ctx, "Rejecting request: %v", err)
+		if herr, ok := err.(httpError); ok &&
+			herr.code == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="KBFS"`)
+		}
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	mode := libkbfs.WriteMode
+	var handler handlerFunc
+	switch r.Method {
+	case "OPTIONS":
+		mode = libkbfs.ReadMode
+		handler = s.options
+	case "PROPFIND":
+		mode = libkbfs.ReadMode
+		handler = s.propfind
+	case "GET", "HEAD":
+		mode = libkbfs.ReadMode
+		handler = s.get
+	case "PUT":
+		handler = s.put
+	case "MKCOL":
+		handler = s.mkcol
+	case "MOVE":
+		handler = s.move
+	case "DELETE":
+		handler = s.delete
+	case "LOCK":
+		handler = s.lock
+	case "UNLOCK":
+		handler = s.unlock
+	default:
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "Unsupported method "+r.Method,
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	components, err := splitPath(r.URL.Path)
+	if err == nil {
+		err = handler(ctx, w, r, components)
+	}
+	s.reportErr(ctx, mode, components, err)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+	}
+}
+
+func (s *Server) options(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, components []string) error {
+	w.Header().Set("Allow", allowedMethods)
+	w.Header().Set("DAV", "1, 2")
+	// Makes Windows clients treat this as a WebDAV server.
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// splitPath returns the components of a request path, which must be
+// the root or within PrivateName or PublicName.
+func splitPath(p string) ([]string, error) {
+	cleanPath := path.Clean("/" + p)
+	if cleanPath == "/" {
+		return nil, nil
+	}
+	components := strings.Split(cleanPath[1:], "/")
+	if components[0] != PrivateName && components[0] != PublicName {
+		return nil, httpError{http.StatusNotFound, cleanPath + " not found"}
+	}
+	return components, nil
+}
+
+// hrefForComponents returns the escaped URL path for the given
+// components.
+func hrefForComponents(components []string, isDir bool) string {
+	p := "/" + strings.Join(components, "/")
+	if isDir && len(components) > 0 {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// resource is what a request path refers to.
+type resource struct {
+	components []string
+	// node is nil above the top-level folders, for folders that
+	// don't exist yet and can't be created by the user, and for
+	// special files.
+	node libkbfs.Node
+	ei   libkbfs.EntryInfo
+	// special is set for the read-only special files from libfs.
+	special func(context.Context) ([]byte, time.Time, error)
+}
+
+func (res resource) isDir() bool {
+	return res.special == nil && res.ei.Type == libkbfs.Dir
+}
+
+func (s *Server) getHandle(ctx context.Context, name string, public bool) (
+	*libkbfs.TlfHandle, error) {
+	for {
+		h, err := libkbfs.ParseTlfHandle(
+			ctx, s.config.KBPKI(), name, public,
+			s.config.SharingBeforeSignupEnabled())
+		switch err := err.(type) {
+		case nil:
+			// No error.
+			return h, nil
+
+		case libkbfs.TlfNameNotCanonical:
+			// Non-canonical name, so try again.
+			name = err.NameToTry
+
+		default:
+			// Some other error.
+			return nil, err
+		}
+	}
+}
+
+// getRootNode returns the root node of the top-level folder named by
+// components[1], or a nil node if the folder is empty for now.
+func (s *Server) getRootNode(ctx context.Context, components []string) (
+	libkbfs.Node, libkbfs.EntryInfo, error) {
+	h, err := s.getHandle(ctx, components[1], components[0] == PublicName)
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, err
+	}
+	n, ei, err := s.config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	if exitEarly, err := libfs.FilterTLFEarlyExitError(
+		ctx, err, s.log, h.GetCanonicalName()); exitEarly {
+		return nil, libkbfs.EntryInfo{Type: libkbfs.Dir}, err
+	}
+	return n, ei, nil
+}
+
+// specialFile returns the read function for the libfs special file
+// named by components, if there is one.
+func (s *Server) specialFile(components []string) func(
+	context.Context) ([]byte, time.Time, error) {
+	if len(components) == 0 {
+		return nil
+	}
+	name := components[len(components)-1]
+	if q, ok := libfs.ErrorQueryForFileName(
+		name, s.config.Clock().Now()); ok {
+		// Error files within a folder only show that folder's errors.
+		if len(components) >= 3 {
+			q.Tlf = libkbfs.CanonicalTlfName(components[1])
+			q.Public = components[0] == PublicName
+		}
+		return libfs.GetEncodedErrors(s.config, q)
+	}
+	if q, ok := libfs.ActivityQueryForFileName(name); ok &&
+		len(components) >= 3 {
+		return func(ctx context.Context) ([]byte, time.Time, error) {
+			n, _, err := s.getRootNode(ctx, components[:2])
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			if n == nil {
+				return nil, time.Time{}, libkbfs.NoSuchNameError{Name: name}
+			}
+			return libfs.GetEncodedActivity(
+				s.config, n.GetFolderBranch(), q)(ctx)
+		}
+	}
+	switch name {
+	case libfs.MetricsFileName:
+		return libfs.GetEncodedMetrics(s.config)
+	case libfs.StatusFileName:
+		if len(components) < 3 {
+			return func(ctx context.Context) ([]byte, time.Time, error) {
+				return libfs.GetEncodedStatus(ctx, s.config)
+			}
+		}
+		return func(ctx context.Context) ([]byte, time.Time, error) {
+			n, _, err := s.getRootNode(ctx, components[:2])
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			if n == nil {
+				return nil, time.Time{},
+					libkbfs.NoSuchNameError{Name: libfs.StatusFileName}
+			}
+			folderBranch := n.GetFolderBranch()
+			return libfs.GetEncodedFolderStatus(ctx, s.config, &folderBranch)
+		}
+	}
+	return nil
+}
+
+// statusWaitFile returns the read function for a GET of the
+// top-level status file with a "wait" parameter, which waits for the
+// status to change for at most the given duration.  Other files
+// don't take the parameter.
+func (s *Server) statusWaitFile(components []string, wait string) (
+	func(context.Context) ([]byte, time.Time, error), error) {
+	if len(components) != 2 || components[1] != libfs.StatusFileName {
+		return nil, httpError{http.StatusBadRequest,
+			"Only the top-level status file can be waited on"}
+	}
+	timeout, err := time.ParseDuration(wait)
+	if err != nil || timeout <= 0 || timeout > libfs.StatusWaitTimeout {
+		return nil, httpError{http.StatusBadRequest, fmt.Sprintf(
+			"Invalid wait %q; must be a duration of at most %s",
+			wait, libfs.StatusWaitTimeout)}
+	}
+	return func(ctx context.Context) ([]byte, time.Time, error) {
+		return libfs.GetEncodedStatusAfterChange(ctx, s.config, timeout)
+	}, nil
+}
+
+// resolve looks up the resource named by components.
+func (s *Server) resolve(ctx context.Context, components []string) (
+	resource, error) {
+	res := resource{components: components}
+	if read := s.specialFile(components); read != nil {
+		res.special = read
+		return res, nil
+	}
+	if len(components) < 2 {
+		res.ei.Type = libkbfs.Dir
+		return res, nil
+	}
+
+	n, ei, err := s.getRootNode(ctx, components)
+	if err != nil {
+		return resource{}, err
+	}
+	for _, name := range components[2:] {
+		if n == nil || ei.Type != libkbfs.Dir {
+			return resource{}, libkbfs.NoSuchNameError{Name: name}
+		}
+		n, ei, err = s.config.KBFSOps().Lookup(ctx, n, name)
+		if err != nil {
+			return resource{}, err
+		}
+		if ei.Type == libkbfs.Sym {
+			return resource{}, libkbfs.NoSuchNameError{Name: name}
+		}
+	}
+	res.node = n
+	res.ei = ei
+	return res, nil
+}
+
+// lookupParent returns the directory that holds (or would hold) the
+// entry named by components, along with the entry's name.
+func (s *Server) lookupParent(ctx context.Context, components []string) (
+	libkbfs.Node, string, error) {
+	if len(components) < 3 {
+		return nil, "", httpError{http.StatusForbidden,
+			"Only entries within a top-level folder can be changed"}
+	}
+	if s.specialFile(components) != nil {
+		return nil, "", httpError{http.StatusMethodNotAllowed,
+			"Special files can't be changed"}
+	}
+	parent, err := s.resolve(ctx, components[:len(components)-1])
+	switch err.(type) {
+	case nil:
+	case libkbfs.NoSuchNameError:
+		return nil, "", httpError{http.StatusConflict,
+			"The parent directory doesn't exist"}
+	default:
+		return nil, "", err
+	}
+	if !parent.isDir() {
+		return nil, "", httpError{http.StatusConflict,
+			"The parent isn't a directory"}
+	}
+	if parent.node == nil {
+		return nil, "", httpError{http.StatusForbidden,
+			"The top-level folder doesn't exist and can't be created"}
+	}
+	return parent.node, components[len(components)-1], nil
+}
@@ -0,0 +1,519 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const testPassword = "hunter2"
+
+func makeServer(t *testing.T, config libkbfs.Config) *httptest.Server {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config.Handler = NewServer(
+		config, false, srv.Listener.Addr().String(), testPassword)
+	srv.Start()
+	return srv
+}
+
+func doRequest(t *testing.T, srv *httptest.Server, method, p, body string,
+	headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, srv.URL+p, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("jdoe", testPassword)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(respBody)
+}
+
+func checkStatus(t *testing.T, srv *httptest.Server, method, p, body string,
+	headers map[string]string, expected int) (*http.Response, string) {
+	resp, respBody := doRequest(t, srv, method, p, body, headers)
+	if resp.StatusCode != expected {
+		t.Fatalf("%s %s: got status %d (%s), expected %d",
+			method, p, resp.StatusCode, respBody, expected)
+	}
+	return resp, respBody
+}
+
+// propfindHrefs returns the hrefs listed by a PROPFIND of the given
+// path, along with which of them are collections.
+func propfindHrefs(t *testing.T, srv *httptest.Server, p string) (
+	hrefs []string, collections map[string]bool) {
+	_, body := checkStatus(t, srv, "PROPFIND", p, "",
+		map[string]string{"Depth": "1"}, http.StatusMultiStatus)
+	var ms struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal([]byte(body), &ms); err != nil {
+		t.Fatalf("Couldn't parse PROPFIND reply %s: %v", body, err)
+	}
+	collections = make(map[string]bool)
+	for _, r := range ms.Responses {
+		hrefs = append(hrefs, r.Href)
+		collections[r.Href] = r.Collection != nil
+	}
+	return hrefs, collections
+}
+
+func TestPutGetPropfind(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	checkStatus(t, srv, "PUT", "/private/jdoe/a.txt", "hello", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "PUT", "/private/jdoe/a.txt", "hello world", nil,
+		http.StatusNoContent)
+	_, body := checkStatus(t, srv, "GET", "/private/jdoe/a.txt", "", nil,
+		http.StatusOK)
+	if body != "hello world" {
+		t.Errorf("Unexpected contents %q", body)
+	}
+	_, body = checkStatus(t, srv, "GET", "/private/jdoe/a.txt", "",
+		map[string]string{"Range": "bytes=6-"}, http.StatusPartialContent)
+	if body != "world" {
+		t.Errorf("Unexpected partial contents %q", body)
+	}
+
+	checkStatus(t, srv, "MKCOL", "/private/jdoe/d", "", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "MKCOL", "/private/jdoe/d", "", nil,
+		http.StatusMethodNotAllowed)
+	checkStatus(t, srv, "MKCOL", "/private/jdoe/x/y", "", nil,
+		http.StatusConflict)
+	checkStatus(t, srv, "PUT", "/private/jdoe/x/y", "", nil,
+		http.StatusConflict)
+	checkStatus(t, srv, "GET", "/private/jdoe/d", "", nil,
+		http.StatusMethodNotAllowed)
+	checkStatus(t, srv, "GET", "/private/jdoe/b.txt", "", nil,
+		http.StatusNotFound)
+
+	hrefs, collections := propfindHrefs(t, srv, "/private/jdoe")
+	expected := []string{"/private/jdoe/", "/private/jdoe/a.txt",
+		"/private/jdoe/d/"}
+	if !reflect.DeepEqual(hrefs, expected) {
+		t.Errorf("Listed %v, expected %v", hrefs, expected)
+	}
+	if !collections["/private/jdoe/d/"] || collections["/private/jdoe/a.txt"] {
+		t.Errorf("Unexpected collections %v", collections)
+	}
+
+	hrefs, _ = propfindHrefs(t, srv, "/")
+	expected = []string{"/", "/private/", "/public/"}
+	if !reflect.DeepEqual(hrefs, expected) {
+		t.Errorf("Listed %v, expected %v", hrefs, expected)
+	}
+	hrefs, _ = propfindHrefs(t, srv, "/private")
+	expected = []string{"/private/", "/private/jdoe/"}
+	if !reflect.DeepEqual(hrefs, expected) {
+		t.Errorf("Listed %v, expected %v", hrefs, expected)
+	}
+
+	checkStatus(t, srv, "PROPFIND", "/private/jdoe", "",
+		map[string]string{"Depth": "infinity"}, http.StatusForbidden)
+	checkStatus(t, srv, "GET", "/other", "", nil, http.StatusNotFound)
+}
+
+func TestMoveDelete(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "a", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "MKCOL", "/private/jdoe/d", "", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "MOVE", "/private/jdoe/a", "",
+		map[string]string{"Destination": srv.URL + "/private/jdoe/d/b"},
+		http.StatusCreated)
+	checkStatus(t, srv, "GET", "/private/jdoe/a", "", nil,
+		http.StatusNotFound)
+	_, body := checkStatus(t, srv, "GET", "/private/jdoe/d/b", "", nil,
+		http.StatusOK)
+	if body != "a" {
+		t.Errorf("Unexpected contents %q", body)
+	}
+
+	checkStatus(t, srv, "PUT", "/private/jdoe/c", "c", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "MOVE", "/private/jdoe/c", "",
+		map[string]string{
+			"Destination": srv.URL + "/private/jdoe/d/b",
+			"Overwrite":   "F",
+		}, http.StatusPreconditionFailed)
+	checkStatus(t, srv, "MOVE", "/private/jdoe/c", "",
+		map[string]string{"Destination": srv.URL + "/private/jdoe/d/b"},
+		http.StatusNoContent)
+	_, body = checkStatus(t, srv, "GET", "/private/jdoe/d/b", "", nil,
+		http.StatusOK)
+	if body != "c" {
+		t.Errorf("Unexpected contents %q", body)
+	}
+
+	// A directory can replace a file, and vice versa.
+	checkStatus(t, srv, "MKCOL", "/private/jdoe/e", "", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "MOVE", "/private/jdoe/e", "",
+		map[string]string{"Destination": srv.URL + "/private/jdoe/d/b"},
+		http.StatusNoContent)
+	hrefs, _ := propfindHrefs(t, srv, "/private/jdoe/d")
+	expected := []string{"/private/jdoe/d/", "/private/jdoe/d/b/"}
+	if !reflect.DeepEqual(hrefs, expected) {
+		t.Errorf("Listed %v, expected %v", hrefs, expected)
+	}
+
+	// Deleting a directory deletes everything in it.
+	checkStatus(t, srv, "PUT", "/private/jdoe/d/b/f", "f", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "DELETE", "/private/jdoe/d", "", nil,
+		http.StatusNoContent)
+	checkStatus(t, srv, "PROPFIND", "/private/jdoe/d", "",
+		map[string]string{"Depth": "0"}, http.StatusNotFound)
+	checkStatus(t, srv, "DELETE", "/private/jdoe/d", "", nil,
+		http.StatusNotFound)
+	checkStatus(t, srv, "DELETE", "/private/jdoe", "", nil,
+		http.StatusForbidden)
+
+	// Entries can't move between folders.
+	checkStatus(t, srv, "PUT", "/private/jdoe/g", "g", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "MOVE", "/private/jdoe/g", "",
+		map[string]string{"Destination": srv.URL + "/public/jdoe/g"},
+		http.StatusBadGateway)
+}
+
+func TestLockUnlock(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	const lockInfo = `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner><D:href>jdoe</D:href></D:owner>
+</D:lockinfo>`
+
+	// Locking a new path creates an empty file.
+	resp, body := checkStatus(t, srv, "LOCK", "/private/jdoe/a", lockInfo,
+		nil, http.StatusCreated)
+	token := resp.Header.Get("Lock-Token")
+	if !strings.HasPrefix(token, "<"+lockTokenPrefix) ||
+		!strings.Contains(body, token[1:len(token)-1]) {
+		t.Fatalf("Unexpected lock token %q in reply %s", token, body)
+	}
+	_, body = checkStatus(t, srv, "GET", "/private/jdoe/a", "", nil,
+		http.StatusOK)
+	if body != "" {
+		t.Errorf("Unexpected contents %q", body)
+	}
+
+	// Only the lock holder can write to or lock the file.
+	checkStatus(t, srv, "LOCK", "/private/jdoe/a", lockInfo, nil,
+		http.StatusLocked)
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "a", nil,
+		http.StatusLocked)
+	checkStatus(t, srv, "DELETE", "/private/jdoe/a", "", nil,
+		http.StatusLocked)
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "a",
+		map[string]string{"If": "(" + token + ")"}, http.StatusNoContent)
+	checkStatus(t, srv, "LOCK", "/private/jdoe/a", "",
+		map[string]string{"If": "(" + token + ")"}, http.StatusOK)
+
+	// The token only works for the file it locks.
+	checkStatus(t, srv, "PUT", "/private/jdoe/b", "b", nil,
+		http.StatusCreated)
+	checkStatus(t, srv, "PUT", "/private/jdoe/b", "b",
+		map[string]string{"If": "(" + token + ")"},
+		http.StatusPreconditionFailed)
+
+	checkStatus(t, srv, "UNLOCK", "/private/jdoe/a", "",
+		map[string]string{"Lock-Token": token}, http.StatusNoContent)
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "b", nil,
+		http.StatusNoContent)
+	checkStatus(t, srv, "UNLOCK", "/private/jdoe/a", "",
+		map[string]string{"Lock-Token": "<bogus>"}, http.StatusBadRequest)
+
+	// A stale token is rejected, rather than taking the lock
+	// again without an expiry.
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "c",
+		map[string]string{"If": "(" + token + ")"},
+		http.StatusPreconditionFailed)
+	checkStatus(t, srv, "LOCK", "/private/jdoe/a", "",
+		map[string]string{"If": "(" + token + ")"},
+		http.StatusPreconditionFailed)
+	checkStatus(t, srv, "UNLOCK", "/private/jdoe/a", "",
+		map[string]string{"Lock-Token": token}, http.StatusConflict)
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "d", nil,
+		http.StatusNoContent)
+}
+
+func TestLockExpiry(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	const lockInfo = `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+</D:lockinfo>`
+
+	// Infinite locks aren't handed out.
+	resp, body := checkStatus(t, srv, "LOCK", "/private/jdoe/a", lockInfo,
+		map[string]string{"Timeout": "Infinite"}, http.StatusCreated)
+	if !strings.Contains(body, "<D:timeout>Second-600</D:timeout>") {
+		t.Errorf("Unexpected timeout in reply %s", body)
+	}
+	checkStatus(t, srv, "UNLOCK", "/private/jdoe/a", "",
+		map[string]string{"Lock-Token": resp.Header.Get("Lock-Token")},
+		http.StatusNoContent)
+
+	_, body = checkStatus(t, srv, "LOCK", "/private/jdoe/a", lockInfo,
+		map[string]string{"Timeout": "Second-1, Infinite"}, http.StatusOK)
+	if !strings.Contains(body, "<D:timeout>Second-1</D:timeout>") {
+		t.Errorf("Unexpected timeout in reply %s", body)
+	}
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "a", nil,
+		http.StatusLocked)
+
+	// The lock goes away by itself once it times out.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, _ := doRequest(t, srv, "PUT", "/private/jdoe/a", "a", nil)
+		if resp.StatusCode == http.StatusNoContent {
+			break
+		} else if resp.StatusCode != http.StatusLocked ||
+			time.Now().After(deadline) {
+			t.Fatalf("Unexpected status %d", resp.StatusCode)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestAccessChecks(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	checkStatus(t, srv, "GET", "/private/jdoe/.kbfs_status", "", nil,
+		http.StatusOK)
+
+	send := func(host, password string, expected int) {
+		req, err := http.NewRequest(
+			"GET", srv.URL+"/private/jdoe/.kbfs_status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		if password != "" {
+			req.SetBasicAuth("jdoe", password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Host %q, password %q: got status %d, expected %d",
+				host, password, resp.StatusCode, expected)
+		}
+	}
+	send("", "", http.StatusUnauthorized)
+	send("", "wrong", http.StatusUnauthorized)
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send("localhost:"+port, testPassword, http.StatusOK)
+	// E.g. a web page that rebound its own name to the loopback
+	// address.
+	send("evil.example.com:"+port, testPassword, http.StatusForbidden)
+}
+
+func TestSpecialFiles(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "a", nil,
+		http.StatusCreated)
+	_, body := checkStatus(t, srv, "GET", "/private/jdoe/.kbfs_status", "",
+		nil, http.StatusOK)
+	var status libkbfs.FolderBranchStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("Couldn't parse folder status %s: %v", body, err)
+	}
+	if status.FolderID == "" {
+		t.Errorf("Unexpected folder status %s", body)
+	}
+
+	_, body = checkStatus(t, srv, "GET", "/private/.kbfs_status", "",
+		nil, http.StatusOK)
+	var kbfsStatus libkbfs.KBFSStatus
+	if err := json.Unmarshal([]byte(body), &kbfsStatus); err != nil {
+		t.Fatalf("Couldn't parse status %s: %v", body, err)
+	}
+	if kbfsStatus.CurrentUser != "jdoe" {
+		t.Errorf("Unexpected status %s", body)
+	}
+
+	_, body = checkStatus(t, srv, "GET", "/private/jdoe/.kbfs_activity",
+		"", nil, http.StatusOK)
+	if !strings.HasPrefix(body, "jdoe (dev1) created a") {
+		t.Errorf("Unexpected activity %s", body)
+	}
+	checkStatus(t, srv, "GET", "/private/.kbfs_activity", "", nil,
+		http.StatusNotFound)
+
+	checkStatus(t, srv, "GET", "/private/jdoe/.kbfs_metrics", "", nil,
+		http.StatusOK)
+	checkStatus(t, srv, "PROPFIND", "/private/jdoe/.kbfs_error", "",
+		map[string]string{"Depth": "0"}, http.StatusMultiStatus)
+	checkStatus(t, srv, "PUT", "/private/jdoe/.kbfs_status", "x", nil,
+		http.StatusMethodNotAllowed)
+}
+
+func TestErrorFiles(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	config.SetReporter(libkbfs.NewReporterSimple(config.Clock(), 0))
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	checkStatus(t, srv, "GET", "/private/jdoe/missing", "", nil,
+		http.StatusNotFound)
+
+	getErrors := func(p string) []libfs.JSONReportedError {
+		_, body := checkStatus(t, srv, "GET", p, "", nil, http.StatusOK)
+		var recs []libfs.JSONReportedError
+		if err := json.Unmarshal([]byte(body), &recs); err != nil {
+			t.Fatalf("Couldn't parse errors %s: %v", body, err)
+		}
+		return recs
+	}
+
+	recs := getErrors("/private/jdoe/.kbfs_error")
+	if len(recs) != 1 || recs[0].Tlf != "jdoe" ||
+		recs[0].Type != "libkbfs.NoSuchNameError" {
+		t.Errorf("Unexpected folder errors %+v", recs)
+	} else if len(recs[0].Stack) == 0 || recs[0].Stack[0].Name == "" {
+		t.Errorf("Unexpected stack in %+v", recs[0])
+	}
+	if recs := getErrors("/public/jdoe/.kbfs_error"); len(recs) != 0 {
+		t.Errorf("Unexpected public folder errors %+v", recs)
+	}
+	recs = getErrors("/private/.kbfs_error.type=NoSuchNameError,since=1h")
+	if len(recs) != 1 {
+		t.Errorf("Unexpected filtered errors %+v", recs)
+	}
+	if recs := getErrors(
+		"/private/.kbfs_error.type=ReadAccessError"); len(recs) != 0 {
+		t.Errorf("Unexpected filtered errors %+v", recs)
+	}
+}
+
+func TestStatusWait(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	srv := makeServer(t, config)
+	defer srv.Close()
+
+	checkStatus(t, srv, "GET", "/private/jdoe/.kbfs_status?wait=1s", "",
+		nil, http.StatusBadRequest)
+	checkStatus(t, srv, "GET", "/private/.kbfs_status?wait=forever", "",
+		nil, http.StatusBadRequest)
+
+	// With no change, the wait times out and returns the status.
+	checkStatus(t, srv, "GET", "/private/.kbfs_status?wait=10ms", "",
+		nil, http.StatusOK)
+
+	// A change in a folder ends the wait.
+	done := make(chan string, 1)
+	go func() {
+		// Don't use doRequest, which can't fail outside the test's
+		// goroutine.
+		req, err := http.NewRequest(
+			"GET", srv.URL+"/private/.kbfs_status?wait=1m", nil)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		req.SetBasicAuth("jdoe", testPassword)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		done <- string(body)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Status wait returned before any change")
+	case <-time.After(10 * time.Millisecond):
+	}
+	checkStatus(t, srv, "PUT", "/private/jdoe/a", "a", nil,
+		http.StatusCreated)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Status wait didn't return after a change")
+	}
+	// The wait can end on the first of several changes the PUT
+	// makes, e.g. the new folder's rekey, so check the folder
+	// list once the PUT is done.
+	_, body := checkStatus(t, srv, "GET", "/private/.kbfs_status", "",
+		nil, http.StatusOK)
+	var kbfsStatus libkbfs.KBFSStatus
+	if err := json.Unmarshal([]byte(body), &kbfsStatus); err != nil {
+		t.Fatalf("Couldn't parse status %s: %v", body, err)
+	}
+	if len(kbfsStatus.Folders) != 1 ||
+		kbfsStatus.Folders[0].Folder != "/keybase/private/jdoe" {
+		t.Errorf("Unexpected status %s", body)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdav
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// StartOptions are options for starting up
+type StartOptions struct {
+	KbfsParams libkbfs.InitParams
+	RuntimeDir string
+	Label      string
+	// ListenAddr is the host:port to serve on, which must be a
+	// loopback address.
+	ListenAddr string
+}
+
+// checkLoopback returns an error unless addr is on a loopback
+// interface, since anyone who can connect gets the user's files.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// passwordFileName is the name of the file in the runtime directory
+// that holds the password for the current server.
+const passwordFileName = "kbfsdav.password"
+
+// makePassword returns a new random password for a server.
+func makePassword() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// writePasswordFile writes password to a file that only the current
+// user can read, replacing any old one.
+func writePasswordFile(p string, password string) error {
+	// Remove any old file first, so that its permissions aren't
+	// reused.
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(password)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Start the WebDAV server.  Will block until interrupted, or until
+// serving fails.
+func Start(options StartOptions) *libfs.Error {
+	// InitLog errors are non-fatal and are ignored.
+	log, _ := libkbfs.InitLog(options.KbfsParams)
+
+	if err := checkLoopback(options.ListenAddr); err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	password, err := makePassword()
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+	if options.RuntimeDir != "" {
+		// Don't clobber the kbfs.info written by kbfsfuse, which
+		// may be running from the same runtime directory.
+		info := libkb.NewServiceInfo(libkbfs.Version, libkbfs.PrereleaseBuild, options.Label, os.Getpid())
+		err := info.WriteFile(path.Join(options.RuntimeDir, "kbfsdav.info"))
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		passwordFile := path.Join(options.RuntimeDir, passwordFileName)
+		if err := writePasswordFile(passwordFile, password); err != nil {
+			return libfs.InitError(err.Error())
+		}
+		defer os.Remove(passwordFile)
+		fmt.Printf("The WebDAV password is in %s\n", passwordFile)
+	} else {
+		fmt.Printf("The WebDAV password is %s\n", password)
+	}
+
+	log.Debug("Listening on: %s", options.ListenAddr)
+	l, err := net.Listen("tcp", options.ListenAddr)
+	if err != nil {
+		return libfs.MountError(err.Error())
+	}
+	defer l.Close()
+
+	// Closing the listener on an interrupt is what stops the
+	// server, so the error that causes isn't reported.
+	interrupted := make(chan struct{})
+	var interruptOnce sync.Once
+	onInterruptFn := func() {
+		interruptOnce.Do(func() {
+			close(interrupted)
+			l.Close()
+		})
+	}
+
+	log.Debug("Initializing")
+	config, err := libkbfs.Init(options.KbfsParams, onInterruptFn, log)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	defer libkbfs.Shutdown()
+
+	log.Debug("Serving WebDAV")
+	// Blocks until the listener is closed.
+	srv := NewServer(config, options.KbfsParams.Debug, l.Addr().String(),
+		password)
+	defer srv.Shutdown()
+	err = http.Serve(l, srv)
+	select {
+	case <-interrupted:
+		log.Debug("Ending")
+		return nil
+	default:
+	}
+	log.Debug("Ending: %v", err)
+	return libfs.MountError(err.Error())
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ActivityQueryForFileName returns the activity query selected by the
+// given activity file name, and whether the name is an activity file
+// name at all.  Besides the plain ActivityFileName, which selects the
+// most recent page, names of the form
+//
+//     .kbfs_activity.before=120,revisions=20
+//
+// select older pages: "before" selects only the revisions before the
+// given one, and "revisions" is the number of revisions in the page.
+// Names with malformed parameters aren't activity file names.
+func ActivityQueryForFileName(name string) (
+	q libkbfs.ActivityQuery, ok bool) {
+	params, ok := fileNameParams(name, ActivityFileName)
+	if !ok {
+		return q, false
+	}
+	for k, v := range params {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return libkbfs.ActivityQuery{}, false
+		}
+		switch k {
+		case "before":
+			q.Before = libkbfs.MetadataRevision(n)
+		case "revisions":
+			q.Revisions = n
+		default:
+			return libkbfs.ActivityQuery{}, false
+		}
+	}
+	return q, true
+}
+
+// activityFileName is the inverse of ActivityQueryForFileName.
+func activityFileName(q libkbfs.ActivityQuery) string {
+	var params []string
+	if q.Before != libkbfs.MetadataRevisionUninitialized {
+		params = append(params, fmt.Sprintf("before=%d", q.Before))
+	}
+	if q.Revisions > 0 {
+		params = append(params, fmt.Sprintf("revisions=%d", q.Revisions))
+	}
+	if len(params) == 0 {
+		return ActivityFileName
+	}
+	return ActivityFileName + "." + strings.Join(params, ",")
+}
+
+// formatActivityAge describes how long before now t was, e.g. "3 min
+// ago".
+func formatActivityAge(t, now time.Time) string {
+	d := now.Sub(t)
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%d min ago", int64(d/time.Minute))
+	case d < 24*time.Hour:
+		return plural(int64(d/time.Hour), "hour")
+	case d < 7*24*time.Hour:
+		return plural(int64(d/(24*time.Hour)), "day")
+	}
+	return "on " + t.Format("Jan 2, 2006")
+}
+
+// FormatActivityEdit renders the given edit as a line of the
+// activity feed, e.g. "alice (laptop) modified src/main.go, 3 min
+// ago".
+func FormatActivityEdit(edit libkbfs.ActivityEdit, now time.Time) string {
+	writer := edit.Writer
+	if edit.Device != "" {
+		writer += " (" + edit.Device + ")"
+	}
+	what := edit.Path
+	if edit.Action == libkbfs.ActivityRenamed {
+		what = edit.OldPath + " to " + edit.Path
+	}
+	if edit.Deleted && edit.Action != libkbfs.ActivityDeleted {
+		what += " (since deleted)"
+	}
+	if edit.Count > 1 {
+		what += fmt.Sprintf(" (%d changes)", edit.Count)
+	}
+	return fmt.Sprintf("%s %s %s, %s", writer, edit.Action, what,
+		formatActivityAge(edit.Time, now))
+}
+
+// GetEncodedActivity returns a function that renders the page of the
+// given folder's activity feed selected by q, in a format suitable
+// for the activity file.
+func GetEncodedActivity(config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch, q libkbfs.ActivityQuery) func(
+	context.Context) ([]byte, time.Time, error) {
+	return func(ctx context.Context) ([]byte, time.Time, error) {
+		activity, err := config.KBFSOps().GetActivity(ctx, folderBranch, q)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		now := config.Clock().Now()
+		var buf bytes.Buffer
+		for _, edit := range activity.Edits {
+			fmt.Fprintln(&buf, FormatActivityEdit(edit, now))
+		}
+		if activity.NextBefore != libkbfs.MetadataRevisionUninitialized {
+			q.Before = activity.NextBefore
+			fmt.Fprintf(&buf, "\nOlder activity: %s\n", activityFileName(q))
+		}
+		var t time.Time
+		if len(activity.Edits) > 0 {
+			t = activity.Edits[0].Time
+		}
+		return buf.Bytes(), t, nil
+	}
+}
@@ -4,6 +4,10 @@
 
 package libfs
 
+// ActivityFileName is the name of the KBFS activity feed file -- it
+// can be reached anywhere within a top-level folder.
+const ActivityFileName = ".kbfs_activity"
+
 // MetricsFileName is the name of the KBFS metrics file -- it can be
 // reached from any KBFS directory.
 const MetricsFileName = ".kbfs_metrics"
@@ -20,6 +24,11 @@ const RekeyFileName = ".kbfs_rekey"
 // anywhere within a top-level folder or inside the Keybase root
 const StatusFileName = ".kbfs_status"
 
+// StatusWaitFileName is the name of the KBFS status file that blocks
+// readers until the top-level status changes -- it can be reached
+// inside the Keybase root.
+const StatusWaitFileName = ".kbfs_status.wait"
+
 // SyncFromServerFileName is the name of the KBFS sync-from-server
 // file -- it can be reached anywhere within a top-level folder.
 const SyncFromServerFileName = ".kbfs_sync_from_server"
@@ -36,5 +45,10 @@ const DisableUpdatesFileName = ".kbfs_disable_updates"
 // file -- it can be reached anywhere within a top-level folder.
 const EnableUpdatesFileName = ".kbfs_enable_updates"
 
+// RestoreFileName is the name of the KBFS trash-restoring file -- it
+// can be reached anywhere within a top-level folder.  Writing
+// "<date>/<name>" to it restores that entry from the folder's trash.
+const RestoreFileName = ".kbfs_restore"
+
 // ResetCachesFileName is the name of the KBFS unstaging file.
 const ResetCachesFileName = ".kbfs_reset_caches"
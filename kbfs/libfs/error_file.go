@@ -6,6 +6,8 @@ package libfs
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -13,33 +15,100 @@ import (
 	"golang.org/x/net/context"
 )
 
-// JSONReportedError stringifies the reported error before marshalling
+// JSONReportedError stringifies the reported error before
+// marshalling.  Time, Error and Stack are the original format of the
+// error files; the rest were added later.
 type JSONReportedError struct {
 	Time  time.Time
 	Error string
 	Stack []errors.StackFrame
+	// The folder and mode of the operation that failed, the Go type
+	// of its error, and the debug tags from its context.
+	Tlf    string            `json:",omitempty"`
+	Public bool              `json:",omitempty"`
+	Mode   string            `json:",omitempty"`
+	Type   string            `json:",omitempty"`
+	Tags   map[string]string `json:",omitempty"`
 }
 
-func convertStack(stack []uintptr) []errors.StackFrame {
-	frames := make([]errors.StackFrame, len(stack))
-	for i, pc := range stack {
-		// TODO: Handle panics correctly, as described in the
-		// docs for runtime.Callers().
-		frames[i] = errors.NewStackFrame(pc)
+// ParseErrorTime parses a time bound for an error query, given either
+// as a duration before now (e.g. "2h") or as an RFC 3339 time.
+func ParseErrorTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
 	}
-	return frames
+	return time.Parse(time.RFC3339, s)
 }
 
-// GetEncodedErrors gets the list of encoded errors in a format suitable
-// for error file.
-func GetEncodedErrors(config libkbfs.Config) func(context.Context) ([]byte, time.Time, error) {
+// ErrorQueryForFileName returns the error query selected by the
+// given error file name, and whether the name is an error file name
+// at all.  Besides the plain libkbfs.ErrorFile, which selects every
+// error, names of the form
+//
+//     .kbfs_error.since=2h,type=NoSuchNameError,limit=10
+//
+// filter the errors; see ErrorQueryFromParams for the parameters.
+// Names with malformed filters aren't error file names.
+func ErrorQueryForFileName(name string, now time.Time) (
+	q libkbfs.ErrorQuery, ok bool) {
+	params, ok := fileNameParams(name, libkbfs.ErrorFile)
+	if !ok {
+		return q, false
+	}
+	q, err := ErrorQueryFromParams(params, now)
+	if err != nil {
+		return q, false
+	}
+	return q, true
+}
+
+// ErrorQueryFromParams builds an error query from the given
+// parameters: "since" and "until" bound the error times (see
+// ParseErrorTime), "type" selects an error type, and "limit" selects
+// only that many of the most recent errors.
+func ErrorQueryFromParams(params map[string]string, now time.Time) (
+	q libkbfs.ErrorQuery, err error) {
+	for k, v := range params {
+		switch k {
+		case "since":
+			q.Since, err = ParseErrorTime(v, now)
+		case "until":
+			q.Until, err = ParseErrorTime(v, now)
+		case "type":
+			q.Type = v
+		case "limit":
+			q.Limit, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("Unknown error query parameter %q", k)
+		}
+		if err != nil {
+			return libkbfs.ErrorQuery{}, err
+		}
+	}
+	return q, nil
+}
+
+// GetEncodedErrors gets the list of encoded errors selected by the
+// given query in a format suitable for error file.
+func GetEncodedErrors(config libkbfs.Config, q libkbfs.ErrorQuery) func(
+	context.Context) ([]byte, time.Time, error) {
 	return func(_ context.Context) ([]byte, time.Time, error) {
-		errors := config.Reporter().AllKnownErrors()
+		errors, err := config.Reporter().QueryErrors(q)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
 		jsonErrors := make([]JSONReportedError, len(errors))
 		for i, e := range errors {
-			jsonErrors[i].Time = e.Time
-			jsonErrors[i].Error = e.Error.Error()
-			jsonErrors[i].Stack = convertStack(e.Stack)
+			jsonErrors[i] = JSONReportedError{
+				Time:   e.Time,
+				Error:  e.Error,
+				Stack:  e.Stack,
+				Tlf:    e.Tlf,
+				Public: e.Public,
+				Mode:   e.Mode,
+				Type:   e.Type,
+				Tags:   e.Tags,
+			}
 		}
 		data, err := json.MarshalIndent(jsonErrors, "", "  ")
 		if err != nil {
@@ -0,0 +1,144 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// File is an open KBFS file, as returned by FS.Open and FS.Create.
+// Writes are flushed to the servers by Sync and Close.  A File
+// shouldn't be used by more than one goroutine at a time.
+type File struct {
+	config libkbfs.Config
+	// ctx is used for all the operations on the file; see
+	// WithContext.
+	ctx  context.Context
+	name string
+	node libkbfs.Node
+	off  int64
+	// dirty is set when the file has writes that haven't been
+	// synced yet.
+	dirty bool
+}
+
+var _ io.ReadWriteSeeker = (*File)(nil)
+var _ io.Closer = (*File)(nil)
+
+// WithContext makes all later operations on the file use the given
+// context, instead of the one it was opened with, and returns the
+// file.
+func (f *File) WithContext(ctx context.Context) *File {
+	f.ctx = ctx
+	return f
+}
+
+// Name returns the cleaned path the file was opened with.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Read implements the io.Reader interface for File.
+func (f *File) Read(p []byte) (int, error) {
+	if f.node == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := f.config.KBFSOps().Read(f.ctx, f.node, p, f.off)
+	f.off += n
+	if n == 0 && err == nil && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return int(n), err
+}
+
+// Write implements the io.Writer interface for File.
+func (f *File) Write(p []byte) (int, error) {
+	if f.node == nil {
+		return 0, os.ErrClosed
+	}
+	if err := f.config.KBFSOps().Write(f.ctx, f.node, p, f.off); err != nil {
+		return 0, err
+	}
+	f.off += int64(len(p))
+	f.dirty = true
+	return len(p), nil
+}
+
+// Seek implements the io.Seeker interface for File.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.node == nil {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		ei, err := f.config.KBFSOps().Stat(f.ctx, f.node)
+		if err != nil {
+			return f.off, err
+		}
+		offset += int64(ei.Size)
+	default:
+		return f.off, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return f.off, errors.New("negative offset")
+	}
+	f.off = offset
+	return f.off, nil
+}
+
+// Stat returns the os.FileInfo for the file, including any writes
+// that haven't been synced yet.
+func (f *File) Stat() (os.FileInfo, error) {
+	if f.node == nil {
+		return nil, os.ErrClosed
+	}
+	ei, err := f.config.KBFSOps().Stat(f.ctx, f.node)
+	if err != nil {
+		return nil, err
+	}
+	p, err := makeKbfsPath(f.name)
+	if err != nil {
+		return nil, err
+	}
+	writable, err := p.isWritable(f.ctx, f.config)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{path.Base(f.name), ei, p.mode(ei.Type, writable)}, nil
+}
+
+// Sync flushes any writes to the KBFS servers.
+func (f *File) Sync() error {
+	if f.node == nil {
+		return os.ErrClosed
+	}
+	if !f.dirty {
+		return nil
+	}
+	if err := f.config.KBFSOps().Sync(f.ctx, f.node); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// Close implements the io.Closer interface for File.  It syncs the
+// file, and makes it unusable.
+func (f *File) Close() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	f.node = nil
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import "strings"
+
+// fileNameParams splits a special file name of the form
+//
+//     base.k1=v1,k2=v2
+//
+// into its parameters.  The plain base name has no parameters.  ok is
+// false if the name isn't base, with or without parameters, or if a
+// parameter has no value.
+func fileNameParams(name, base string) (
+	params map[string]string, ok bool) {
+	params = make(map[string]string)
+	if name == base {
+		return params, true
+	}
+	prefix := base + "."
+	if !strings.HasPrefix(name, prefix) {
+		return nil, false
+	}
+	for _, param := range strings.Split(name[len(prefix):], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+		params[kv[0]] = kv[1]
+	}
+	return params, true
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func TestFileNameParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected bool
+	}{
+		{".f", map[string]string{}, true},
+		{".f.a=1", map[string]string{"a": "1"}, true},
+		{".f.a=1,b=x=y", map[string]string{"a": "1", "b": "x=y"}, true},
+		{".f.a=", map[string]string{"a": ""}, true},
+		{".f.", nil, false},
+		{".f.a", nil, false},
+		{".f.a=1,", nil, false},
+		{".fa=1", nil, false},
+		{".g.a=1", nil, false},
+	}
+	for _, test := range tests {
+		params, ok := fileNameParams(test.name, ".f")
+		if ok != test.expected || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("Got %v, %t for %q", params, ok, test.name)
+		}
+	}
+}
+
+func TestActivityQueryForFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		q        libkbfs.ActivityQuery
+		expected bool
+	}{
+		{ActivityFileName, libkbfs.ActivityQuery{}, true},
+		{ActivityFileName + ".before=120,revisions=20",
+			libkbfs.ActivityQuery{Before: 120, Revisions: 20}, true},
+		{ActivityFileName + ".revisions=5",
+			libkbfs.ActivityQuery{Revisions: 5}, true},
+		{ActivityFileName + ".before=0", libkbfs.ActivityQuery{}, false},
+		{ActivityFileName + ".before=x", libkbfs.ActivityQuery{}, false},
+		{ActivityFileName + ".after=1", libkbfs.ActivityQuery{}, false},
+		{ActivityFileName + ".before", libkbfs.ActivityQuery{}, false},
+	}
+	for _, test := range tests {
+		q, ok := ActivityQueryForFileName(test.name)
+		if ok != test.expected || q != test.q {
+			t.Errorf("Got %+v, %t for %q", q, ok, test.name)
+		}
+		if ok && activityFileName(q) != test.name {
+			t.Errorf("Name %q doesn't round trip: %q",
+				test.name, activityFileName(q))
+		}
+	}
+}
+
+func TestErrorQueryForFileName(t *testing.T) {
+	now := time.Now()
+	q, ok := ErrorQueryForFileName(
+		libkbfs.ErrorFile+".since=2h,type=NoSuchNameError,limit=10", now)
+	expected := libkbfs.ErrorQuery{
+		Since: now.Add(-2 * time.Hour),
+		Type:  "NoSuchNameError",
+		Limit: 10,
+	}
+	if !ok || q != expected {
+		t.Errorf("Got %+v, %t", q, ok)
+	}
+
+	q, ok = ErrorQueryForFileName(libkbfs.ErrorFile, now)
+	if !ok || q != (libkbfs.ErrorQuery{}) {
+		t.Errorf("Got %+v, %t for the plain error file", q, ok)
+	}
+
+	for _, name := range []string{
+		libkbfs.ErrorFile + ".limit=x",
+		libkbfs.ErrorFile + ".color=red",
+		libkbfs.ErrorFile + ".since",
+		ActivityFileName,
+	} {
+		if q, ok := ErrorQueryForFileName(name, now); ok {
+			t.Errorf("Got %+v for %q", q, name)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FS is a path-based API to KBFS, for Go programs that would rather
+// use it like the os package than deal with libkbfs Nodes directly.
+// Paths are absolute, and look like they would under a KBFS mount at
+// /keybase, e.g. "/keybase/private/alice,bob/dir/file".  Top-level
+// folders are looked up (and created, for writers) as needed, and
+// non-canonical folder names are followed to their canonical
+// folders.
+//
+// Symlinks are never followed, except by the programs reading them.
+type FS struct {
+	config libkbfs.Config
+}
+
+// NewFS creates an FS on top of the given config.
+func NewFS(config libkbfs.Config) *FS {
+	return &FS{config: config}
+}
+
+// fileInfo implements os.FileInfo for KBFS entries.
+type fileInfo struct {
+	name string
+	ei   libkbfs.EntryInfo
+	mode os.FileMode
+}
+
+var _ os.FileInfo = fileInfo{}
+
+// Name implements the os.FileInfo interface for fileInfo.
+func (fi fileInfo) Name() string {
+	return fi.name
+}
+
+// Size implements the os.FileInfo interface for fileInfo.
+func (fi fileInfo) Size() int64 {
+	return int64(fi.ei.Size)
+}
+
+// Mode implements the os.FileInfo interface for fileInfo.
+func (fi fileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+// ModTime implements the os.FileInfo interface for fileInfo.
+func (fi fileInfo) ModTime() time.Time {
+	return time.Unix(0, fi.ei.Mtime)
+}
+
+// IsDir implements the os.FileInfo interface for fileInfo.
+func (fi fileInfo) IsDir() bool {
+	return fi.ei.Type == libkbfs.Dir
+}
+
+// Sys implements the os.FileInfo interface for fileInfo.  It returns
+// the entry's libkbfs.EntryInfo.
+func (fi fileInfo) Sys() interface{} {
+	return fi.ei
+}
+
+func (fs *FS) fileInfo(ctx context.Context, p kbfsPath,
+	ei libkbfs.EntryInfo) (os.FileInfo, error) {
+	writable, err := p.isWritable(ctx, fs.config)
+	if err != nil {
+		return nil, err
+	}
+	name := "/"
+	if p.pathType != rootPath {
+		_, name, err = p.dirAndBasename()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fileInfo{name, ei, p.mode(ei.Type, writable)}, nil
+}
+
+// Stat returns the os.FileInfo for the named entry, whose Sys method
+// returns the entry's libkbfs.EntryInfo.  Like os.Lstat, it describes
+// symlinks themselves.
+func (fs *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := makeKbfsPath(name)
+	if err != nil {
+		return nil, err
+	}
+	n, ei, err := p.getNode(ctx, fs.config)
+	if err != nil {
+		return nil, err
+	}
+	if n != nil {
+		// Get the freshest info, including any unsynced writes.
+		ei, err = fs.config.KBFSOps().Stat(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs.fileInfo(ctx, p, ei)
+}
+
+type fileInfosByName []os.FileInfo
+
+func (f fileInfosByName) Len() int           { return len(f) }
+func (f fileInfosByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f fileInfosByName) Less(i, j int) bool { return f[i].Name() < f[j].Name() }
+
+// ReadDir returns the entries of the named directory, sorted by name.
+// Within /keybase/public and /keybase/private, these are the current
+// user's favorite folders.
+func (fs *FS) ReadDir(ctx context.Context, name string) (
+	[]os.FileInfo, error) {
+	p, err := makeKbfsPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var childNames []string
+	var children map[string]libkbfs.EntryInfo
+	switch p.pathType {
+	case rootPath:
+		childNames = []string{topName}
+	case keybasePath:
+		childNames = []string{privateName, publicName}
+	case keybaseChildPath:
+		favs, err := fs.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, fav := range favs {
+			if fav.Public == p.public {
+				childNames = append(childNames, fav.Name)
+			}
+		}
+	default:
+		n, err := p.getDirNode(ctx, fs.config)
+		if err != nil {
+			return nil, err
+		}
+		children, err = fs.config.KBFSOps().GetDirChildren(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fis []os.FileInfo
+	if children != nil {
+		// All the children are in the same folder, so they share
+		// its permissions.
+		writable, err := p.isWritable(ctx, fs.config)
+		if err != nil {
+			return nil, err
+		}
+		for childName, ei := range children {
+			fis = append(fis, fileInfo{childName, ei,
+				p.mode(ei.Type, writable)})
+		}
+	}
+	for _, childName := range childNames {
+		childPath, err := p.join(childName)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := fs.fileInfo(ctx, childPath,
+			libkbfs.EntryInfo{Type: libkbfs.Dir})
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	sort.Sort(fileInfosByName(fis))
+	return fis, nil
+}
+
+// Mkdir creates the named directory.  Naming a top-level folder
+// creates the folder, if it doesn't exist yet and the current user
+// is one of its writers.
+func (fs *FS) Mkdir(ctx context.Context, name string) error {
+	p, err := makeKbfsPath(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.pathType != tlfPath:
+		return libkbfs.NameExistsError{Name: p.String()}
+	case !p.isTlfEntry():
+		return fs.mkdirTlf(ctx, p)
+	}
+
+	dirNode, dirName, err := p.getParentNode(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	_, _, err = fs.config.KBFSOps().CreateDir(ctx, dirNode, dirName)
+	return err
+}
+
+// mkdirTlf creates the top-level folder at p, or returns
+// NameExistsError if it already has a root directory.
+func (fs *FS) mkdirTlf(ctx context.Context, p kbfsPath) error {
+	h, err := p.getHandle(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	md, err := fs.config.MDOps().GetForHandle(ctx, h)
+	if err != nil {
+		return err
+	}
+	if md.Data().Dir.Type == libkbfs.Dir {
+		return libkbfs.NameExistsError{Name: p.String()}
+	}
+	_, err = p.getDirNode(ctx, fs.config)
+	return err
+}
+
+// Open opens the named file for reading and writing.
+func (fs *FS) Open(ctx context.Context, name string) (*File, error) {
+	p, err := makeKbfsPath(name)
+	if err != nil {
+		return nil, err
+	}
+	n, err := p.getFileNode(ctx, fs.config)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		config: fs.config,
+		ctx:    ctx,
+		name:   p.String(),
+		node:   n,
+	}, nil
+}
+
+// Create creates the named file, or truncates it if it already
+// exists, and opens it for reading and writing.
+func (fs *FS) Create(ctx context.Context, name string) (*File, error) {
+	p, err := makeKbfsPath(name)
+	if err != nil {
+		return nil, err
+	}
+	dirNode, fileName, err := p.getParentNode(ctx, fs.config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The operations below are racy, but that is inherent to a
+	// distributed FS.
+	kbfsOps := fs.config.KBFSOps()
+	f := &File{
+		config: fs.config,
+		ctx:    ctx,
+		name:   p.String(),
+	}
+	n, ei, err := kbfsOps.Lookup(ctx, dirNode, fileName)
+	switch err.(type) {
+	case nil:
+		if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+			return nil, NotFileError{p.String()}
+		}
+		if err := kbfsOps.Truncate(ctx, n, 0); err != nil {
+			return nil, err
+		}
+		f.dirty = true
+	case libkbfs.NoSuchNameError:
+		n, _, err = kbfsOps.CreateFile(ctx, dirNode, fileName, false)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	f.node = n
+	return f, nil
+}
+
+// Remove removes the named file, symlink or empty directory.
+func (fs *FS) Remove(ctx context.Context, name string) error {
+	p, err := makeKbfsPath(name)
+	if err != nil {
+		return err
+	}
+	dirNode, entryName, err := p.getParentNode(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	kbfsOps := fs.config.KBFSOps()
+	_, ei, err := kbfsOps.Lookup(ctx, dirNode, entryName)
+	if err != nil {
+		return err
+	}
+	if ei.Type == libkbfs.Dir {
+		return kbfsOps.RemoveDir(ctx, dirNode, entryName)
+	}
+	return kbfsOps.RemoveEntry(ctx, dirNode, entryName)
+}
+
+// Rename renames oldName to newName, replacing any file already
+// there.  Both must be within the same top-level folder.
+func (fs *FS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := makeKbfsPath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := makeKbfsPath(newName)
+	if err != nil {
+		return err
+	}
+	oldDirNode, oldEntryName, err := oldPath.getParentNode(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	newDirNode, newEntryName, err := newPath.getParentNode(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	return fs.config.KBFSOps().Rename(
+		ctx, oldDirNode, oldEntryName, newDirNode, newEntryName)
+}
+
+// Symlink creates newName as a symlink to oldName, which is stored
+// as given.
+func (fs *FS) Symlink(ctx context.Context, oldName, newName string) error {
+	p, err := makeKbfsPath(newName)
+	if err != nil {
+		return err
+	}
+	dirNode, linkName, err := p.getParentNode(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	_, err = fs.config.KBFSOps().CreateLink(ctx, dirNode, linkName, oldName)
+	return err
+}
+
+// FolderHandle returns the handle of the top-level folder holding
+// the named entry, along with the slash-separated path of the entry
+// within it ("" for the folder itself).  Unlike Folder, it doesn't
+// load the folder.
+func (fs *FS) FolderHandle(ctx context.Context, name string) (
+	h *libkbfs.TlfHandle, relPath string, err error) {
+	p, err := makeKbfsPath(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if p.pathType != tlfPath {
+		return nil, "", NotTlfEntryError{p.String()}
+	}
+	h, err = p.getHandle(ctx, fs.config)
+	if err != nil {
+		return nil, "", err
+	}
+	return h, strings.Join(p.tlfComponents, "/"), nil
+}
+
+// Folder returns the folder-branch of the top-level folder holding
+// the named entry, along with the folder's canonical path and the
+// slash-separated path of the entry within it ("" for the folder
+// itself).
+func (fs *FS) Folder(ctx context.Context, name string) (
+	folderBranch libkbfs.FolderBranch, tlfPathStr, relPath string,
+	err error) {
+	h, relPath, err := fs.FolderHandle(ctx, name)
+	if err != nil {
+		return libkbfs.FolderBranch{}, "", "", err
+	}
+	rootNode, _, err := fs.config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		return libkbfs.FolderBranch{}, "", "", err
+	}
+	return rootNode.GetFolderBranch(), h.GetCanonicalPath(), relPath, nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func TestFileReadWriteSeek(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	fs := NewFS(config)
+
+	const name = "/keybase/private/jdoe/file"
+	f, err := fs.Create(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	} else if n != 11 {
+		t.Errorf("Wrote %d bytes, expected 11", n)
+	}
+	if off, err := f.Seek(-5, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	} else if off != 6 {
+		t.Errorf("Offset %d, expected 6", off)
+	}
+	if _, err := f.Write([]byte("there")); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "file" || fi.Size() != 11 || fi.IsDir() {
+		t.Errorf("Unexpected file info %s, %d, %t",
+			fi.Name(), fi.Size(), fi.IsDir())
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("Read on a closed file succeeded")
+	}
+
+	f, err = fs.Open(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if off, err := f.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if off != 6 {
+		t.Errorf("Offset %d, expected 6", off)
+	}
+	buf := make([]byte, 10)
+	n, err := f.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "there" {
+		t.Errorf("Read %q, expected %q", buf[:n], "there")
+	}
+	if _, err := f.Read(buf); err != io.EOF {
+		t.Errorf("Got %v at the end of the file, expected io.EOF", err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seeking to a negative offset succeeded")
+	}
+}
+
+// Test that a File works with the standard io helpers, and that
+// WithContext switches the context of later operations.
+func TestFileStandardInterfaces(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	fs := NewFS(config)
+
+	const name = "/keybase/private/jdoe/file"
+	f, err := fs.Create(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(f, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file must keep working on a new context after the one
+	// it was opened with is canceled.
+	openCtx, cancel := context.WithCancel(ctx)
+	f, err = fs.Open(openCtx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	defer f.Close()
+	if f.WithContext(ctx).ctx != ctx {
+		t.Fatal("WithContext didn't replace the context")
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("Read %q, expected %q", data, "hello")
+	}
+}
+
+func TestFSPathErrors(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	fs := NewFS(config)
+
+	if err := fs.Mkdir(ctx, "/keybase/private/jdoe/dir"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create(ctx, "/keybase/private/jdoe/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Stat(ctx, "keybase/private/jdoe")
+	if _, ok := err.(InvalidPathError); !ok {
+		t.Errorf("Relative path: got %v, expected InvalidPathError", err)
+	}
+	_, err = fs.Open(ctx, "/keybase/private/jdoe/dir")
+	if _, ok := err.(NotFileError); !ok {
+		t.Errorf("Open on a dir: got %v, expected NotFileError", err)
+	}
+	_, err = fs.ReadDir(ctx, "/keybase/private/jdoe/file")
+	if _, ok := err.(NotDirError); !ok {
+		t.Errorf("ReadDir on a file: got %v, expected NotDirError", err)
+	}
+	_, err = fs.Stat(ctx, "/keybase/private/jdoe/file/child")
+	if _, ok := err.(NotDirError); !ok {
+		t.Errorf("Path through a file: got %v, expected NotDirError", err)
+	}
+	_, err = fs.Create(ctx, "/keybase/private/jdoe")
+	if _, ok := err.(NotTlfEntryError); !ok {
+		t.Errorf("Create on a folder: got %v, expected NotTlfEntryError",
+			err)
+	}
+	_, err = fs.Stat(ctx, "/keybase/private/jdoe/missing")
+	if _, ok := err.(libkbfs.NoSuchNameError); !ok {
+		t.Errorf("Missing entry: got %v, expected NoSuchNameError", err)
+	}
+}
+
+func TestFSMkdirTlf(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "janedoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	fs := NewFS(config)
+
+	const name = "/keybase/private/jdoe,janedoe"
+	if err := fs.Mkdir(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() {
+		t.Errorf("%s isn't a directory", name)
+	}
+
+	err = fs.Mkdir(ctx, name)
+	if _, ok := err.(libkbfs.NameExistsError); !ok {
+		t.Errorf("Second Mkdir: got %v, expected NameExistsError", err)
+	}
+	err = fs.Mkdir(ctx, "/keybase/private")
+	if _, ok := err.(libkbfs.NameExistsError); !ok {
+		t.Errorf("Mkdir above the folders: got %v, expected NameExistsError",
+			err)
+	}
+}
@@ -2,10 +2,10 @@
 // Use of this source code is governed by a BSD
 // license that can be found in the LICENSE file.
 
-package main
+package libfs
 
 import (
-	"fmt"
+	"os"
 	"path"
 	"strings"
 
@@ -13,6 +13,12 @@ import (
 	"golang.org/x/net/context"
 )
 
+const (
+	topName     = "keybase"
+	publicName  = "public"
+	privateName = "private"
+)
+
 type pathType int
 
 const (
@@ -46,7 +52,7 @@ func splitHelper(cleanPath string) []string {
 func split(pathStr string) ([]string, error) {
 	cleanPath := path.Clean(pathStr)
 	if !path.IsAbs(cleanPath) {
-		return nil, fmt.Errorf("split: %s is not an absolute path", pathStr)
+		return nil, InvalidPathError{pathStr}
 	}
 	return splitHelper(cleanPath), nil
 }
@@ -60,7 +66,7 @@ func makeKbfsPath(pathStr string) (kbfsPath, error) {
 
 	if (len >= 1 && components[0] != topName) ||
 		(len >= 2 && components[1] != publicName && components[1] != privateName) {
-		return kbfsPath{}, invalidKbfsPathErr{pathStr}
+		return kbfsPath{}, InvalidPathError{pathStr}
 	}
 
 	if len == 0 {
@@ -118,6 +124,12 @@ func (p kbfsPath) String() string {
 	return "/" + strings.Join(components, "/")
 }
 
+// isTlfEntry returns whether p is an entry within a top-level folder,
+// rather than a folder itself or one of the directories above them.
+func (p kbfsPath) isTlfEntry() bool {
+	return p.pathType == tlfPath && len(p.tlfComponents) > 0
+}
+
 func (p kbfsPath) dirAndBasename() (dir kbfsPath, basename string, err error) {
 	switch p.pathType {
 	case keybasePath:
@@ -159,7 +171,7 @@ func (p kbfsPath) dirAndBasename() (dir kbfsPath, basename string, err error) {
 		return
 	}
 
-	err = errCannotSplit
+	err = InvalidPathError{p.String()}
 	return
 }
 
@@ -167,7 +179,7 @@ func (p kbfsPath) join(childName string) (childPath kbfsPath, err error) {
 	switch p.pathType {
 	case rootPath:
 		if childName != topName {
-			err = cannotJoinErr{p, childName}
+			err = InvalidPathError{path.Join(p.String(), childName)}
 			return
 		}
 
@@ -178,7 +190,8 @@ func (p kbfsPath) join(childName string) (childPath kbfsPath, err error) {
 
 	case keybasePath:
 		if childName != publicName && childName != privateName {
-			err = cannotJoinErr{p, childName}
+			err = InvalidPathError{path.Join(p.String(), childName)}
+			return
 		}
 
 		public := (childName == publicName)
@@ -198,30 +211,27 @@ func (p kbfsPath) join(childName string) (childPath kbfsPath, err error) {
 
 	case tlfPath:
 		childPath = kbfsPath{
-			pathType:      tlfPath,
-			public:        p.public,
-			tlfName:       p.tlfName,
-			tlfComponents: append(p.tlfComponents, childName),
+			pathType: tlfPath,
+			public:   p.public,
+			tlfName:  p.tlfName,
+			tlfComponents: append(append([]string(nil),
+				p.tlfComponents...), childName),
 		}
 		return
 	}
 
-	err = cannotJoinErr{p, childName}
+	err = InvalidPathError{path.Join(p.String(), childName)}
 	return
 }
 
-// Returns a nil node if p doesn't have type tlfPath.
-func (p kbfsPath) getNode(ctx context.Context, config libkbfs.Config) (n libkbfs.Node, ei libkbfs.EntryInfo, err error) {
+// Returns a nil handle if p doesn't have type tlfPath.  Non-canonical
+// folder names are followed to their canonical folder.
+func (p kbfsPath) getHandle(ctx context.Context, config libkbfs.Config) (h *libkbfs.TlfHandle, err error) {
 	if p.pathType != tlfPath {
-		ei := libkbfs.EntryInfo{
-			Type: libkbfs.Dir,
-		}
-		return nil, ei, nil
+		return nil, nil
 	}
 
-	var h *libkbfs.TlfHandle
 	name := p.tlfName
-outer:
 	for {
 		h, err = libkbfs.ParseTlfHandle(
 			ctx, config.KBPKI(), name, p.public,
@@ -229,7 +239,7 @@ outer:
 		switch err := err.(type) {
 		case nil:
 			// No error.
-			break outer
+			return h, nil
 
 		case libkbfs.TlfNameNotCanonical:
 			// Non-canonical name, so try again.
@@ -237,15 +247,70 @@ outer:
 
 		default:
 			// Some other error.
-			return nil, libkbfs.EntryInfo{}, err
+			return nil, err
 		}
 	}
+}
+
+// Returns whether the current user can write to the top-level folder
+// of p.  Nothing above the top-level folders is writable.
+func (p kbfsPath) isWritable(ctx context.Context, config libkbfs.Config) (bool, error) {
+	if p.pathType != tlfPath {
+		return false, nil
+	}
+
+	h, err := p.getHandle(ctx, config)
+	if err != nil {
+		return false, err
+	}
+
+	// Anyone who isn't logged in is just a reader.
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	return err == nil && h.IsWriter(uid), nil
+}
+
+// Returns the mode of an entry of the given type at p, as seen by a
+// user with the given write permission.
+func (p kbfsPath) mode(entryType libkbfs.EntryType, writable bool) os.FileMode {
+	if p.pathType != tlfPath {
+		// Everyone can list the directories above the TLFs.
+		return os.ModeDir | 0755
+	}
+	return entryType.Mode(p.public, writable)
+}
+
+// Returns a nil node if p doesn't have type tlfPath, or if p is a
+// symlink.
+func (p kbfsPath) getNode(ctx context.Context, config libkbfs.Config) (n libkbfs.Node, ei libkbfs.EntryInfo, err error) {
+	if p.pathType != tlfPath {
+		ei := libkbfs.EntryInfo{
+			Type: libkbfs.Dir,
+		}
+		return nil, ei, nil
+	}
+
+	h, err := p.getHandle(ctx, config)
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, err
+	}
 
 	n, ei, err =
 		config.KBFSOps().GetOrCreateRootNode(
 			ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, err
+	}
 
-	for _, component := range p.tlfComponents {
+	for i, component := range p.tlfComponents {
+		if ei.Type != libkbfs.Dir {
+			// TODO: What to do with symlinks?
+			return nil, libkbfs.EntryInfo{}, NotDirError{kbfsPath{
+				pathType:      tlfPath,
+				public:        p.public,
+				tlfName:       p.tlfName,
+				tlfComponents: p.tlfComponents[:i],
+			}.String()}
+		}
 		cn, cei, err := config.KBFSOps().Lookup(ctx, n, component)
 		if err != nil {
 			return nil, libkbfs.EntryInfo{}, err
@@ -266,7 +331,7 @@ func (p kbfsPath) getFileNode(ctx context.Context, config libkbfs.Config) (libkb
 	// TODO: What to do with symlinks?
 
 	if de.Type != libkbfs.File && de.Type != libkbfs.Exec {
-		return nil, fmt.Errorf("openFile: %s is not a file, but a %s", p, de.Type)
+		return nil, NotFileError{p.String()}
 	}
 
 	return n, nil
@@ -274,8 +339,6 @@ func (p kbfsPath) getFileNode(ctx context.Context, config libkbfs.Config) (libkb
 
 // Returns a nil node if p doesn't have type tlfPath.
 func (p kbfsPath) getDirNode(ctx context.Context, config libkbfs.Config) (libkbfs.Node, error) {
-	// TODO: Handle non-tlfPaths.
-
 	n, de, err := p.getNode(ctx, config)
 	if err != nil {
 		return nil, err
@@ -284,8 +347,25 @@ func (p kbfsPath) getDirNode(ctx context.Context, config libkbfs.Config) (libkbf
 	// TODO: What to do with symlinks?
 
 	if de.Type != libkbfs.Dir {
-		return nil, fmt.Errorf("openDir: %s is not a dir, but a %s", p, de.Type)
+		return nil, NotDirError{p.String()}
 	}
 
 	return n, nil
 }
+
+// getParentNode returns the directory node holding p, which must be
+// an entry within a top-level folder, and p's name within it.
+func (p kbfsPath) getParentNode(ctx context.Context, config libkbfs.Config) (libkbfs.Node, string, error) {
+	if !p.isTlfEntry() {
+		return nil, "", NotTlfEntryError{p.String()}
+	}
+	dir, name, err := p.dirAndBasename()
+	if err != nil {
+		return nil, "", err
+	}
+	dirNode, err := dir.getDirNode(ctx, config)
+	if err != nil {
+		return nil, "", err
+	}
+	return dirNode, name, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import "fmt"
+
+// InvalidPathError indicates that a path given to FS isn't an
+// absolute path within /keybase/public or /keybase/private.
+type InvalidPathError struct {
+	Path string
+}
+
+// Error implements the error interface for InvalidPathError.
+func (e InvalidPathError) Error() string {
+	return fmt.Sprintf("invalid KBFS path %s", e.Path)
+}
+
+// NotDirError indicates that a path given to FS names something
+// other than a directory, where a directory was needed.
+type NotDirError struct {
+	Path string
+}
+
+// Error implements the error interface for NotDirError.
+func (e NotDirError) Error() string {
+	return fmt.Sprintf("%s is not a directory", e.Path)
+}
+
+// NotFileError indicates that a path given to FS names something
+// other than a file, where a file was needed.
+type NotFileError struct {
+	Path string
+}
+
+// Error implements the error interface for NotFileError.
+func (e NotFileError) Error() string {
+	return fmt.Sprintf("%s is not a file", e.Path)
+}
+
+// NotTlfEntryError indicates that a path given to FS names a
+// top-level folder, or one of the directories above them, where an
+// entry within a top-level folder was needed.
+type NotTlfEntryError struct {
+	Path string
+}
+
+// Error implements the error interface for NotTlfEntryError.
+func (e NotTlfEntryError) Error() string {
+	return fmt.Sprintf("%s is not within a top-level folder", e.Path)
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMakeKbfsPath(t *testing.T) {
+	tests := []struct {
+		pathStr  string
+		expected kbfsPath
+	}{
+		{"/", kbfsPath{pathType: rootPath}},
+		{"/keybase", kbfsPath{pathType: keybasePath}},
+		{"/keybase/", kbfsPath{pathType: keybasePath}},
+		{"/keybase/public", kbfsPath{
+			pathType: keybaseChildPath, public: true}},
+		{"/keybase/private", kbfsPath{pathType: keybaseChildPath}},
+		{"/keybase/private/jdoe", kbfsPath{
+			pathType: tlfPath, tlfName: "jdoe", tlfComponents: []string{}}},
+		{"/keybase/public/jdoe/a/b", kbfsPath{
+			pathType: tlfPath, public: true, tlfName: "jdoe",
+			tlfComponents: []string{"a", "b"}}},
+		{"/keybase/private/jdoe/a/../b//c/.", kbfsPath{
+			pathType: tlfPath, tlfName: "jdoe",
+			tlfComponents: []string{"b", "c"}}},
+	}
+	for _, test := range tests {
+		p, err := makeKbfsPath(test.pathStr)
+		if err != nil {
+			t.Errorf("makeKbfsPath(%q): %v", test.pathStr, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, test.expected) {
+			t.Errorf("makeKbfsPath(%q) = %+v, expected %+v",
+				test.pathStr, p, test.expected)
+		}
+	}
+}
+
+func TestMakeKbfsPathInvalid(t *testing.T) {
+	for _, pathStr := range []string{
+		"", "keybase/private/jdoe", "/foo", "/keybase/foo",
+		"/keybase/foo/jdoe", "/foo/private/jdoe",
+	} {
+		_, err := makeKbfsPath(pathStr)
+		if _, ok := err.(InvalidPathError); !ok {
+			t.Errorf("makeKbfsPath(%q): got %v, expected InvalidPathError",
+				pathStr, err)
+		}
+	}
+}
+
+func TestKbfsPathString(t *testing.T) {
+	for _, pathStr := range []string{
+		"/", "/keybase", "/keybase/public", "/keybase/private",
+		"/keybase/private/jdoe", "/keybase/public/jdoe/a/b",
+	} {
+		p, err := makeKbfsPath(pathStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != pathStr {
+			t.Errorf("Got %q, expected %q", p.String(), pathStr)
+		}
+	}
+}
+
+func TestKbfsPathDirAndBasename(t *testing.T) {
+	tests := []struct {
+		pathStr, dir, basename string
+	}{
+		{"/keybase", "/", "keybase"},
+		{"/keybase/public", "/keybase", "public"},
+		{"/keybase/private/jdoe", "/keybase/private", "jdoe"},
+		{"/keybase/private/jdoe/a", "/keybase/private/jdoe", "a"},
+		{"/keybase/public/jdoe/a/b", "/keybase/public/jdoe/a", "b"},
+	}
+	for _, test := range tests {
+		p, err := makeKbfsPath(test.pathStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, basename, err := p.dirAndBasename()
+		if err != nil {
+			t.Errorf("%s: %v", test.pathStr, err)
+			continue
+		}
+		if dir.String() != test.dir || basename != test.basename {
+			t.Errorf("%s: got (%s, %s), expected (%s, %s)", test.pathStr,
+				dir, basename, test.dir, test.basename)
+		}
+	}
+
+	root, err := makeKbfsPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = root.dirAndBasename()
+	if _, ok := err.(InvalidPathError); !ok {
+		t.Errorf("Got %v, expected InvalidPathError", err)
+	}
+}
+
+func TestKbfsPathJoin(t *testing.T) {
+	tests := []struct {
+		pathStr, child, expected string
+	}{
+		{"/", "keybase", "/keybase"},
+		{"/keybase", "private", "/keybase/private"},
+		{"/keybase/public", "jdoe", "/keybase/public/jdoe"},
+		{"/keybase/private/jdoe", "a", "/keybase/private/jdoe/a"},
+		{"/keybase/private/jdoe/a", "b", "/keybase/private/jdoe/a/b"},
+	}
+	for _, test := range tests {
+		p, err := makeKbfsPath(test.pathStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		childPath, err := p.join(test.child)
+		if err != nil {
+			t.Errorf("%s: %v", test.pathStr, err)
+			continue
+		}
+		if childPath.String() != test.expected {
+			t.Errorf("Got %s, expected %s", childPath, test.expected)
+		}
+	}
+
+	// Joining mustn't share components between the children.
+	p, err := makeKbfsPath("/keybase/private/jdoe/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, _, err := p.dirAndBasename()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child1, err := dir.join("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child2, err := dir.join("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child1.String() != "/keybase/private/jdoe/a/c" ||
+		child2.String() != "/keybase/private/jdoe/a/d" {
+		t.Errorf("Got %s and %s", child1, child2)
+	}
+
+	for _, test := range []struct{ pathStr, child string }{
+		{"/", "foo"}, {"/keybase", "foo"},
+	} {
+		p, err := makeKbfsPath(test.pathStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.join(test.child)
+		if _, ok := err.(InvalidPathError); !ok {
+			t.Errorf("%s + %s: got %v, expected InvalidPathError",
+				test.pathStr, test.child, err)
+		}
+	}
+}
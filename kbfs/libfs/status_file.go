@@ -12,6 +12,10 @@ import (
 	"golang.org/x/net/context"
 )
 
+// StatusWaitTimeout is the longest GetEncodedStatusAfterChange waits
+// for a change by default.
+const StatusWaitTimeout = 1 * time.Minute
+
 // GetEncodedFolderStatus returns serialized JSON containing status information
 // for a folder
 func GetEncodedFolderStatus(ctx context.Context, config libkbfs.Config,
@@ -48,3 +52,21 @@ func GetEncodedStatus(ctx context.Context, config libkbfs.Config) (
 	data = append(data, '\n')
 	return data, t, err
 }
+
+// GetEncodedStatusAfterChange is like GetEncodedStatus, but it first
+// waits until the top-level status changes, or until the given timeout
+// passes, whichever comes first.
+func GetEncodedStatusAfterChange(ctx context.Context, config libkbfs.Config,
+	timeout time.Duration) (data []byte, t time.Time, err error) {
+	// Any error is reported once the wait is over.
+	_, ch, _ := config.KBFSOps().Status(ctx)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+	return GetEncodedStatus(ctx, config)
+}
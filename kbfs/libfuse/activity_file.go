@@ -0,0 +1,23 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// NewActivityFile returns a special read file that contains the page
+// of the activity feed of the current TLF selected by q.
+func NewActivityFile(folder *Folder, resp *fuse.LookupResponse,
+	q libkbfs.ActivityQuery) *SpecialReadFile {
+	resp.EntryValid = 0
+	return &SpecialReadFile{
+		read: libfs.GetEncodedActivity(
+			folder.fs.config, folder.getFolderBranch(), q),
+	}
+}
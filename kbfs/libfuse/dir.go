@@ -68,6 +68,30 @@ func (f *Folder) name() libkbfs.CanonicalTlfName {
 	return f.h.GetCanonicalName()
 }
 
+// checkWriter returns a libkbfs.WriteAccessError if the current user
+// can't write to this folder, e.g. because they are only a reader.
+func (f *Folder) checkWriter(ctx context.Context) error {
+	username, uid, err := f.fs.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	f.handleMu.RLock()
+	defer f.handleMu.RUnlock()
+	if !f.h.IsWriter(uid) {
+		return libkbfs.NewWriteAccessError(f.h, username)
+	}
+	return nil
+}
+
+// entryMode returns the mode of an entry of the given type in this
+// folder, as seen by the current user.
+func (f *Folder) entryMode(
+	ctx context.Context, entryType libkbfs.EntryType) os.FileMode {
+	// Anyone who isn't logged in is just a reader.
+	writable := f.checkWriter(ctx) == nil
+	return entryType.Mode(f.list.public, writable)
+}
+
 func (f *Folder) reportErr(ctx context.Context,
 	mode libkbfs.ErrorModeType, err error) {
 	if err == nil {
@@ -336,10 +360,7 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	}
 	fillAttr(&de, a)
 
-	a.Mode = os.ModeDir | 0700
-	if d.folder.list.public {
-		a.Mode |= 0055
-	}
+	a.Mode = d.folder.entryMode(ctx, libkbfs.Dir)
 	return nil
 }
 
@@ -348,6 +369,17 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	d.folder.fs.log.CDebugf(ctx, "Dir Lookup %s", req.Name)
 	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
 
+	// Error files within a folder only show that folder's errors.
+	if q, ok := libfs.ErrorQueryForFileName(
+		req.Name, d.folder.fs.config.Clock().Now()); ok {
+		q.Tlf, q.Public = d.folder.name(), d.folder.list.public
+		return NewErrorFile(d.folder.fs, resp, q), nil
+	}
+
+	if q, ok := libfs.ActivityQueryForFileName(req.Name); ok {
+		return NewActivityFile(d.folder, resp, q), nil
+	}
+
 	specialNode := handleSpecialFile(req.Name, d.folder.fs, resp)
 	if specialNode != nil {
 		return specialNode, nil
@@ -397,6 +429,13 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		}
 		return child, nil
 
+	case libfs.RestoreFileName:
+		resp.EntryValid = 0
+		child := &RestoreFile{
+			folder: d.folder,
+		}
+		return child, nil
+
 	case libfs.SyncFromServerFileName:
 		resp.EntryValid = 0
 		child := &SyncFromServerFile{
@@ -609,6 +648,44 @@ func (d *Dir) ReadDirAll(ctx context.Context) (res []fuse.Dirent, err error) {
 	return res, nil
 }
 
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Getxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return getxattr(ctx, d.folder.fs.config.KBFSOps(), d.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Listxattr")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return listxattr(ctx, d.folder.fs.config.KBFSOps(), d.node, resp)
+}
+
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for Dir.
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Setxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return setxattr(ctx, d.folder.fs.config.KBFSOps(), d.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for Dir.
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Removexattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return removexattr(ctx, d.folder.fs.config.KBFSOps(), d.node, req)
+}
+
 // Forget kernel reference to this node.
 func (d *Dir) Forget() {
 	d.folder.forgetNode(d.node)
@@ -781,10 +858,7 @@ func (tlf *TLF) Attr(ctx context.Context, a *fuse.Attr) error {
 		// stale data for too long if we end up loading the
 		// dir.
 		a.Valid = 1 * time.Second
-		a.Mode = os.ModeDir | 0700
-		if tlf.isPublic() {
-			a.Mode |= 0055
-		}
+		a.Mode = tlf.folder.entryMode(ctx, libkbfs.Dir)
 		return nil
 	}
 
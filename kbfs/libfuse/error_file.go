@@ -7,11 +7,13 @@ package libfuse
 import (
 	"bazil.org/fuse"
 	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
 )
 
 // NewErrorFile returns a special read file that contains a text
-// representation of the last few KBFS errors.
-func NewErrorFile(fs *FS, resp *fuse.LookupResponse) *SpecialReadFile {
+// representation of the KBFS errors selected by q.
+func NewErrorFile(fs *FS, resp *fuse.LookupResponse,
+	q libkbfs.ErrorQuery) *SpecialReadFile {
 	resp.EntryValid = 0
-	return &SpecialReadFile{read: libfs.GetEncodedErrors(fs.config)}
+	return &SpecialReadFile{read: libfs.GetEncodedErrors(fs.config, q)}
 }
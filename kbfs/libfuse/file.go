@@ -37,13 +37,28 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	}
 
 	fillAttr(&de, a)
-	a.Mode = 0644
-	if de.Type == libkbfs.Exec {
-		a.Mode |= 0111
-	}
+	a.Mode = f.folder.entryMode(ctx, de.Type)
 	return nil
 }
 
+var _ fs.NodeOpener = (*File)(nil)
+
+// Open implements the fs.NodeOpener interface for File.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Open %v", req.Flags)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	// Readers would otherwise only find out they can't write when
+	// the file gets synced.
+	if !req.Flags.IsReadOnly() {
+		if err := f.folder.checkWriter(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
 var _ fs.NodeFsyncer = (*File)(nil)
 
 func (f *File) sync(ctx context.Context) error {
@@ -186,6 +201,44 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Getxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return getxattr(ctx, f.folder.fs.config.KBFSOps(), f.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Listxattr")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return listxattr(ctx, f.folder.fs.config.KBFSOps(), f.node, resp)
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for File.
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Setxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return setxattr(ctx, f.folder.fs.config.KBFSOps(), f.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for File.
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Removexattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return removexattr(ctx, f.folder.fs.config.KBFSOps(), f.node, req)
+}
+
 var _ fs.NodeForgetter = (*File)(nil)
 
 // Forget kernel reference to this node.
@@ -165,9 +165,8 @@ func (fl *FolderList) Remove(ctx context.Context, req *fuse.RemoveRequest) (err
 	// TODO trying to delete non-canonical folder handles
 	// could be skipped.
 	//
-	// TODO how to handle closing down the folderbranchops
-	// object? Open files may still exist long after removing
-	// the favorite.
+	// KBFSOps shuts down the folder, unless files in it are still
+	// open, in which case it's shut down once it's idle.
 	return fl.fs.config.KBFSOps().DeleteFavorite(ctx, req.Name, fl.public)
 }
 
@@ -42,6 +42,9 @@ type FS struct {
 
 	// remoteStatus is the current status of remote connections.
 	remoteStatus libfs.RemoteStatus
+
+	// quotaUsage caches the user's quota usage for Statfs.
+	quotaUsage *libkbfs.EventuallyConsistentQuotaUsage
 }
 
 // NewFS creates an FS
@@ -56,7 +59,13 @@ func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool) *FS {
 		log.Configure("", true, "")
 		errLog.Configure("", true, "")
 	}
-	fs := &FS{config: config, conn: conn, log: log, errLog: errLog}
+	fs := &FS{
+		config:     config,
+		conn:       conn,
+		log:        log,
+		errLog:     errLog,
+		quotaUsage: libkbfs.NewEventuallyConsistentQuotaUsage(config, "FS"),
+	}
 	return fs
 }
 
@@ -221,20 +230,46 @@ func (f *FS) Root() (fs.Node, error) {
 	return n, nil
 }
 
+const (
+	// The block size reported by Statfs.  KBFS blocks vary in
+	// size, so this is only the unit in which quota is reported.
+	statfsBlockSize = 32 * 1024
+	// How old the cached quota usage may get before it's refreshed
+	// in the background.
+	quotaUsageStaleTolerance = 10 * time.Second
+	// How old the cached quota usage may get before Statfs waits
+	// for a refresh.
+	quotaUsageBlockTolerance = 10 * time.Minute
+)
+
 // Statfs implements the fs.FSStatfser interface for FS.
 func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
-	// TODO: Fill in real values for these.
-	var bsize uint32 = 32 * 1024
 	*resp = fuse.StatfsResponse{
-		Blocks:  ^uint64(0) / uint64(bsize),
-		Bfree:   ^uint64(0) / uint64(bsize),
-		Bavail:  ^uint64(0) / uint64(bsize),
-		Files:   0,
-		Ffree:   0,
-		Bsize:   bsize,
-		Namelen: ^uint32(0),
-		Frsize:  0,
+		Bsize:   statfsBlockSize,
+		Frsize:  statfsBlockSize,
+		Namelen: f.config.MaxNameBytes(),
+	}
+
+	usageBytes, limitBytes, err := f.quotaUsage.Get(
+		ctx, quotaUsageStaleTolerance, quotaUsageBlockTolerance)
+	if err != nil {
+		// Don't fail statfs just because we're e.g. logged out;
+		// report that there's no limit instead.
+		f.log.CDebugf(ctx, "Couldn't get quota usage: %v", err)
+		usageBytes, limitBytes = 0, int64(^uint64(0)>>1)
 	}
+
+	freeBytes := limitBytes - usageBytes
+	if freeBytes < 0 {
+		freeBytes = 0
+	}
+	resp.Blocks = uint64(limitBytes) / statfsBlockSize
+	resp.Bfree = uint64(freeBytes) / statfsBlockSize
+	resp.Bavail = resp.Bfree
+	// KBFS doesn't limit the number of files, so report as many as
+	// would fit if each one took up a single block.
+	resp.Files = resp.Blocks
+	resp.Ffree = resp.Bfree
 	return nil
 }
 
@@ -267,6 +302,9 @@ func (r *Root) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.L
 	switch req.Name {
 	case libfs.StatusFileName:
 		return NewStatusFile(r.private.fs, nil, resp), nil
+	case libfs.StatusWaitFileName:
+		resp.EntryValid = 0
+		return &StatusWaitFile{r.private.fs}, nil
 	case PrivateName:
 		return r.private, nil
 	case PublicName:
@@ -150,6 +150,27 @@ func TestStatRoot(t *testing.T) {
 	}
 }
 
+func TestStatfs(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mnt.Dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := uint64(st.Bsize), uint64(statfsBlockSize); g != e {
+		t.Errorf("wrong block size: %d != %d", g, e)
+	}
+	// The local block server has a practically unlimited quota.
+	if st.Blocks == 0 || st.Bfree == 0 || uint64(st.Bavail) != st.Bfree {
+		t.Errorf("unexpected block counts: blocks=%d free=%d avail=%d",
+			st.Blocks, st.Bfree, st.Bavail)
+	}
+}
+
 func TestStatPrivate(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -1064,6 +1085,52 @@ func TestRemoveDirNotEmpty(t *testing.T) {
 	}
 }
 
+func TestRemoveFileToTrashAndRestore(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	config.SetTrashRetention(24 * time.Hour)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	root := path.Join(mnt.Dir, PrivateName, "jdoe")
+	if err := os.Mkdir(path.Join(root, "mydir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := path.Join(root, "mydir", "myfile")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Rmdir(path.Join(root, "mydir")); err != nil {
+		t.Fatal(err)
+	}
+
+	date := config.Clock().Now().UTC().Format(libkbfs.TrashDateFormat)
+	trashDay := path.Join(root, libkbfs.TrashDirName, date)
+	checkDir(t, trashDay, map[string]fileInfoCheck{
+		"mydir%2Fmyfile": nil,
+	})
+
+	err := ioutil.WriteFile(path.Join(root, libfs.RestoreFileName),
+		[]byte(date+"/mydir%2Fmyfile"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), input; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+	checkDir(t, trashDay, map[string]fileInfoCheck{})
+}
+
 func TestRemoveFileWhileOpenWriting(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -1730,6 +1797,55 @@ func TestReaddirOtherFolderAsReader(t *testing.T) {
 	})
 }
 
+func TestOpenForWriteOtherFolderAsReader(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "wsmith")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	func() {
+		mnt, _, cancelFn := makeFS(t, config)
+		defer mnt.Close()
+		defer cancelFn()
+
+		// cause the folder to exist
+		if err := ioutil.WriteFile(path.Join(mnt.Dir, PrivateName, "jdoe#wsmith", "myfile"), []byte("data for myfile"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	c2 := libkbfs.ConfigAsUser(config, "wsmith")
+	defer libkbfs.CheckConfigAndShutdown(t, c2)
+	mnt, _, cancelFn := makeFS(t, c2)
+	defer mnt.Close()
+	defer cancelFn()
+
+	// Readers don't get any write bits.
+	dirPath := path.Join(mnt.Dir, PrivateName, "jdoe#wsmith")
+	fi, err := os.Lstat(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Mode().String(), `dr-x------`; g != e {
+		t.Errorf("wrong dir mode: %q != %q", g, e)
+	}
+	p := path.Join(dirPath, "myfile")
+	fi, err = os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Mode().String(), `-r--r--r--`; g != e {
+		t.Errorf("wrong file mode: %q != %q", g, e)
+	}
+
+	// Opening for write fails right away.
+	switch _, err := os.OpenFile(p, os.O_WRONLY, 0); err := err.(type) {
+	case *os.PathError:
+		if g, e := err.Err, syscall.EACCES; g != e {
+			t.Fatalf("wrong error: %v != %v", g, e)
+		}
+	default:
+		t.Fatalf("expected a PathError, got %T: %v", err, err)
+	}
+}
+
 func TestReaddirMissingOtherFolderAsReader(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "wsmith")
 	defer config.Shutdown()
@@ -2225,8 +2341,10 @@ func TestInvalidateEntryOnDelete(t *testing.T) {
 	}
 }
 
-func testForErrorText(t *testing.T, path string, expectedErr error,
-	fileType string) {
+// errorFileContains returns whether the error file at path contains
+// the given error.
+func errorFileContains(t *testing.T, path string, expectedErr error) (
+	bool, string) {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		t.Fatalf("Bad error reading %s error file: %v", path, err)
@@ -2239,20 +2357,30 @@ func testForErrorText(t *testing.T, path string, expectedErr error,
 			err, string(buf))
 	}
 
-	found := false
 	for _, e := range errors {
 		if e.Error == expectedErr.Error() {
-			found = true
-			break
+			return true, string(buf)
 		}
 	}
+	return false, string(buf)
+}
 
-	if !found {
+func testForErrorText(t *testing.T, path string, expectedErr error,
+	fileType string) {
+	if found, buf := errorFileContains(t, path, expectedErr); !found {
 		t.Errorf("%s error file did not contain the error %s. "+
 			"Full contents: %s", fileType, expectedErr, buf)
 	}
 }
 
+func testForNoErrorText(t *testing.T, path string, unexpectedErr error,
+	fileType string) {
+	if found, buf := errorFileContains(t, path, unexpectedErr); found {
+		t.Errorf("%s error file contained the error %s. "+
+			"Full contents: %s", fileType, unexpectedErr, buf)
+	}
+}
+
 func TestErrorFile(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	config.SetReporter(libkbfs.NewReporterSimple(config.Clock(), 0))
@@ -2266,21 +2394,33 @@ func TestErrorFile(t *testing.T) {
 	if err == nil {
 		t.Fatal("Stat of non-existent user worked!")
 	}
+	// and another within jdoe's private folder
+	err = os.Remove(path.Join(mnt.Dir, PrivateName, "jdoe", "missing"))
+	if err == nil {
+		t.Fatal("Removing a non-existent file worked!")
+	}
 
-	// Make sure the root error file reads as expected
-	expectedErr := libkbfs.NoSuchUserError{Input: "janedoe"}
+	userErr := libkbfs.NoSuchUserError{Input: "janedoe"}
+	nameErr := libkbfs.NoSuchNameError{Name: "missing"}
 
-	// test both the root error file and one in a directory
-	testForErrorText(t, path.Join(mnt.Dir, libkbfs.ErrorFile),
-		expectedErr, "root")
-	testForErrorText(t, path.Join(mnt.Dir, PublicName, libkbfs.ErrorFile),
-		expectedErr, "root")
-	testForErrorText(t, path.Join(mnt.Dir, PrivateName, libkbfs.ErrorFile),
-		expectedErr, "root")
-	testForErrorText(t, path.Join(mnt.Dir, PublicName, "jdoe", libkbfs.ErrorFile),
-		expectedErr, "dir")
-	testForErrorText(t, path.Join(mnt.Dir, PrivateName, "jdoe", libkbfs.ErrorFile),
-		expectedErr, "dir")
+	// The root error files show every error.
+	for _, p := range []string{
+		path.Join(mnt.Dir, libkbfs.ErrorFile),
+		path.Join(mnt.Dir, PublicName, libkbfs.ErrorFile),
+		path.Join(mnt.Dir, PrivateName, libkbfs.ErrorFile),
+	} {
+		testForErrorText(t, p, userErr, "root")
+		testForErrorText(t, p, nameErr, "root")
+	}
+
+	// The error file in a folder only shows that folder's errors;
+	// the janedoe error was reported for the janedoe folder.
+	privatePath := path.Join(mnt.Dir, PrivateName, "jdoe", libkbfs.ErrorFile)
+	testForErrorText(t, privatePath, nameErr, "dir")
+	testForNoErrorText(t, privatePath, userErr, "dir")
+	publicPath := path.Join(mnt.Dir, PublicName, "jdoe", libkbfs.ErrorFile)
+	testForNoErrorText(t, publicPath, nameErr, "dir")
+	testForNoErrorText(t, publicPath, userErr, "dir")
 }
 
 type testMountObserver struct {
@@ -2562,6 +2702,28 @@ func TestStatusFile(t *testing.T) {
 	}
 }
 
+func TestActivityFile(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	if err := ioutil.WriteFile(p, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(path.Join(mnt.Dir, PrivateName, "jdoe",
+		libfs.ActivityFileName))
+	if err != nil {
+		t.Fatalf("Couldn't read activity file: %v", err)
+	}
+	if !strings.HasPrefix(string(buf), "jdoe (dev1) created myfile") {
+		t.Errorf("Unexpected activity: %s", buf)
+	}
+}
+
 // TODO: remove once we have automatic conflict resolution tests
 func TestUnstageFile(t *testing.T) {
 	config1 := libkbfs.MakeTestConfigOrBust(t, "user1",
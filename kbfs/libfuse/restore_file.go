@@ -0,0 +1,59 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// RestoreFile represents a write-only file where a write of
+// "<date>/<name>" restores that entry from the folder's trash to
+// where it was removed from.
+type RestoreFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*RestoreFile)(nil)
+
+// Attr implements the fs.Node interface for RestoreFile.
+func (f *RestoreFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*RestoreFile)(nil)
+
+var _ fs.HandleWriter = (*RestoreFile)(nil)
+
+// Write implements the fs.HandleWriter interface for RestoreFile.
+func (f *RestoreFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "RestoreFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	entry := strings.TrimSpace(string(req.Data))
+	if len(entry) == 0 {
+		return nil
+	}
+	entry = strings.TrimPrefix(entry, libkbfs.TrashDirName+"/")
+	i := strings.Index(entry, "/")
+	if i < 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	_, err = f.folder.fs.config.KBFSOps().RestoreFromTrash(
+		ctx, f.folder.getFolderBranch(), entry[:i], entry[i+1:])
+	if err != nil {
+		return err
+	}
+	f.folder.fs.NotificationGroupWait()
+	resp.Size = len(req.Data)
+	return nil
+}
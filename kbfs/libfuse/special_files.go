@@ -8,13 +8,15 @@ import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/keybase/kbfs/libfs"
-	"github.com/keybase/kbfs/libkbfs"
 )
 
 func handleSpecialFile(name string, fs *FS, resp *fuse.LookupResponse) fs.Node {
+	if q, ok := libfs.ErrorQueryForFileName(
+		name, fs.config.Clock().Now()); ok {
+		return NewErrorFile(fs, resp, q)
+	}
+
 	switch name {
-	case libkbfs.ErrorFile:
-		return NewErrorFile(fs, resp)
 	case libfs.MetricsFileName:
 		return NewMetricsFile(fs, resp)
 	case libfs.ProfileListDirName:
@@ -0,0 +1,47 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"github.com/keybase/kbfs/libfs"
+)
+
+// StatusWaitFile represents a file containing the top-level status,
+// which isn't read until the status changes.  Opening it blocks until
+// then, or until libfs.StatusWaitTimeout passes, so that readers can
+// long-poll for status changes.
+type StatusWaitFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*StatusWaitFile)(nil)
+
+// Attr implements the fs.Node interface for StatusWaitFile.
+func (f *StatusWaitFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	// Unlike SpecialReadFile, don't read the data here, since that
+	// would block stat calls too.
+	a.Size = 0
+	a.Mode = 0444
+	return nil
+}
+
+var _ fs.NodeOpener = (*StatusWaitFile)(nil)
+
+// Open implements the fs.NodeOpener interface for StatusWaitFile.
+func (f *StatusWaitFile) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (fs.Handle, error) {
+	data, _, err := libfs.GetEncodedStatusAfterChange(
+		ctx, f.fs.config, libfs.StatusWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Flags |= fuse.OpenDirectIO
+	return fs.DataHandle(data), nil
+}
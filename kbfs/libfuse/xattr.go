@@ -0,0 +1,75 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"sort"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// Flags for setxattr(2).  These have the same values on Linux and
+// OS X, but aren't exposed by the syscall package on both.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+func getxattr(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	node libkbfs.Node, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) error {
+	xattrs, err := kbfsOps.GetXattrs(ctx, node)
+	if err != nil {
+		return err
+	}
+	value, ok := xattrs[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func listxattr(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	node libkbfs.Node, resp *fuse.ListxattrResponse) error {
+	xattrs, err := kbfsOps.GetXattrs(ctx, node)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	return nil
+}
+
+func setxattr(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	node libkbfs.Node, req *fuse.SetxattrRequest) error {
+	if req.Flags&(xattrCreate|xattrReplace) != 0 {
+		xattrs, err := kbfsOps.GetXattrs(ctx, node)
+		if err != nil {
+			return err
+		}
+		_, exists := xattrs[req.Name]
+		if exists && req.Flags&xattrCreate != 0 {
+			return fuse.Errno(syscall.EEXIST)
+		} else if !exists && req.Flags&xattrReplace != 0 {
+			return fuse.ErrNoXattr
+		}
+	}
+	// KBFS copies the value, so it's fine that req.Xattr is reused
+	// once this returns.
+	return kbfsOps.SetXattr(ctx, node, req.Name, req.Xattr)
+}
+
+func removexattr(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	node libkbfs.Node, req *fuse.RemovexattrRequest) error {
+	return kbfsOps.RemoveXattr(ctx, node, req.Name)
+}
@@ -363,3 +363,9 @@ func (b *BlockCacheStandard) DirtyBytesEstimate() uint64 {
 	}
 	return b.dirtyBytesEstimate
 }
+
+// CleanBytesCapacity implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) CleanBytesCapacity() uint64 {
+	return b.cleanBytesCapacity
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/metricsutil"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// BlockCacheMeasured delegates to another BlockCache instance but
+// also keeps track of stats.
+type BlockCacheMeasured struct {
+	delegate      BlockCache
+	getCountMeter metrics.Meter
+	hitCountMeter metrics.Meter
+}
+
+var _ BlockCache = BlockCacheMeasured{}
+
+// NewBlockCacheMeasured creates and returns a new BlockCacheMeasured
+// instance with the given delegate and registry.
+func NewBlockCacheMeasured(delegate BlockCache, r metrics.Registry) BlockCacheMeasured {
+	getCountMeter := metrics.GetOrRegisterMeter("BlockCache.GetCount", r)
+	hitCountMeter := metrics.GetOrRegisterMeter("BlockCache.HitCount", r)
+	metricsutil.GetOrRegisterRatioGauge(
+		"BlockCache.HitRatio", hitCountMeter, getCountMeter, r)
+	return BlockCacheMeasured{
+		delegate:      delegate,
+		getCountMeter: getCountMeter,
+		hitCountMeter: hitCountMeter,
+	}
+}
+
+// Get implements the BlockCache interface for BlockCacheMeasured.
+func (b BlockCacheMeasured) Get(ptr BlockPointer, branch BranchName) (
+	Block, error) {
+	block, err := b.delegate.Get(ptr, branch)
+	b.getCountMeter.Mark(1)
+	if err == nil {
+		b.hitCountMeter.Mark(1)
+	}
+	return block, err
+}
+
+// CheckForKnownPtr implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) CheckForKnownPtr(tlf TlfID, block *FileBlock) (
+	BlockPointer, error) {
+	return b.delegate.CheckForKnownPtr(tlf, block)
+}
+
+// Put implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) Put(ptr BlockPointer, tlf TlfID, block Block,
+	lifetime BlockCacheLifetime) error {
+	return b.delegate.Put(ptr, tlf, block, lifetime)
+}
+
+// PutDirty implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) PutDirty(ptr BlockPointer, branch BranchName,
+	block Block) error {
+	return b.delegate.PutDirty(ptr, branch, block)
+}
+
+// DeleteTransient implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) DeleteTransient(ptr BlockPointer, tlf TlfID) error {
+	return b.delegate.DeleteTransient(ptr, tlf)
+}
+
+// DeletePermanent implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) DeletePermanent(id BlockID) error {
+	return b.delegate.DeletePermanent(id)
+}
+
+// DeleteDirty implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) DeleteDirty(ptr BlockPointer, branch BranchName) error {
+	return b.delegate.DeleteDirty(ptr, branch)
+}
+
+// DeleteKnownPtr implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) DeleteKnownPtr(tlf TlfID, block *FileBlock) error {
+	return b.delegate.DeleteKnownPtr(tlf, block)
+}
+
+// IsDirty implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) IsDirty(ptr BlockPointer, branch BranchName) bool {
+	return b.delegate.IsDirty(ptr, branch)
+}
+
+// DirtyBytesEstimate implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) DirtyBytesEstimate() uint64 {
+	return b.delegate.DirtyBytesEstimate()
+}
+
+// CleanBytesCapacity implements the BlockCache interface for
+// BlockCacheMeasured.
+func (b BlockCacheMeasured) CleanBytesCapacity() uint64 {
+	return b.delegate.CleanBytesCapacity()
+}
@@ -0,0 +1,40 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/metricsutil"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestBcacheMeasuredHitRatio(t *testing.T) {
+	config := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	registry := metrics.NewRegistry()
+	bcache := NewBlockCacheMeasured(config.BlockCache(), registry)
+
+	testBcachePut(t, fakeBlockID(1), bcache, TransientEntry)
+	testExpectedMissing(t, fakeBlockID(2), bcache)
+
+	ratio, ok := registry.Get("BlockCache.HitRatio").(metrics.GaugeFloat64)
+	if !ok {
+		t.Fatalf("No hit ratio gauge registered")
+	}
+	if v := ratio.Value(); v != 0.5 {
+		t.Errorf("Unexpected hit ratio %f", v)
+	}
+
+	var buf bytes.Buffer
+	metricsutil.WritePrometheus(registry, &buf)
+	expected := "# TYPE kbfs_BlockCache_HitRatio gauge\n" +
+		"kbfs_BlockCache_HitRatio 0.5\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("Hit ratio missing from Prometheus output:\n%s", buf.String())
+	}
+}
@@ -147,6 +147,65 @@ func (b *BlockOpsStandard) Put(ctx context.Context, md *RootMetadata,
 	return bserv.AddBlockReference(ctx, blockPtr.ID, md.ID, blockPtr)
 }
 
+// addBatchErrors records err as the error for every block reference
+// in refs, unless it's a BlockBatchError, in which case only the
+// references that it lists failed.
+func addBatchErrors(
+	errs map[BlockBatchRef]error, refs []blockRef, err error) {
+	if err == nil {
+		return
+	}
+	if batchErr, ok := err.(BlockBatchError); ok {
+		for ref, refErr := range batchErr.Errors {
+			errs[ref] = refErr
+		}
+		return
+	}
+	for _, ref := range refs {
+		errs[ref.batchRef()] = err
+	}
+}
+
+// PutBatch implements the BlockOps interface for BlockOpsStandard.
+func (b *BlockOpsStandard) PutBatch(ctx context.Context, md *RootMetadata,
+	blockPtrs []BlockPointer, readyBlockDatas []ReadyBlockData) error {
+	var puts []BlockServerPut
+	var putRefs, refRefs []blockRef
+	contexts := make(map[BlockID][]BlockContext)
+	for i, ptr := range blockPtrs {
+		if ptr.RefNonce == zeroBlockRefNonce {
+			puts = append(puts, BlockServerPut{
+				ID:         ptr.ID,
+				Context:    ptr,
+				Buf:        readyBlockDatas[i].buf,
+				ServerHalf: readyBlockDatas[i].serverHalf,
+			})
+			putRefs = append(putRefs, ptr.ref())
+			continue
+		}
+		// non-zero block refnonce means this is a new reference to
+		// an existing block.
+		refRefs = append(refRefs, ptr.ref())
+		contexts[ptr.ID] = append(contexts[ptr.ID], ptr)
+	}
+
+	bserv := b.config.BlockServer()
+	errs := make(map[BlockBatchRef]error)
+	// Put the new blocks first, in case some of the new references
+	// are to them.
+	if len(puts) > 0 {
+		addBatchErrors(errs, putRefs, bserv.PutBlocks(ctx, md.ID, puts))
+	}
+	if len(contexts) > 0 {
+		addBatchErrors(errs, refRefs,
+			bserv.AddBlockReferences(ctx, md.ID, contexts))
+	}
+	if len(errs) > 0 {
+		return BlockBatchError{errs}
+	}
+	return nil
+}
+
 // Delete implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Delete(ctx context.Context, md *RootMetadata,
 	ptrs []BlockPointer) (liveCounts map[BlockID]int, err error) {
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -361,6 +362,104 @@ func TestBlockOpsPutFail(t *testing.T) {
 	}
 }
 
+func TestBlockOpsPutBatchSuccess(t *testing.T) {
+	mockCtrl, config, ctx := blockOpsInit(t)
+	defer blockOpsShutdown(mockCtrl, config)
+
+	// expect one call for the new blocks, and one for the new
+	// references
+	rmd := makeRMD()
+	nonce := BlockRefNonce([8]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	newPtr1 := BlockPointer{ID: fakeBlockID(1)}
+	newPtr2 := BlockPointer{ID: fakeBlockID(2)}
+	refPtr := BlockPointer{ID: fakeBlockID(3), RefNonce: nonce}
+	blockPtrs := []BlockPointer{newPtr1, refPtr, newPtr2}
+	readyBlockDatas := []ReadyBlockData{
+		{buf: []byte{1}}, {}, {buf: []byte{2}},
+	}
+
+	puts := []BlockServerPut{
+		{ID: newPtr1.ID, Context: newPtr1, Buf: []byte{1}},
+		{ID: newPtr2.ID, Context: newPtr2, Buf: []byte{2}},
+	}
+	putCall := config.mockBserv.EXPECT().PutBlocks(ctx, rmd.ID, puts).
+		Return(nil)
+	contexts := map[BlockID][]BlockContext{refPtr.ID: {refPtr}}
+	config.mockBserv.EXPECT().AddBlockReferences(ctx, rmd.ID, contexts).
+		After(putCall).Return(nil)
+
+	if err := config.BlockOps().
+		PutBatch(ctx, rmd, blockPtrs, readyBlockDatas); err != nil {
+		t.Errorf("Got error on batched put: %v", err)
+	}
+}
+
+func TestBlockOpsPutBatchFail(t *testing.T) {
+	mockCtrl, config, ctx := blockOpsInit(t)
+	defer blockOpsShutdown(mockCtrl, config)
+
+	// fail one of the new blocks, and all of the new references
+	rmd := makeRMD()
+	nonce := BlockRefNonce([8]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	newPtr1 := BlockPointer{ID: fakeBlockID(1)}
+	newPtr2 := BlockPointer{ID: fakeBlockID(2)}
+	refPtr1 := BlockPointer{ID: fakeBlockID(3), RefNonce: nonce}
+	refPtr2 := BlockPointer{ID: fakeBlockID(4), RefNonce: nonce}
+	blockPtrs := []BlockPointer{newPtr1, newPtr2, refPtr1, refPtr2}
+	readyBlockDatas := make([]ReadyBlockData, len(blockPtrs))
+
+	putErr := errors.New("Fake put fail")
+	config.mockBserv.EXPECT().PutBlocks(ctx, rmd.ID, gomock.Any()).
+		Return(BlockBatchError{map[BlockBatchRef]error{
+			newPtr2.ref().batchRef(): putErr,
+		}})
+	refErr := errors.New("Fake reference fail")
+	config.mockBserv.EXPECT().AddBlockReferences(ctx, rmd.ID, gomock.Any()).
+		Return(refErr)
+
+	err := config.BlockOps().PutBatch(ctx, rmd, blockPtrs, readyBlockDatas)
+	expectedErr := BlockBatchError{map[BlockBatchRef]error{
+		newPtr2.ref().batchRef(): putErr,
+		refPtr1.ref().batchRef(): refErr,
+		refPtr2.ref().batchRef(): refErr,
+	}}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Got bad error on batched put: %v", err)
+	}
+}
+
+// Test that when only one of several new references to the same
+// block fails, only that reference is reported as failed.
+func TestBlockOpsPutBatchFailOneRefOfBlock(t *testing.T) {
+	mockCtrl, config, ctx := blockOpsInit(t)
+	defer blockOpsShutdown(mockCtrl, config)
+
+	rmd := makeRMD()
+	refPtr1 := BlockPointer{ID: fakeBlockID(1),
+		RefNonce: BlockRefNonce([8]byte{1})}
+	refPtr2 := BlockPointer{ID: fakeBlockID(1),
+		RefNonce: BlockRefNonce([8]byte{2})}
+	blockPtrs := []BlockPointer{refPtr1, refPtr2}
+	readyBlockDatas := make([]ReadyBlockData, len(blockPtrs))
+
+	refErr := errors.New("Fake reference fail")
+	contexts := map[BlockID][]BlockContext{
+		refPtr1.ID: {refPtr1, refPtr2},
+	}
+	config.mockBserv.EXPECT().AddBlockReferences(ctx, rmd.ID, contexts).
+		Return(BlockBatchError{map[BlockBatchRef]error{
+			refPtr2.ref().batchRef(): refErr,
+		}})
+
+	err := config.BlockOps().PutBatch(ctx, rmd, blockPtrs, readyBlockDatas)
+	expectedErr := BlockBatchError{map[BlockBatchRef]error{
+		refPtr2.ref().batchRef(): refErr,
+	}}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Got bad error on batched put: %v", err)
+	}
+}
+
 func TestBlockOpsDeleteSuccess(t *testing.T) {
 	mockCtrl, config, ctx := blockOpsInit(t)
 	defer blockOpsShutdown(mockCtrl, config)
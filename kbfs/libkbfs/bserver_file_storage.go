@@ -0,0 +1,644 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+)
+
+const (
+	bserverFileBlocksDir = "blocks"
+	bserverFileTlfsDir   = "tlfs"
+	bserverFileDataName  = "data"
+	bserverFileRefsName  = "refs"
+	// Temporary files made by writeFileAtomically have names
+	// starting with the name of the file they replace, followed by
+	// this.
+	bserverFileTempInfix = ".tmp"
+)
+
+// bserverFileData is what's stored in the data file of a block.
+type bserverFileData struct {
+	// These fields are only exported for serialization purposes.
+	BlockData     []byte
+	KeyServerHalf BlockCryptKeyServerHalf
+	Tlf           TlfID
+}
+
+// bserverFileStorage stores blocks on disk, with a directory for each
+// block.  The directories are fanned out by the first bytes of the
+// block IDs, so that no directory gets too big even with millions of
+// blocks:
+//
+//	<dir>/blocks/<type and 1st byte>/<2nd byte>/<rest of ID>/data
+//	<dir>/blocks/<type and 1st byte>/<2nd byte>/<rest of ID>/refs
+//	<dir>/tlfs/<TLF ID>/<type and 1st byte>/<2nd byte>/<rest of ID>
+//
+// The data file holds the block data and the server half of its key,
+// and is written once, when the block is put.  The refs file holds
+// the references to the block, and is replaced atomically whenever
+// they change; a block exists only as long as it has a refs file.
+// The empty files under tlfs index the blocks of each TLF, for
+// getAll.
+//
+// Removing the last reference to a block only removes its refs file.
+// The rest of it is deleted by a compaction running in the
+// background, which also cleans up after any puts, deletes or
+// reference changes that were interrupted by a crash.
+//
+// Blocks stored in the older, flat layout (one file per block,
+// directly under <dir>/<type and 1st byte>/) are moved into this one
+// when the storage is opened.
+type bserverFileStorage struct {
+	codec Codec
+	log   logger.Logger
+	dir   string
+	// locks protects the files of the blocks, striped by the first
+	// byte of their hashes.
+	locks [256]sync.RWMutex
+
+	// toCompactLock protects toCompact, the blocks that have lost
+	// their last reference since the last compaction.
+	toCompactLock sync.Mutex
+	toCompact     map[BlockID]bool
+	compactCh     chan struct{}
+	shutdownCh    chan struct{}
+	shutdownOnce  sync.Once
+	doneCh        chan struct{}
+}
+
+var _ bserverLocalStorage = (*bserverFileStorage)(nil)
+
+// makeBserverFileStorage makes a bserverFileStorage that stores its
+// blocks under dir, migrating any blocks stored there in the old
+// layout, and starts compacting them in the background.
+func makeBserverFileStorage(codec Codec, log logger.Logger, dir string) (
+	*bserverFileStorage, error) {
+	s := &bserverFileStorage{
+		codec:      codec,
+		log:        log,
+		dir:        dir,
+		toCompact:  make(map[BlockID]bool),
+		compactCh:  make(chan struct{}, 1),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	migrated, err := s.migrateFlatLayout()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Couldn't migrate the blocks in %s to the new layout: %v",
+			dir, err)
+	}
+	if migrated > 0 {
+		log.Debug("Migrated %d blocks in %s to the new layout",
+			migrated, dir)
+	}
+	go s.compactInBackground()
+	return s, nil
+}
+
+// isFlatLayoutShard returns whether name is the name of a directory
+// of blocks in the old, flat layout, i.e. the first four hex digits
+// of a block ID.
+func isFlatLayoutShard(name string) bool {
+	if len(name) != 4 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// migrateFlatLayout moves the blocks stored in the old, flat layout
+// into the current one, and returns how many it moved.  Each old
+// file is removed only once its block has been stored in the new
+// layout, so an interrupted migration is finished the next time.
+func (s *bserverFileStorage) migrateFlatLayout() (migrated int, err error) {
+	shards, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() || !isFlatLayoutShard(shard.Name()) {
+			continue
+		}
+		shardDir := filepath.Join(s.dir, shard.Name())
+		files, err := ioutil.ReadDir(shardDir)
+		if err != nil {
+			return migrated, err
+		}
+		others := 0
+		for _, file := range files {
+			id, err := BlockIDFromString(shard.Name() + file.Name())
+			if err != nil {
+				// Not one of ours.
+				others++
+				continue
+			}
+			p := filepath.Join(shardDir, file.Name())
+			buf, err := ioutil.ReadFile(p)
+			if err != nil {
+				return migrated, err
+			}
+			var entry blockEntry
+			if err := s.codec.Decode(buf, &entry); err != nil {
+				return migrated, fmt.Errorf("Couldn't decode %s: %v", p, err)
+			}
+			// A block without references doesn't exist anymore.
+			if len(entry.Refs) > 0 {
+				if err := s.put(id, entry); err != nil {
+					return migrated, err
+				}
+			}
+			if err := os.Remove(p); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+		// Leave the directory in place if there's anything else
+		// in it.
+		if others == 0 {
+			if err := os.Remove(shardDir); err != nil {
+				return migrated, err
+			}
+		}
+	}
+	return migrated, nil
+}
+
+// shardedPath returns the path of the given block under root.
+func shardedPath(root string, id BlockID) string {
+	idStr := id.String()
+	return filepath.Join(root, idStr[:4], idStr[4:6], idStr[6:])
+}
+
+func (s *bserverFileStorage) blockPath(id BlockID) string {
+	return shardedPath(filepath.Join(s.dir, bserverFileBlocksDir), id)
+}
+
+func (s *bserverFileStorage) tlfDir(tlf TlfID) string {
+	return filepath.Join(s.dir, bserverFileTlfsDir, tlf.String())
+}
+
+func (s *bserverFileStorage) lockFor(id BlockID) *sync.RWMutex {
+	return &s.locks[id.h.hashData()[0]]
+}
+
+// writeFileAtomically replaces the contents of the file at p with
+// buf, by writing them to a temporary file first and renaming it
+// over p, so that p never has partial contents.
+func writeFileAtomically(p string, buf []byte) (err error) {
+	f, err := ioutil.TempFile(
+		filepath.Dir(p), filepath.Base(p)+bserverFileTempInfix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// getRefsLocked returns the references to the given block, or an
+// error satisfying os.IsNotExist if the block doesn't exist.
+func (s *bserverFileStorage) getRefsLocked(id BlockID) (
+	map[BlockRefNonce]blockRefLocalStatus, error) {
+	buf, err := ioutil.ReadFile(
+		filepath.Join(s.blockPath(id), bserverFileRefsName))
+	if err != nil {
+		return nil, err
+	}
+
+	var refs map[BlockRefNonce]blockRefLocalStatus
+	err = s.codec.Decode(buf, &refs)
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (s *bserverFileStorage) putRefsLocked(id BlockID,
+	refs map[BlockRefNonce]blockRefLocalStatus) error {
+	buf, err := s.codec.Encode(refs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(
+		filepath.Join(s.blockPath(id), bserverFileRefsName), buf)
+}
+
+func (s *bserverFileStorage) getDataLocked(id BlockID) (
+	bserverFileData, error) {
+	buf, err := ioutil.ReadFile(
+		filepath.Join(s.blockPath(id), bserverFileDataName))
+	if err != nil {
+		return bserverFileData{}, err
+	}
+
+	var data bserverFileData
+	err = s.codec.Decode(buf, &data)
+	if err != nil {
+		return bserverFileData{}, err
+	}
+	return data, nil
+}
+
+func (s *bserverFileStorage) get(id BlockID) (blockEntry, error) {
+	lock := s.lockFor(id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	refs, err := s.getRefsLocked(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = BServerErrorBlockNonExistent{}
+		}
+		return blockEntry{}, err
+	}
+	data, err := s.getDataLocked(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = BServerErrorBlockNonExistent{}
+		}
+		return blockEntry{}, err
+	}
+
+	return blockEntry{
+		BlockData:     data.BlockData,
+		Refs:          refs,
+		KeyServerHalf: data.KeyServerHalf,
+		Tlf:           data.Tlf,
+	}, nil
+}
+
+func (s *bserverFileStorage) getAll(tlf TlfID) (
+	map[BlockID]map[BlockRefNonce]blockRefLocalStatus, error) {
+	res := make(map[BlockID]map[BlockRefNonce]blockRefLocalStatus)
+	root := s.tlfDir(tlf)
+	err := filepath.Walk(root, func(
+		p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Either nothing was ever put in this TLF, or the
+			// block was compacted while walking.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		id, err := BlockIDFromString(
+			strings.Replace(rel, string(filepath.Separator), "", -1))
+		if err != nil {
+			return err
+		}
+
+		lock := s.lockFor(id)
+		lock.RLock()
+		defer lock.RUnlock()
+		refs, err := s.getRefsLocked(id)
+		if os.IsNotExist(err) {
+			// The block is gone, and waiting to be compacted.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		res[id] = make(map[BlockRefNonce]blockRefLocalStatus)
+		for ref, status := range refs {
+			res[id][ref] = status
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *bserverFileStorage) put(id BlockID, entry blockEntry) error {
+	lock := s.lockFor(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	p := s.blockPath(id)
+	if oldData, err := s.getDataLocked(id); err == nil &&
+		oldData.Tlf != entry.Tlf {
+		// The block is moving to another TLF, so take it out of
+		// the index of the old one.
+		err := os.Remove(shardedPath(s.tlfDir(oldData.Tlf), id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(p, 0700)
+	if err != nil {
+		return err
+	}
+	dataBuf, err := s.codec.Encode(bserverFileData{
+		BlockData:     entry.BlockData,
+		KeyServerHalf: entry.KeyServerHalf,
+		Tlf:           entry.Tlf,
+	})
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(filepath.Join(p, bserverFileDataName), dataBuf)
+	if err != nil {
+		return err
+	}
+
+	indexPath := shardedPath(s.tlfDir(entry.Tlf), id)
+	err = os.MkdirAll(filepath.Dir(indexPath), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(indexPath, nil, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Write the refs last, since the block exists once they're
+	// there.
+	return s.putRefsLocked(id, entry.Refs)
+}
+
+func (s *bserverFileStorage) addReference(id BlockID, refNonce BlockRefNonce) error {
+	lock := s.lockFor(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	refs, err := s.getRefsLocked(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return BServerErrorBlockNonExistent{fmt.Sprintf("Block ID %s "+
+				"doesn't exist and cannot be referenced.", id)}
+		}
+		return err
+	}
+
+	// only add it if there's a non-archived reference
+	for _, status := range refs {
+		if status == liveBlockRef {
+			refs[refNonce] = liveBlockRef
+			return s.putRefsLocked(id, refs)
+		}
+	}
+
+	return BServerErrorBlockArchived{fmt.Sprintf("Block ID %s has "+
+		"been archived and cannot be referenced.", id)}
+}
+
+func (s *bserverFileStorage) removeReference(id BlockID, refNonce BlockRefNonce) (
+	liveCount int, err error) {
+	lock := s.lockFor(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	refs, err := s.getRefsLocked(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// This block is already gone; no error.
+			return 0, nil
+		}
+		return -1, err
+	}
+
+	delete(refs, refNonce)
+	if len(refs) > 0 {
+		return len(refs), s.putRefsLocked(id, refs)
+	}
+
+	// Removing the refs file is enough to make the block go away;
+	// leave deleting everything else to the compaction.
+	err = os.Remove(filepath.Join(s.blockPath(id), bserverFileRefsName))
+	if err != nil {
+		return -1, err
+	}
+	s.toCompactLock.Lock()
+	defer s.toCompactLock.Unlock()
+	s.toCompact[id] = true
+	select {
+	case s.compactCh <- struct{}{}:
+	default:
+	}
+	return 0, nil
+}
+
+func (s *bserverFileStorage) archiveReference(id BlockID, refNonce BlockRefNonce) error {
+	lock := s.lockFor(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	refs, err := s.getRefsLocked(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return BServerErrorBlockNonExistent{fmt.Sprintf("Block ID %s "+
+				"doesn't exist and cannot be archived.", id)}
+		}
+		return err
+	}
+
+	_, ok := refs[refNonce]
+	if !ok {
+		return BServerErrorBlockNonExistent{fmt.Sprintf("Block ID %s (ref %s) "+
+			"doesn't exist and cannot be archived.", id, refNonce)}
+	}
+
+	refs[refNonce] = archivedBlockRef
+	return s.putRefsLocked(id, refs)
+}
+
+// removeTempFilesLocked removes the temporary files left in the
+// directory of the given block by writes that were interrupted by a
+// crash.  Writes hold the lock of the block, so any temporary file
+// found while holding it is a leftover.  It returns whether anything
+// was removed.
+func (s *bserverFileStorage) removeTempFilesLocked(id BlockID) (bool, error) {
+	p := s.blockPath(id)
+	files, err := ioutil.ReadDir(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	removed := false
+	for _, file := range files {
+		if !strings.Contains(file.Name(), bserverFileTempInfix) {
+			continue
+		}
+		err := os.Remove(filepath.Join(p, file.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = true
+	}
+	return removed, nil
+}
+
+// compactBlock deletes what's left of the given block, including its
+// entry in the index of its TLF, if it no longer exists, i.e. if it
+// has no refs file.  Either way, it deletes any leftover temporary
+// files of the block.  It returns whether anything was deleted.
+func (s *bserverFileStorage) compactBlock(id BlockID) (bool, error) {
+	lock := s.lockFor(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	removedTemp, err := s.removeTempFilesLocked(id)
+	if err != nil {
+		return false, err
+	}
+
+	p := s.blockPath(id)
+	_, err = os.Stat(filepath.Join(p, bserverFileRefsName))
+	if err == nil {
+		// The block still exists, or it was put again.
+		return removedTemp, nil
+	} else if !os.IsNotExist(err) {
+		return removedTemp, err
+	}
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		// Already compacted.
+		return false, nil
+	}
+
+	// Take the block out of the index first, so that a crash can't
+	// leave an index entry without a block directory to find it
+	// from.  If the data file never got written, neither did the
+	// index entry.
+	data, err := s.getDataLocked(id)
+	if err == nil {
+		err := os.Remove(shardedPath(s.tlfDir(data.Tlf), id))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, os.RemoveAll(p)
+}
+
+// compactPending compacts the blocks that have lost their last
+// reference since it was last called.
+func (s *bserverFileStorage) compactPending() {
+	s.toCompactLock.Lock()
+	toCompact := s.toCompact
+	s.toCompact = make(map[BlockID]bool)
+	s.toCompactLock.Unlock()
+
+	for id := range toCompact {
+		if _, err := s.compactBlock(id); err != nil {
+			s.log.Warning("Couldn't compact block %s: %v", id, err)
+		}
+	}
+}
+
+// compact goes through all the blocks, and compacts those that no
+// longer exist.  It only locks one block at a time, so the storage
+// stays usable while it runs.  It returns the number of blocks that
+// were compacted, and stops early if stopCh is closed.
+func (s *bserverFileStorage) compact(stopCh <-chan struct{}) (
+	compacted int, err error) {
+	blocksDir := filepath.Join(s.dir, bserverFileBlocksDir)
+	firstShards, err := ioutil.ReadDir(blocksDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, first := range firstShards {
+		firstDir := filepath.Join(blocksDir, first.Name())
+		secondShards, err := ioutil.ReadDir(firstDir)
+		if err != nil {
+			return compacted, err
+		}
+		for _, second := range secondShards {
+			blocks, err := ioutil.ReadDir(
+				filepath.Join(firstDir, second.Name()))
+			if err != nil {
+				return compacted, err
+			}
+			for _, block := range blocks {
+				select {
+				case <-stopCh:
+					return compacted, nil
+				default:
+				}
+
+				id, err := BlockIDFromString(
+					first.Name() + second.Name() + block.Name())
+				if err != nil {
+					// Not one of ours.
+					continue
+				}
+				didCompact, err := s.compactBlock(id)
+				if err != nil {
+					return compacted, err
+				}
+				if didCompact {
+					compacted++
+				}
+			}
+		}
+	}
+	return compacted, nil
+}
+
+func (s *bserverFileStorage) compactInBackground() {
+	defer close(s.doneCh)
+
+	// Clean up after anything that was interrupted the last time
+	// this storage was used.
+	compacted, err := s.compact(s.shutdownCh)
+	if err != nil {
+		s.log.Warning("Couldn't compact blocks in %s: %v", s.dir, err)
+	} else if compacted > 0 {
+		s.log.Debug("Compacted %d leftover blocks in %s", compacted, s.dir)
+	}
+
+	for {
+		select {
+		case <-s.compactCh:
+			s.compactPending()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *bserverFileStorage) shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdownCh)
+	})
+	<-s.doneCh
+}
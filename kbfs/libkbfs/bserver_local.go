@@ -12,7 +12,7 @@ import (
 )
 
 // BlockServerLocal implements the BlockServer interface by just
-// storing blocks in a local leveldb instance
+// storing blocks in a local storage backend (on disk or in memory)
 type BlockServerLocal struct {
 	config Config
 	log    logger.Logger
@@ -21,21 +21,30 @@ type BlockServerLocal struct {
 
 var _ BlockServer = (*BlockServerLocal)(nil)
 
+// newBlockServerLocalWithStorage constructs a new BlockServerLocal
+// that stores its data in the given storage backend.
+func newBlockServerLocalWithStorage(
+	config Config, s bserverLocalStorage) *BlockServerLocal {
+	return &BlockServerLocal{config: config, log: config.MakeLogger(""), s: s}
+}
+
 // NewBlockServerLocal constructs a new BlockServerLocal that stores
-// its data in the given leveldb directory.
-func NewBlockServerLocal(config Config, dbfile string) (
+// its data in the given directory.
+func NewBlockServerLocal(config Config, dirPath string) (
 	*BlockServerLocal, error) {
-	s := makeBserverFileStorage(config.Codec(), dbfile)
-	bserv := &BlockServerLocal{config: config, log: config.MakeLogger(""), s: s}
-	return bserv, nil
+	s, err := makeBserverFileStorage(
+		config.Codec(), config.MakeLogger("BSF"), dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockServerLocalWithStorage(config, s), nil
 }
 
 // NewBlockServerMemory constructs a new BlockServerLocal that stores
 // its data in memory.
 func NewBlockServerMemory(config Config) (*BlockServerLocal, error) {
 	s := makeBserverMemStorage()
-	bserv := &BlockServerLocal{config: config, log: config.MakeLogger(""), s: s}
-	return bserv, nil
+	return newBlockServerLocalWithStorage(config, s), nil
 }
 
 // Get implements the BlockServer interface for BlockServerLocal
@@ -71,6 +80,22 @@ func (b *BlockServerLocal) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	return b.s.put(id, entry)
 }
 
+// PutBlocks implements the BlockServer interface for BlockServerLocal
+func (b *BlockServerLocal) PutBlocks(ctx context.Context, tlfID TlfID,
+	puts []BlockServerPut) error {
+	errs := make(map[BlockBatchRef]error)
+	for _, put := range puts {
+		err := b.Put(ctx, put.ID, tlfID, put.Context, put.Buf, put.ServerHalf)
+		if err != nil {
+			errs[BlockBatchRef{put.ID, put.Context.GetRefNonce()}] = err
+		}
+	}
+	if len(errs) > 0 {
+		return BlockBatchError{errs}
+	}
+	return nil
+}
+
 // AddBlockReference implements the BlockServer interface for BlockServerLocal
 func (b *BlockServerLocal) AddBlockReference(ctx context.Context, id BlockID,
 	tlfID TlfID, context BlockContext) error {
@@ -82,6 +107,25 @@ func (b *BlockServerLocal) AddBlockReference(ctx context.Context, id BlockID,
 	return b.s.addReference(id, refNonce)
 }
 
+// AddBlockReferences implements the BlockServer interface for
+// BlockServerLocal
+func (b *BlockServerLocal) AddBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	errs := make(map[BlockBatchRef]error)
+	for id, idContexts := range contexts {
+		for _, context := range idContexts {
+			err := b.AddBlockReference(ctx, id, tlfID, context)
+			if err != nil {
+				errs[BlockBatchRef{id, context.GetRefNonce()}] = err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return BlockBatchError{errs}
+	}
+	return nil
+}
+
 // RemoveBlockReference implements the BlockServer interface for
 // BlockServerLocal
 func (b *BlockServerLocal) RemoveBlockReference(ctx context.Context,
@@ -5,11 +5,7 @@
 package libkbfs
 
 import (
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
@@ -31,15 +27,34 @@ type blockEntry struct {
 	Tlf           TlfID
 }
 
-// bserverLocalStorage abstracts the various methods of storing blocks
-// for bserverLocal.
+// bserverLocalStorage is the storage backend of a BlockServerLocal.
+// Implementations must be safe for concurrent use.
 type bserverLocalStorage interface {
+	// get returns the entry for the given block, or
+	// BServerErrorBlockNonExistent if there's no such block.
 	get(id BlockID) (blockEntry, error)
+	// getAll returns the references of every block in the given
+	// TLF.
 	getAll(tlf TlfID) (map[BlockID]map[BlockRefNonce]blockRefLocalStatus, error)
+	// put stores the given entry for the given block, replacing
+	// any existing one.
 	put(id BlockID, entry blockEntry) error
+	// addReference adds a live reference to the given block, which
+	// must exist and have at least one live reference already.
+	// Otherwise it returns BServerErrorBlockNonExistent or
+	// BServerErrorBlockArchived, respectively.
 	addReference(id BlockID, refNonce BlockRefNonce) error
+	// removeReference removes the given reference to the given
+	// block, and returns how many references the block has left.
+	// Once there are none left, the block no longer exists.
+	// Removing a reference from a block that doesn't exist is a
+	// no-op.
 	removeReference(id BlockID, refNonce BlockRefNonce) (int, error)
+	// archiveReference marks the given reference to the given
+	// block as archived.  It returns BServerErrorBlockNonExistent
+	// if there's no such reference.
 	archiveReference(id BlockID, refNonce BlockRefNonce) error
+	// shutdown releases any resources held by the storage.
 	shutdown()
 }
 
@@ -160,158 +175,6 @@ func (s *bserverMemStorage) shutdown() {
 	// Nothing to do.
 }
 
-// bserverFileStorage stores block data in flat files on disk.
-type bserverFileStorage struct {
-	codec Codec
-	lock  sync.RWMutex
-	dir   string
-}
-
-var _ bserverLocalStorage = (*bserverFileStorage)(nil)
-
-func makeBserverFileStorage(codec Codec, dir string) *bserverFileStorage {
-	return &bserverFileStorage{codec: codec, dir: dir}
-}
-
-// Store each block in its own file with name equal to the hex-encoded
-// blockID. Splay the filenames over 256^2 subdirectories (one byte
-// for the hash type plus the first byte of the hash data) using the
-// first four characters of the name to keep the number of directories
-// in dir itself to a manageable number, similar to git.
-func (s *bserverFileStorage) buildPath(id BlockID) string {
-	idStr := id.String()
-	return filepath.Join(s.dir, idStr[:4], idStr[4:])
-}
-
-func (s *bserverFileStorage) getLocked(p string) (blockEntry, error) {
-	buf, err := ioutil.ReadFile(p)
-	if err != nil {
-		return blockEntry{}, err
-	}
-
-	var entry blockEntry
-	err = s.codec.Decode(buf, &entry)
-	if err != nil {
-		return blockEntry{}, err
-	}
-
-	return entry, nil
-}
-
-func (s *bserverFileStorage) get(id BlockID) (blockEntry, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	entry, err := s.getLocked(s.buildPath(id))
-	if err != nil {
-		if os.IsNotExist(err) {
-			err = BServerErrorBlockNonExistent{}
-		}
-		return blockEntry{}, err
-	}
-	return entry, nil
-}
-
-func (s *bserverFileStorage) getAll(tlf TlfID) (
-	map[BlockID]map[BlockRefNonce]blockRefLocalStatus, error) {
-	return nil, errors.New("getAll not yet implemented for bserverFileStorage")
-}
-
-func (s *bserverFileStorage) putLocked(p string, entry blockEntry) error {
-	entryBuf, err := s.codec.Encode(entry)
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(filepath.Dir(p), 0700)
-	if err != nil {
-		return err
-	}
-
-	return ioutil.WriteFile(p, entryBuf, 0600)
-}
-
-func (s *bserverFileStorage) put(id BlockID, entry blockEntry) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.putLocked(s.buildPath(id), entry)
-}
-
-func (s *bserverFileStorage) addReference(id BlockID, refNonce BlockRefNonce) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	p := s.buildPath(id)
-	entry, err := s.getLocked(p)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return BServerErrorBlockNonExistent{fmt.Sprintf("Block ID %s "+
-				"doesn't exist and cannot be referenced.", id)}
-		}
-		return err
-	}
-
-	// only add it if there's a non-archived reference
-	for _, status := range entry.Refs {
-		if status == liveBlockRef {
-			entry.Refs[refNonce] = liveBlockRef
-			return s.putLocked(p, entry)
-		}
-	}
-
-	return BServerErrorBlockArchived{fmt.Sprintf("Block ID %s has "+
-		"been archived and cannot be referenced.", id)}
-}
-
-func (s *bserverFileStorage) removeReference(id BlockID, refNonce BlockRefNonce) (
-	liveCount int, err error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	p := s.buildPath(id)
-	entry, err := s.getLocked(p)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// This block is already gone; no error.
-			return 0, nil
-		}
-		return -1, err
-	}
-
-	delete(entry.Refs, refNonce)
-	if len(entry.Refs) == 0 {
-		return 0, os.Remove(p)
-	}
-	return len(entry.Refs), s.putLocked(p, entry)
-}
-
-func (s *bserverFileStorage) archiveReference(id BlockID, refNonce BlockRefNonce) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	p := s.buildPath(id)
-	entry, err := s.getLocked(p)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return BServerErrorBlockNonExistent{fmt.Sprintf("Block ID %s "+
-				"doesn't exist and cannot be archived.", id)}
-		}
-		return err
-	}
-
-	_, ok := entry.Refs[refNonce]
-	if !ok {
-		return BServerErrorBlockNonExistent{fmt.Sprintf("Block ID %s (ref %s) "+
-			"doesn't exist and cannot be archived.", id, refNonce)}
-	}
-
-	entry.Refs[refNonce] = archivedBlockRef
-	return s.putLocked(p, entry)
-}
-
-func (s *bserverFileStorage) shutdown() {
-	// Nothing to do.
-}
-
 // bserverLeveldbStorage stores block data in a LevelDB database. This
 // is kept around only for benchmarking purposes.
 type bserverLeveldbStorage struct {
@@ -356,8 +219,32 @@ func (s *bserverLeveldbStorage) get(id BlockID) (blockEntry, error) {
 
 func (s *bserverLeveldbStorage) getAll(tlf TlfID) (
 	map[BlockID]map[BlockRefNonce]blockRefLocalStatus, error) {
-	return nil,
-		errors.New("getAll not yet implemented for bserverLeveldbStorage")
+	res := make(map[BlockID]map[BlockRefNonce]blockRefLocalStatus)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var entry blockEntry
+		err := s.codec.Decode(iter.Value(), &entry)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Tlf != tlf {
+			continue
+		}
+		var id BlockID
+		err = id.UnmarshalBinary(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		res[id] = make(map[BlockRefNonce]blockRefLocalStatus)
+		for ref, status := range entry.Refs {
+			res[id][ref] = status
+		}
+	}
+	return res, iter.Error()
 }
 
 func (s *bserverLeveldbStorage) putLocked(id BlockID, entry blockEntry) error {
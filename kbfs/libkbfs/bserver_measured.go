@@ -5,17 +5,29 @@
 package libkbfs
 
 import (
+	"time"
+
+	"github.com/keybase/kbfs/metricsutil"
 	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
+// blockServerMeasuredMaxTlfs is the number of TLFs that get their
+// own per-TLF timers; requests for any other TLF are aggregated
+// under metricsutil.OverflowLabelValue.
+const blockServerMeasuredMaxTlfs = 100
+
 // BlockServerMeasured delegates to another BlockServer instance but
-// also keeps track of stats.
+// also keeps track of stats, both overall and per TLF.
 type BlockServerMeasured struct {
 	delegate                    BlockServer
+	registry                    metrics.Registry
+	tlfLabels                   *metricsutil.LabelValueLimiter
 	getTimer                    metrics.Timer
 	putTimer                    metrics.Timer
+	putBlocksTimer              metrics.Timer
 	addBlockReferenceTimer      metrics.Timer
+	addBlockReferencesTimer     metrics.Timer
 	removeBlockReferenceTimer   metrics.Timer
 	archiveBlockReferencesTimer metrics.Timer
 }
@@ -27,24 +39,45 @@ var _ BlockServer = BlockServerMeasured{}
 func NewBlockServerMeasured(delegate BlockServer, r metrics.Registry) BlockServerMeasured {
 	getTimer := metrics.GetOrRegisterTimer("BlockServer.Get", r)
 	putTimer := metrics.GetOrRegisterTimer("BlockServer.Put", r)
+	putBlocksTimer := metrics.GetOrRegisterTimer("BlockServer.PutBlocks", r)
 	addBlockReferenceTimer := metrics.GetOrRegisterTimer("BlockServer.AddBlockReference", r)
+	addBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.AddBlockReferences", r)
 	removeBlockReferenceTimer := metrics.GetOrRegisterTimer("BlockServer.RemoveBlockReference", r)
 	archiveBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.ArchiveBlockReferences", r)
 	return BlockServerMeasured{
 		delegate:                    delegate,
+		registry:                    r,
+		tlfLabels:                   metricsutil.NewLabelValueLimiter(blockServerMeasuredMaxTlfs),
 		getTimer:                    getTimer,
 		putTimer:                    putTimer,
+		putBlocksTimer:              putBlocksTimer,
 		addBlockReferenceTimer:      addBlockReferenceTimer,
+		addBlockReferencesTimer:     addBlockReferencesTimer,
 		removeBlockReferenceTimer:   removeBlockReferenceTimer,
 		archiveBlockReferencesTimer: archiveBlockReferencesTimer,
 	}
 }
 
+// timeForTlf runs f, and records its duration in both the given
+// timer and a timer for the given TLF, labeled with its ID.  The
+// per-TLF timer is named after the given one, with a ".ByTLF" suffix.
+// Past blockServerMeasuredMaxTlfs TLFs, the label is
+// metricsutil.OverflowLabelValue instead of the ID.
+func (b BlockServerMeasured) timeForTlf(
+	timer metrics.Timer, name string, tlfID TlfID, f func()) {
+	start := time.Now()
+	f()
+	timer.UpdateSince(start)
+	tlfName := metricsutil.NameWithLabels(
+		name+".ByTLF", "tlf", b.tlfLabels.Value(tlfID.String()))
+	metrics.GetOrRegisterTimer(tlfName, b.registry).UpdateSince(start)
+}
+
 // Get implements the BlockServer interface for BlockServerMeasured.
 func (b BlockServerMeasured) Get(ctx context.Context, id BlockID, tlfID TlfID,
 	context BlockContext) (
 	buf []byte, serverHalf BlockCryptKeyServerHalf, err error) {
-	b.getTimer.Time(func() {
+	b.timeForTlf(b.getTimer, "BlockServer.Get", tlfID, func() {
 		buf, serverHalf, err = b.delegate.Get(ctx, id, tlfID, context)
 	})
 	return buf, serverHalf, err
@@ -54,28 +87,48 @@ func (b BlockServerMeasured) Get(ctx context.Context, id BlockID, tlfID TlfID,
 func (b BlockServerMeasured) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	context BlockContext, buf []byte,
 	serverHalf BlockCryptKeyServerHalf) (err error) {
-	b.putTimer.Time(func() {
+	b.timeForTlf(b.putTimer, "BlockServer.Put", tlfID, func() {
 		err = b.delegate.Put(ctx, id, tlfID, context, buf, serverHalf)
 	})
 	return err
 }
 
+// PutBlocks implements the BlockServer interface for
+// BlockServerMeasured.
+func (b BlockServerMeasured) PutBlocks(ctx context.Context, tlfID TlfID,
+	puts []BlockServerPut) (err error) {
+	b.timeForTlf(b.putBlocksTimer, "BlockServer.PutBlocks", tlfID, func() {
+		err = b.delegate.PutBlocks(ctx, tlfID, puts)
+	})
+	return err
+}
+
 // AddBlockReference implements the BlockServer interface for
 // BlockServerMeasured.
 func (b BlockServerMeasured) AddBlockReference(ctx context.Context, id BlockID,
 	tlfID TlfID, context BlockContext) (err error) {
-	b.addBlockReferenceTimer.Time(func() {
+	b.timeForTlf(b.addBlockReferenceTimer, "BlockServer.AddBlockReference", tlfID, func() {
 		err = b.delegate.AddBlockReference(ctx, id, tlfID, context)
 	})
 	return err
 }
 
+// AddBlockReferences implements the BlockServer interface for
+// BlockServerMeasured.
+func (b BlockServerMeasured) AddBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (err error) {
+	b.timeForTlf(b.addBlockReferencesTimer, "BlockServer.AddBlockReferences", tlfID, func() {
+		err = b.delegate.AddBlockReferences(ctx, tlfID, contexts)
+	})
+	return err
+}
+
 // RemoveBlockReference implements the BlockServer interface for
 // BlockServerMeasured.
 func (b BlockServerMeasured) RemoveBlockReference(ctx context.Context,
 	tlfID TlfID, contexts map[BlockID][]BlockContext) (
 	liveCounts map[BlockID]int, err error) {
-	b.removeBlockReferenceTimer.Time(func() {
+	b.timeForTlf(b.removeBlockReferenceTimer, "BlockServer.RemoveBlockReference", tlfID, func() {
 		liveCounts, err = b.delegate.RemoveBlockReference(ctx, tlfID, contexts)
 	})
 	return liveCounts, err
@@ -85,7 +138,7 @@ func (b BlockServerMeasured) RemoveBlockReference(ctx context.Context,
 // BlockServerRemote
 func (b BlockServerMeasured) ArchiveBlockReferences(ctx context.Context,
 	tlfID TlfID, contexts map[BlockID][]BlockContext) (err error) {
-	b.archiveBlockReferencesTimer.Time(func() {
+	b.timeForTlf(b.archiveBlockReferencesTimer, "BlockServer.ArchiveBlockReferences", tlfID, func() {
 		err = b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
 	})
 	return err
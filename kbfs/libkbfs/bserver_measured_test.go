@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/metricsutil"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// Test that block server requests are timed both overall and per
+// TLF, and that the per-TLF timers are exported with a tlf label.
+func TestBServerMeasuredPerTlfTimers(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	registry := metrics.NewRegistry()
+	bserv := NewBlockServerMeasured(config.BlockServer(), registry)
+
+	ctx := context.Background()
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+	for _, tlf := range []TlfID{tlf1, tlf2, tlf2} {
+		// The blocks don't exist, but the requests are timed
+		// anyway.
+		_, _, _ = bserv.Get(ctx, fakeBlockID(1), tlf, BlockPointer{})
+	}
+
+	var buf bytes.Buffer
+	metricsutil.WritePrometheus(registry, &buf)
+	output := buf.String()
+	for _, expected := range []string{
+		"# TYPE kbfs_BlockServer_Get_seconds summary\n",
+		"kbfs_BlockServer_Get_seconds_count 3\n",
+		"# TYPE kbfs_BlockServer_Get_ByTLF_seconds summary\n",
+		fmt.Sprintf("kbfs_BlockServer_Get_ByTLF_seconds_count{tlf=\"%s\"} 1\n",
+			tlf1),
+		fmt.Sprintf("kbfs_BlockServer_Get_ByTLF_seconds_count{tlf=\"%s\"} 2\n",
+			tlf2),
+		fmt.Sprintf(
+			"kbfs_BlockServer_Get_ByTLF_seconds{tlf=\"%s\",quantile=\"0.5\"} ",
+			tlf2),
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("%q missing from Prometheus output:\n%s", expected, output)
+		}
+	}
+	if n := strings.Count(output,
+		"# TYPE kbfs_BlockServer_Get_ByTLF_seconds "); n != 1 {
+		t.Errorf("Expected one TYPE line for the per-TLF family, got %d", n)
+	}
+}
+
+// Test that TLFs past the limit share one aggregated per-TLF timer.
+func TestBServerMeasuredPerTlfTimersLimited(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	registry := metrics.NewRegistry()
+	bserv := NewBlockServerMeasured(config.BlockServer(), registry)
+	bserv.tlfLabels = metricsutil.NewLabelValueLimiter(1)
+
+	ctx := context.Background()
+	tlf1 := FakeTlfID(1, false)
+	for _, tlf := range []TlfID{
+		tlf1, FakeTlfID(2, false), FakeTlfID(3, false), tlf1} {
+		_, _, _ = bserv.Get(ctx, fakeBlockID(1), tlf, BlockPointer{})
+	}
+
+	var buf bytes.Buffer
+	metricsutil.WritePrometheus(registry, &buf)
+	output := buf.String()
+	for _, expected := range []string{
+		fmt.Sprintf("kbfs_BlockServer_Get_ByTLF_seconds_count{tlf=\"%s\"} 2\n",
+			tlf1),
+		fmt.Sprintf("kbfs_BlockServer_Get_ByTLF_seconds_count{tlf=\"%s\"} 2\n",
+			metricsutil.OverflowLabelValue),
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("%q missing from Prometheus output:\n%s", expected, output)
+		}
+	}
+	if n := strings.Count(output,
+		"kbfs_BlockServer_Get_ByTLF_seconds_count{"); n != 2 {
+		t.Errorf("Expected 2 per-TLF timers, got %d", n)
+	}
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"encoding/hex"
+	"sync"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
@@ -31,6 +32,10 @@ type BlockServerRemote struct {
 	log        logger.Logger
 	blkSrvAddr string
 	authToken  *AuthToken
+	// putSlots holds a token for each block put or reference add
+	// in flight, to limit them to MaxParallelBlockPuts at once
+	// across all callers, however they're batched.
+	putSlots chan struct{}
 }
 
 // Test that BlockServerRemote fully implements the BlockServer interface.
@@ -46,6 +51,7 @@ func NewBlockServerRemote(config Config, blkSrvAddr string) *BlockServerRemote {
 		config:     config,
 		log:        config.MakeLogger("BSR"),
 		blkSrvAddr: blkSrvAddr,
+		putSlots:   makePutSlots(config),
 	}
 	bs.log.Debug("new instance server addr %s", blkSrvAddr)
 	bs.authToken = NewAuthToken(config,
@@ -64,13 +70,38 @@ func NewBlockServerRemote(config Config, blkSrvAddr string) *BlockServerRemote {
 func newBlockServerRemoteWithClient(config Config,
 	client keybase1.BlockInterface) *BlockServerRemote {
 	bs := &BlockServerRemote{
-		config: config,
-		client: client,
-		log:    config.MakeLogger(""),
+		config:   config,
+		client:   client,
+		log:      config.MakeLogger(""),
+		putSlots: makePutSlots(config),
 	}
 	return bs
 }
 
+func makePutSlots(config Config) chan struct{} {
+	n := config.MaxParallelBlockPuts()
+	if n < 1 {
+		n = 1
+	}
+	return make(chan struct{}, n)
+}
+
+// acquirePutSlot waits until fewer than MaxParallelBlockPuts block
+// puts and reference adds are in flight.  The caller must call
+// releasePutSlot once its call is done.
+func (b *BlockServerRemote) acquirePutSlot(ctx context.Context) error {
+	select {
+	case b.putSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *BlockServerRemote) releasePutSlot() {
+	<-b.putSlots
+}
+
 // RemoteAddress returns the remote bserver this client is talking to
 func (b *BlockServerRemote) RemoteAddress() string {
 	return b.blkSrvAddr
@@ -240,7 +271,11 @@ func (b *BlockServerRemote) Put(ctx context.Context, id BlockID, tlfID TlfID,
 		Buf:      buf,
 	}
 
+	if err = b.acquirePutSlot(ctx); err != nil {
+		return err
+	}
 	err = b.client.PutBlock(ctx, arg)
+	b.releasePutSlot()
 	if err != nil {
 		if qe, ok := err.(BServerErrorOverQuota); ok && !qe.Throttled {
 			return nil
@@ -250,6 +285,76 @@ func (b *BlockServerRemote) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	return nil
 }
 
+// doBatch calls f for each of the given block references.  The
+// block server protocol doesn't have batched calls yet, so the calls
+// are made concurrently instead, up to MaxParallelBlockPuts at a
+// time, which still saves most of the round-trip latency of making
+// them one after another.  (Puts and reference adds are further
+// limited to MaxParallelBlockPuts in total, since several batches
+// may be in progress at once.)  The errors returned by f are
+// gathered into a BlockBatchError.
+func (b *BlockServerRemote) doBatch(ctx context.Context, refs []blockRef,
+	f func(ref blockRef) error) error {
+	numWorkers := b.config.MaxParallelBlockPuts()
+	if numWorkers > len(refs) {
+		numWorkers = len(refs)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	refChan := make(chan blockRef, len(refs))
+	for _, ref := range refs {
+		refChan <- ref
+	}
+	close(refChan)
+
+	var errsLock sync.Mutex
+	errs := make(map[BlockBatchRef]error)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for ref := range refChan {
+				// Don't bother starting calls once the batch has
+				// been canceled.
+				err := ctx.Err()
+				if err == nil {
+					err = f(ref)
+				}
+				if err != nil {
+					errsLock.Lock()
+					errs[ref.batchRef()] = err
+					errsLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return BlockBatchError{errs}
+	}
+	return nil
+}
+
+// PutBlocks implements the BlockServer interface for BlockServerRemote.
+func (b *BlockServerRemote) PutBlocks(ctx context.Context, tlfID TlfID,
+	puts []BlockServerPut) error {
+	refs := make([]blockRef, 0, len(puts))
+	putsByRef := make(map[blockRef]BlockServerPut, len(puts))
+	for _, put := range puts {
+		ref := blockRef{put.ID, put.Context.GetRefNonce()}
+		refs = append(refs, ref)
+		putsByRef[ref] = put
+	}
+	return b.doBatch(ctx, refs, func(ref blockRef) error {
+		put := putsByRef[ref]
+		return b.Put(ctx, put.ID, tlfID, put.Context, put.Buf,
+			put.ServerHalf)
+	})
+}
+
 // AddBlockReference implements the BlockServer interface for BlockServerRemote
 func (b *BlockServerRemote) AddBlockReference(ctx context.Context, id BlockID,
 	tlfID TlfID, context BlockContext) error {
@@ -273,10 +378,14 @@ func (b *BlockServerRemote) AddBlockReference(ctx context.Context, id BlockID,
 		Nonce:     keybase1.BlockRefNonce(context.GetRefNonce()),
 	}
 
+	if err = b.acquirePutSlot(ctx); err != nil {
+		return err
+	}
 	err = b.client.AddReference(ctx, keybase1.AddReferenceArg{
 		Ref:    ref,
 		Folder: tlfID.String(),
 	})
+	b.releasePutSlot()
 	if err != nil {
 		if qe, ok := err.(BServerErrorOverQuota); ok && !qe.Throttled {
 			return nil
@@ -286,6 +395,24 @@ func (b *BlockServerRemote) AddBlockReference(ctx context.Context, id BlockID,
 	return nil
 }
 
+// AddBlockReferences implements the BlockServer interface for
+// BlockServerRemote
+func (b *BlockServerRemote) AddBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	var refs []blockRef
+	contextsByRef := make(map[blockRef]BlockContext)
+	for id, idContexts := range contexts {
+		for _, context := range idContexts {
+			ref := blockRef{id, context.GetRefNonce()}
+			refs = append(refs, ref)
+			contextsByRef[ref] = context
+		}
+	}
+	return b.doBatch(ctx, refs, func(ref blockRef) error {
+		return b.AddBlockReference(ctx, ref.id, tlfID, contextsByRef[ref])
+	})
+}
+
 // RemoveBlockReference implements the BlockServer interface for
 // BlockServerRemote
 func (b *BlockServerRemote) RemoveBlockReference(ctx context.Context,
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
@@ -97,8 +98,15 @@ func (fc *FakeBServerClient) GetBlock(ctx context.Context, arg keybase1.GetBlock
 	return getRes, nil
 }
 
-func (fc *FakeBServerClient) AddReference(context.Context, keybase1.AddReferenceArg) error {
-	// Do nothing.
+func (fc *FakeBServerClient) AddReference(ctx context.Context, arg keybase1.AddReferenceArg) error {
+	fc.blocksLock.Lock()
+	defer fc.blocksLock.Unlock()
+	// Only check that the block exists; references aren't tracked.
+	if _, ok := fc.blocks[keybase1.GetBlockArg{
+		Bid: arg.Ref.Bid, Folder: arg.Folder}]; !ok {
+		return BServerErrorBlockNonExistent{
+			fmt.Sprintf("No such block: %v", arg.Ref.Bid)}
+	}
 	return nil
 }
 
@@ -174,6 +182,144 @@ func TestBServerRemotePutAndGet(t *testing.T) {
 	}
 }
 
+// Test that batches of blocks can be put and referenced, and that
+// only the references that fail are reported in the batch error.
+func TestBServerRemoteBatchPutAndAddReferences(t *testing.T) {
+	codec := NewCodecMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"testuser"})
+	currentUID := localUsers[0].UID
+	config := &ConfigLocal{codec: codec}
+	setTestLogger(config, t)
+	config.SetMaxParallelBlockPuts(2)
+	fc := NewFakeBServerClient(nil, nil, nil)
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	tlfID := FakeTlfID(2, false)
+	crypto := MakeCryptoCommon(config)
+	var puts []BlockServerPut
+	for i := byte(1); i <= 5; i++ {
+		bID := fakeBlockID(i)
+		bCtx := BlockPointer{bID, 1, 1, currentUID, "", zeroBlockRefNonce}
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		if err != nil {
+			t.Fatalf("Couldn't make block server key half: %v", err)
+		}
+		puts = append(puts, BlockServerPut{
+			ID:         bID,
+			Context:    bCtx,
+			Buf:        []byte{i, i + 1, i + 2},
+			ServerHalf: serverHalf,
+		})
+	}
+	ctx := context.Background()
+	err := b.PutBlocks(ctx, tlfID, puts)
+	if err != nil {
+		t.Fatalf("PutBlocks got error: %v", err)
+	}
+	if nb := fc.numBlocks(); nb != len(puts) {
+		t.Errorf("There are %d blocks in the db, not %d as expected",
+			nb, len(puts))
+	}
+	for _, put := range puts {
+		buf, serverHalf, err := b.Get(ctx, put.ID, tlfID, put.Context)
+		if err != nil {
+			t.Fatalf("Get of %s got error: %v", put.ID, err)
+		}
+		if !bytes.Equal(buf, put.Buf) {
+			t.Errorf("Got bad data for %s -- got %v, expected %v",
+				put.ID, buf, put.Buf)
+		}
+		if serverHalf != put.ServerHalf {
+			t.Errorf("Got bad key for %s -- got %v, expected %v",
+				put.ID, serverHalf, put.ServerHalf)
+		}
+	}
+
+	// Add a new reference to each block that was put, and to one
+	// that wasn't.
+	nonce := BlockRefNonce{1}
+	contexts := make(map[BlockID][]BlockContext)
+	for _, put := range puts {
+		contexts[put.ID] = []BlockContext{
+			BlockPointer{put.ID, 1, 1, currentUID, "", nonce}}
+	}
+	missingID := fakeBlockID(6)
+	contexts[missingID] = []BlockContext{
+		BlockPointer{missingID, 1, 1, currentUID, "", nonce}}
+	err = b.AddBlockReferences(ctx, tlfID, contexts)
+	batchErr, ok := err.(BlockBatchError)
+	if !ok {
+		t.Fatalf("AddBlockReferences returned unexpected error: %v", err)
+	}
+	missingRef := BlockBatchRef{ID: missingID, RefNonce: nonce}
+	if _, ok := batchErr.Errors[missingRef].(BServerErrorBlockNonExistent); !ok ||
+		len(batchErr.Errors) != 1 {
+		t.Errorf("Unexpected errors in the batch: %v", batchErr.Errors)
+	}
+}
+
+// Test that concurrent batches of puts share one limit on the number
+// of puts in flight, rather than each getting its own.
+func TestBServerRemoteBatchPutsLimitedInTotal(t *testing.T) {
+	codec := NewCodecMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"testuser"})
+	currentUID := localUsers[0].UID
+	config := &ConfigLocal{codec: codec}
+	setTestLogger(config, t)
+	maxPuts := 2
+	config.SetMaxParallelBlockPuts(maxPuts)
+	numBatches, batchSize := 3, 3
+	readyChan := make(chan struct{}, numBatches*batchSize)
+	goChan := make(chan struct{})
+	fc := NewFakeBServerClient(readyChan, goChan, nil)
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	tlfID := FakeTlfID(2, false)
+	crypto := MakeCryptoCommon(config)
+	ctx := context.Background()
+	errChan := make(chan error, numBatches)
+	for i := 0; i < numBatches; i++ {
+		var puts []BlockServerPut
+		for j := 0; j < batchSize; j++ {
+			bID := fakeBlockID(byte(i*batchSize + j + 1))
+			serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+			if err != nil {
+				t.Fatalf("Couldn't make block server key half: %v", err)
+			}
+			puts = append(puts, BlockServerPut{
+				ID: bID,
+				Context: BlockPointer{
+					bID, 1, 1, currentUID, "", zeroBlockRefNonce},
+				Buf:        []byte{byte(i), byte(j)},
+				ServerHalf: serverHalf,
+			})
+		}
+		go func() {
+			errChan <- b.PutBlocks(ctx, tlfID, puts)
+		}()
+	}
+
+	for i := 0; i < maxPuts; i++ {
+		<-readyChan
+	}
+	select {
+	case <-readyChan:
+		t.Fatalf("More than %d puts in flight at once", maxPuts)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(goChan)
+	for i := 0; i < numBatches; i++ {
+		if err := <-errChan; err != nil {
+			t.Errorf("PutBlocks got error: %v", err)
+		}
+	}
+	if nb := fc.numBlocks(); nb != numBatches*batchSize {
+		t.Errorf("There are %d blocks in the db, not %d as expected",
+			nb, numBatches*batchSize)
+	}
+}
+
 // If we cancel the RPC before the RPC returns, the call should error quickly.
 func TestBServerRemotePutCanceled(t *testing.T) {
 	codec := NewCodecMsgpack()
@@ -8,8 +8,11 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
+	"github.com/keybase/client/go/logger"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
@@ -151,7 +154,12 @@ func BenchmarkFileStorageGet(b *testing.B) {
 		f.cleanup()
 	}()
 
-	s := makeBserverFileStorage(NewCodecMsgpack(), f.tempdir)
+	s, err := makeBserverFileStorage(
+		NewCodecMsgpack(), logger.NewNull(), f.tempdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.shutdown()
 	err = runGetBenchmark(b, s)
 	if err != nil {
 		b.Fatal(err)
@@ -205,7 +213,12 @@ func BenchmarkFileStoragePut(b *testing.B) {
 		f.cleanup()
 	}()
 
-	s := makeBserverFileStorage(NewCodecMsgpack(), f.tempdir)
+	s, err := makeBserverFileStorage(
+		NewCodecMsgpack(), logger.NewNull(), f.tempdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.shutdown()
 	err = runPutBenchmark(b, s)
 	if err != nil {
 		b.Fatal(err)
@@ -228,3 +241,303 @@ func BenchmarkLeveldbStoragePut(b *testing.B) {
 		b.Fatal(err)
 	}
 }
+
+// testBserverStorage checks that s behaves like a bserverLocalStorage
+// should.
+func testBserverStorage(t *testing.T, s bserverLocalStorage) {
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+	id1 := fakeBlockID(1)
+	id2 := fakeBlockID(2)
+	id3 := fakeBlockID(3)
+	ref1 := BlockRefNonce{1}
+	ref2 := BlockRefNonce{2}
+
+	_, err := s.get(id1)
+	if _, ok := err.(BServerErrorBlockNonExistent); !ok {
+		t.Fatalf("Unexpected error getting a missing block: %v", err)
+	}
+
+	for _, put := range []struct {
+		id  BlockID
+		tlf TlfID
+	}{{id1, tlf1}, {id2, tlf1}, {id3, tlf2}} {
+		err := s.put(put.id, blockEntry{
+			BlockData: []byte{put.id.h.hashData()[0]},
+			Refs: map[BlockRefNonce]blockRefLocalStatus{
+				zeroBlockRefNonce: liveBlockRef,
+			},
+			Tlf: put.tlf,
+		})
+		if err != nil {
+			t.Fatalf("Couldn't put %s: %v", put.id, err)
+		}
+	}
+
+	entry, err := s.get(id1)
+	if err != nil {
+		t.Fatalf("Couldn't get %s: %v", id1, err)
+	}
+	if !reflect.DeepEqual(entry.BlockData, []byte{1}) || entry.Tlf != tlf1 {
+		t.Errorf("Unexpected entry for %s: %+v", id1, entry)
+	}
+
+	if err := s.addReference(id1, ref1); err != nil {
+		t.Fatalf("Couldn't add a reference to %s: %v", id1, err)
+	}
+	if err := s.addReference(id1, ref2); err != nil {
+		t.Fatalf("Couldn't add a reference to %s: %v", id1, err)
+	}
+	if err := s.archiveReference(id2, zeroBlockRefNonce); err != nil {
+		t.Fatalf("Couldn't archive a reference to %s: %v", id2, err)
+	}
+	err = s.addReference(id2, ref1)
+	if _, ok := err.(BServerErrorBlockArchived); !ok {
+		t.Errorf("Unexpected error referencing an archived block: %v", err)
+	}
+	err = s.addReference(fakeBlockID(4), ref1)
+	if _, ok := err.(BServerErrorBlockNonExistent); !ok {
+		t.Errorf("Unexpected error referencing a missing block: %v", err)
+	}
+
+	refs, err := s.getAll(tlf1)
+	if err != nil {
+		t.Fatalf("Couldn't get all refs of %s: %v", tlf1, err)
+	}
+	expectedRefs := map[BlockID]map[BlockRefNonce]blockRefLocalStatus{
+		id1: {
+			zeroBlockRefNonce: liveBlockRef,
+			ref1:              liveBlockRef,
+			ref2:              liveBlockRef,
+		},
+		id2: {zeroBlockRefNonce: archivedBlockRef},
+	}
+	if !reflect.DeepEqual(refs, expectedRefs) {
+		t.Errorf("Unexpected refs for %s: %v", tlf1, refs)
+	}
+	refs, err = s.getAll(FakeTlfID(3, false))
+	if err != nil {
+		t.Fatalf("Couldn't get all refs of an empty TLF: %v", err)
+	}
+	if len(refs) != 0 {
+		t.Errorf("Unexpected refs for an empty TLF: %v", refs)
+	}
+
+	for i, ref := range []BlockRefNonce{zeroBlockRefNonce, ref1, ref2} {
+		liveCount, err := s.removeReference(id1, ref)
+		if err != nil {
+			t.Fatalf("Couldn't remove a reference to %s: %v", id1, err)
+		}
+		if liveCount != 2-i {
+			t.Errorf("Unexpected live count %d after removing ref %d",
+				liveCount, i)
+		}
+	}
+	_, err = s.get(id1)
+	if _, ok := err.(BServerErrorBlockNonExistent); !ok {
+		t.Errorf("Unexpected error getting a removed block: %v", err)
+	}
+	liveCount, err := s.removeReference(id1, ref1)
+	if err != nil || liveCount != 0 {
+		t.Errorf("Unexpected result removing a reference to a removed "+
+			"block: %d, %v", liveCount, err)
+	}
+
+	refs, err = s.getAll(tlf2)
+	if err != nil {
+		t.Fatalf("Couldn't get all refs of %s: %v", tlf2, err)
+	}
+	expectedRefs = map[BlockID]map[BlockRefNonce]blockRefLocalStatus{
+		id3: {zeroBlockRefNonce: liveBlockRef},
+	}
+	if !reflect.DeepEqual(refs, expectedRefs) {
+		t.Errorf("Unexpected refs for %s: %v", tlf2, refs)
+	}
+}
+
+func TestBserverMemStorage(t *testing.T) {
+	s := makeBserverMemStorage()
+	defer s.shutdown()
+	testBserverStorage(t, s)
+}
+
+func TestBserverFileStorage(t *testing.T) {
+	f, err := makeFileFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.cleanup()
+
+	s, err := makeBserverFileStorage(
+		NewCodecMsgpack(), logger.NewNull(), f.tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.shutdown()
+	testBserverStorage(t, s)
+}
+
+func TestBserverLeveldbStorage(t *testing.T) {
+	f, err := makeLeveldbFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.cleanup()
+
+	s := makeBserverLeveldbStorage(NewCodecMsgpack(), f.db)
+	testBserverStorage(t, s)
+}
+
+func TestBserverFileStorageCompact(t *testing.T) {
+	f, err := makeFileFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.cleanup()
+
+	s, err := makeBserverFileStorage(
+		NewCodecMsgpack(), logger.NewNull(), f.tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stop the background compaction, so that the compact() call
+	// below does all the work.
+	s.shutdown()
+
+	tlf := FakeTlfID(1, false)
+	id1 := fakeBlockID(1)
+	id2 := fakeBlockID(2)
+	for _, id := range []BlockID{id1, id2} {
+		err := s.put(id, blockEntry{
+			BlockData: []byte{1, 2, 3},
+			Refs: map[BlockRefNonce]blockRefLocalStatus{
+				zeroBlockRefNonce: liveBlockRef,
+			},
+			Tlf: tlf,
+		})
+		if err != nil {
+			t.Fatalf("Couldn't put %s: %v", id, err)
+		}
+	}
+
+	liveCount, err := s.removeReference(id1, zeroBlockRefNonce)
+	if err != nil || liveCount != 0 {
+		t.Fatalf("Unexpected result removing a reference to %s: %d, %v",
+			id1, liveCount, err)
+	}
+	// Simulate a put that was interrupted before its refs were
+	// written.
+	id3 := fakeBlockID(3)
+	if err := os.MkdirAll(s.blockPath(id3), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// And a reference change to a live block that was interrupted
+	// before its new refs file was renamed into place.
+	tempPath := filepath.Join(
+		s.blockPath(id2), bserverFileRefsName+bserverFileTempInfix+"123")
+	if err := ioutil.WriteFile(tempPath, []byte{1}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := s.compact(nil)
+	if err != nil {
+		t.Fatalf("Couldn't compact: %v", err)
+	}
+	if compacted != 3 {
+		t.Errorf("Compacted %d blocks instead of 3", compacted)
+	}
+
+	for _, p := range []string{
+		s.blockPath(id1),
+		shardedPath(s.tlfDir(tlf), id1),
+		s.blockPath(id3),
+		tempPath,
+	} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't deleted: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(
+		s.blockPath(id2), bserverFileDataName)); err != nil {
+		t.Errorf("Live block %s was deleted: %v", id2, err)
+	}
+	if _, err := s.get(id2); err != nil {
+		t.Errorf("Couldn't get live block %s: %v", id2, err)
+	}
+}
+
+func TestBserverFileStorageMigrateFlatLayout(t *testing.T) {
+	f, err := makeFileFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.cleanup()
+
+	// Store two blocks in the old layout, one of which has no
+	// references left.
+	codec := NewCodecMsgpack()
+	tlf := FakeTlfID(1, false)
+	id1 := fakeBlockID(1)
+	id2 := fakeBlockID(2)
+	entry1 := blockEntry{
+		BlockData: []byte{1, 2, 3},
+		Refs: map[BlockRefNonce]blockRefLocalStatus{
+			zeroBlockRefNonce: liveBlockRef,
+		},
+		Tlf: tlf,
+	}
+	entry2 := blockEntry{
+		BlockData: []byte{4, 5, 6},
+		Refs:      map[BlockRefNonce]blockRefLocalStatus{},
+		Tlf:       tlf,
+	}
+	var oldPaths []string
+	for id, entry := range map[BlockID]blockEntry{id1: entry1, id2: entry2} {
+		idStr := id.String()
+		p := filepath.Join(f.tempdir, idStr[:4], idStr[4:])
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := codec.Encode(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+		oldPaths = append(oldPaths, filepath.Dir(p))
+	}
+
+	s, err := makeBserverFileStorage(codec, logger.NewNull(), f.tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't open storage: %v", err)
+	}
+	defer s.shutdown()
+
+	entry, err := s.get(id1)
+	if err != nil {
+		t.Fatalf("Couldn't get migrated block %s: %v", id1, err)
+	}
+	if !reflect.DeepEqual(entry, entry1) {
+		t.Errorf("Migrated block %s is %+v, expected %+v", id1, entry, entry1)
+	}
+	if _, err := s.get(id2); err != (BServerErrorBlockNonExistent{}) {
+		t.Errorf("Unexpected result getting unreferenced block %s: %v",
+			id2, err)
+	}
+	all, err := s.getAll(tlf)
+	if err != nil {
+		t.Fatalf("Couldn't get all blocks: %v", err)
+	}
+	if !reflect.DeepEqual(all, map[BlockID]map[BlockRefNonce]blockRefLocalStatus{
+		id1: entry1.Refs,
+	}) {
+		t.Errorf("Unexpected blocks in %s: %v", tlf, all)
+	}
+	for _, p := range oldPaths {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Old directory %s wasn't removed: %v", p, err)
+		}
+	}
+}
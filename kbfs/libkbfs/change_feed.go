@@ -0,0 +1,374 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// ChangeFeedSocketName is the name of the change feed's Unix domain
+// socket within the runtime directory.
+const ChangeFeedSocketName = "kbfs.changes.sock"
+
+const (
+	// How many events can be waiting to be sent out before the
+	// feed gives up on its clients.
+	changeFeedEventBuffer = 1000
+	// How many encoded events can be waiting to be written to a
+	// single client before the feed gives up on it.
+	changeFeedClientBuffer = 1000
+)
+
+// ChangeFeedEvent is a change to a folder, as streamed to change feed
+// clients, one JSON object per line.
+type ChangeFeedEvent struct {
+	// Path is the full path of the changed entry, starting with
+	// the folder's canonical path, like
+	// "/keybase/private/alice/dir/file".
+	Path string `json:"path"`
+	// Op is the type of change: "create", "remove", "rename" (sent
+	// for both the old and the new path), "write", "setattr", or
+	// "handle" (the folder itself got a new name, given by Path).
+	Op string `json:"op"`
+	// Writer is the user whose change this was, if known.
+	Writer string `json:"writer,omitempty"`
+	// Revision is the folder revision that made the change, if
+	// known.
+	Revision MetadataRevision `json:"revision,omitempty"`
+}
+
+type ctxNotifyOpKeyType int
+
+const ctxNotifyOpKey ctxNotifyOpKeyType = iota
+
+// notifyOpInfo describes the change behind a BatchChanges
+// notification, for the observers that want more than the nodes.
+type notifyOpInfo struct {
+	op       string
+	folder   string
+	writer   keybase1.UID
+	revision MetadataRevision
+}
+
+// ctxWithNotifyOpInfo returns a context for notifying observers about
+// the given op from the given MD.
+func ctxWithNotifyOpInfo(ctx context.Context, o op,
+	md *RootMetadata) context.Context {
+	var opName string
+	switch o.(type) {
+	case *createOp:
+		opName = "create"
+	case *rmOp:
+		opName = "remove"
+	case *renameOp:
+		opName = "rename"
+	case *syncOp:
+		opName = "write"
+	case *setAttrOp:
+		opName = "setattr"
+	default:
+		return ctx
+	}
+	return context.WithValue(ctx, ctxNotifyOpKey, notifyOpInfo{
+		op:       opName,
+		folder:   md.GetTlfHandle().GetCanonicalPath(),
+		writer:   md.LastModifyingWriter,
+		revision: md.Revision,
+	})
+}
+
+// changeFeedEvent is a ChangeFeedEvent whose writer hasn't been
+// resolved to a name yet.
+type changeFeedEvent struct {
+	ChangeFeedEvent
+	writer keybase1.UID
+}
+
+// ChangeFeed is an Observer of every folder-branch that streams the
+// changes it sees, as ChangeFeedEvents, to any local program that
+// connects to its Unix domain socket.  Only changes that have been
+// saved to the server are sent; local writes in progress are not.
+//
+// If a client falls too far behind, the feed disconnects it, so that
+// it knows to rescan anything it cares about before reconnecting.
+type ChangeFeed struct {
+	config     Config
+	log        logger.Logger
+	socketPath string
+	listener   net.Listener
+	events     chan changeFeedEvent
+
+	shutdownOnce sync.Once
+	shutdownChan chan struct{}
+
+	// protects clients
+	clientsLock sync.Mutex
+	clients     map[net.Conn]chan []byte
+}
+
+var _ Observer = (*ChangeFeed)(nil)
+
+// NewChangeFeed creates a ChangeFeed listening on the given socket
+// path, which is replaced if it already exists.  It must still be
+// registered with KBFSOpsStandard.RegisterForAllChanges.
+func NewChangeFeed(config Config, socketPath string) (*ChangeFeed, error) {
+	l, err := listenUnixPrivate(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cf := &ChangeFeed{
+		config:       config,
+		log:          config.MakeLogger("CF"),
+		socketPath:   socketPath,
+		listener:     l,
+		events:       make(chan changeFeedEvent, changeFeedEventBuffer),
+		shutdownChan: make(chan struct{}),
+		clients:      make(map[net.Conn]chan []byte),
+	}
+	go cf.accept()
+	go cf.dispatch()
+	return cf, nil
+}
+
+// listenUnixPrivate listens on a Unix domain socket at the given
+// path, replacing any existing file there, such that only the
+// current user can ever connect to it.  The changes are as private
+// as the folders themselves, so the socket is bound inside a new
+// directory only the current user can access, restricted, and only
+// then moved into place; binding it at its final path and
+// restricting it afterwards would leave a window in which anyone
+// could connect.
+func listenUnixPrivate(socketPath string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(socketPath), ".kbfs_socket")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tempPath := filepath.Join(dir, filepath.Base(socketPath))
+	l, err := net.Listen("unix", tempPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tempPath, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// Rename atomically replaces any existing socket.
+	if err := os.Rename(tempPath, socketPath); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (cf *ChangeFeed) accept() {
+	for {
+		conn, err := cf.listener.Accept()
+		if err != nil {
+			// The listener is only closed on shutdown.
+			cf.log.Debug("Stopped accepting change feed clients: %v", err)
+			return
+		}
+		cf.log.Debug("New change feed client")
+		ch := make(chan []byte, changeFeedClientBuffer)
+		cf.clientsLock.Lock()
+		select {
+		case <-cf.shutdownChan:
+			conn.Close()
+			cf.clientsLock.Unlock()
+			return
+		default:
+		}
+		cf.clients[conn] = ch
+		cf.clientsLock.Unlock()
+		go cf.writeToClient(conn, ch)
+	}
+}
+
+func (cf *ChangeFeed) writeToClient(conn net.Conn, ch <-chan []byte) {
+	defer conn.Close()
+	for line := range ch {
+		if _, err := conn.Write(line); err != nil {
+			cf.log.Debug("Couldn't write to change feed client: %v", err)
+			cf.dropClient(conn)
+			return
+		}
+	}
+}
+
+// dropClientLocked stops sending events to the given client, and
+// disconnects it (which also unblocks any write in progress).
+func (cf *ChangeFeed) dropClientLocked(conn net.Conn, ch chan []byte) {
+	close(ch)
+	delete(cf.clients, conn)
+	conn.Close()
+}
+
+func (cf *ChangeFeed) dropClient(conn net.Conn) {
+	cf.clientsLock.Lock()
+	defer cf.clientsLock.Unlock()
+	if ch, ok := cf.clients[conn]; ok {
+		cf.dropClientLocked(conn, ch)
+	}
+}
+
+func (cf *ChangeFeed) dropAllClients() {
+	cf.clientsLock.Lock()
+	defer cf.clientsLock.Unlock()
+	for conn, ch := range cf.clients {
+		cf.dropClientLocked(conn, ch)
+	}
+}
+
+func (cf *ChangeFeed) broadcast(line []byte) {
+	cf.clientsLock.Lock()
+	defer cf.clientsLock.Unlock()
+	for conn, ch := range cf.clients {
+		select {
+		case ch <- line:
+		default:
+			cf.log.Debug("Dropping a change feed client that fell behind")
+			cf.dropClientLocked(conn, ch)
+		}
+	}
+}
+
+// dispatch resolves the writers of queued events, and sends them out
+// to the clients.
+func (cf *ChangeFeed) dispatch() {
+	writerNames := make(map[keybase1.UID]string)
+	for {
+		var e changeFeedEvent
+		select {
+		case e = <-cf.events:
+		case <-cf.shutdownChan:
+			return
+		}
+
+		if e.writer != keybase1.UID("") {
+			name, ok := writerNames[e.writer]
+			if !ok {
+				ctx, cancel := context.WithTimeout(context.Background(),
+					cf.config.BackgroundTaskTimeout())
+				n, err := cf.config.KBPKI().GetNormalizedUsername(
+					ctx, e.writer)
+				cancel()
+				if err != nil {
+					cf.log.Debug("Couldn't get name for %s: %v", e.writer, err)
+				} else {
+					name = string(n)
+					writerNames[e.writer] = name
+				}
+			}
+			e.Writer = name
+		}
+
+		line, err := json.Marshal(e.ChangeFeedEvent)
+		if err != nil {
+			cf.log.Warning("Couldn't encode change feed event: %v", err)
+			continue
+		}
+		cf.broadcast(append(line, '\n'))
+	}
+}
+
+// queue hands the event off to the dispatcher, without blocking.
+func (cf *ChangeFeed) queue(e changeFeedEvent) {
+	select {
+	case cf.events <- e:
+	default:
+		// Clients can't rely on the feed anymore, so make sure they
+		// notice.
+		cf.log.Warning("Too many change feed events; dropping all clients")
+		cf.dropAllClients()
+	}
+}
+
+// LocalChange implements the Observer interface for ChangeFeed.
+func (cf *ChangeFeed) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+	// Only changes that made it to the server are sent out.
+}
+
+// BatchChanges implements the Observer interface for ChangeFeed.
+func (cf *ChangeFeed) BatchChanges(
+	ctx context.Context, changes []NodeChange) {
+	info, ok := ctx.Value(ctxNotifyOpKey).(notifyOpInfo)
+	if !ok {
+		return
+	}
+
+	for _, change := range changes {
+		ns, ok := change.Node.(*nodeStandard)
+		if !ok {
+			continue
+		}
+		p := ns.core.cache.PathFromNode(ns)
+		if !p.isValid() {
+			continue
+		}
+		components := []string{info.folder}
+		for _, pn := range p.path[1:] {
+			components = append(components, pn.Name)
+		}
+		nodePath := strings.Join(components, "/")
+
+		e := changeFeedEvent{
+			ChangeFeedEvent: ChangeFeedEvent{
+				Op:       info.op,
+				Revision: info.revision,
+			},
+			writer: info.writer,
+		}
+		if len(change.DirUpdated) == 0 {
+			e.Path = nodePath
+			cf.queue(e)
+			continue
+		}
+		for _, name := range change.DirUpdated {
+			e.Path = nodePath + "/" + name
+			cf.queue(e)
+		}
+	}
+}
+
+// TlfHandleChange implements the Observer interface for ChangeFeed.
+func (cf *ChangeFeed) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+	cf.queue(changeFeedEvent{
+		ChangeFeedEvent: ChangeFeedEvent{
+			Path: newHandle.GetCanonicalPath(),
+			Op:   "handle",
+		},
+	})
+}
+
+// Shutdown stops the feed, and disconnects all its clients.
+func (cf *ChangeFeed) Shutdown() {
+	cf.shutdownOnce.Do(func() {
+		cf.clientsLock.Lock()
+		close(cf.shutdownChan)
+		cf.clientsLock.Unlock()
+		cf.listener.Close()
+		// The listener only removes the temporary path it was
+		// bound to.
+		if err := os.Remove(cf.socketPath); err != nil &&
+			!os.IsNotExist(err) {
+			cf.log.Debug("Couldn't remove change feed socket: %v", err)
+		}
+		cf.dropAllClients()
+	})
+}
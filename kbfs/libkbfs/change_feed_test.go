@@ -0,0 +1,162 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+func TestChangeFeed(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "change_feed")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+	socketPath := filepath.Join(tempdir, ChangeFeedSocketName)
+	cf, err := NewChangeFeed(config, socketPath)
+	if err != nil {
+		t.Fatalf("Couldn't start change feed: %v", err)
+	}
+	defer cf.Shutdown()
+	config.KBFSOps().(*KBFSOpsStandard).RegisterForAllChanges(cf)
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Couldn't connect to change feed: %v", err)
+	}
+	defer conn.Close()
+	// Wait for the feed to pick up the client.
+	for {
+		cf.clientsLock.Lock()
+		n := len(cf.clients)
+		cf.clientsLock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dec := json.NewDecoder(conn)
+	var lastRev MetadataRevision
+	checkEvent := func(expectedPath, expectedOp string) {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		var e ChangeFeedEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Couldn't read event: %v", err)
+		}
+		if e.Path != expectedPath || e.Op != expectedOp ||
+			e.Writer != string(userName) || e.Revision < lastRev {
+			t.Fatalf("Unexpected event %+v, expected %s %s after "+
+				"revision %d", e, expectedOp, expectedPath, lastRev)
+		}
+		lastRev = e.Revision
+	}
+
+	// The folder-branch doesn't exist until after registration.
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	checkEvent("/keybase/private/u1/a", "create")
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	checkEvent("/keybase/private/u1/a/b", "create")
+
+	if err := kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkEvent("/keybase/private/u1/a/b", "write")
+
+	if err := kbfsOps.Rename(ctx, dirNode, "b", rootNode, "c"); err != nil {
+		t.Fatalf("Couldn't rename file: %v", err)
+	}
+	checkEvent("/keybase/private/u1/a/b", "rename")
+	checkEvent("/keybase/private/u1/c", "rename")
+
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "c"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	checkEvent("/keybase/private/u1/c", "remove")
+
+	// Shutting down disconnects the client.
+	cf.Shutdown()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var e ChangeFeedEvent
+	if err := dec.Decode(&e); err == nil {
+		t.Errorf("Unexpected event after shutdown: %+v", e)
+	}
+}
+
+// Test that the socket replaces any stale file, is only accessible
+// by the current user, leaves no temporary files behind, and is
+// removed on shutdown.
+func TestChangeFeedSocketPrivate(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "change_feed")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+	socketPath := filepath.Join(tempdir, ChangeFeedSocketName)
+	if err := ioutil.WriteFile(socketPath, nil, 0666); err != nil {
+		t.Fatalf("Couldn't create stale socket file: %v", err)
+	}
+
+	cf, err := NewChangeFeed(config, socketPath)
+	if err != nil {
+		t.Fatalf("Couldn't start change feed: %v", err)
+	}
+	defer cf.Shutdown()
+
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Couldn't stat socket: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s isn't a socket: %v", socketPath, fi.Mode())
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("Unexpected socket permissions %o", perm)
+	}
+	fis, err := ioutil.ReadDir(tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't read temp dir: %v", err)
+	}
+	if len(fis) != 1 {
+		t.Errorf("Expected only the socket in %s, got %d entries",
+			tempdir, len(fis))
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Couldn't connect to change feed: %v", err)
+	}
+	conn.Close()
+
+	cf.Shutdown()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Socket still exists after shutdown: %v", err)
+	}
+}
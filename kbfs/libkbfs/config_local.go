@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -34,8 +35,42 @@ const (
 	qrUnrefAgeDefault = 1 * time.Minute
 	// tlfValidDurationDefault is the default for tlf validity before redoing identify.
 	tlfValidDurationDefault = 6 * time.Hour
+	// tlfIdleTimeoutDefault is the default for how long a TLF may
+	// go unaccessed before it is shut down, when running with
+	// InitParams.  ConfigLocal itself never shuts down idle TLFs
+	// unless told to.
+	tlfIdleTimeoutDefault = 1 * time.Hour
+	// maxMDsInMemoryDefault is the default number of MD updates a
+	// folder may hold in memory at once while processing updates.
+	maxMDsInMemoryDefault = 100
+	// readAheadBlocksDefault is the default number of indirect file
+	// blocks to prefetch ahead of sequential reads.
+	readAheadBlocksDefault = 8
+	// maxParallelBlockPutsDefault is the default number of block
+	// puts (and other block server requests) a folder may have
+	// outstanding at once.
+	maxParallelBlockPutsDefault = 10
+	// dirtyBytesThresholdDefault is the default number of dirty bytes
+	// above which a sync is forced, and writes start to block.
+	dirtyBytesThresholdDefault = maxParallelBlockPutsDefault * (512 << 10)
+	// backgroundFlushPeriodDefault is the default time between checks
+	// for dirty files to flush, in case Sync is never called.
+	backgroundFlushPeriodDefault = 10 * time.Second
+	// maxRetriesOnRecoverableErrorsDefault is the default cap on the
+	// number of times a sync is retried after a recoverable error.
+	maxRetriesOnRecoverableErrorsDefault = 10
+	// backgroundTaskTimeoutDefault is the default timeout for any
+	// background task.
+	backgroundTaskTimeoutDefault = 1 * time.Minute
+	// maxDirtyBytesDefault is the default number of outstanding
+	// dirty bytes, across all folders, above which writes block.
+	maxDirtyBytesDefault = dirtyBytesThresholdDefault
 )
 
+// quotaWarningPercentagesDefault are the default percentages of the
+// user's quota at which to warn them about their usage.
+var quotaWarningPercentagesDefault = []int{80, 90, 95}
+
 // ConfigLocal implements the Config interface using purely local
 // server objects (no KBFS operations used RPCs).
 type ConfigLocal struct {
@@ -71,6 +106,7 @@ type ConfigLocal struct {
 	maxNameBytes uint32
 	maxDirBytes  uint64
 	rekeyQueue   RekeyQueue
+	dirtyBudget  DirtyBudget
 
 	qrPeriod   time.Duration
 	qrUnrefAge time.Duration
@@ -81,6 +117,26 @@ type ConfigLocal struct {
 
 	// tlfValidDuration is the time TLFs are valid before redoing identification.
 	tlfValidDuration time.Duration
+
+	// maxMDsInMemory bounds the number of MD updates held in memory
+	// at once while processing long histories.
+	maxMDsInMemory int
+
+	// readAheadBlocks and prefetchDirChildren control how
+	// aggressively blocks are fetched before they're needed.
+	readAheadBlocks     int
+	prefetchDirChildren bool
+
+	// Tunables for block puts, dirty data, and background work.
+	maxParallelBlockPuts          int
+	dirtyBytesThreshold           uint64
+	bgFlushPeriod                 time.Duration
+	maxRetriesOnRecoverableErrors int
+	bgTaskTimeout                 time.Duration
+	maxDirtyBytes                 uint64
+	quotaWarningPercentages       []int
+	trashRetention                time.Duration
+	tlfIdleTimeout                time.Duration
 }
 
 var _ Config = (*ConfigLocal)(nil)
@@ -196,6 +252,7 @@ func NewConfigLocal() *ConfigLocal {
 	config.SetBlockOps(&BlockOpsStandard{config})
 	config.SetKeyOps(&KeyOpsStandard{config})
 	config.SetRekeyQueue(NewRekeyQueueStandard(config))
+	config.SetDirtyBudget(NewDirtyBudgetStandard(config))
 
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
@@ -212,6 +269,15 @@ func NewConfigLocal() *ConfigLocal {
 	}
 
 	config.tlfValidDuration = tlfValidDurationDefault
+	config.maxMDsInMemory = maxMDsInMemoryDefault
+	config.readAheadBlocks = readAheadBlocksDefault
+	config.maxParallelBlockPuts = maxParallelBlockPutsDefault
+	config.dirtyBytesThreshold = dirtyBytesThresholdDefault
+	config.bgFlushPeriod = backgroundFlushPeriodDefault
+	config.maxRetriesOnRecoverableErrors = maxRetriesOnRecoverableErrorsDefault
+	config.bgTaskTimeout = backgroundTaskTimeoutDefault
+	config.maxDirtyBytes = maxDirtyBytesDefault
+	config.quotaWarningPercentages = quotaWarningPercentagesDefault
 
 	return config
 }
@@ -624,6 +690,16 @@ func (c *ConfigLocal) RekeyQueue() RekeyQueue {
 	return c.rekeyQueue
 }
 
+// SetDirtyBudget implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDirtyBudget(d DirtyBudget) {
+	c.dirtyBudget = d
+}
+
+// DirtyBudget implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DirtyBudget() DirtyBudget {
+	return c.dirtyBudget
+}
+
 // SetMetricsRegistry implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetMetricsRegistry(r metrics.Registry) {
 	c.registry = r
@@ -639,10 +715,185 @@ func (c *ConfigLocal) TLFValidDuration() time.Duration {
 	return c.tlfValidDuration
 }
 
+// SetMaxMDsInMemory implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxMDsInMemory(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxMDsInMemory = n
+}
+
+// MaxMDsInMemory implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxMDsInMemory() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxMDsInMemory
+}
+
+// SetReadAheadBlocks implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetReadAheadBlocks(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readAheadBlocks = n
+}
+
+// ReadAheadBlocks implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ReadAheadBlocks() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.readAheadBlocks
+}
+
+// SetPrefetchDirChildren implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetPrefetchDirChildren(prefetch bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prefetchDirChildren = prefetch
+}
+
+// PrefetchDirChildren implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) PrefetchDirChildren() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.prefetchDirChildren
+}
+
+// SetMaxParallelBlockPuts implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxParallelBlockPuts(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxParallelBlockPuts = n
+}
+
+// MaxParallelBlockPuts implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxParallelBlockPuts() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxParallelBlockPuts
+}
+
+// SetDirtyBytesThreshold implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDirtyBytesThreshold(n uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dirtyBytesThreshold = n
+}
+
+// DirtyBytesThreshold implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DirtyBytesThreshold() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dirtyBytesThreshold
+}
+
+// SetBackgroundFlushPeriod implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBackgroundFlushPeriod(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bgFlushPeriod = d
+}
+
+// BackgroundFlushPeriod implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BackgroundFlushPeriod() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bgFlushPeriod
+}
+
+// SetMaxRetriesOnRecoverableErrors implements the Config interface
+// for ConfigLocal.
+func (c *ConfigLocal) SetMaxRetriesOnRecoverableErrors(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxRetriesOnRecoverableErrors = n
+}
+
+// MaxRetriesOnRecoverableErrors implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) MaxRetriesOnRecoverableErrors() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxRetriesOnRecoverableErrors
+}
+
+// SetBackgroundTaskTimeout implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBackgroundTaskTimeout(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bgTaskTimeout = d
+}
+
+// BackgroundTaskTimeout implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BackgroundTaskTimeout() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bgTaskTimeout
+}
+
+// SetMaxDirtyBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxDirtyBytes(n uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxDirtyBytes = n
+}
+
+// MaxDirtyBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxDirtyBytes() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxDirtyBytes
+}
+
+// SetQuotaWarningPercentages implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetQuotaWarningPercentages(percentages []int) {
+	sorted := append([]int(nil), percentages...)
+	sort.Ints(sorted)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.quotaWarningPercentages = sorted
+}
+
+// QuotaWarningPercentages implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) QuotaWarningPercentages() []int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.quotaWarningPercentages
+}
+
+// SetTrashRetention implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTrashRetention(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.trashRetention = d
+}
+
+// TrashRetention implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TrashRetention() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.trashRetention
+}
+
+// SetTLFIdleTimeout implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTLFIdleTimeout(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tlfIdleTimeout = d
+}
+
+// TLFIdleTimeout implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TLFIdleTimeout() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tlfIdleTimeout
+}
+
 // Shutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Shutdown() error {
 	c.RekeyQueue().Clear()
 	c.RekeyQueue().Wait(context.Background())
+	c.RekeyQueue().Shutdown()
 	if c.CheckStateOnShutdown() {
 		// Before we do anything, wait for all archiving to finish.
 		for _, config := range *c.allKnownConfigsForTesting {
@@ -672,7 +923,11 @@ func (c *ConfigLocal) Shutdown() error {
 
 // CheckStateOnShutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) CheckStateOnShutdown() bool {
-	if md, ok := c.MDServer().(*MDServerLocal); ok {
+	mdServer := c.MDServer()
+	if mdm, ok := mdServer.(MDServerMeasured); ok {
+		mdServer = mdm.delegate
+	}
+	if md, ok := mdServer.(*MDServerLocal); ok {
 		return !md.isShutdown()
 	}
 	return false
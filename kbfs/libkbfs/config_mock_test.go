@@ -95,6 +95,18 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.SetKeyOps(config.mockKops)
 	config.mockBops = NewMockBlockOps(c)
 	config.SetBlockOps(config.mockBops)
+	// Tests set up expectations for the individual block puts, so
+	// check the blocks in each batched put against those.  (Only
+	// successful puts can be expected this way, since the result of
+	// the batch doesn't depend on them.)
+	config.mockBops.EXPECT().PutBatch(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes().Do(
+		func(ctx context.Context, md *RootMetadata,
+			blockPtrs []BlockPointer, readyBlockDatas []ReadyBlockData) {
+			for i, ptr := range blockPtrs {
+				config.mockBops.Put(ctx, md, ptr, readyBlockDatas[i])
+			}
+		}).Return(nil)
 	config.mockMdserv = NewMockMDServer(c)
 	config.SetMDServer(config.mockMdserv)
 	config.mockKserv = NewMockKeyServer(c)
@@ -125,6 +137,14 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.qrPeriod = 0 * time.Second // no auto reclamation
 	config.qrUnrefAge = qrUnrefAgeDefault
 
+	config.maxParallelBlockPuts = maxParallelBlockPutsDefault
+	config.dirtyBytesThreshold = dirtyBytesThresholdDefault
+	config.bgFlushPeriod = backgroundFlushPeriodDefault
+	config.maxRetriesOnRecoverableErrors = maxRetriesOnRecoverableErrorsDefault
+	config.bgTaskTimeout = backgroundTaskTimeoutDefault
+	config.maxDirtyBytes = maxDirtyBytesDefault
+	config.SetDirtyBudget(NewDirtyBudgetStandard(config))
+
 	return config
 }
 
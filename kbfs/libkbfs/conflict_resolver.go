@@ -213,36 +213,57 @@ func (cr *ConflictResolver) checkDone(ctx context.Context) error {
 	}
 }
 
-func (cr *ConflictResolver) getMDs(ctx context.Context, lState *lockState) (
-	unmerged []*RootMetadata, merged []*RootMetadata, err error) {
-	// first get all outstanding unmerged MDs for this device
-	branchPoint, unmerged, err := cr.fbo.getUnmergedMDUpdates(ctx, lState)
+// makeChains builds the crChains for all the outstanding unmerged MDs
+// for this device, and for all the merged MDs since the branch point.
+// The MDs are fetched and folded into the chains in bounded windows,
+// so that a long history never needs to be held in memory all at once.
+func (cr *ConflictResolver) makeChains(ctx context.Context,
+	lState *lockState) (
+	unmergedChains *crChains, mergedChains *crChains, err error) {
+	// first process all outstanding unmerged MDs for this device
+	unmergedChains = newCRChainsEmpty()
+	branchPoint, err := cr.fbo.forEachUnmergedMDWindow(ctx, lState,
+		func(rmds []*RootMetadata) error {
+			return cr.addMDsToChains(ctx, lState, unmergedChains, rmds)
+		})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// now get all the merged MDs, starting from after the branch point
-	merged, err = getMergedMDUpdates(ctx, cr.fbo.config, cr.fbo.id(),
-		branchPoint+1)
+	// now process all the merged MDs, starting from after the branch
+	// point
+	mergedChains = newCRChainsEmpty()
+	err = forEachMergedMDWindow(ctx, cr.config, cr.fbo.id(), branchPoint+1,
+		func(rmds []*RootMetadata) error {
+			return cr.addMDsToChains(ctx, lState, mergedChains, rmds)
+		})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// re-embed all the block changes
-	err = cr.fbo.reembedBlockChanges(ctx, lState, unmerged)
+	cr.fbo.status.setCRChains(unmergedChains, mergedChains)
+	return unmergedChains, mergedChains, nil
+}
+
+// addMDsToChains re-embeds the block changes for one window of MDs,
+// and adds them to the given chains.
+func (cr *ConflictResolver) addMDsToChains(ctx context.Context,
+	lState *lockState, chains *crChains, rmds []*RootMetadata) error {
+	// Canceled while we were fetching?
+	err := cr.checkDone(ctx)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	err = cr.fbo.reembedBlockChanges(ctx, lState, merged)
+
+	err = cr.fbo.reembedBlockChanges(ctx, lState, rmds)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-
-	return unmerged, merged, nil
+	return chains.addMDs(ctx, cr.config, rmds)
 }
 
 func (cr *ConflictResolver) updateCurrInput(ctx context.Context,
-	unmerged []*RootMetadata, merged []*RootMetadata) (err error) {
+	unmergedChains, mergedChains *crChains) (err error) {
 	cr.inputLock.Lock()
 	defer cr.inputLock.Unlock()
 	// check done while holding the lock, so we know for sure if
@@ -260,16 +281,16 @@ func (cr *ConflictResolver) updateCurrInput(ctx context.Context,
 		}
 	}()
 
-	if len(unmerged) > 0 {
-		rev := unmerged[len(unmerged)-1].Revision
+	if unmergedChains.mostRecentMD != nil {
+		rev := unmergedChains.mostRecentMD.Revision
 		if rev < cr.currInput.unmerged {
 			return fmt.Errorf("Unmerged revision %d is lower than the "+
 				"expected unmerged revision %d", rev, cr.currInput.unmerged)
 		}
 		cr.currInput.unmerged = rev
 	}
-	if len(merged) > 0 {
-		rev := merged[len(merged)-1].Revision
+	if mergedChains.mostRecentMD != nil {
+		rev := mergedChains.mostRecentMD.Revision
 		if rev < cr.currInput.merged {
 			return fmt.Errorf("Merged revision %d is lower than the "+
 				"expected merged revision %d", rev, cr.currInput.merged)
@@ -279,23 +300,6 @@ func (cr *ConflictResolver) updateCurrInput(ctx context.Context,
 	return nil
 }
 
-func (cr *ConflictResolver) makeChains(ctx context.Context,
-	unmerged []*RootMetadata, merged []*RootMetadata) (
-	unmergedChains *crChains, mergedChains *crChains, err error) {
-	unmergedChains, err = newCRChains(ctx, cr.config, unmerged)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	mergedChains, err = newCRChains(ctx, cr.config, merged)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	cr.fbo.status.setCRChains(unmergedChains, mergedChains)
-	return unmergedChains, mergedChains, nil
-}
-
 // A helper class that implements sort.Interface to sort paths by
 // descending path length.
 type crSortedPaths []path
@@ -970,43 +974,39 @@ func (cr *ConflictResolver) resolveMergedPaths(ctx context.Context,
 
 // buildChainsAndPaths make crChains for both the unmerged and merged
 // branches since the branch point, the corresponding full paths for
-// those changes, any new recreate ops, and returns the MDs used to
-// compute all this.  Note that even if err is nil, the merged MD list
-// might be non-nil to allow for better error handling.
+// those changes, and any new recreate ops.  Note that even if err is
+// nil, the merged chains might be non-nil to allow for better error
+// handling.
 func (cr *ConflictResolver) buildChainsAndPaths(
 	ctx context.Context, lState *lockState) (
 	unmergedChains, mergedChains *crChains, unmergedPaths []path,
 	mergedPaths map[BlockPointer]path, recreateOps []*createOp,
-	unmerged, merged []*RootMetadata, err error) {
-	// Fetch the merged and unmerged MDs
-	unmerged, merged, err = cr.getMDs(ctx, lState)
+	err error) {
+	// Fetch the merged and unmerged MDs, and make the chains
+	unmergedChains, mergedChains, err = cr.makeChains(ctx, lState)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
-	if u, m := len(unmerged), len(merged); u == 0 || m == 0 {
+	if unmergedChains.mostRecentMD == nil || mergedChains.mostRecentMD == nil {
 		cr.log.CDebugf(ctx, "Skipping merge process due to empty MD list: "+
-			"%d unmerged, %d merged", u, m)
-		return nil, nil, nil, nil, nil, nil, nil, nil
+			"unmerged empty=%t, merged empty=%t",
+			unmergedChains.mostRecentMD == nil,
+			mergedChains.mostRecentMD == nil)
+		return nil, nil, nil, nil, nil, nil
 	}
 
 	// Update the current input to reflect the MDs we'll actually be
 	// working with.
-	err = cr.updateCurrInput(ctx, unmerged, merged)
+	err = cr.updateCurrInput(ctx, unmergedChains, mergedChains)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	// Canceled before we start the heavy lifting?
 	err = cr.checkDone(ctx)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
-	}
-
-	// Make the chains
-	unmergedChains, mergedChains, err = cr.makeChains(ctx, unmerged, merged)
-	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	// TODO: if the root node didn't change in either chain, we can
@@ -1019,14 +1019,14 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 	unmergedPaths, err = cr.getPathsFromChains(ctx, unmergedChains,
 		cr.fbo.nodeCache)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	// Add in any directory paths that were created in both branches.
 	newUnmergedPaths, err := cr.findCreatedDirsToMerge(ctx, unmergedPaths,
 		unmergedChains, mergedChains)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
 	if len(newUnmergedPaths) > 0 {
@@ -1041,7 +1041,7 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 	if err != nil {
 		// Return mergedChains in this error case, to allow the error
 		// handling code to unstage if necessary.
-		return nil, nil, nil, nil, nil, nil, merged, err
+		return nil, mergedChains, nil, nil, nil, err
 	}
 	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
 	if len(newUnmergedPaths) > 0 {
@@ -1049,7 +1049,7 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 	}
 
 	return unmergedChains, mergedChains, unmergedPaths, mergedPaths,
-		recreateOps, unmerged, merged, nil
+		recreateOps, nil
 }
 
 // addRecreateOpsToUnmergedChains inserts each recreateOp, into its
@@ -3030,7 +3030,7 @@ func (cr *ConflictResolver) finalizeResolution(ctx context.Context,
 func (cr *ConflictResolver) completeResolution(ctx context.Context,
 	lState *lockState, unmergedChains *crChains, mergedChains *crChains,
 	unmergedPaths []path, mergedPaths map[BlockPointer]path, lbc localBcache,
-	newFileBlocks fileBlockMap, unmergedMDs []*RootMetadata) error {
+	newFileBlocks fileBlockMap) error {
 	md, err := cr.createResolvedMD(ctx, lState, unmergedPaths, unmergedChains,
 		mergedChains)
 	if err != nil {
@@ -3062,7 +3062,7 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 // conflict resolution failure due to missing blocks, caused by a
 // concurrent gcOp on the main branch.
 func (cr *ConflictResolver) maybeUnstageAfterFailure(ctx context.Context,
-	lState *lockState, mergedMDs []*RootMetadata, err error) error {
+	lState *lockState, mergedChains *crChains, err error) error {
 	// Make sure the error is related to a missing block.
 	_, isBlockNotFound := err.(BServerErrorBlockNonExistent)
 	_, isBlockDeleted := err.(BServerErrorBlockDeleted)
@@ -3071,17 +3071,7 @@ func (cr *ConflictResolver) maybeUnstageAfterFailure(ctx context.Context,
 	}
 
 	// Make sure there was a gcOp on the main branch.
-	foundGCOp := false
-outer:
-	for _, rmd := range mergedMDs {
-		for _, op := range rmd.data.Changes.Ops {
-			if _, ok := op.(*gcOp); ok {
-				foundGCOp = true
-				break outer
-			}
-		}
-	}
-	if !foundGCOp {
+	if mergedChains == nil || !mergedChains.containsGCOp {
 		return err
 	}
 
@@ -3130,10 +3120,10 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		return
 	}
 
-	var mergedMDs []*RootMetadata
+	var mergedChains *crChains
 	defer func() {
 		if err != nil {
-			err = cr.maybeUnstageAfterFailure(ctx, lState, mergedMDs, err)
+			err = cr.maybeUnstageAfterFailure(ctx, lState, mergedChains, err)
 		}
 	}()
 
@@ -3147,7 +3137,7 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	//     to recreate any directories that were modified in the unmerged
 	//     branch but removed in the merged branch.
 	unmergedChains, mergedChains, unmergedPaths, mergedPaths, recOps,
-		unmergedMDs, mergedMDs, err := cr.buildChainsAndPaths(ctx, lState)
+		err := cr.buildChainsAndPaths(ctx, lState)
 	if err != nil {
 		return
 	}
@@ -3157,7 +3147,7 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		lbc := make(localBcache)
 		newFileBlocks := make(fileBlockMap)
 		err = cr.completeResolution(ctx, lState, unmergedChains, mergedChains,
-			unmergedPaths, mergedPaths, lbc, newFileBlocks, unmergedMDs)
+			unmergedPaths, mergedPaths, lbc, newFileBlocks)
 		return
 	}
 
@@ -3247,7 +3237,7 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// putting the final resolved MD, and issuing all the local
 	// notifications.
 	err = cr.completeResolution(ctx, lState, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, lbc, newFileBlocks, unmergedMDs)
+		unmergedPaths, mergedPaths, lbc, newFileBlocks)
 	if err != nil {
 		return
 	}
@@ -267,7 +267,7 @@ func testCRCheckPathsAndActions(t *testing.T, cr *ConflictResolver,
 
 	// Step 1 -- check the chains and paths
 	unmergedChains, mergedChains, unmergedPaths, mergedPaths,
-		recreateOps, _, _, err := cr.buildChainsAndPaths(ctx, lState)
+		recreateOps, err := cr.buildChainsAndPaths(ctx, lState)
 	if err != nil {
 		t.Fatalf("Couldn't build chains and paths: %v", err)
 	}
@@ -413,7 +413,7 @@ func TestCRMergedChainsSimple(t *testing.T) {
 	mergedPaths[expectedUnmergedPath.tailPointer()] = mergedPath
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil}},
 	}
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
 		mergedPaths, nil, expectedActions)
@@ -475,7 +475,7 @@ func TestCRMergedChainsDifferentDirectories(t *testing.T) {
 	mergedPaths[expectedUnmergedPath.tailPointer()] = mergedPath
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil}},
 	}
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
 		mergedPaths, nil, expectedActions)
@@ -565,11 +565,11 @@ func TestCRMergedChainsDeletedDirectories(t *testing.T) {
 	dirAPtr1 := cr1.fbo.nodeCache.PathFromNode(dirA1).tailPointer()
 	expectedActions := map[BlockPointer]crActionList{
 		dirCPtr: {&copyUnmergedEntryAction{"file2", "file2", "",
-			false, false, DirEntry{}, nil}},
+			false, false, DirEntry{}, nil, nil}},
 		dirBPtr: {&copyUnmergedEntryAction{"dirC", "dirC", "", false, false,
-			DirEntry{}, nil}},
+			DirEntry{}, nil, nil}},
 		dirAPtr1: {&copyUnmergedEntryAction{"dirB", "dirB", "", false, false,
-			DirEntry{}, nil}},
+			DirEntry{}, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
@@ -649,7 +649,7 @@ func TestCRMergedChainsRenamedDirectory(t *testing.T) {
 
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
@@ -823,13 +823,13 @@ func TestCRMergedChainsComplex(t *testing.T) {
 	mergedPathE := cr1.fbo.nodeCache.PathFromNode(dirE1)
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathA.tailPointer(): {&copyUnmergedEntryAction{
-			"dirJ", "dirJ", "", false, false, DirEntry{}, nil}},
+			"dirJ", "dirJ", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathE.tailPointer(): {&copyUnmergedEntryAction{
-			"dirF", "dirF", "", false, false, DirEntry{}, nil}},
+			"dirF", "dirF", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathF.tailPointer(): {&copyUnmergedEntryAction{
-			"file3", "file3", "", false, false, DirEntry{}, nil}},
+			"file3", "file3", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathH.tailPointer(): {&copyUnmergedEntryAction{
-			"file4", "file4", "", false, false, DirEntry{}, nil}},
+			"file4", "file4", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathB.tailPointer(): {&rmMergedEntryAction{"dirD"}},
 	}
 	// `rm file5` doesn't get an action because the parent directory
@@ -915,7 +915,7 @@ func TestCRMergedChainsRenameCycleSimple(t *testing.T) {
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathRoot.tailPointer(): {&dropUnmergedAction{ro}},
 		mergedPathB.tailPointer(): {&copyUnmergedEntryAction{
-			"dirA", "dirA", "./../", false, false, DirEntry{}, nil}},
+			"dirA", "dirA", "./../", false, false, DirEntry{}, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{unmergedPathRoot, unmergedPathB},
@@ -1143,7 +1143,7 @@ func TestCRDoActionsSimple(t *testing.T) {
 
 	// Now run through conflict resolution manually for user2.
 	unmergedChains, mergedChains, unmergedPaths, mergedPaths,
-		recreateOps, _, _, err := cr2.buildChainsAndPaths(ctx, lState)
+		recreateOps, err := cr2.buildChainsAndPaths(ctx, lState)
 	if err != nil {
 		t.Fatalf("Couldn't build chains and paths: %v", err)
 	}
@@ -1259,7 +1259,7 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 
 	// Now run through conflict resolution manually for user2.
 	unmergedChains, mergedChains, unmergedPaths, mergedPaths,
-		recreateOps, _, _, err := cr2.buildChainsAndPaths(ctx, lState)
+		recreateOps, err := cr2.buildChainsAndPaths(ctx, lState)
 	if err != nil {
 		t.Fatalf("Couldn't build chains and paths: %v", err)
 	}
@@ -22,12 +22,57 @@ type kbfsCurrentStatus struct {
 	lock            sync.Mutex
 	failingServices map[string]error
 	invalidateChan  chan StatusUpdate
+	// The last seen quota usage and limit, or -1 if unknown.
+	usageBytes int64
+	limitBytes int64
+	// mergedChan is closed when either invalidateChan or
+	// mergedOther is, as of when it was made.
+	mergedChan  chan StatusUpdate
+	mergedSelf  chan StatusUpdate
+	mergedOther <-chan StatusUpdate
 }
 
 // Init inits the kbfsCurrentStatus.
 func (kcs *kbfsCurrentStatus) Init() {
 	kcs.failingServices = map[string]error{}
 	kcs.invalidateChan = make(chan StatusUpdate)
+	kcs.usageBytes = -1
+	kcs.limitBytes = -1
+}
+
+// mergeLocked returns a channel that is closed when either the
+// current invalidateChan or other is.  kcs.lock must be held by the
+// caller.
+func (kcs *kbfsCurrentStatus) mergeLocked(
+	other <-chan StatusUpdate) chan StatusUpdate {
+	if other == nil {
+		return kcs.invalidateChan
+	}
+	if kcs.mergedChan != nil && kcs.mergedSelf == kcs.invalidateChan &&
+		kcs.mergedOther == other {
+		return kcs.mergedChan
+	}
+	// A new merged channel is only needed once one of the old
+	// sources has been closed, so at most one of these goroutines
+	// is ever waiting.
+	merged := make(chan StatusUpdate)
+	self := kcs.invalidateChan
+	go func() {
+		select {
+		case <-self:
+		case <-other:
+		}
+		close(merged)
+	}()
+	kcs.mergedChan, kcs.mergedSelf, kcs.mergedOther = merged, self, other
+	return merged
+}
+
+// signalChangeLocked signals a change in the status.  kcs.lock must
+// be held by the caller.
+func (kcs *kbfsCurrentStatus) signalChangeLocked() {
+	close(kcs.invalidateChan)
+	kcs.invalidateChan = make(chan StatusUpdate)
 }
 
 // CurrentStatus returns a copy of the current status.
@@ -42,6 +87,42 @@ func (kcs *kbfsCurrentStatus) CurrentStatus() (map[string]error, chan StatusUpda
 	return res, kcs.invalidateChan
 }
 
+// CurrentStatusWithUpdates is like CurrentStatus, but the returned
+// channel is also closed when the given channel is, so the caller can
+// wait for changes in other sources of status.
+func (kcs *kbfsCurrentStatus) CurrentStatusWithUpdates(
+	other <-chan StatusUpdate) (map[string]error, chan StatusUpdate) {
+	kcs.lock.Lock()
+	defer kcs.lock.Unlock()
+
+	res := map[string]error{}
+	for k, v := range kcs.failingServices {
+		res[k] = v
+	}
+	return res, kcs.mergeLocked(other)
+}
+
+// PushStatusChange signals a change in some other part of the
+// status, like the state of a folder-branch.
+func (kcs *kbfsCurrentStatus) PushStatusChange() {
+	kcs.lock.Lock()
+	defer kcs.lock.Unlock()
+	kcs.signalChangeLocked()
+}
+
+// PushQuotaUsage records the quota usage and limit most recently
+// seen, and signals a change if they differ from the previous ones.
+func (kcs *kbfsCurrentStatus) PushQuotaUsage(usageBytes, limitBytes int64) {
+	kcs.lock.Lock()
+	defer kcs.lock.Unlock()
+	if kcs.usageBytes == usageBytes && kcs.limitBytes == limitBytes {
+		return
+	}
+	kcs.usageBytes = usageBytes
+	kcs.limitBytes = limitBytes
+	kcs.signalChangeLocked()
+}
+
 // PushConnectionStatusChange pushes a change to the connection status of one of the services.
 func (kcs *kbfsCurrentStatus) PushConnectionStatusChange(service string, err error) {
 	kcs.lock.Lock()
@@ -58,6 +139,5 @@ func (kcs *kbfsCurrentStatus) PushConnectionStatusChange(service string, err err
 		delete(kcs.failingServices, service)
 	}
 
-	close(kcs.invalidateChan)
-	kcs.invalidateChan = make(chan StatusUpdate)
+	kcs.signalChangeLocked()
 }
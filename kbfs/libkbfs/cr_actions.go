@@ -27,6 +27,7 @@ type copyUnmergedEntryAction struct {
 	unique        bool
 	unmergedEntry DirEntry
 	attr          []attrChange
+	xattrs        []string
 }
 
 func fixupNamesInOps(fromName string, toName string, ops []op,
@@ -101,6 +102,9 @@ func (cuea *copyUnmergedEntryAction) swapUnmergedBlock(
 			// attributes so we can re-apply them during do().
 			if sao, ok := op.(*setAttrOp); ok {
 				cuea.attr = append(cuea.attr, sao.Attr)
+				if sao.Attr == xattrAttr {
+					cuea.xattrs = append(cuea.xattrs, sao.XattrName)
+				}
 			} else {
 				return false, zeroPtr, nil
 			}
@@ -189,6 +193,8 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				copyXattrs(&unmergedEntry, cuea.unmergedEntry, cuea.xattrs)
 			}
 		}
 	}
@@ -197,6 +203,46 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 	return nil
 }
 
+// copyXattrs copies the named extended attributes from src into dst,
+// removing any of them that don't exist in src.  dst's map is
+// copied rather than modified in place, since it may be shared with
+// other copies of the entry.
+func copyXattrs(dst *DirEntry, src DirEntry, names []string) {
+	xattrs := make(map[string][]byte, len(dst.Xattrs))
+	for name, value := range dst.Xattrs {
+		xattrs[name] = value
+	}
+	for _, name := range names {
+		if value, ok := src.Xattrs[name]; ok {
+			xattrs[name] = value
+		} else {
+			delete(xattrs, name)
+		}
+	}
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+	dst.Xattrs = xattrs
+}
+
+// appendMissingStrings appends each string in toAdd to s, unless
+// it's already there.
+func appendMissingStrings(s []string, toAdd []string) []string {
+	for _, a := range toAdd {
+		found := false
+		for _, existing := range s {
+			if a == existing {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, a)
+		}
+	}
+	return s
+}
+
 func prependOpsToChain(mostRecent BlockPointer, chains *crChains,
 	newOps ...op) error {
 	chain := chains.byMostRecent[mostRecent]
@@ -283,6 +329,9 @@ type copyUnmergedAttrAction struct {
 	fromName string
 	toName   string
 	attr     []attrChange
+	// The names of the extended attributes to copy, if attr
+	// contains xattrAttr.
+	xattrs []string
 }
 
 func (cuaa *copyUnmergedAttrAction) swapUnmergedBlock(
@@ -310,6 +359,8 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Type = unmergedEntry.Type
 		case mtimeAttr:
 			mergedEntry.Mtime = unmergedEntry.Mtime
+		case xattrAttr:
+			copyXattrs(&mergedEntry, unmergedEntry, cuaa.xattrs)
 		case sizeAttr:
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
@@ -836,6 +887,8 @@ func (cal crActionList) collapse() crActionList {
 						topAction.attr = append(topAction.attr, a)
 					}
 				}
+				topAction.xattrs = appendMissingStrings(
+					topAction.xattrs, action.xattrs)
 				indicesToRemove[i] = true
 			default:
 				setTopAction(action, action.fromName, i, infoMap,
@@ -12,12 +12,12 @@ import (
 func TestCRActionsCollapseNoChange(t *testing.T) {
 	al := crActionList{
 		&copyUnmergedEntryAction{"old1", "new1", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&copyUnmergedEntryAction{"old2", "new2", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&renameUnmergedAction{"old3", "new3", "", zeroPtr, zeroPtr},
 		&renameMergedAction{"old4", "new4", ""},
-		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}},
+		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}, nil},
 	}
 
 	newList := al.collapse()
@@ -28,9 +28,9 @@ func TestCRActionsCollapseNoChange(t *testing.T) {
 
 func TestCRActionsCollapseEntry(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil},
 		&copyUnmergedEntryAction{"old", "new", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&renameUnmergedAction{"old", "new", "", zeroPtr, zeroPtr},
 	}
 
@@ -65,13 +65,13 @@ func TestCRActionsCollapseEntry(t *testing.T) {
 }
 func TestCRActionsCollapseAttr(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil},
 	}
 
 	expected := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr, exAttr}},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr, exAttr}, nil},
 	}
 
 	newList := al.collapse()
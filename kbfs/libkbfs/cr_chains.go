@@ -201,6 +201,10 @@ type crChains struct {
 	// chain.
 	mostRecentMD *RootMetadata
 
+	// Whether any of the MDs that make up these chains contained a
+	// gcOp.
+	containsGCOp bool
+
 	// We need to be able to track ANY BlockPointer, at any point in
 	// the chain, back to its original.
 	originals map[BlockPointer]BlockPointer
@@ -371,7 +375,8 @@ func (ccs *crChains) makeChainForOp(op op) error {
 	case *rekeyOp:
 		// ignore rekey op
 	case *gcOp:
-		// ignore gc op
+		// remember that a gc happened, but otherwise ignore gc op
+		ccs.containsGCOp = true
 	}
 
 	return nil
@@ -513,7 +518,20 @@ func newCRChainsEmpty() *crChains {
 func newCRChains(ctx context.Context, cfg Config, rmds []*RootMetadata) (
 	ccs *crChains, err error) {
 	ccs = newCRChainsEmpty()
+	err = ccs.addMDs(ctx, cfg, rmds)
+	if err != nil {
+		return nil, err
+	}
+	return ccs, nil
+}
 
+// addMDs folds the operations in the given MD updates into these
+// chains, and collapses the chains.  The MDs must directly follow
+// any that were previously added.  This allows the chains for a long
+// run of updates to be built up one window at a time, without
+// holding all of the MDs in memory.
+func (ccs *crChains) addMDs(ctx context.Context, cfg Config,
+	rmds []*RootMetadata) error {
 	// For each MD update, turn each update in each op into map
 	// entries and create chains for the BlockPointers that are
 	// affected directly by the operation.
@@ -525,7 +543,7 @@ func newCRChains(ctx context.Context, cfg Config, rmds []*RootMetadata) (
 
 		winfo, err := newWriterInfo(ctx, cfg, rmd.LastModifyingWriter, rmd.writerKID())
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if ptr := rmd.data.cachedChanges.Info.BlockPointer; ptr != zeroPtr {
@@ -536,7 +554,7 @@ func newCRChains(ctx context.Context, cfg Config, rmds []*RootMetadata) (
 			op.setWriterInfo(winfo)
 			err := ccs.makeChainForOp(op)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 
@@ -549,6 +567,8 @@ func newCRChains(ctx context.Context, cfg Config, rmds []*RootMetadata) (
 		}
 	}
 
+	// Collapsing again after each batch of MDs is safe, since
+	// collapse always considers the full set of ops in each chain.
 	for _, chain := range ccs.byOriginal {
 		chain.collapse()
 		// NOTE: even if we've removed all its ops, still keep the
@@ -560,7 +580,7 @@ func newCRChains(ctx context.Context, cfg Config, rmds []*RootMetadata) (
 		ccs.mostRecentMD = rmds[len(rmds)-1]
 	}
 
-	return ccs, nil
+	return nil
 }
 
 type crChainSummary struct {
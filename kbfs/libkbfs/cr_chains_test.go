@@ -209,6 +209,59 @@ func TestCRChainsRenameOp(t *testing.T) {
 	testCRCheckOps(t, cc, dir1Unref, []op{rmo})
 }
 
+// Test that chains built up one window of MDs at a time collapse ops
+// across window boundaries, and remember any gcOps.
+func TestCRChainsAddMDsInWindows(t *testing.T) {
+	currPtr, ptrs, revPtrs := testCRInitPtrs(2)
+	rootPtrUnref := ptrs[0]
+	dir1Unref := ptrs[1]
+	expected := make(map[BlockPointer]BlockPointer)
+
+	// create root/dir1/file1
+	rmd1 := &RootMetadata{}
+	co := newCreateOp("file1", dir1Unref, File)
+	currPtr = testCRFillOpPtrs(currPtr, expected, revPtrs,
+		[]BlockPointer{rootPtrUnref, dir1Unref}, co)
+	rmd1.AddOp(co)
+	rmd1.data.Dir.BlockPointer = expected[rootPtrUnref]
+
+	// rm root/dir1/file1
+	rmd2 := &RootMetadata{}
+	ro := newRmOp("file1", expected[dir1Unref])
+	currPtr = testCRFillOpPtrs(currPtr, expected, revPtrs,
+		[]BlockPointer{expected[rootPtrUnref], expected[dir1Unref]}, ro)
+	rmd2.AddOp(ro)
+	rmd2.data.Dir.BlockPointer = expected[rootPtrUnref]
+
+	// gc
+	rmd3 := &RootMetadata{}
+	rmd3.AddOp(newGCOp(MetadataRevisionInitial))
+	rmd3.data.Dir.BlockPointer = expected[rootPtrUnref]
+
+	rmds := []*RootMetadata{rmd1, rmd2, rmd3}
+	config := testCRChainsFillInWriter(t, rmds)
+	defer config.Shutdown()
+	cc := newCRChainsEmpty()
+	for _, rmd := range rmds {
+		err := cc.addMDs(context.Background(), config, []*RootMetadata{rmd})
+		if err != nil {
+			t.Fatalf("Error adding MD to chains: %v", err)
+		}
+	}
+	checkExpectedChains(t, expected, make(map[BlockPointer]renameInfo),
+		rootPtrUnref, cc, true)
+
+	// The create and rm cancel each other out.
+	testCRCheckOps(t, cc, dir1Unref, []op{})
+
+	if !cc.containsGCOp {
+		t.Errorf("Chains didn't notice the gcOp")
+	}
+	if cc.mostRecentMD != rmd3 {
+		t.Errorf("Unexpected most recent MD: %v", cc.mostRecentMD)
+	}
+}
+
 // Test multiple operations, both in one MD and across multiple MDs
 func TestCRChainsMultiOps(t *testing.T) {
 	// To start, we have: root/dir1/dir2/file1 and root/dir3/file2
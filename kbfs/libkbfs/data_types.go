@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"encoding/hex"
 	"fmt"
+	"os"
 	"reflect"
 	"strings"
 	"time"
@@ -221,6 +222,21 @@ func (r blockRef) String() string {
 	return s
 }
 
+func (r blockRef) batchRef() BlockBatchRef {
+	return BlockBatchRef{r.id, r.refNonce}
+}
+
+// BlockBatchRef identifies one of the block references in a batched
+// block call, for reporting its error in a BlockBatchError.
+type BlockBatchRef struct {
+	ID       BlockID
+	RefNonce BlockRefNonce
+}
+
+func (r BlockBatchRef) String() string {
+	return blockRef{r.ID, r.RefNonce}.String()
+}
+
 // BlockPointer contains the identifying information for a block in KBFS.
 //
 // NOTE: Don't add or modify anything in this struct without
@@ -347,6 +363,14 @@ func (r ReadyBlockData) GetEncodedSize() int {
 	return len(r.buf)
 }
 
+// BlockServerPut is one block to be stored by BlockServer.PutBlocks.
+type BlockServerPut struct {
+	ID         BlockID
+	Context    BlockContext
+	Buf        []byte
+	ServerHalf BlockCryptKeyServerHalf
+}
+
 // Favorite is a top-level favorited folder name.
 type Favorite struct {
 	Name    string
@@ -623,6 +647,34 @@ func (et EntryType) String() string {
 	return "<invalid EntryType>"
 }
 
+// Mode returns the file mode, including the type and permission
+// bits, that represents an entry of this type to the current user.
+// public says whether the entry's top-level folder is public, and
+// writable whether the current user is one of its writers; readers
+// don't get any write bits.  Only public directories can be listed
+// by other local users.
+func (et EntryType) Mode(public, writable bool) os.FileMode {
+	var mode os.FileMode
+	switch et {
+	case Exec:
+		mode = 0755
+	case Dir:
+		mode = os.ModeDir | 0700
+		if public {
+			mode |= 0055
+		}
+	case Sym:
+		// Permissions don't apply to symlinks themselves.
+		return os.ModeSymlink | 0777
+	default:
+		mode = 0644
+	}
+	if !writable {
+		mode &^= 0222
+	}
+	return mode
+}
+
 // EntryInfo is the (non-block-related) info a directory knows about
 // its child.
 //
@@ -654,6 +706,12 @@ type ReportedError struct {
 	Time  time.Time
 	Error error
 	Stack []uintptr
+	// The folder and mode of the operation that failed, and the
+	// debug tags from its context.
+	Tlf    CanonicalTlfName
+	Public bool
+	Mode   ErrorModeType
+	Tags   map[string]string
 }
 
 // MergeStatus represents the merge status of a TLF.
@@ -827,6 +885,30 @@ type TLFUpdateHistory struct {
 	Updates []UpdateSummary
 }
 
+// WriterUsage describes how a single writer has changed the storage
+// used by a TLF, over all the revisions they made.
+type WriterUsage struct {
+	// RefBytes is the total size of the blocks they referenced.
+	RefBytes uint64
+	// UnrefBytes is the total size of the blocks they unreferenced.
+	UnrefBytes uint64
+}
+
+// TLFUsage describes the storage used by a TLF.
+type TLFUsage struct {
+	ID   string
+	Name string
+	// LiveBytes is the size of all the blocks referenced by the
+	// current version of the TLF.
+	LiveBytes uint64
+	// ArchivedBytes is the size of the blocks that have been
+	// unreferenced, but not yet reclaimed, and so still count
+	// against the writers' quotas.
+	ArchivedBytes uint64
+	// Writers breaks down the changes by writer name.
+	Writers map[string]WriterUsage
+}
+
 // writerInfo is the keybase username and device that generated the operation.
 type writerInfo struct {
 	name       libkb.NormalizedUsername
@@ -844,3 +926,15 @@ const (
 	// WriteMode indicates that an error happened while trying to write.
 	WriteMode
 )
+
+// String implements the fmt.Stringer interface for ErrorModeType.
+func (m ErrorModeType) String() string {
+	switch m {
+	case ReadMode:
+		return errorModeRead
+	case WriteMode:
+		return errorModeWrite
+	default:
+		return fmt.Sprintf("ErrorModeType(%d)", int(m))
+	}
+}
@@ -10,6 +10,10 @@ import "github.com/keybase/go-codec/codec"
 type DirEntry struct {
 	BlockInfo
 	EntryInfo
+	// Xattrs holds the extended attributes of the entry, by name.
+	// Like the rest of the entry, they are encrypted as part of the
+	// parent directory's block.
+	Xattrs map[string][]byte `codec:"x,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
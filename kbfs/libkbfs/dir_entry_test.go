@@ -34,6 +34,7 @@ func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
 				101,
 				102,
 			},
+			map[string][]byte{"user.fake": []byte("fake value")},
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("dirEntry", t),
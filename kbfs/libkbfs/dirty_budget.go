@@ -0,0 +1,114 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "sync"
+
+// DirtyBudgetStatus describes how much of the global dirty data
+// budget is in use.  It is suitable for encoding directly as JSON.
+type DirtyBudgetStatus struct {
+	// DirtyBytes is the estimated number of dirty bytes in the
+	// block cache, across all folders.
+	DirtyBytes uint64
+	// OutstandingBytes is the part of DirtyBytes that hasn't yet
+	// been put to the block server.
+	OutstandingBytes uint64
+	// MaxBytes is the number of outstanding bytes above which
+	// writes are blocked.
+	MaxBytes uint64
+}
+
+// DirtyBudgetStandard implements the DirtyBudget interface, using
+// the dirty bytes estimate from the Config's BlockCache.
+type DirtyBudgetStandard struct {
+	config Config
+
+	// protects all fields below
+	lock sync.Mutex
+	// Dirty bytes that have been put to the block server, but are
+	// still in the dirty cache because their syncs haven't
+	// finished yet.
+	bytesPut uint64
+	// Closed and replaced whenever room might have opened up.
+	wakeCh chan struct{}
+}
+
+var _ DirtyBudget = (*DirtyBudgetStandard)(nil)
+
+// NewDirtyBudgetStandard constructs a new DirtyBudgetStandard
+// instance, with a limit given by config.MaxDirtyBytes().
+func NewDirtyBudgetStandard(config Config) *DirtyBudgetStandard {
+	return &DirtyBudgetStandard{
+		config: config,
+		wakeCh: make(chan struct{}),
+	}
+}
+
+func (d *DirtyBudgetStandard) getBytesLocked() (dirty, outstanding uint64) {
+	dirty = d.config.BlockCache().DirtyBytesEstimate()
+	// The estimate may drop before the corresponding SyncFinished
+	// call.
+	if dirty < d.bytesPut {
+		return dirty, 0
+	}
+	return dirty, dirty - d.bytesPut
+}
+
+func (d *DirtyBudgetStandard) wakeLocked() {
+	close(d.wakeCh)
+	d.wakeCh = make(chan struct{})
+}
+
+// CheckRoom implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (d *DirtyBudgetStandard) CheckRoom() (bool, <-chan struct{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, outstanding := d.getBytesLocked()
+	if outstanding < d.config.MaxDirtyBytes() {
+		return true, nil
+	}
+	return false, d.wakeCh
+}
+
+// BytesPut implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (d *DirtyBudgetStandard) BytesPut(n uint64) {
+	if n == 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.bytesPut += n
+	d.wakeLocked()
+}
+
+// SyncFinished implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (d *DirtyBudgetStandard) SyncFinished(n uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if n > d.bytesPut {
+		d.bytesPut = 0
+	} else {
+		d.bytesPut -= n
+	}
+	// Even if n is 0, the sync might have cleaned up some dirty
+	// blocks.
+	d.wakeLocked()
+}
+
+// Status implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (d *DirtyBudgetStandard) Status() DirtyBudgetStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	dirty, outstanding := d.getBytesLocked()
+	return DirtyBudgetStatus{
+		DirtyBytes:       dirty,
+		OutstandingBytes: outstanding,
+		MaxBytes:         d.config.MaxDirtyBytes(),
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "testing"
+
+func dirtyBudgetTestPutDirty(t *testing.T, config Config, id BlockID,
+	size int) {
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, size)
+	err := config.BlockCache().PutDirty(BlockPointer{ID: id}, MasterBranch,
+		block)
+	if err != nil {
+		t.Fatalf("Couldn't put dirty block: %v", err)
+	}
+}
+
+func dirtyBudgetTestCheckClosed(t *testing.T, ch <-chan struct{},
+	expected bool) {
+	select {
+	case <-ch:
+		if !expected {
+			t.Fatalf("Channel unexpectedly closed")
+		}
+	default:
+		if expected {
+			t.Fatalf("Channel unexpectedly open")
+		}
+	}
+}
+
+func TestDirtyBudgetPutAndSync(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	// A fresh cache, so the sizes are known.
+	config.SetBlockCache(NewBlockCacheStandard(config, 100, 1<<30))
+	budget := NewDirtyBudgetStandard(config)
+
+	dirtyBudgetTestPutDirty(t, config, fakeBlockID(1), 100)
+	blockSize := config.BlockCache().DirtyBytesEstimate()
+	config.SetMaxDirtyBytes(2 * blockSize)
+
+	if hasRoom, _ := budget.CheckRoom(); !hasRoom {
+		t.Fatalf("No room with only one dirty block")
+	}
+
+	dirtyBudgetTestPutDirty(t, config, fakeBlockID(2), 100)
+	hasRoom, roomCh := budget.CheckRoom()
+	if hasRoom {
+		t.Fatalf("Still room with two dirty blocks")
+	}
+	dirtyBudgetTestCheckClosed(t, roomCh, false)
+
+	// Putting one of the blocks makes room, even though it's still
+	// in the dirty cache.
+	budget.BytesPut(blockSize)
+	dirtyBudgetTestCheckClosed(t, roomCh, true)
+	if hasRoom, _ := budget.CheckRoom(); !hasRoom {
+		t.Fatalf("No room after putting a block")
+	}
+	status := budget.Status()
+	expectedStatus := DirtyBudgetStatus{
+		DirtyBytes:       2 * blockSize,
+		OutstandingBytes: blockSize,
+		MaxBytes:         2 * blockSize,
+	}
+	if status != expectedStatus {
+		t.Errorf("Unexpected status %+v, expected %+v", status, expectedStatus)
+	}
+
+	// Once the sync cleans up the put block, the accounting stays
+	// the same.
+	err := config.BlockCache().DeleteDirty(
+		BlockPointer{ID: fakeBlockID(1)}, MasterBranch)
+	if err != nil {
+		t.Fatalf("Couldn't delete dirty block: %v", err)
+	}
+	budget.SyncFinished(blockSize)
+	status = budget.Status()
+	expectedStatus.DirtyBytes = blockSize
+	if status != expectedStatus {
+		t.Errorf("Unexpected status %+v, expected %+v", status, expectedStatus)
+	}
+}
+
+// Test that the estimate dropping before SyncFinished is called
+// doesn't make the outstanding bytes underflow.
+func TestDirtyBudgetEstimateDropsFirst(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetBlockCache(NewBlockCacheStandard(config, 100, 1<<30))
+	budget := NewDirtyBudgetStandard(config)
+
+	dirtyBudgetTestPutDirty(t, config, fakeBlockID(1), 100)
+	blockSize := config.BlockCache().DirtyBytesEstimate()
+	budget.BytesPut(blockSize)
+	err := config.BlockCache().DeleteDirty(
+		BlockPointer{ID: fakeBlockID(1)}, MasterBranch)
+	if err != nil {
+		t.Fatalf("Couldn't delete dirty block: %v", err)
+	}
+	if status := budget.Status(); status.OutstandingBytes != 0 {
+		t.Errorf("Unexpected outstanding bytes: %d", status.OutstandingBytes)
+	}
+
+	budget.SyncFinished(blockSize)
+	dirtyBudgetTestPutDirty(t, config, fakeBlockID(2), 100)
+	if status := budget.Status(); status.OutstandingBytes != blockSize {
+		t.Errorf("Unexpected outstanding bytes: %d", status.OutstandingBytes)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+const (
+	// errorHistoryMaxFileBytes is the size at which the current
+	// error history file is rotated out.
+	errorHistoryMaxFileBytes = 1024 * 1024
+	// errorHistoryMaxFiles is the number of error history files
+	// kept, including the current one.
+	errorHistoryMaxFiles = 5
+	// errorHistoryFileName is the name of the current error history
+	// file.  Rotated files get a numeric suffix, with higher numbers
+	// being older.
+	errorHistoryFileName = "errors.log"
+)
+
+// ErrorRecord is the persistent form of a ReportedError.  It is
+// suitable for encoding directly as JSON.
+type ErrorRecord struct {
+	Time   time.Time
+	Tlf    string `json:",omitempty"`
+	Public bool   `json:",omitempty"`
+	Mode   string
+	// Type is the Go type of the error, e.g. "libkbfs.NoSuchNameError".
+	Type  string
+	Error string
+	// Tags are the debug tags (e.g., FBO, CR or rekey IDs) from the
+	// context of the operation that failed, which can be used to
+	// find the operation in the logs.
+	Tags  map[string]string   `json:",omitempty"`
+	Stack []errors.StackFrame `json:",omitempty"`
+}
+
+func convertStack(stack []uintptr) []errors.StackFrame {
+	if len(stack) == 0 {
+		return nil
+	}
+	frames := make([]errors.StackFrame, len(stack))
+	for i, pc := range stack {
+		// TODO: Handle panics correctly, as described in the
+		// docs for runtime.Callers().
+		frames[i] = errors.NewStackFrame(pc)
+	}
+	return frames
+}
+
+// Record returns the persistent form of this error.
+func (re ReportedError) Record() ErrorRecord {
+	rec := ErrorRecord{
+		Time:   re.Time,
+		Tlf:    string(re.Tlf),
+		Public: re.Public,
+		Mode:   re.Mode.String(),
+		Tags:   re.Tags,
+		Stack:  convertStack(re.Stack),
+	}
+	if re.Error != nil {
+		rec.Type = fmt.Sprintf("%T", re.Error)
+		rec.Error = re.Error.Error()
+	}
+	return rec
+}
+
+// ErrorQuery selects reported errors.  Zero-valued fields match
+// every error.
+type ErrorQuery struct {
+	// Tlf and Public select the errors for one top-level folder.
+	Tlf    CanonicalTlfName
+	Public bool
+	// Since and Until bound the times of the selected errors.
+	Since time.Time
+	Until time.Time
+	// Type selects errors by their Go type, with or without the
+	// package name, e.g. "NoSuchNameError".
+	Type string
+	// Limit, if positive, selects only the most recent errors.
+	Limit int
+}
+
+func (q ErrorQuery) matches(rec ErrorRecord) bool {
+	if q.Tlf != "" && (string(q.Tlf) != rec.Tlf || q.Public != rec.Public) {
+		return false
+	}
+	if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && rec.Time.After(q.Until) {
+		return false
+	}
+	if q.Type != "" && rec.Type != q.Type &&
+		!strings.HasSuffix(rec.Type, "."+q.Type) {
+		return false
+	}
+	return true
+}
+
+// filter returns the records that match q, oldest first.
+func (q ErrorQuery) filter(recs []ErrorRecord) []ErrorRecord {
+	var matched []ErrorRecord
+	for _, rec := range recs {
+		if q.matches(rec) {
+			matched = append(matched, rec)
+		}
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[len(matched)-q.Limit:]
+	}
+	return matched
+}
+
+// ErrorHistory persists ErrorRecords to a set of rotating files in a
+// directory, one JSON-encoded record per line.  The history may be
+// shared by several KBFS processes; appends of a single record are
+// atomic, but rotations may race and lose a few records.
+type ErrorHistory struct {
+	dir          string
+	maxFileBytes int64
+	maxFiles     int
+
+	lock sync.Mutex // protects everything below
+	f    *os.File
+	size int64
+}
+
+// NewErrorHistory opens (or creates) an error history in the given
+// directory.
+func NewErrorHistory(dir string) (*ErrorHistory, error) {
+	return newErrorHistory(dir, errorHistoryMaxFileBytes, errorHistoryMaxFiles)
+}
+
+func newErrorHistory(dir string, maxFileBytes int64, maxFiles int) (
+	*ErrorHistory, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	h := &ErrorHistory{
+		dir:          dir,
+		maxFileBytes: maxFileBytes,
+		maxFiles:     maxFiles,
+	}
+	if err := h.openLocked(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// filePath returns the path of the history file with the given
+// index, where 0 is the current file.
+func (h *ErrorHistory) filePath(i int) string {
+	if i == 0 {
+		return filepath.Join(h.dir, errorHistoryFileName)
+	}
+	return filepath.Join(h.dir, fmt.Sprintf("%s.%d", errorHistoryFileName, i))
+}
+
+func (h *ErrorHistory) openLocked() error {
+	f, err := os.OpenFile(
+		h.filePath(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	h.f = f
+	h.size = fi.Size()
+	return nil
+}
+
+func (h *ErrorHistory) rotateLocked() error {
+	if err := h.f.Close(); err != nil {
+		return err
+	}
+	h.f = nil
+	for i := h.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(h.filePath(i-1), h.filePath(i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return h.openLocked()
+}
+
+// Add appends the given record to the history.
+func (h *ErrorHistory) Add(rec ErrorRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.f == nil {
+		return os.ErrClosed
+	}
+	if h.size > 0 && h.size+int64(len(buf)) > h.maxFileBytes {
+		if err := h.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := h.f.Write(buf)
+	h.size += int64(n)
+	return err
+}
+
+func (h *ErrorHistory) readFile(path string) ([]ErrorRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []ErrorRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, int(h.maxFileBytes))
+	for scanner.Scan() {
+		var rec ErrorRecord
+		// Skip lines that were cut short by a crash.
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, scanner.Err()
+}
+
+// Query returns the persisted records that match q, oldest first.
+func (h *ErrorHistory) Query(q ErrorQuery) ([]ErrorRecord, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var recs []ErrorRecord
+	for i := h.maxFiles - 1; i >= 0; i-- {
+		fileRecs, err := h.readFile(h.filePath(i))
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, q.filter(fileRecs)...)
+	}
+	return q.filter(recs), nil
+}
+
+// Close closes the history.
+func (h *ErrorHistory) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.f == nil {
+		return nil
+	}
+	err := h.f.Close()
+	h.f = nil
+	return err
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func makeTestErrorHistory(t *testing.T, maxFileBytes int64, maxFiles int) (
+	*ErrorHistory, string) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "error_history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newErrorHistory(tempdir, maxFileBytes, maxFiles)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		t.Fatal(err)
+	}
+	return h, tempdir
+}
+
+func checkErrorRecords(t *testing.T, expected []string, got []ErrorRecord) {
+	if len(expected) != len(got) {
+		t.Errorf("Unexpected number of errors: %d (%+v)", len(got), got)
+		return
+	}
+	for i, e := range expected {
+		if e != got[i].Error {
+			t.Errorf("Unexpected error at %d: %s vs %s", i, e, got[i].Error)
+		}
+	}
+}
+
+func TestErrorHistoryQuery(t *testing.T) {
+	h, tempdir := makeTestErrorHistory(t, errorHistoryMaxFileBytes,
+		errorHistoryMaxFiles)
+	defer os.RemoveAll(tempdir)
+	defer h.Close()
+
+	start := time.Now()
+	recs := []ErrorRecord{
+		{Time: start, Tlf: "u1", Type: "libkbfs.NoSuchNameError",
+			Error: "1"},
+		{Time: start.Add(1 * time.Minute), Tlf: "u1", Public: true,
+			Type: "libkbfs.NoSuchNameError", Error: "2"},
+		{Time: start.Add(2 * time.Minute), Tlf: "u2",
+			Type: "libkbfs.WriteAccessError", Error: "3"},
+		{Time: start.Add(3 * time.Minute), Type: "*errors.errorString",
+			Error: "4"},
+	}
+	for _, rec := range recs {
+		if err := h.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(q ErrorQuery, expected ...string) {
+		got, err := h.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkErrorRecords(t, expected, got)
+	}
+	check(ErrorQuery{}, "1", "2", "3", "4")
+	check(ErrorQuery{Tlf: "u1"}, "1")
+	check(ErrorQuery{Tlf: "u1", Public: true}, "2")
+	check(ErrorQuery{Type: "NoSuchNameError"}, "1", "2")
+	check(ErrorQuery{Type: "libkbfs.WriteAccessError"}, "3")
+	check(ErrorQuery{Since: start.Add(1 * time.Minute),
+		Until: start.Add(2 * time.Minute)}, "2", "3")
+	check(ErrorQuery{Limit: 2}, "3", "4")
+	check(ErrorQuery{Type: "NoSuchNameError", Limit: 1}, "2")
+
+	// The records are still there after reopening the history.
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewErrorHistory(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	check(ErrorQuery{}, "1", "2", "3", "4")
+}
+
+func TestErrorHistoryRotation(t *testing.T) {
+	// Each file fits only a couple of records.
+	h, tempdir := makeTestErrorHistory(t, 150, 3)
+	defer os.RemoveAll(tempdir)
+	defer h.Close()
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("%02d", i)
+		err := h.Add(ErrorRecord{Time: time.Now(), Error: msg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, msg)
+	}
+
+	got, err := h.Query(ErrorQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || len(got) >= len(expected) {
+		t.Fatalf("Unexpected number of errors after rotation: %d", len(got))
+	}
+	// Only the most recent records remain, in order.
+	checkErrorRecords(t, expected[len(expected)-len(got):], got)
+
+	files, err := ioutil.ReadDir(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Unexpected number of history files: %d", len(files))
+	}
+}
+
+func TestReporterSimpleErrorHistory(t *testing.T) {
+	h, tempdir := makeTestErrorHistory(t, errorHistoryMaxFileBytes,
+		errorHistoryMaxFiles)
+	defer os.RemoveAll(tempdir)
+
+	r := NewReporterSimple(wallClock{}, 1)
+	r.SetErrorHistory(h)
+	ctx := ctxWithRandomID(context.Background(), CtxFBOIDKey, CtxFBOOpID, nil)
+	r.ReportErr(ctx, "u1", false, WriteMode, NoSuchNameError{"a"})
+	r.ReportErr(ctx, "u2", true, ReadMode, errors.New("b"))
+
+	// The history keeps more errors than the in-memory buffer.
+	recs, err := r.QueryErrors(ErrorQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErrorRecords(t, []string{NoSuchNameError{"a"}.Error(), "b"}, recs)
+	rec := recs[0]
+	if rec.Tlf != "u1" || rec.Public || rec.Mode != "write" ||
+		rec.Type != "libkbfs.NoSuchNameError" {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+	if rec.Tags[CtxFBOOpID] == "" {
+		t.Errorf("Record is missing the FBO ID tag: %+v", rec.Tags)
+	}
+	if len(rec.Stack) == 0 {
+		t.Errorf("Record is missing a stack")
+	}
+
+	// Without a history, queries use the in-memory errors.
+	r.Shutdown()
+	r = NewReporterSimple(wallClock{}, 0)
+	r.ReportErr(ctx, "u1", false, WriteMode, NoSuchNameError{"a"})
+	r.ReportErr(ctx, "u2", true, ReadMode, errors.New("b"))
+	recs, err = r.QueryErrors(ErrorQuery{Tlf: "u2", Public: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErrorRecords(t, []string{"b"}, recs)
+}
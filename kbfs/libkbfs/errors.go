@@ -829,6 +829,43 @@ func (e NameTooLongError) Error() string {
 		"allowed number of bytes (%d)", e.name, e.maxAllowedBytes)
 }
 
+// NoSuchXattrError indicates that the user tried to access an
+// extended attribute that doesn't exist.
+type NoSuchXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("Extended attribute %s doesn't exist", e.Name)
+}
+
+// XattrTooBigError indicates that the user tried to set an extended
+// attribute value that is bigger than KBFS's supported size.
+type XattrTooBigError struct {
+	name            string
+	size            int
+	maxAllowedBytes int
+}
+
+// Error implements the error interface for XattrTooBigError.
+func (e XattrTooBigError) Error() string {
+	return fmt.Sprintf("Extended attribute %s has a %d-byte value, which is "+
+		"over the supported limit of %d bytes", e.name, e.size,
+		e.maxAllowedBytes)
+}
+
+// FileLockedError indicates that the user tried to lock a file that
+// is already locked by another owner.
+type FileLockedError struct {
+	Name string
+}
+
+// Error implements the error interface for FileLockedError.
+func (e FileLockedError) Error() string {
+	return fmt.Sprintf("%s is locked by someone else", e.Name)
+}
+
 // DirTooBigError indicates that the user tried to write a directory
 // that would be bigger than KBFS's supported size.
 type DirTooBigError struct {
@@ -1007,3 +1044,100 @@ type MetadataIsFinalError struct {
 func (e MetadataIsFinalError) Error() string {
 	return "Metadata is final"
 }
+
+// NotDirError indicates that the user tried to perform a
+// directory-specific operation on something that isn't a directory.
+type NotDirError struct {
+	path path
+}
+
+// Error implements the error interface for NotDirError
+func (e NotDirError) Error() string {
+	return fmt.Sprintf("%s is not a directory (folder %s)", e.path, e.path.Tlf)
+}
+
+// InvalidTrashEntryError indicates that the user tried to restore
+// something that isn't an entry in a folder's trash.
+type InvalidTrashEntryError struct {
+	Date string
+	Name string
+}
+
+// Error implements the error interface for InvalidTrashEntryError.
+func (e InvalidTrashEntryError) Error() string {
+	return fmt.Sprintf("%s/%s is not an entry in the trash", e.Date, e.Name)
+}
+
+// FolderInUseError indicates that a folder couldn't be shut down
+// because something still depends on its running state.
+type FolderInUseError struct {
+	FolderBranch FolderBranch
+	Reason       string
+}
+
+// Error implements the error interface for FolderInUseError.
+func (e FolderInUseError) Error() string {
+	return fmt.Sprintf("Folder %s is still in use: %s",
+		e.FolderBranch, e.Reason)
+}
+
+// TlfNotConflictedError indicates that a folder was expected to be a
+// conflicted copy (one whose name has a conflict suffix), but isn't.
+type TlfNotConflictedError struct {
+	Name CanonicalTlfName
+}
+
+// Error implements the error interface for TlfNotConflictedError.
+func (e TlfNotConflictedError) Error() string {
+	return fmt.Sprintf("Folder %s is not a conflicted copy", e.Name)
+}
+
+// CloneToSameTlfError indicates that the user tried to clone a folder
+// into itself.
+type CloneToSameTlfError struct {
+	Name CanonicalTlfName
+}
+
+// Error implements the error interface for CloneToSameTlfError.
+func (e CloneToSameTlfError) Error() string {
+	return fmt.Sprintf("Can't clone folder %s into itself", e.Name)
+}
+
+// BlockBatchError indicates that the operations on some of the blocks
+// in a batched block call failed.  The errors are keyed by block
+// reference, since a batch may hold several references to the same
+// block.  The operations on all the references that aren't in Errors
+// succeeded.
+type BlockBatchError struct {
+	Errors map[BlockBatchRef]error
+}
+
+// Error implements the error interface for BlockBatchError.
+func (e BlockBatchError) Error() string {
+	// Report the same block every time, so that the message is
+	// stable.
+	var first string
+	var firstErr error
+	for ref, err := range e.Errors {
+		if s := ref.String(); first == "" || s < first {
+			first, firstErr = s, err
+		}
+	}
+	return fmt.Sprintf("%d block(s) in the batch failed, including %s: %v",
+		len(e.Errors), first, firstErr)
+}
+
+// QuotaUsageWarningError is reported when the current user's usage
+// crosses one of the quota warning percentages (see
+// Config.QuotaWarningPercentages).  Nothing actually failed.
+type QuotaUsageWarningError struct {
+	UsageBytes int64
+	LimitBytes int64
+	Percent    int
+}
+
+// Error implements the error interface for QuotaUsageWarningError.
+func (e QuotaUsageWarningError) Error() string {
+	return fmt.Sprintf("Using %d of %d bytes (%d%%) of quota",
+		e.UsageBytes, e.LimitBytes, e.Percent)
+}
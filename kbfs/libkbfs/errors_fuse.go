@@ -96,6 +96,27 @@ func (e NameTooLongError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENAMETOOLONG)
 }
 
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for NoSuchXattrError.
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = XattrTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for XattrTooBigError.
+func (e XattrTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.E2BIG)
+}
+
+var _ fuse.ErrorNumber = FileLockedError{}
+
+// Errno implements the fuse.ErrorNumber interface for FileLockedError.
+func (e FileLockedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EAGAIN)
+}
+
 var _ fuse.ErrorNumber = DirTooBigError{}
 
 // Errno implements the fuse.ErrorNumber interface for DirTooBigError.
@@ -124,3 +145,18 @@ var _ fuse.ErrorNumber = NoSuchFolderListError{}
 func (e NoSuchFolderListError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
+
+var _ fuse.ErrorNumber = NotDirError{}
+
+// Errno implements the fuse.ErrorNumber interface for NotDirError.
+func (e NotDirError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOTDIR)
+}
+
+var _ fuse.ErrorNumber = InvalidTrashEntryError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// InvalidTrashEntryError.
+func (e InvalidTrashEntryError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EINVAL)
+}
@@ -0,0 +1,468 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// activityRevisionsPerPageDefault is the number of MD revisions that
+// a page of a folder's activity covers, unless the query says
+// otherwise.
+const activityRevisionsPerPageDefault = 50
+
+// ActivityAction is what a writer did in an ActivityEdit.  It reads
+// as a verb in the feed, e.g. "alice modified a.txt".
+type ActivityAction string
+
+// The actions that can appear in the activity feed.
+const (
+	ActivityCreated      ActivityAction = "created"
+	ActivityModified     ActivityAction = "modified"
+	ActivityDeleted      ActivityAction = "deleted"
+	ActivityRenamed      ActivityAction = "renamed"
+	ActivityChangedAttrs ActivityAction = "changed attributes of"
+)
+
+// ActivityQuery selects a page of a folder's activity feed.  The zero
+// value selects the most recent page.
+type ActivityQuery struct {
+	// Before, if set, selects only the revisions before it.
+	// Otherwise the page ends at the latest merged revision.
+	Before MetadataRevision
+	// Revisions is the number of revisions the page covers.  If it
+	// isn't positive, a default is used.
+	Revisions int
+}
+
+// ActivityEdit describes a change made to a folder, or several
+// consecutive ones made by the same writer to the same entry.  It is
+// suitable for encoding directly as JSON.
+type ActivityEdit struct {
+	// Revision and Time are those of the most recent change.  Time
+	// is when the server says it received the revision, or the zero
+	// time if that isn't known.
+	Revision MetadataRevision
+	Time     time.Time
+	Writer   string
+	// Device is the name of the writer's device, if known.
+	Device string `json:",omitempty"`
+	Action ActivityAction
+	// Path is the path of the changed entry relative to the folder
+	// root, as it is now; renames made since the change are taken
+	// into account.  If the entry has been deleted since, it's the
+	// path the entry had when it was deleted.
+	Path string
+	// OldPath is the path the entry was renamed from, for renames.
+	OldPath string `json:",omitempty"`
+	// Deleted is true if the entry doesn't exist anymore.
+	Deleted bool `json:",omitempty"`
+	// Count is the number of changes this edit aggregates.
+	Count int
+}
+
+// TLFActivity is a page of the activity feed of a TLF, in a form
+// suitable for encoding directly as JSON.
+type TLFActivity struct {
+	ID   string
+	Name string
+	// Edits are the edits in the page, most recent first.
+	Edits []ActivityEdit
+	// NextBefore is the ActivityQuery.Before of the next, older,
+	// page, or 0 if this is the oldest page.
+	NextBefore MetadataRevision `json:",omitempty"`
+}
+
+// activityEntry names a directory entry by its parent directory.
+type activityEntry struct {
+	dir  BlockPointer
+	name string
+}
+
+// activityItem is a single change in the feed, along with what's
+// needed to find the current path of the changed entry: either the
+// pointer of the entry itself, or, for created entries, the entry's
+// name, which is kept up to date with later renames.
+type activityItem struct {
+	edit    ActivityEdit
+	ptr     BlockPointer
+	entry   activityEntry
+	removed bool
+	oldDir  BlockPointer
+	oldName string
+}
+
+// activityResolver turns a range of MD updates, added a window at a
+// time, into activity items, and resolves the pointers they mention
+// to the current paths of the corresponding entries.
+type activityResolver struct {
+	// next maps each pointer to the one that replaced it.
+	next map[BlockPointer]BlockPointer
+	// newPtrs are all the pointers made by the updates.
+	newPtrs map[BlockPointer]bool
+	// removed maps the final pointer of each removed entry to the
+	// entry it was removed as.
+	removed map[BlockPointer]activityEntry
+	// nodes maps the current pointers to their nodes in cache, or
+	// to nil if they are no longer in the folder.
+	nodes map[BlockPointer]Node
+	cache NodeCache
+	// items are the items made so far, oldest first.
+	items []*activityItem
+	// writers caches the writer info for each writer and key.
+	writers map[string]writerInfo
+}
+
+func newActivityResolver() *activityResolver {
+	return &activityResolver{
+		next:    make(map[BlockPointer]BlockPointer),
+		newPtrs: make(map[BlockPointer]bool),
+		removed: make(map[BlockPointer]activityEntry),
+		writers: make(map[string]writerInfo),
+	}
+}
+
+// addUpdates records the pointer updates and removals of the given
+// MDs.
+func (ar *activityResolver) addUpdates(rmds []*RootMetadata) {
+	for _, rmd := range rmds {
+		for _, op := range rmd.data.Changes.Ops {
+			for _, update := range op.AllUpdates() {
+				if update.Unref != zeroPtr && update.Ref != zeroPtr {
+					ar.next[update.Unref] = update.Ref
+				}
+				ar.newPtrs[update.Ref] = true
+			}
+			if ro, ok := op.(*rmOp); ok {
+				for _, ptr := range ro.Unrefs() {
+					ar.removed[ptr] = activityEntry{ro.Dir.Ref, ro.OldName}
+				}
+			}
+		}
+	}
+}
+
+// current returns the pointer that ptr was most recently replaced
+// with, or ptr itself.
+func (ar *activityResolver) current(ptr BlockPointer) BlockPointer {
+	for {
+		next, ok := ar.next[ptr]
+		if !ok {
+			return ptr
+		}
+		ptr = next
+	}
+}
+
+// path returns the path relative to the folder root of the entry that
+// ptr is a version of, and whether the entry was deleted.  ok is
+// false if the path can't be found.
+func (ar *activityResolver) path(ptr BlockPointer) (
+	p string, deleted bool, ok bool) {
+	ptr = ar.current(ptr)
+	if n := ar.nodes[ptr]; n != nil {
+		nodes := ar.cache.PathFromNode(n).path
+		names := make([]string, 0, len(nodes))
+		for _, pn := range nodes[1:] {
+			names = append(names, pn.Name)
+		}
+		return strings.Join(names, "/"), false, true
+	}
+	if e, ok := ar.removed[ptr]; ok {
+		p, _, ok := ar.entryPath(e)
+		return p, true, ok
+	}
+	return "", false, false
+}
+
+// entryPath is like path, for the given entry.
+func (ar *activityResolver) entryPath(e activityEntry) (
+	p string, deleted bool, ok bool) {
+	dir, deleted, ok := ar.path(e.dir)
+	if !ok {
+		return "", false, false
+	}
+	if dir == "" {
+		return e.name, deleted, true
+	}
+	return dir + "/" + e.name, deleted, true
+}
+
+// sameEntry returns whether the entries name the same entry, as of
+// the current versions of their directories.
+func (ar *activityResolver) sameEntry(e1, e2 activityEntry) bool {
+	return e1.name == e2.name && ar.current(e1.dir) == ar.current(e2.dir)
+}
+
+// addItems turns the ops of the given MDs, which must follow any
+// previously added ones, into activity items, with the writer of
+// each set.  Ops in revisions after pageEnd aren't turned into
+// items, but their renames and removals are applied to the entries
+// of the items made so far.  The updates of the MDs must already
+// have been added with addUpdates.
+func (ar *activityResolver) addItems(ctx context.Context, config Config,
+	rmds []*RootMetadata, pageEnd MetadataRevision) error {
+	for _, rmd := range rmds {
+		// No new operations in these.
+		if rmd.IsWriterMetadataCopiedSet() {
+			continue
+		}
+
+		var winfo writerInfo
+		if rmd.Revision <= pageEnd {
+			kid := rmd.writerKID()
+			key := rmd.LastModifyingWriter.String() + "/" + kid.String()
+			var ok bool
+			winfo, ok = ar.writers[key]
+			if !ok {
+				var err error
+				winfo, err = newWriterInfo(
+					ctx, config, rmd.LastModifyingWriter, kid)
+				if err != nil {
+					return err
+				}
+				ar.writers[key] = winfo
+			}
+		}
+
+		for _, op := range rmd.data.Changes.Ops {
+			// Keep the created entries up to date.
+			switch realOp := op.(type) {
+			case *rmOp:
+				e := activityEntry{realOp.Dir.Ref, realOp.OldName}
+				for _, item := range ar.items {
+					if item.ptr == zeroPtr && !item.removed &&
+						ar.sameEntry(item.entry, e) {
+						item.removed = true
+					}
+				}
+			case *renameOp:
+				e := activityEntry{realOp.OldDir.Ref, realOp.OldName}
+				newDir := realOp.NewDir.Ref
+				if newDir == zeroPtr {
+					newDir = realOp.OldDir.Ref
+				}
+				for _, item := range ar.items {
+					if item.ptr == zeroPtr && !item.removed &&
+						ar.sameEntry(item.entry, e) {
+						item.entry = activityEntry{newDir, realOp.NewName}
+					}
+				}
+			}
+
+			if rmd.Revision > pageEnd {
+				continue
+			}
+			item := &activityItem{
+				edit: ActivityEdit{
+					Revision: rmd.Revision,
+					Time:     rmd.untrustedServerTimestamp,
+					Writer:   string(winfo.name),
+					Device:   winfo.deviceName,
+					Count:    1,
+				},
+			}
+			switch realOp := op.(type) {
+			case *createOp:
+				item.edit.Action = ActivityCreated
+				item.entry = activityEntry{realOp.Dir.Ref, realOp.NewName}
+			case *rmOp:
+				item.edit.Action = ActivityDeleted
+				item.entry = activityEntry{realOp.Dir.Ref, realOp.OldName}
+				item.removed = true
+			case *renameOp:
+				item.edit.Action = ActivityRenamed
+				item.ptr = realOp.Renamed
+				item.oldDir = realOp.OldDir.Ref
+				item.oldName = realOp.OldName
+			case *syncOp:
+				item.edit.Action = ActivityModified
+				item.ptr = realOp.File.Ref
+			case *setAttrOp:
+				item.edit.Action = ActivityChangedAttrs
+				item.ptr = realOp.File
+				if item.ptr == zeroPtr {
+					item.entry = activityEntry{realOp.Dir.Ref, realOp.Name}
+				}
+			default:
+				// Other ops don't change any entries.
+				continue
+			}
+			ar.items = append(ar.items, item)
+		}
+	}
+	return nil
+}
+
+// search finds the current nodes for all the pointers that the items
+// might need, under the root of the given head.
+func (ar *activityResolver) search(ctx context.Context,
+	fbo *folderBranchOps, head *RootMetadata) error {
+	ptrSet := make(map[BlockPointer]bool)
+	add := func(ptr BlockPointer) {
+		if ptr != zeroPtr {
+			ptrSet[ar.current(ptr)] = true
+		}
+	}
+	for _, item := range ar.items {
+		add(item.ptr)
+		add(item.entry.dir)
+		add(item.oldDir)
+	}
+	for _, e := range ar.removed {
+		add(e.dir)
+	}
+	ptrs := make([]BlockPointer, 0, len(ptrSet))
+	for ptr := range ptrSet {
+		ptrs = append(ptrs, ptr)
+	}
+
+	// Use a separate node cache, so as not to disturb the folder's
+	// nodes.
+	ar.cache = newNodeCacheStandard(fbo.folderBranch)
+	_, err := ar.cache.GetOrCreate(head.data.Dir.BlockPointer,
+		string(head.GetTlfHandle().GetCanonicalName()), nil)
+	if err != nil {
+		return err
+	}
+	ar.nodes, err = fbo.blocks.SearchForNodes(
+		ctx, ar.cache, ptrs, ar.newPtrs, head)
+	return err
+}
+
+// resolve sets the paths of the item's edit.  It returns false if
+// the path can't be found.
+func (ar *activityResolver) resolve(item *activityItem) bool {
+	var ok bool
+	if item.ptr != zeroPtr {
+		item.edit.Path, item.edit.Deleted, ok = ar.path(item.ptr)
+	} else {
+		var deleted bool
+		item.edit.Path, deleted, ok = ar.entryPath(item.entry)
+		item.edit.Deleted = deleted || item.removed
+	}
+	if !ok {
+		return false
+	}
+	if item.oldDir != zeroPtr {
+		item.edit.OldPath, _, ok = ar.entryPath(
+			activityEntry{item.oldDir, item.oldName})
+	}
+	return ok
+}
+
+// canAggregateActivity returns whether the older edit can be folded
+// into the newer one.
+func canAggregateActivity(newer, older ActivityEdit) bool {
+	if newer.Writer != older.Writer || newer.Device != older.Device ||
+		newer.Path != older.Path || newer.OldPath != older.OldPath ||
+		newer.Deleted != older.Deleted {
+		return false
+	}
+	return newer.Action == older.Action ||
+		(newer.Action == ActivityModified && older.Action == ActivityCreated)
+}
+
+// aggregateActivity returns the edits of the given items, most
+// recent first, with consecutive changes to the same entry by the
+// same writer folded together.
+func aggregateActivity(items []*activityItem) []ActivityEdit {
+	edits := make([]ActivityEdit, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		edit := items[i].edit
+		if n := len(edits); n > 0 && canAggregateActivity(edits[n-1], edit) {
+			// Creating and then writing a file is just creating it.
+			edits[n-1].Action = edit.Action
+			edits[n-1].Count += edit.Count
+			continue
+		}
+		edits = append(edits, edit)
+	}
+	return edits
+}
+
+// GetActivity implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) GetActivity(ctx context.Context,
+	folderBranch FolderBranch, q ActivityQuery) (
+	activity TLFActivity, err error) {
+	fbo.log.CDebugf(ctx, "GetActivity %+v", q)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return TLFActivity{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+
+	head, err := fbo.config.MDOps().GetForTLF(ctx, fbo.id())
+	if err != nil {
+		return TLFActivity{}, err
+	}
+	activity.ID = fbo.id().String()
+	activity.Name = head.GetTlfHandle().GetCanonicalPath()
+	activity.Edits = []ActivityEdit{}
+
+	revisions := q.Revisions
+	if revisions <= 0 {
+		revisions = activityRevisionsPerPageDefault
+	}
+	pageEnd := head.Revision
+	if q.Before != MetadataRevisionUninitialized && q.Before <= pageEnd {
+		pageEnd = q.Before - 1
+	}
+	if pageEnd < MetadataRevisionInitial {
+		return activity, nil
+	}
+	start := MetadataRevisionInitial
+	if pageEnd > MetadataRevision(revisions) {
+		start = pageEnd - MetadataRevision(revisions) + 1
+		activity.NextBefore = start
+	}
+
+	// Go through everything from the start of the page to the head,
+	// a window at a time, so that later renames and removals can be
+	// taken into account.
+	ar := newActivityResolver()
+	var last *RootMetadata
+	err = forEachMergedMDWindow(ctx, fbo.config, fbo.id(), start,
+		func(rmds []*RootMetadata) error {
+			err := fbo.reembedBlockChanges(ctx, lState, rmds)
+			if err != nil {
+				return err
+			}
+			ar.addUpdates(rmds)
+			err = ar.addItems(ctx, fbo.config, rmds, pageEnd)
+			if err != nil {
+				return err
+			}
+			last = rmds[len(rmds)-1]
+			return nil
+		})
+	if err != nil {
+		return TLFActivity{}, err
+	}
+	if last == nil {
+		return activity, nil
+	}
+
+	err = ar.search(ctx, fbo, last)
+	if err != nil {
+		return TLFActivity{}, err
+	}
+	resolved := ar.items[:0]
+	for _, item := range ar.items {
+		if !ar.resolve(item) {
+			fbo.log.CDebugf(ctx, "Ignoring %s at revision %d with no "+
+				"found path", item.edit.Action, item.edit.Revision)
+			continue
+		}
+		resolved = append(resolved, item)
+	}
+	activity.Edits = aggregateActivity(resolved)
+	return activity, nil
+}
@@ -18,6 +18,7 @@ type fbmHelper interface {
 	getMDForFBM(ctx context.Context) (*RootMetadata, error)
 	reembedForFBM(ctx context.Context, rmds []*RootMetadata) error
 	finalizeGCOp(ctx context.Context, gco *gcOp) error
+	purgeTrashBefore(ctx context.Context, cutoff time.Time) error
 }
 
 const (
@@ -243,8 +244,8 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 	numChunks := (len(ptrs) + numPointersToDowngradePerChunk - 1) /
 		numPointersToDowngradePerChunk
 	numWorkers := numChunks
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
+	if maxWorkers := fbm.config.MaxParallelBlockPuts(); numWorkers > maxWorkers {
+		numWorkers = maxWorkers
 	}
 	chunks := make(chan []BlockPointer, numChunks)
 
@@ -467,7 +468,7 @@ func (fbm *folderBlockManager) archiveBlocksInBackground() {
 				// block md writes due to the buffered channel.  So
 				// use the long timeout to make sure things get
 				// unblocked eventually, but no need for a short timeout.
-				ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+				ctx, cancel := context.WithTimeout(ctx, fbm.config.BackgroundTaskTimeout())
 				fbm.setArchiveCancel(cancel)
 				defer fbm.cancelArchive()
 
@@ -720,6 +721,21 @@ func (fbm *folderBlockManager) finalizeReclamation(ctx context.Context,
 		func() error { return fbm.helper.finalizeGCOp(ctx, gco) })
 }
 
+// purgeExpiredTrash removes the days in the folder's trash that are
+// older than the configured retention.  Their blocks are then
+// reclaimed like any other unreferenced blocks.
+func (fbm *folderBlockManager) purgeExpiredTrash(ctx context.Context) error {
+	retention := fbm.config.TrashRetention()
+	if retention <= 0 {
+		return nil
+	}
+	cutoff := fbm.config.Clock().Now().Add(-retention)
+	// purgeTrashBefore could wait indefinitely on locks, so run it
+	// in a goroutine.
+	return runUnlessCanceled(ctx,
+		func() error { return fbm.helper.purgeTrashBefore(ctx, cutoff) })
+}
+
 func (fbm *folderBlockManager) isQRNecessary(head *RootMetadata) bool {
 	if head == nil {
 		return false
@@ -769,6 +785,18 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 		return NewWriteAccessError(head.GetTlfHandle(), username)
 	}
 
+	if err := fbm.purgeExpiredTrash(ctx); err != nil {
+		fbm.log.CDebugf(ctx, "Couldn't purge the trash: %v", err)
+	}
+	// Purging the trash may have made new revisions, so get the
+	// head again.
+	head, err = fbm.helper.getMDForFBM(ctx)
+	if err != nil {
+		return err
+	} else if head.MergedStatus() != Merged {
+		return errors.New("Skipping quota reclamation while unstaged")
+	}
+
 	if !fbm.isQRNecessary(head) {
 		// Nothing has changed since last time, so no need to do any QR.
 		return nil
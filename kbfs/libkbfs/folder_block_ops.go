@@ -420,6 +420,28 @@ func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	return blockInfos, nil
 }
 
+// GetIndirectFilePtrsForPrefetch returns the indirect pointers in the
+// top block of the given file, for prefetching.  It returns nil if the
+// file has no indirect blocks, or if it has local changes that
+// haven't been synced yet.
+func (fbo *folderBlockOps) GetIndirectFilePtrsForPrefetch(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path) (
+	[]IndirectFilePtr, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	if fbo.config.BlockCache().IsDirty(file.tailPointer(), file.Branch) {
+		return nil, nil
+	}
+	fBlock, err := fbo.getFileLocked(ctx, lState, md, file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !fBlock.IsInd {
+		return nil, nil
+	}
+	return fBlock.IPtrs, nil
+}
+
 // getDirLocked retrieves the block pointed to by the tail pointer of
 // the given path, which must be valid, either from the cache or from
 // the server. An error is returned if the retrieved block is not a
@@ -975,21 +997,23 @@ func (fbo *folderBlockOps) Read(
 
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	ctx context.Context, lState *lockState) error {
-	// If there is too much unflushed data, we should wait until some
-	// of it gets flush so our memory usage doesn't grow without
-	// bound.
-	bcache := fbo.config.BlockCache()
+	// If there is too much unflushed data across all folders, we
+	// should wait until some of it gets put to the server so our
+	// memory usage doesn't grow without bound.
+	budget := fbo.config.DirtyBudget()
 	var syncBlockingCh chan error
 	for {
-		overThreshold := func() bool {
+		var roomCh <-chan struct{}
+		overBudget := func() bool {
 			fbo.blockLock.Lock(lState)
 			defer fbo.blockLock.Unlock(lState)
-			dirtyBytes := bcache.DirtyBytesEstimate()
-			if dirtyBytes < dirtyBytesThreshold {
+			var hasRoom bool
+			hasRoom, roomCh = budget.CheckRoom()
+			if hasRoom {
 				return false
 			}
-			fbo.log.CDebugf(ctx, "Blocking a write because of %d dirty bytes",
-				dirtyBytes)
+			fbo.log.CDebugf(ctx, "Blocking a write because the dirty "+
+				"budget is full: %+v", budget.Status())
 			if syncBlockingCh == nil {
 				syncBlockingCh = make(chan error, 1)
 				fbo.syncListeners =
@@ -997,7 +1021,7 @@ func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 			}
 			return true
 		}()
-		if !overThreshold {
+		if !overBudget {
 			break
 		}
 
@@ -1008,10 +1032,12 @@ func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 		default:
 		}
 
-		// Check again periodically, in case some other TLF is hogging
-		// all the dirty bytes.
+		// Check again whenever some dirty blocks are put, and
+		// periodically in case dirty blocks are dropped some other
+		// way.
 		t := time.NewTimer(100 * time.Millisecond)
 		select {
+		case <-roomCh:
 		case err := <-syncBlockingCh:
 			syncBlockingCh = nil
 			if err != nil {
@@ -1185,7 +1211,7 @@ func (fbo *folderBlockOps) writeDataLocked(
 	}
 	latestWrite := si.op.addWrite(uint64(off), uint64(len(data)))
 
-	if d := bcache.DirtyBytesEstimate(); d > dirtyBytesThreshold {
+	if d := bcache.DirtyBytesEstimate(); d > fbo.config.DirtyBytesThreshold() {
 		fbo.log.CDebugf(ctx, "Forcing a sync due to %d dirty bytes", d)
 		select {
 		// If we can't send on the channel, that means a sync is
@@ -1750,7 +1776,8 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 
 				fblock.IPtrs[i].BlockInfo = newInfo
 				md.AddRefBlock(newInfo)
-				si.bps.addNewBlock(newInfo.BlockPointer, block, readyBlockData)
+				si.bps.addNewDirtyBlock(newInfo.BlockPointer, block,
+					readyBlockData, uint64(getCachedBlockSize(block)))
 				fbo.fileBlockStates[localPtr] = blockSyncingNotDirty
 				syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = localPtr
 			}
@@ -1972,7 +1999,7 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 
 	numNodesFound := 0
 	for name, de := range dirBlock.Children {
-		if _, ok := nodeMap[de.BlockPointer]; ok {
+		if n, ok := nodeMap[de.BlockPointer]; ok && n == nil {
 			childPath := currDir.ChildPath(name, de.BlockPointer)
 			// make a node for every pathnode
 			var n Node
@@ -2007,6 +2034,36 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 	return numNodesFound, nil
 }
 
+// isCachedNodeInMDLocked returns whether the cached path of the
+// given node is one that searchForNodesInDirLocked would find: it
+// starts at the root of md, only goes through directories in
+// newPtrs, and matches the entries of md's directories.
+func (fbo *folderBlockOps) isCachedNodeInMDLocked(ctx context.Context,
+	lState *lockState, cache NodeCache, newPtrs map[BlockPointer]bool,
+	md *RootMetadata, n Node) (bool, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	p := cache.PathFromNode(n)
+	if !p.isValid() || p.path[0].BlockPointer != md.data.Dir.BlockPointer {
+		return false, nil
+	}
+	for i := 1; i < len(p.path); i++ {
+		if i > 1 && !newPtrs[p.path[i-1].BlockPointer] {
+			return false, nil
+		}
+		dir := path{FolderBranch: p.FolderBranch, path: p.path[:i]}
+		dirBlock, err := fbo.getDirLocked(ctx, lState, md, dir, blockRead)
+		if err != nil {
+			return false, err
+		}
+		de, ok := dirBlock.Children[p.path[i].Name]
+		if !ok || de.BlockPointer != p.path[i].BlockPointer {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 // SearchForNodes tries to resolve all the given pointers to a Node
 // object, using only the updated pointers specified in newPtrs.
 // Returns an error if any subset of the pointer paths do not exist;
@@ -2036,14 +2093,31 @@ func (fbo *folderBlockOps) SearchForNodes(ctx context.Context,
 			rootPtr)
 	}
 
-	// are they looking for the root directory?
+	// The cache already indexes its nodes by block ref, so any
+	// pointer with a linked node there (including the root) whose
+	// path the walk could find doesn't need the walk, which would
+	// just find the same node, since GetOrCreate returns existing
+	// linked nodes as they are.  Checking the path only reads the
+	// directories along it.  Unlinked nodes do need the walk, which
+	// replaces them.
 	numNodesFound := 0
-	if _, ok := nodeMap[rootPtr]; ok {
-		nodeMap[rootPtr] = node
-		numNodesFound++
-		if numNodesFound >= len(nodeMap) {
-			return nodeMap, nil
+	for ptr := range nodeMap {
+		n := cache.Get(ptr.ref())
+		if n == nil || n.GetBasename() == "" {
+			continue
+		}
+		inMD, err := fbo.isCachedNodeInMDLocked(
+			ctx, lState, cache, newPtrs, md, n)
+		if err != nil {
+			return nil, err
 		}
+		if inMD {
+			nodeMap[ptr] = n
+			numNodesFound++
+		}
+	}
+	if numNodesFound >= len(nodeMap) {
+		return nodeMap, nil
 	}
 
 	rootPath := cache.PathFromNode(node)
@@ -2107,6 +2181,8 @@ func (fbo *folderBlockOps) setCachedAttr(
 		fileEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.Xattrs = realEntry.Xattrs
 	}
 	fbo.deCache[ref] = fileEntry
 }
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keybase/backoff"
@@ -44,20 +45,19 @@ const (
 	archiveOffline                   // an offline, read-only branch
 )
 
-// Constants used in this file.  TODO: Make these configurable?
+// Constants used in this file.  The tunable ones live in Config.
 const (
-	maxParallelBlockPuts = 10
 	// Max response size for a single DynamoDB query is 1MB.
 	maxMDsAtATime = 10
-	// Time between checks for dirty files to flush, in case Sync is
-	// never called.
-	secondsBetweenBackgroundFlushes = 10
-	// Cap the number of times we retry after a recoverable error
-	maxRetriesOnRecoverableErrors = 10
-	// When the number of dirty bytes exceeds this level, force a sync.
-	dirtyBytesThreshold = maxParallelBlockPuts * (512 << 10)
-	// The timeout for any background task.
-	backgroundTaskTimeout = 1 * time.Minute
+	// Matches Linux's XATTR_SIZE_MAX.
+	maxXattrValueBytes = 64 * 1024
+	// New blocks up to this size are put in batches, along with
+	// new references to existing blocks, rather than one at a time.
+	maxBatchedBlockPutBytes = 64 * 1024
+	// Max number of blocks, and total size of the new ones, in one
+	// batched block put.
+	maxBlocksPerPutBatch = 64
+	maxBytesPerPutBatch  = 512 * 1024
 )
 
 type fboMutexLevel mutexLevel
@@ -232,6 +232,20 @@ type folderBranchOps struct {
 	// seen by other devices.  Protected by mdWriterLock.
 	staged bool
 
+	// The revision of the head of the folder-branch this one
+	// replaces, which is the first head fetched, or
+	// MetadataRevisionUninitialized.  Protected by mdWriterLock.
+	retainedHeadRev MetadataRevision
+
+	// When this folder-branch was last accessed, for shutting it
+	// down once it's idle, which is only tracked when
+	// Config.TLFIdleTimeout is set, and how many times it has been
+	// accessed, so that a shutdown can tell whether it raced with
+	// an access.
+	accessLock sync.Mutex
+	lastAccess time.Time
+	accesses   uint64
+
 	// Whether we've identified this TLF or not.
 	identifyLock sync.Mutex
 	identifyDone bool
@@ -264,20 +278,65 @@ type folderBranchOps struct {
 	// Helper class for archiving and cleaning up the blocks for this TLF
 	fbm *folderBlockManager
 
+	// Fetches blocks in the background before they're needed
+	prefetcher *blockPrefetcher
+
+	// Tracks the advisory file locks held by this device
+	fileLocks *folderFileLocks
+
 	// rekeyWithPromptTimer tracks a timed function that will try to
 	// rekey with a paper key prompt, if enough time has passed.
 	// Protected by mdWriterLock
 	rekeyWithPromptTimer *time.Timer
+
+	// If set, renames put the blocks of both paths in one batch
+	// once both are ready, like they used to, rather than starting
+	// the old path's puts early.  Only set by benchmarks, before
+	// any renames.
+	batchRenamePutsForTesting bool
 }
 
 var _ KBFSOps = (*folderBranchOps)(nil)
 
 var _ fbmHelper = (*folderBranchOps)(nil)
 
+// folderBranchRetainedState is what's kept of a folder-branch that
+// has been shut down, so that the nodes and observers it still had
+// carry over to the folder-branch that replaces it.
+type folderBranchRetainedState struct {
+	nodeCache NodeCache
+	observers *observerList
+	// headRev is the revision of the folder-branch's head, or
+	// MetadataRevisionUninitialized if it had none.
+	headRev MetadataRevision
+}
+
+// inUse returns whether anything other than the numGlobalObservers
+// observers registered for every folder-branch is still using s.
+func (s folderBranchRetainedState) inUse(numGlobalObservers int) bool {
+	return s.nodeCache.NumNodes() > 0 ||
+		s.observers.len() > numGlobalObservers
+}
+
 // newFolderBranchOps constructs a new folderBranchOps object.
 func newFolderBranchOps(config Config, fb FolderBranch,
 	bType branchType) *folderBranchOps {
-	nodeCache := newNodeCacheStandard(fb)
+	return newFolderBranchOpsWithState(config, fb, bType,
+		folderBranchRetainedState{
+			nodeCache: newNodeCacheStandard(fb),
+			observers: newObserverList(),
+			headRev:   MetadataRevisionUninitialized,
+		})
+}
+
+// newFolderBranchOpsWithState constructs a new folderBranchOps
+// object that replaces a shut-down one, with the given state.  The
+// first head it fetches is the shut-down one's, if any, so that the
+// nodes carried over keep working, and the updates made since are
+// applied as usual.
+func newFolderBranchOpsWithState(config Config, fb FolderBranch,
+	bType branchType, state folderBranchRetainedState) *folderBranchOps {
+	nodeCache := state.nodeCache
 
 	// make logger
 	branchSuffix := ""
@@ -292,7 +351,7 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 	// But print it out once in full, just in case.
 	log.CInfof(nil, "Created new folder-branch for %s", tlfStringFull)
 
-	observers := newObserverList()
+	observers := state.observers
 
 	mdWriterLock := makeLeveledMutex(mutexLevel(fboMDWriter), &sync.Mutex{})
 	headLock := makeLeveledRWMutex(mutexLevel(fboHead), &sync.RWMutex{})
@@ -326,6 +385,7 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 			nodeCache: nodeCache,
 		},
 		nodeCache:       nodeCache,
+		retainedHeadRev: state.headRev,
 		log:             log,
 		deferLog:        log.CloneWithAddedDepth(1),
 		shutdownChan:    make(chan struct{}),
@@ -334,8 +394,15 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 	}
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
+	fbo.prefetcher = newBlockPrefetcher(config, fb)
+	if ncs, ok := nodeCache.(*nodeCacheStandard); ok {
+		// Forget the read pattern of each file once nothing
+		// references its node anymore.
+		ncs.setForgetHook(fbo.prefetcher.cancelFile)
+	}
+	fbo.fileLocks = newFolderFileLocks()
 	if config.DoBackgroundFlushes() {
-		go fbo.backgroundFlusher(secondsBetweenBackgroundFlushes * time.Second)
+		go fbo.backgroundFlusher(config.BackgroundFlushPeriod())
 	}
 	return fbo
 }
@@ -351,6 +418,109 @@ func (fbo *folderBranchOps) markForReIdentifyIfNeeded(now time.Time, maxValid ti
 	}
 }
 
+// noteAccess records an access to fbo, at the given time if it's
+// non-zero.
+func (fbo *folderBranchOps) noteAccess(now time.Time) {
+	fbo.accessLock.Lock()
+	defer fbo.accessLock.Unlock()
+	fbo.accesses++
+	if !now.IsZero() {
+		fbo.lastAccess = now
+	}
+}
+
+// numAccesses returns the number of accesses to fbo so far.
+func (fbo *folderBranchOps) numAccesses() uint64 {
+	fbo.accessLock.Lock()
+	defer fbo.accessLock.Unlock()
+	return fbo.accesses
+}
+
+// isIdleSince returns whether fbo hasn't been accessed since the
+// given time.
+func (fbo *folderBranchOps) isIdleSince(t time.Time) bool {
+	fbo.accessLock.Lock()
+	defer fbo.accessLock.Unlock()
+	return fbo.lastAccess.Before(t)
+}
+
+// flushDirtyFiles syncs every dirty file that still has a node.
+func (fbo *folderBranchOps) flushDirtyFiles(ctx context.Context) error {
+	lState := makeFBOLockState()
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		if err := fbo.Sync(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNotInUse returns a FolderInUseError if shutting down fbo would
+// lose anything: nodes someone still holds, other than the root
+// node, unsynced writes, file locks, or unmerged changes.  The root
+// node (which e.g. a FUSE mount keeps for as long as the folder's
+// directory is cached) and the observers carry over to the
+// folder-branch that replaces fbo; see retainedState.
+func (fbo *folderBranchOps) checkNotInUse(lState *lockState) error {
+	var reason string
+	switch {
+	case !fbo.holdsAtMostRootNode(lState):
+		reason = "files or directories are open"
+	case fbo.blocks.GetState(lState) != cleanState:
+		reason = "there are unsynced writes"
+	case fbo.fileLocks.numHeld() > 0:
+		reason = "file locks are held"
+	case fbo.getStaged(lState):
+		reason = "there are unmerged changes"
+	default:
+		return nil
+	}
+	return FolderInUseError{fbo.folderBranch, reason}
+}
+
+// headRootPtr returns the root pointer of the head, or zeroPtr if
+// there's no readable head.
+func (fbo *folderBranchOps) headRootPtr(lState *lockState) BlockPointer {
+	head := fbo.getHead(lState)
+	if head == nil || !head.IsReadable() {
+		return zeroPtr
+	}
+	return head.data.Dir.BlockPointer
+}
+
+// holdsAtMostRootNode returns whether the only node anyone holds
+// for fbo, if any, is its root node.
+func (fbo *folderBranchOps) holdsAtMostRootNode(lState *lockState) bool {
+	switch fbo.nodeCache.NumNodes() {
+	case 0:
+		return true
+	case 1:
+		rootPtr := fbo.headRootPtr(lState)
+		return rootPtr != zeroPtr && fbo.nodeCache.Get(rootPtr.ref()) != nil
+	default:
+		return false
+	}
+}
+
+// retainedState returns what a folder-branch replacing fbo needs to
+// keep fbo's nodes and observers working.
+func (fbo *folderBranchOps) retainedState(
+	lState *lockState) folderBranchRetainedState {
+	headRev := MetadataRevisionUninitialized
+	if head := fbo.getHead(lState); head != nil {
+		headRev = head.Revision
+	}
+	return folderBranchRetainedState{
+		nodeCache: fbo.nodeCache,
+		observers: fbo.observers,
+		headRev:   headRev,
+	}
+}
+
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by folderBranchOps.
 func (fbo *folderBranchOps) Shutdown() error {
@@ -376,15 +546,23 @@ func (fbo *folderBranchOps) Shutdown() error {
 		}
 	}
 
+	fbo.stopBackgroundWork()
+	return nil
+}
+
+// stopBackgroundWork stops all of fbo's goroutines, without checking
+// its state first.
+func (fbo *folderBranchOps) stopBackgroundWork() {
 	close(fbo.shutdownChan)
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
+	fbo.prefetcher.shutdown()
+	fbo.fileLocks.shutdown()
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
 	if fbo.updateDoneChan != nil {
 		<-fbo.updateDoneChan
 	}
-	return nil
 }
 
 func (fbo *folderBranchOps) id() TlfID {
@@ -614,6 +792,20 @@ func (fbo *folderBranchOps) getMDLocked(
 	if err != nil {
 		return nil, err
 	}
+	if md == nil && fbo.retainedHeadRev != MetadataRevisionUninitialized {
+		// Start from the head of the folder-branch fbo replaces,
+		// so that the nodes carried over from it get the updates
+		// made since.
+		rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+			fbo.retainedHeadRev, fbo.retainedHeadRev, Merged)
+		if err != nil {
+			return nil, err
+		}
+		if len(rmds) > 0 {
+			md = rmds[0]
+		}
+		fbo.retainedHeadRev = MetadataRevisionUninitialized
+	}
 	if md == nil {
 		// no unmerged MDs for this device, so just get the current head
 		md, err = mdops.GetForTLF(ctx, fbo.id())
@@ -674,6 +866,20 @@ func (fbo *folderBranchOps) getMDForReadNeedIdentify(
 	return fbo.getMDForReadHelper(ctx, lState, mdReadNeedIdentify)
 }
 
+// checkWriteAccess returns a WriteAccessError if the current user
+// isn't a writer of the given MD's folder.
+func (fbo *folderBranchOps) checkWriteAccess(
+	ctx context.Context, md *RootMetadata) error {
+	username, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if !md.GetTlfHandle().IsWriter(uid) {
+		return NewWriteAccessError(md.GetTlfHandle(), username)
+	}
+	return nil
+}
+
 func (fbo *folderBranchOps) getMDForWriteLocked(
 	ctx context.Context, lState *lockState) (*RootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -683,14 +889,9 @@ func (fbo *folderBranchOps) getMDForWriteLocked(
 		return nil, err
 	}
 
-	username, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
-	if err != nil {
+	if err := fbo.checkWriteAccess(ctx, md); err != nil {
 		return nil, err
 	}
-	if !md.GetTlfHandle().IsWriter(uid) {
-		return nil,
-			NewWriteAccessError(md.GetTlfHandle(), username)
-	}
 
 	// Make a new successor of the current MD to hold the coming
 	// writes.  The caller must pass this into
@@ -1030,6 +1231,18 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 		if err != nil {
 			return err
 		}
+
+		if fbo.config.PrefetchDirChildren() {
+			dblock, err := fbo.blocks.GetDirBlockForReading(ctx, lState, md,
+				dirPath.tailPointer(), dirPath.Branch, dirPath)
+			if err != nil {
+				// The children were read fine; just don't prefetch.
+				fbo.log.CDebugf(ctx, "Not prefetching children of %s: %v",
+					dirPath, err)
+				return nil
+			}
+			fbo.prefetcher.prefetchDirChildren(ctx, md, dirPath.Branch, dblock)
+		}
 		return nil
 	})
 	if err != nil {
@@ -1138,6 +1351,9 @@ type blockState struct {
 	blockPtr       BlockPointer
 	block          Block
 	readyBlockData ReadyBlockData
+	// The number of bytes this block counts for in the dirty
+	// budget, if it was dirty before the sync.
+	dirtyBytes uint64
 }
 
 func (fbo *folderBranchOps) Stat(ctx context.Context, node Node) (
@@ -1169,8 +1385,24 @@ func newBlockPutState(length int) *blockPutState {
 
 func (bps *blockPutState) addNewBlock(blockPtr BlockPointer, block Block,
 	readyBlockData ReadyBlockData) {
-	bps.blockStates = append(bps.blockStates,
-		blockState{blockPtr, block, readyBlockData})
+	bps.blockStates = append(bps.blockStates, blockState{
+		blockPtr:       blockPtr,
+		block:          block,
+		readyBlockData: readyBlockData,
+	})
+}
+
+// addNewDirtyBlock is like addNewBlock, but for a block that was
+// dirty and counts dirtyBytes against the dirty budget until it is
+// put.
+func (bps *blockPutState) addNewDirtyBlock(blockPtr BlockPointer,
+	block Block, readyBlockData ReadyBlockData, dirtyBytes uint64) {
+	bps.blockStates = append(bps.blockStates, blockState{
+		blockPtr:       blockPtr,
+		block:          block,
+		readyBlockData: readyBlockData,
+		dirtyBytes:     dirtyBytes,
+	})
 }
 
 func (bps *blockPutState) mergeOtherBps(other *blockPutState) {
@@ -1457,31 +1689,123 @@ func isRecoverableBlockError(err error) bool {
 	return isArchiveError || isDeleteError || isRefError
 }
 
-func isRetriableError(err error, retries int) bool {
+func (fbo *folderBranchOps) isRetriableError(err error, retries int) bool {
 	recoverable := isRecoverableBlockError(err)
-	return recoverable && retries < maxRetriesOnRecoverableErrors
+	return recoverable && retries < fbo.config.MaxRetriesOnRecoverableErrors()
+}
+
+// blockPutFailed queues the given block for removal if its put
+// failed with a recoverable error, and reports err unless another
+// error has already been reported.
+func (fbo *folderBranchOps) blockPutFailed(blockState blockState, err error,
+	errChan chan error, blocksToRemoveChan chan *FileBlock) {
+	if isRecoverableBlockError(err) {
+		fblock, ok := blockState.block.(*FileBlock)
+		if ok && !fblock.IsInd {
+			blocksToRemoveChan <- fblock
+		}
+	}
+
+	// one error causes everything else to cancel
+	select {
+	case errChan <- err:
+	default:
+	}
+}
+
+// blockPutSucceeded reports the dirty bytes of a block that was
+// successfully put.
+func (fbo *folderBranchOps) blockPutSucceeded(blockState blockState,
+	dirtyBytesPut *uint64) {
+	if blockState.dirtyBytes > 0 {
+		atomic.AddUint64(dirtyBytesPut, blockState.dirtyBytes)
+		fbo.config.DirtyBudget().BytesPut(blockState.dirtyBytes)
+	}
 }
 
 func (fbo *folderBranchOps) doOneBlockPut(ctx context.Context,
 	md *RootMetadata, blockState blockState,
-	errChan chan error, blocksToRemoveChan chan *FileBlock) {
+	errChan chan error, blocksToRemoveChan chan *FileBlock,
+	dirtyBytesPut *uint64) {
 	err := fbo.config.BlockOps().
 		Put(ctx, md, blockState.blockPtr, blockState.readyBlockData)
 	if err != nil {
-		if isRecoverableBlockError(err) {
-			fblock, ok := blockState.block.(*FileBlock)
-			if ok && !fblock.IsInd {
-				blocksToRemoveChan <- fblock
-			}
+		fbo.blockPutFailed(blockState, err, errChan, blocksToRemoveChan)
+		return
+	}
+	fbo.blockPutSucceeded(blockState, dirtyBytesPut)
+}
+
+// doBlockPutBatch puts the given blocks with a single batched call,
+// unless there's only one of them.
+func (fbo *folderBranchOps) doBlockPutBatch(ctx context.Context,
+	md *RootMetadata, blockStates []blockState,
+	errChan chan error, blocksToRemoveChan chan *FileBlock,
+	dirtyBytesPut *uint64) {
+	if len(blockStates) == 1 {
+		fbo.doOneBlockPut(ctx, md, blockStates[0], errChan,
+			blocksToRemoveChan, dirtyBytesPut)
+		return
+	}
+
+	ptrs := make([]BlockPointer, len(blockStates))
+	readyBlockDatas := make([]ReadyBlockData, len(blockStates))
+	for i, blockState := range blockStates {
+		ptrs[i] = blockState.blockPtr
+		readyBlockDatas[i] = blockState.readyBlockData
+	}
+	err := fbo.config.BlockOps().PutBatch(ctx, md, ptrs, readyBlockDatas)
+	batchErr, isBatchErr := err.(BlockBatchError)
+	for _, blockState := range blockStates {
+		blockErr := err
+		if isBatchErr {
+			blockErr = batchErr.Errors[blockState.blockPtr.ref().batchRef()]
 		}
+		if blockErr != nil {
+			fbo.blockPutFailed(
+				blockState, blockErr, errChan, blocksToRemoveChan)
+		} else {
+			fbo.blockPutSucceeded(blockState, dirtyBytesPut)
+		}
+	}
+}
 
-		// one error causes everything else to cancel
-		select {
-		case errChan <- err:
+// batchBlockPuts groups the given block puts into the batches that
+// are each put with one call.  New references to existing blocks,
+// which carry no data, and small new blocks are batched; bigger
+// blocks are put on their own.
+func batchBlockPuts(blockStates []blockState) (batches [][]blockState) {
+	var refs, small []blockState
+	smallBytes := 0
+	for _, bs := range blockStates {
+		size := bs.readyBlockData.GetEncodedSize()
+		switch {
+		case !bs.blockPtr.IsFirstRef():
+			if len(refs) == maxBlocksPerPutBatch {
+				batches = append(batches, refs)
+				refs = nil
+			}
+			refs = append(refs, bs)
+		case size <= maxBatchedBlockPutBytes:
+			if len(small) == maxBlocksPerPutBatch ||
+				smallBytes+size > maxBytesPerPutBatch {
+				batches = append(batches, small)
+				small = nil
+				smallBytes = 0
+			}
+			small = append(small, bs)
+			smallBytes += size
 		default:
-			return
+			batches = append(batches, []blockState{bs})
 		}
 	}
+	if len(refs) > 0 {
+		batches = append(batches, refs)
+	}
+	if len(small) > 0 {
+		batches = append(batches, small)
+	}
+	return batches
 }
 
 // doBlockPuts writes all the pending block puts to the cache and
@@ -1493,26 +1817,51 @@ func (fbo *folderBranchOps) doOneBlockPut(ctx context.Context,
 // errors and should be removed by the caller from any saved state.
 func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
 	md *RootMetadata, bps blockPutState) ([]BlockPointer, error) {
+	blocksToRemove, _, err := fbo.doBlockPutsCountingDirty(ctx, md, bps)
+	return blocksToRemove, err
+}
+
+// doBlockPutsCountingDirty is like doBlockPuts, but it also returns
+// the number of dirty bytes that were successfully put, all of which
+// have been reported to the DirtyBudget.  The caller must report
+// them again via DirtyBudget.SyncFinished once the corresponding
+// dirty blocks have been cleaned up.
+func (fbo *folderBranchOps) doBlockPutsCountingDirty(ctx context.Context,
+	md *RootMetadata, bps blockPutState) (
+	blocksToRemove []BlockPointer, dirtyBytesPut uint64, err error) {
 	errChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	blocks := make(chan blockState, len(bps.blockStates))
+	batches := batchBlockPuts(bps.blockStates)
+	batchChan := make(chan []blockState, len(batches))
 	var wg sync.WaitGroup
 
-	numWorkers := len(bps.blockStates)
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
+	// Report the puts as pending uploads in the status until they
+	// are done or abandoned.
+	fbo.status.addPendingUploads(len(bps.blockStates))
+	var numPut int64
+	defer func() {
+		fbo.status.addPendingUploads(
+			-(len(bps.blockStates) - int(atomic.LoadInt64(&numPut))))
+	}()
+
+	numWorkers := len(batches)
+	if maxWorkers := fbo.config.MaxParallelBlockPuts(); numWorkers > maxWorkers {
+		numWorkers = maxWorkers
 	}
 	wg.Add(numWorkers)
 	// A channel to list any blocks that have been archived or
-	// deleted.  Any of these will result in an error, so the maximum
-	// we'll get is the same as the number of workers.
-	blocksToRemoveChan := make(chan *FileBlock, numWorkers)
+	// deleted.  Any of these will result in an error, but a single
+	// batch can report several of them, so make room for every block.
+	blocksToRemoveChan := make(chan *FileBlock, len(bps.blockStates))
 
 	worker := func() {
 		defer wg.Done()
-		for blockState := range blocks {
-			fbo.doOneBlockPut(ctx, md, blockState, errChan, blocksToRemoveChan)
+		for batch := range batchChan {
+			fbo.doBlockPutBatch(ctx, md, batch, errChan,
+				blocksToRemoveChan, &dirtyBytesPut)
+			atomic.AddInt64(&numPut, int64(len(batch)))
+			fbo.status.addPendingUploads(-len(batch))
 			select {
 			// return early if the context has been canceled
 			case <-ctx.Done():
@@ -1525,18 +1874,24 @@ func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
 		go worker()
 	}
 
-	for _, blockState := range bps.blockStates {
-		blocks <- blockState
+	for _, batch := range batches {
+		batchChan <- batch
 	}
-	close(blocks)
+	close(batchChan)
 
+	doneCh := make(chan struct{})
 	go func() {
 		wg.Wait()
 		close(errChan)
 		close(blocksToRemoveChan)
+		close(doneCh)
 	}()
-	err := <-errChan
-	var blocksToRemove []BlockPointer
+	err = <-errChan
+	if err != nil {
+		// Cancel the remaining puts, but wait for the outstanding
+		// ones so that dirtyBytesPut is final.
+		cancel()
+	}
 	if isRecoverableBlockError(err) {
 		bcache := fbo.config.BlockCache()
 		// Wait for all the outstanding puts to finish, to amortize
@@ -1559,7 +1914,8 @@ func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
 			}
 		}
 	}
-	return blocksToRemove, err
+	<-doneCh
+	return blocksToRemove, atomic.LoadUint64(&dirtyBytesPut), err
 }
 
 func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
@@ -1662,7 +2018,7 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 			// we'll always retry if we notice we haven't been successful in clearing
 			// the bit yet. Note that I haven't actually seen this happen but it seems
 			// theoretically possible.
-			defer fbo.config.RekeyQueue().Enqueue(md.ID)
+			defer fbo.config.RekeyQueue().Enqueue(md.ID, RekeyPriorityAccessed)
 		}
 	}
 
@@ -1712,7 +2068,7 @@ func (fbo *folderBranchOps) finalizeMDRekeyWriteLocked(ctx context.Context,
 		// the case. we'll queue another rekey just in case. it should
 		// be safe as it's idempotent. we don't want any rekeys present
 		// in unmerged history or that will just make a mess.
-		fbo.config.RekeyQueue().Enqueue(md.ID)
+		fbo.config.RekeyQueue().Enqueue(md.ID, RekeyPriorityAccessed)
 		return err
 	}
 
@@ -1852,11 +2208,18 @@ func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
 func (fbo *folderBranchOps) createEntryLocked(
 	ctx context.Context, lState *lockState, dir Node, name string,
 	entryType EntryType) (Node, DirEntry, error) {
-	fbo.mdWriterLock.AssertLocked(lState)
-
 	if err := checkDisallowedPrefixes(name); err != nil {
 		return nil, DirEntry{}, err
 	}
+	return fbo.createEntryAnyNameLocked(ctx, lState, dir, name, entryType)
+}
+
+// createEntryAnyNameLocked is like createEntryLocked, but allows
+// reserved names, for KBFS's own use.
+func (fbo *folderBranchOps) createEntryAnyNameLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
 	if uint32(len(name)) > fbo.config.MaxNameBytes() {
 		return nil, DirEntry{},
@@ -1936,7 +2299,7 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 		}
 
 		err := fn(lState)
-		if isRetriableError(err, i) {
+		if fbo.isRetriableError(err, i) {
 			fbo.log.CDebugf(ctx, "Trying again after retriable error: %v", err)
 			// Release the lock to give someone else a chance
 			doUnlock = false
@@ -2124,9 +2487,7 @@ func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
 	childPath := dir.ChildPath(name, de.BlockPointer)
 
 	// If this is an indirect block, we need to delete all of its
-	// children as well. NOTE: non-empty directories can't be
-	// removed, so no need to check for indirect directory blocks
-	// here.
+	// children as well.
 	if de.Type == File || de.Type == Exec {
 		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
 			ctx, lState, md, childPath)
@@ -2137,6 +2498,12 @@ func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
 			md.AddUnrefBlock(blockInfo)
 		}
 	}
+
+	// Directories are normally empty by the time they're removed,
+	// except when a whole day is purged from the trash.
+	if de.Type == Dir {
+		return fbo.unrefDirChildren(ctx, lState, md, childPath)
+	}
 	return nil
 }
 
@@ -2250,10 +2617,320 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 				return err
 			}
 
+			if fbo.config.TrashRetention() > 0 && !isTrashPath(dirPath) {
+				trashed, err := fbo.moveToTrashLocked(
+					ctx, lState, md, dir, dirPath, name)
+				if err != nil || trashed {
+					return err
+				}
+			}
+
 			return fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
 		})
 }
 
+// getOrCreateDirLocked returns the node for the subdirectory of
+// parent with the given name, creating it first if it doesn't exist
+// and create is true.
+func (fbo *folderBranchOps) getOrCreateDirLocked(ctx context.Context,
+	lState *lockState, parent Node, name string, create bool) (Node, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	parentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	dblock, err := fbo.blocks.GetDir(ctx, lState, md, parentPath, blockRead)
+	if err != nil {
+		return nil, err
+	}
+
+	if de, ok := dblock.Children[name]; ok {
+		if de.Type != Dir {
+			return nil, NotDirError{parentPath.ChildPath(name, de.BlockPointer)}
+		}
+		return fbo.nodeCache.GetOrCreate(de.BlockPointer, name, parent)
+	} else if !create {
+		return nil, NoSuchNameError{name}
+	}
+
+	node, _, err := fbo.createEntryAnyNameLocked(ctx, lState, parent, name, Dir)
+	return node, err
+}
+
+// moveToTrashLocked moves the given entry into today's directory in
+// the folder's trash, instead of removing it, and returns true.  It
+// returns false if the entry should be removed right away instead,
+// which is the case for directories: they can only be removed once
+// they are empty, so there's nothing to save.
+func (fbo *folderBranchOps) moveToTrashLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir Node, dirPath path,
+	name string) (bool, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockRead)
+	if err != nil {
+		return false, err
+	}
+	de, ok := pblock.Children[name]
+	if !ok {
+		return false, NoSuchNameError{name}
+	}
+	if de.Type == Dir {
+		return false, nil
+	}
+
+	// The entry's path, relative to the root of the folder.
+	var components []string
+	for _, pn := range dirPath.path[1:] {
+		components = append(components, pn.Name)
+	}
+	origPath := strings.Join(append(components, name), "/")
+
+	rootNode, err := fbo.nodeCache.GetOrCreate(
+		dirPath.path[0].BlockPointer, dirPath.path[0].Name, nil)
+	if err != nil {
+		return false, err
+	}
+	trashNode, err := fbo.getOrCreateDirLocked(
+		ctx, lState, rootNode, TrashDirName, true)
+	if err != nil {
+		return false, err
+	}
+	date := fbo.config.Clock().Now().UTC().Format(TrashDateFormat)
+	dateNode, err := fbo.getOrCreateDirLocked(
+		ctx, lState, trashNode, date, true)
+	if err != nil {
+		return false, err
+	}
+
+	// Creating the trash directories changed the paths, and the
+	// head.
+	md, err = fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return false, err
+	}
+	datePath, err := fbo.pathFromNodeForMDWriteLocked(lState, dateNode)
+	if err != nil {
+		return false, err
+	}
+	dirPath, err = fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return false, err
+	}
+	dateBlock, err := fbo.blocks.GetDir(ctx, lState, md, datePath, blockRead)
+	if err != nil {
+		return false, err
+	}
+
+	// If the whole path doesn't fit in one name, fall back to the
+	// base name, which gets restored to the root of the folder.
+	if uint32(len(trashEntryName(origPath, 0))) > fbo.config.MaxNameBytes() {
+		origPath = name
+	}
+	var trashName string
+	for i := 0; ; i++ {
+		trashName = trashEntryName(origPath, i)
+		if _, ok := dateBlock.Children[trashName]; !ok {
+			break
+		}
+	}
+
+	fbo.log.CDebugf(ctx, "Moving %s to the trash as %s/%s",
+		origPath, date, trashName)
+	return true, fbo.renameLocked(
+		ctx, lState, dirPath, name, datePath, trashName)
+}
+
+// unrefDirChildren modifies md to unreference all the blocks under
+// the given directory, recursively.  md must already contain the op
+// removing the directory.
+func (fbo *folderBranchOps) unrefDirChildren(ctx context.Context,
+	lState *lockState, md *RootMetadata, dirPath path) error {
+	dblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockRead)
+	if err != nil {
+		return err
+	}
+	for name, de := range dblock.Children {
+		// unrefEntry recurses into subdirectories itself.
+		err := fbo.unrefEntry(ctx, lState, md, dirPath, de, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeTrashBefore removes, and unreferences the contents of, every
+// day in the trash that ended before cutoff.  Each day is removed in
+// its own revision.
+func (fbo *folderBranchOps) purgeTrashBefore(ctx context.Context,
+	cutoff time.Time) error {
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			for {
+				md, err := fbo.getMDForWriteLocked(ctx, lState)
+				if err != nil {
+					return err
+				}
+
+				rootNode, err := fbo.nodeCache.GetOrCreate(
+					md.data.Dir.BlockPointer,
+					string(md.GetTlfHandle().GetCanonicalName()), nil)
+				if err != nil {
+					return err
+				}
+				trashNode, err := fbo.getOrCreateDirLocked(
+					ctx, lState, rootNode, TrashDirName, false)
+				if _, ok := err.(NoSuchNameError); ok {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				trashPath, err := fbo.pathFromNodeForMDWriteLocked(
+					lState, trashNode)
+				if err != nil {
+					return err
+				}
+				tblock, err := fbo.blocks.GetDir(
+					ctx, lState, md, trashPath, blockRead)
+				if err != nil {
+					return err
+				}
+
+				var expiredDate string
+				for date, de := range tblock.Children {
+					start, err := parseTrashDate(date)
+					if err != nil || de.Type != Dir {
+						// Not one of ours; leave it alone.
+						continue
+					}
+					if !start.Add(24 * time.Hour).After(cutoff) {
+						expiredDate = date
+						break
+					}
+				}
+				if expiredDate == "" {
+					return nil
+				}
+
+				fbo.log.CDebugf(ctx, "Purging %s from the trash",
+					expiredDate)
+				err = fbo.removeEntryLocked(
+					ctx, lState, md, trashPath, expiredDate)
+				if err != nil {
+					return err
+				}
+			}
+		})
+}
+
+func (fbo *folderBranchOps) MergeConflictedTLF(ctx context.Context,
+	conflicted *TlfHandle) (TLFMergeResult, error) {
+	return TLFMergeResult{}, errors.New(
+		"MergeConflictedTLF is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) CloneTLF(ctx context.Context, src, dst *TlfHandle,
+	onProgress func(TLFCloneProgress)) (TLFCloneProgress, error) {
+	return TLFCloneProgress{}, errors.New(
+		"CloneTLF is not supported by folderBranchOps")
+}
+
+// RestoreFromTrash implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) RestoreFromTrash(ctx context.Context,
+	folderBranch FolderBranch, date, name string) (
+	origPath string, err error) {
+	fbo.log.CDebugf(ctx, "RestoreFromTrash %s/%s", date, name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return "", WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if _, err := parseTrashDate(date); err != nil {
+		return "", InvalidTrashEntryError{date, name}
+	}
+	origPath, err = origPathFromTrashEntryName(date, name)
+	if err != nil {
+		return "", err
+	}
+	components := strings.Split(origPath, "/")
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+
+			rootNode, err := fbo.nodeCache.GetOrCreate(
+				md.data.Dir.BlockPointer,
+				string(md.GetTlfHandle().GetCanonicalName()), nil)
+			if err != nil {
+				return err
+			}
+			trashNode, err := fbo.getOrCreateDirLocked(
+				ctx, lState, rootNode, TrashDirName, false)
+			if err != nil {
+				return err
+			}
+			dateNode, err := fbo.getOrCreateDirLocked(
+				ctx, lState, trashNode, date, false)
+			if err != nil {
+				return err
+			}
+
+			// Recreate any parent directories that have been
+			// removed since.
+			parentNode := rootNode
+			for _, component := range components[:len(components)-1] {
+				parentNode, err = fbo.getOrCreateDirLocked(
+					ctx, lState, parentNode, component, true)
+				if err != nil {
+					return err
+				}
+			}
+
+			md, err = fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			datePath, err := fbo.pathFromNodeForMDWriteLocked(
+				lState, dateNode)
+			if err != nil {
+				return err
+			}
+			parentPath, err := fbo.pathFromNodeForMDWriteLocked(
+				lState, parentNode)
+			if err != nil {
+				return err
+			}
+			pblock, err := fbo.blocks.GetDir(
+				ctx, lState, md, parentPath, blockRead)
+			if err != nil {
+				return err
+			}
+			base := components[len(components)-1]
+			if _, ok := pblock.Children[base]; ok {
+				return NameExistsError{base}
+			}
+
+			return fbo.renameLocked(
+				ctx, lState, datePath, name, parentPath, base)
+		})
+	if err != nil {
+		return "", err
+	}
+	return origPath, nil
+}
+
 func (fbo *folderBranchOps) renameLocked(
 	ctx context.Context, lState *lockState, oldParent path,
 	oldName string, newParent path, newName string) (err error) {
@@ -2338,7 +3015,6 @@ func (fbo *folderBranchOps) renameLocked(
 		}
 
 		// The old one is not the common ancestor, so we need to sync it.
-		// TODO: optimize by pushing blocks from both paths in parallel
 		newOldPath, _, oldBps, err = fbo.syncBlockAndCheckEmbedLocked(
 			ctx, lState, md, oldPBlock, *oldParent.parentPath(), oldParent.tailName(),
 			Dir, true, true, commonAncestor, lbc)
@@ -2347,10 +3023,36 @@ func (fbo *folderBranchOps) renameLocked(
 		}
 	}
 
+	// Start putting the old path's blocks right away, so that they
+	// go out while the new path is being readied (which might
+	// involve fetching blocks), and in parallel with the new path's
+	// blocks.
+	putCtx, cancelPuts := context.WithCancel(ctx)
+	defer cancelPuts()
+	var oldPutErrCh chan error
+	if oldBps != nil && !fbo.batchRenamePutsForTesting {
+		oldPutErrCh = make(chan error, 1)
+		go func() {
+			_, err := fbo.doBlockPuts(putCtx, md, *oldBps)
+			oldPutErrCh <- err
+		}()
+	}
+	waitForOldPuts := func() error {
+		if oldPutErrCh == nil {
+			return nil
+		}
+		return <-oldPutErrCh
+	}
+
 	newNewPath, _, newBps, err := fbo.syncBlockAndCheckEmbedLocked(
 		ctx, lState, md, newPBlock, *newParent.parentPath(), newParent.tailName(),
 		Dir, true, true, zeroPtr, lbc)
 	if err != nil {
+		cancelPuts()
+		_ = waitForOldPuts()
+		if oldBps != nil {
+			fbo.fbm.cleanUpBlockState(md, oldBps)
+		}
 		return err
 	}
 
@@ -2359,6 +3061,20 @@ func (fbo *folderBranchOps) renameLocked(
 	newOldPath.path = append(make([]pathNode, i+1, i+1), newOldPath.path...)
 	copy(newOldPath.path[:i+1], newNewPath.path[:i+1])
 
+	if oldBps != nil && fbo.batchRenamePutsForTesting {
+		newBps.mergeOtherBps(oldBps)
+		oldBps = nil
+	}
+	_, err = fbo.doBlockPuts(putCtx, md, *newBps)
+	if err != nil {
+		// One error cancels the rest of the puts, just like within
+		// a single doBlockPuts call.
+		cancelPuts()
+	}
+	if oldErr := waitForOldPuts(); err == nil {
+		err = oldErr
+	}
+
 	// merge and finalize the blockPutStates
 	if oldBps != nil {
 		newBps.mergeOtherBps(oldBps)
@@ -2370,7 +3086,6 @@ func (fbo *folderBranchOps) renameLocked(
 		}
 	}()
 
-	_, err = fbo.doBlockPuts(ctx, md, *newBps)
 	if err != nil {
 		return err
 	}
@@ -2443,7 +3158,23 @@ func (fbo *folderBranchOps) Read(
 		}
 
 		bytesRead, err = fbo.blocks.Read(ctx, lState, md, filePath, dest, off)
-		return err
+		if err != nil {
+			return err
+		}
+
+		if fbo.config.ReadAheadBlocks() > 0 {
+			iptrs, err := fbo.blocks.GetIndirectFilePtrsForPrefetch(
+				ctx, lState, md, filePath)
+			if err != nil {
+				// The read itself succeeded; just don't read ahead.
+				fbo.log.CDebugf(ctx, "Not prefetching after read of %s: %v",
+					filePath, err)
+				return nil
+			}
+			fbo.prefetcher.onFileRead(file.GetID(), md, filePath.Branch,
+				iptrs, off, bytesRead)
+		}
+		return nil
 	})
 	if err != nil {
 		return 0, err
@@ -2472,12 +3203,18 @@ func (fbo *folderBranchOps) Write(
 			return err
 		}
 
+		// Fail readers now, rather than when the changes get
+		// synced.
+		if err := fbo.checkWriteAccess(ctx, md); err != nil {
+			return err
+		}
+
 		err = fbo.blocks.Write(ctx, lState, md, file, data, off)
 		if err != nil {
 			return err
 		}
 
-		fbo.status.addDirtyNode(file)
+		fbo.status.addDirtyNode(file, uint64(len(data)))
 		return nil
 	})
 }
@@ -2503,12 +3240,18 @@ func (fbo *folderBranchOps) Truncate(
 			return err
 		}
 
+		// Fail readers now, rather than when the changes get
+		// synced.
+		if err := fbo.checkWriteAccess(ctx, md); err != nil {
+			return err
+		}
+
 		err = fbo.blocks.Truncate(ctx, lState, md, file, size)
 		if err != nil {
 			return err
 		}
 
-		fbo.status.addDirtyNode(file)
+		fbo.status.addDirtyNode(file, 0)
 		return nil
 	})
 }
@@ -2634,6 +3377,184 @@ func (fbo *folderBranchOps) SetMtime(
 		})
 }
 
+// GetXattrs implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetXattrs(ctx context.Context, node Node) (
+	xattrs map[string][]byte, err error) {
+	fbo.log.CDebugf(ctx, "GetXattrs %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy everything, so the caller can't modify the cached entry.
+	xattrs = make(map[string][]byte, len(de.Xattrs))
+	for name, value := range de.Xattrs {
+		xattrs[name] = append([]byte(nil), value...)
+	}
+	return xattrs, nil
+}
+
+func (fbo *folderBranchOps) setXattrLocked(
+	ctx context.Context, lState *lockState, file path, name string,
+	value []byte, remove bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md, file)
+	if err != nil {
+		return err
+	}
+
+	// The map may be shared with cached copies of the entry, so
+	// modify a copy.
+	xattrs := make(map[string][]byte, len(de.Xattrs)+1)
+	for n, v := range de.Xattrs {
+		xattrs[n] = v
+	}
+	if remove {
+		if _, ok := xattrs[name]; !ok {
+			return NoSuchXattrError{name}
+		}
+		delete(xattrs, name)
+		if len(xattrs) == 0 {
+			xattrs = nil
+		}
+	} else {
+		xattrs[name] = append([]byte{}, value...)
+	}
+	de.Xattrs = xattrs
+
+	parentPath := file.parentPath()
+	sao := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		xattrAttr, file.tailPointer())
+	sao.XattrName = name
+	md.AddOp(sao)
+
+	// Changing an xattr counts as changing the file MD, so set the
+	// ctime (to match ext4 behavior).
+	de.Ctime = fbo.nowUnixNano()
+	dblock.Children[file.tailName()] = de
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr)
+	return err
+}
+
+func (fbo *folderBranchOps) doXattrWrite(
+	ctx context.Context, node Node, name string, value []byte,
+	remove bool) error {
+	err := fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+	if len(value) > maxXattrValueBytes {
+		return XattrTooBigError{name, len(value), maxXattrValueBytes}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setXattrLocked(
+				ctx, lState, nodePath, name, value, remove)
+		})
+}
+
+// SetXattr implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %p %s (%d bytes)", node.GetID(), name,
+		len(value))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.doXattrWrite(ctx, node, name, value, false)
+}
+
+// RemoveXattr implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.doXattrWrite(ctx, node, name, nil, true)
+}
+
+// fileLockName returns the current path of the given file within
+// the TLF, to name it in FileLockedErrors.
+func (fbo *folderBranchOps) fileLockName(
+	ctx context.Context, file Node) (string, error) {
+	err := fbo.checkNode(file)
+	if err != nil {
+		return "", err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return "", err
+	}
+	if !filePath.hasValidParent() {
+		return "", InvalidParentPathError{filePath}
+	}
+
+	// Make sure the user can read the folder.
+	lState := makeFBOLockState()
+	_, err = fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(filePath.path)-1)
+	for _, pn := range filePath.path[1:] {
+		names = append(names, pn.Name)
+	}
+	return strings.Join(names, "/"), nil
+}
+
+// LockFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) LockFile(
+	ctx context.Context, file Node, owner uint64) (err error) {
+	fbo.log.CDebugf(ctx, "LockFile %p %d", file.GetID(), owner)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	name, err := fbo.fileLockName(ctx, file)
+	if err != nil {
+		return err
+	}
+	return fbo.fileLocks.lockFile(ctx, file, name, owner)
+}
+
+// UnlockFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) UnlockFile(
+	ctx context.Context, file Node, owner uint64) (err error) {
+	fbo.log.CDebugf(ctx, "UnlockFile %p %d", file.GetID(), owner)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+	return fbo.fileLocks.unlockFile(ctx, file, owner)
+}
+
 func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	lState *lockState, file path) (stillDirty bool, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -2676,8 +3597,15 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
 	defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
 
-	// Filled in by doBlockPuts below.
+	// Filled in by doBlockPutsCountingDirty below.
 	var blocksToRemove []BlockPointer
+	var dirtyBytesPut uint64
+	// Release the dirty bytes that were put only after
+	// CleanupSyncState (deferred below), once the corresponding dirty
+	// blocks are gone from the cache.
+	defer func() {
+		fbo.config.DirtyBudget().SyncFinished(dirtyBytesPut)
+	}()
 	fblock, bps, lbc, syncState, err :=
 		fbo.blocks.StartSync(ctx, lState, md, uid, file)
 	defer func() {
@@ -2704,7 +3632,8 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 		}
 	}()
 
-	blocksToRemove, err = fbo.doBlockPuts(ctx, md, *bps)
+	blocksToRemove, dirtyBytesPut, err = fbo.doBlockPutsCountingDirty(
+		ctx, md, *bps)
 	if err != nil {
 		return true, err
 	}
@@ -3038,7 +3967,7 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 		}
 	}
 
-	fbo.observers.batchChanges(ctx, changes)
+	fbo.observers.batchChanges(ctxWithNotifyOpInfo(ctx, op, md), changes)
 }
 
 func (fbo *folderBranchOps) getCurrMDRevisionLocked(lState *lockState) MetadataRevision {
@@ -3208,40 +4137,29 @@ func (fbo *folderBranchOps) applyMDUpdates(ctx context.Context,
 // is done by applyFunc.
 func (fbo *folderBranchOps) getAndApplyMDUpdates(ctx context.Context,
 	lState *lockState, applyFunc applyMDUpdatesFunc) error {
-	// first look up all MD revisions newer than my current head
+	// first look up all MD revisions newer than my current head, and
+	// apply them a window at a time.
 	start := fbo.getCurrMDRevision(lState) + 1
-	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(), start)
-	if err != nil {
-		return err
-	}
-
-	err = applyFunc(ctx, lState, rmds)
-	if err != nil {
-		return err
-	}
-	return nil
+	return forEachMergedMDWindow(ctx, fbo.config, fbo.id(), start,
+		func(rmds []*RootMetadata) error {
+			return applyFunc(ctx, lState, rmds)
+		})
 }
 
-func (fbo *folderBranchOps) getUnmergedMDUpdates(
-	ctx context.Context, lState *lockState) (
-	MetadataRevision, []*RootMetadata, error) {
+// forEachUnmergedMDWindow passes all of this device's unmerged MD
+// updates to fn, in increasing revision order and in bounded windows,
+// and returns the revision of the branch point.
+func (fbo *folderBranchOps) forEachUnmergedMDWindow(
+	ctx context.Context, lState *lockState, fn mdWindowFunc) (
+	MetadataRevision, error) {
 	// acquire mdWriterLock to read the current branch ID.
 	bid := func() BranchID {
 		fbo.mdWriterLock.Lock(lState)
 		defer fbo.mdWriterLock.Unlock(lState)
 		return fbo.bid
 	}()
-	return getUnmergedMDUpdates(ctx, fbo.config, fbo.id(),
-		bid, fbo.getCurrMDRevision(lState))
-}
-
-func (fbo *folderBranchOps) getUnmergedMDUpdatesLocked(
-	ctx context.Context, lState *lockState) (
-	MetadataRevision, []*RootMetadata, error) {
-	fbo.mdWriterLock.AssertLocked(lState)
-
-	return getUnmergedMDUpdates(ctx, fbo.config, fbo.id(),
-		fbo.bid, fbo.getCurrMDRevision(lState))
+	return forEachUnmergedMDWindow(ctx, fbo.config, fbo.id(),
+		bid, fbo.getCurrMDRevision(lState), fn)
 }
 
 // Returns a list of block pointers that were created during the
@@ -3250,12 +4168,33 @@ func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
 	ctx context.Context, lState *lockState) ([]BlockPointer, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	currHead, unmergedRmds, err := fbo.getUnmergedMDUpdatesLocked(ctx, lState)
-	if err != nil {
-		return nil, err
-	}
+	// Undo the unmerged updates one window at a time, newest first,
+	// keeping only the new refs from each window.
+	var unmergedPtrs []BlockPointer
+	currHead, err := forEachUnmergedMDWindowBackwards(ctx, fbo.config,
+		fbo.id(), fbo.bid, fbo.getCurrMDRevision(lState),
+		func(rmds []*RootMetadata) error {
+			err := fbo.undoMDUpdatesLocked(ctx, lState, rmds)
+			if err != nil {
+				return err
+			}
 
-	err = fbo.undoMDUpdatesLocked(ctx, lState, unmergedRmds)
+			for _, rmd := range rmds {
+				for _, op := range rmd.data.Changes.Ops {
+					for _, ptr := range op.Refs() {
+						if ptr != zeroPtr {
+							unmergedPtrs = append(unmergedPtrs, ptr)
+						}
+					}
+					for _, update := range op.AllUpdates() {
+						if update.Ref != zeroPtr {
+							unmergedPtrs = append(unmergedPtrs, update.Ref)
+						}
+					}
+				}
+			}
+			return nil
+		})
 	if err != nil {
 		return nil, err
 	}
@@ -3285,23 +4224,6 @@ func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
 		return nil, err
 	}
 
-	// Return all new refs
-	var unmergedPtrs []BlockPointer
-	for _, rmd := range unmergedRmds {
-		for _, op := range rmd.data.Changes.Ops {
-			for _, ptr := range op.Refs() {
-				if ptr != zeroPtr {
-					unmergedPtrs = append(unmergedPtrs, ptr)
-				}
-			}
-			for _, update := range op.AllUpdates() {
-				if update.Ref != zeroPtr {
-					unmergedPtrs = append(unmergedPtrs, update.Ref)
-				}
-			}
-		}
-	}
-
 	return unmergedPtrs, nil
 }
 
@@ -3743,7 +4665,7 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 			}
 			// Getting and applying the updates requires holding
 			// locks, so make sure it doesn't take too long.
-			ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+			ctx, cancel := context.WithTimeout(ctx, fbo.config.BackgroundTaskTimeout())
 			defer cancel()
 			err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdates)
 			if err != nil {
@@ -3786,7 +4708,7 @@ func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 			// Just in case network access or a bug gets stuck for a
 			// long time, time out the sync eventually.
 			longCtx, longCancel :=
-				context.WithTimeout(ctx, backgroundTaskTimeout)
+				context.WithTimeout(ctx, fbo.config.BackgroundTaskTimeout())
 			defer longCancel()
 
 			// Make sure this loop doesn't starve user requests for
@@ -3865,7 +4787,7 @@ func (fbo *folderBranchOps) finalizeResolution(ctx context.Context,
 
 	// Queue a rekey if the bit was set.
 	if md.IsRekeySet() {
-		defer fbo.config.RekeyQueue().Enqueue(md.ID)
+		defer fbo.config.RekeyQueue().Enqueue(md.ID, RekeyPriorityAccessed)
 	}
 
 	// Set the head to the new MD.
@@ -3977,6 +4899,86 @@ func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
 	return history, nil
 }
 
+// GetTLFUsage implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetTLFUsage(ctx context.Context,
+	folderBranch FolderBranch) (usage TLFUsage, err error) {
+	fbo.log.CDebugf(ctx, "GetTLFUsage")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return TLFUsage{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+
+	// Blocks unreferenced after the last revision covered by a gc
+	// op haven't been reclaimed yet.  Remember how much each
+	// revision unreferenced until a gc op covers it.
+	type revUnref struct {
+		rev   MetadataRevision
+		bytes uint64
+	}
+	var uncollected []revUnref
+	var head *RootMetadata
+	usage.Writers = make(map[string]WriterUsage)
+	writerNames := make(map[keybase1.UID]string)
+	err = forEachMergedMDWindow(ctx, fbo.config, fbo.id(),
+		MetadataRevisionInitial, func(rmds []*RootMetadata) error {
+			// Needed to find the gc ops.
+			err := fbo.reembedBlockChanges(ctx, lState, rmds)
+			if err != nil {
+				return err
+			}
+			for _, rmd := range rmds {
+				for _, op := range rmd.data.Changes.Ops {
+					gco, ok := op.(*gcOp)
+					if !ok {
+						continue
+					}
+					i := 0
+					for i < len(uncollected) &&
+						uncollected[i].rev <= gco.LatestRev {
+						i++
+					}
+					uncollected = uncollected[i:]
+				}
+				uncollected = append(uncollected,
+					revUnref{rmd.Revision, rmd.UnrefBytes})
+
+				writer, ok := writerNames[rmd.LastModifyingWriter]
+				if !ok {
+					name, err := fbo.config.KBPKI().
+						GetNormalizedUsername(ctx, rmd.LastModifyingWriter)
+					if err != nil {
+						return err
+					}
+					writer = string(name)
+					writerNames[rmd.LastModifyingWriter] = writer
+				}
+				wu := usage.Writers[writer]
+				wu.RefBytes += rmd.RefBytes
+				wu.UnrefBytes += rmd.UnrefBytes
+				usage.Writers[writer] = wu
+			}
+			head = rmds[len(rmds)-1]
+			return nil
+		})
+	if err != nil {
+		return TLFUsage{}, err
+	}
+	if head == nil {
+		return usage, nil
+	}
+
+	usage.ID = head.ID.String()
+	usage.Name = head.GetTlfHandle().GetCanonicalPath()
+	usage.LiveBytes = head.DiskUsage
+	for _, ru := range uncollected {
+		usage.ArchivedBytes += ru.bytes
+	}
+	return usage, nil
+}
+
 // PushConnectionStatusChange pushes human readable connection status changes.
 func (fbo *folderBranchOps) PushConnectionStatusChange(service string, newStatus error) {
 	fbo.config.KBFSOps().PushConnectionStatusChange(service, newStatus)
@@ -5,7 +5,9 @@
 package libkbfs
 
 import (
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 
@@ -32,15 +34,39 @@ type FolderBranchStatus struct {
 	Merged   []*crChainSummary
 }
 
+// FolderStatusSummary is a summary of the status of a folder-branch
+// that KBFS currently has loaded, for the top-level status.  It is
+// suitable for encoding directly as JSON.
+type FolderStatusSummary struct {
+	Folder   string
+	FolderID string
+	Staged   bool
+	// DirtyBytes estimates the bytes written to the folder's files
+	// since they were last synced.
+	DirtyBytes uint64
+	// PendingUploads is the number of blocks that are being put to
+	// the block server.
+	PendingUploads int
+	CRInProgress   bool
+	RekeyPending   bool
+	// LastSync is when the folder's head last changed, either due
+	// to a local write or an update from the server.
+	LastSync time.Time `json:",omitempty"`
+}
+
 // KBFSStatus represents the content of the top-level status file. It is
 // suitable for encoding directly as JSON.
-// TODO: implement magical status update like FolderBranchStatus
 type KBFSStatus struct {
 	CurrentUser     string
 	IsConnected     bool
 	UsageBytes      int64
 	LimitBytes      int64
 	FailingServices map[string]error
+	DirtyBudget     DirtyBudgetStatus
+	RekeyQueue      RekeyQueueStatus
+	// Folders summarizes each loaded folder-branch that has
+	// metadata yet, sorted by folder.
+	Folders []FolderStatusSummary
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -55,12 +81,19 @@ type folderBranchStatusKeeper struct {
 
 	md         *RootMetadata
 	dirtyNodes map[NodeID]Node
-	unmerged   *crChains
-	merged     *crChains
-	dataMutex  sync.Mutex
+	// dirtyBytes counts the bytes written to each dirty node.
+	dirtyBytes     map[NodeID]uint64
+	pendingUploads int
+	lastSync       time.Time
+	unmerged       *crChains
+	merged         *crChains
+	dataMutex      sync.Mutex
 
 	updateChan  chan StatusUpdate
 	updateMutex sync.Mutex
+	// onChange, if set, is called on every change, so that the
+	// top-level status can signal its own change.
+	onChange func()
 }
 
 func newFolderBranchStatusKeeper(
@@ -69,16 +102,27 @@ func newFolderBranchStatusKeeper(
 		config:     config,
 		nodeCache:  nodeCache,
 		dirtyNodes: make(map[NodeID]Node),
+		dirtyBytes: make(map[NodeID]uint64),
 		updateChan: make(chan StatusUpdate, 1),
 	}
 }
 
+// setOnChange sets the function to call on every change.
+func (fbsk *folderBranchStatusKeeper) setOnChange(onChange func()) {
+	fbsk.updateMutex.Lock()
+	defer fbsk.updateMutex.Unlock()
+	fbsk.onChange = onChange
+}
+
 // dataMutex should be taken by the caller
 func (fbsk *folderBranchStatusKeeper) signalChangeLocked() {
 	fbsk.updateMutex.Lock()
 	defer fbsk.updateMutex.Unlock()
 	close(fbsk.updateChan)
 	fbsk.updateChan = make(chan StatusUpdate, 1)
+	if fbsk.onChange != nil {
+		fbsk.onChange()
+	}
 }
 
 // setRootMetadata sets the current head metadata for the
@@ -90,6 +134,7 @@ func (fbsk *folderBranchStatusKeeper) setRootMetadata(md *RootMetadata) {
 		return
 	}
 	fbsk.md = md
+	fbsk.lastSync = fbsk.config.Clock().Now()
 	fbsk.signalChangeLocked()
 }
 
@@ -105,36 +150,44 @@ func (fbsk *folderBranchStatusKeeper) setCRChains(unmerged *crChains,
 	fbsk.signalChangeLocked()
 }
 
-func (fbsk *folderBranchStatusKeeper) addNode(m map[NodeID]Node, n Node) {
+// addDirtyNode marks n as dirty, with the given number of bytes
+// newly written to it.
+func (fbsk *folderBranchStatusKeeper) addDirtyNode(n Node, bytes uint64) {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
 	id := n.GetID()
-	_, ok := m[id]
-	if ok {
+	_, ok := fbsk.dirtyNodes[id]
+	if ok && bytes == 0 {
 		return
 	}
-	m[id] = n
+	fbsk.dirtyNodes[id] = n
+	fbsk.dirtyBytes[id] += bytes
 	fbsk.signalChangeLocked()
 }
 
-func (fbsk *folderBranchStatusKeeper) rmNode(m map[NodeID]Node, n Node) {
+func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
 	id := n.GetID()
-	_, ok := m[id]
+	_, ok := fbsk.dirtyNodes[id]
 	if !ok {
 		return
 	}
-	delete(m, id)
+	delete(fbsk.dirtyNodes, id)
+	delete(fbsk.dirtyBytes, id)
 	fbsk.signalChangeLocked()
 }
 
-func (fbsk *folderBranchStatusKeeper) addDirtyNode(n Node) {
-	fbsk.addNode(fbsk.dirtyNodes, n)
-}
-
-func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) {
-	fbsk.rmNode(fbsk.dirtyNodes, n)
+// addPendingUploads adds delta (which may be negative) to the number
+// of blocks being put to the block server.
+func (fbsk *folderBranchStatusKeeper) addPendingUploads(delta int) {
+	if delta == 0 {
+		return
+	}
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	fbsk.pendingUploads += delta
+	fbsk.signalChangeLocked()
 }
 
 // dataMutex should be taken by the caller
@@ -184,3 +237,46 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context) (
 
 	return fbs, fbsk.updateChan, nil
 }
+
+// getSummary returns a summary of the current status, for the
+// top-level status.  Unlike getStatus, it doesn't need to contact any
+// servers.  ok is false if the folder-branch has no metadata yet, so
+// there's no folder to summarize.
+func (fbsk *folderBranchStatusKeeper) getSummary() (
+	summary FolderStatusSummary, ok bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+
+	if fbsk.md == nil {
+		return FolderStatusSummary{}, false
+	}
+	summary = FolderStatusSummary{
+		PendingUploads: fbsk.pendingUploads,
+		CRInProgress:   fbsk.unmerged != nil,
+		LastSync:       fbsk.lastSync,
+	}
+	for _, bytes := range fbsk.dirtyBytes {
+		summary.DirtyBytes += bytes
+	}
+	summary.Folder = fbsk.md.GetTlfHandle().GetCanonicalPath()
+	summary.FolderID = fbsk.md.ID.String()
+	summary.Staged = (fbsk.md.WFlags & MetadataFlagUnmerged) != 0
+	summary.RekeyPending = fbsk.config.RekeyQueue().IsRekeyPending(fbsk.md.ID)
+	return summary, true
+}
+
+type folderStatusSummariesByFolder []FolderStatusSummary
+
+func (s folderStatusSummariesByFolder) Len() int      { return len(s) }
+func (s folderStatusSummariesByFolder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s folderStatusSummariesByFolder) Less(i, j int) bool {
+	if s[i].Folder != s[j].Folder {
+		return s[i].Folder < s[j].Folder
+	}
+	return s[i].FolderID < s[j].FolderID
+}
+
+// sortFolderStatusSummaries sorts the given summaries by folder.
+func sortFolderStatusSummaries(summaries []FolderStatusSummary) {
+	sort.Sort(folderStatusSummariesByFolder(summaries))
+}
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"golang.org/x/net/context"
@@ -20,6 +21,7 @@ func fbStatusTestInit(t *testing.T) (*gomock.Controller, *ConfigMock,
 	mockCtrl := gomock.NewController(ctr)
 	config := NewConfigMock(mockCtrl, ctr)
 	nodeCache := NewMockNodeCache(mockCtrl)
+	config.mockClock.EXPECT().Now().AnyTimes().Return(time.Now())
 	fbsk := newFolderBranchStatusKeeper(config, nodeCache)
 	interposeDaemonKBPKI(config, "alice", "bob")
 	return mockCtrl, config, fbsk, nodeCache
@@ -51,7 +53,7 @@ func TestFBStatusSignal(t *testing.T) {
 	p1 := path{path: []pathNode{{Name: "a1"}, {Name: "b1"}}}
 	nodeCache.EXPECT().PathFromNode(mockNodeMatcher{n}).AnyTimes().Return(p1)
 
-	fbsk.addDirtyNode(n)
+	fbsk.addDirtyNode(n, 0)
 	<-c
 
 	_, c, err = fbsk.getStatus(ctx)
@@ -60,7 +62,7 @@ func TestFBStatusSignal(t *testing.T) {
 	}
 
 	// no change should result in no signal
-	fbsk.addDirtyNode(n)
+	fbsk.addDirtyNode(n, 0)
 	select {
 	case <-c:
 		t.Fatalf("Status should not have signalled a change")
@@ -116,8 +118,8 @@ func TestFBStatusAllFields(t *testing.T) {
 	nodeCache.EXPECT().PathFromNode(mockNodeMatcher{n2}).AnyTimes().Return(p2)
 
 	fbsk.setRootMetadata(md)
-	fbsk.addDirtyNode(n1)
-	fbsk.addDirtyNode(n2)
+	fbsk.addDirtyNode(n1, 0)
+	fbsk.addDirtyNode(n2, 0)
 
 	config.mockRekeyQueue.EXPECT().IsRekeyPending(id)
 
@@ -136,3 +138,26 @@ func TestFBStatusAllFields(t *testing.T) {
 	expectedDirtyPaths := []string{p1.String(), p2.String()}
 	checkStringSlices(t, expectedDirtyPaths, status.DirtyPaths)
 }
+
+// Test that a folder-branch is only summarized once it has metadata.
+func TestFBStatusSummaryNeedsMD(t *testing.T) {
+	mockCtrl, config, fbsk, _ := fbStatusTestInit(t)
+	defer fbStatusTestShutdown(mockCtrl, config)
+
+	if summary, ok := fbsk.getSummary(); ok {
+		t.Errorf("Got summary %+v without any metadata", summary)
+	}
+
+	id := FakeTlfID(1, false)
+	h := parseTlfHandleOrBust(t, config, "alice", false)
+	fbsk.setRootMetadata(newRootMetadataOrBust(t, id, h))
+	config.mockRekeyQueue.EXPECT().IsRekeyPending(id)
+	summary, ok := fbsk.getSummary()
+	if !ok {
+		t.Fatal("No summary with metadata")
+	}
+	if summary.Folder != "/keybase/private/alice" ||
+		summary.FolderID != id.String() {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+}
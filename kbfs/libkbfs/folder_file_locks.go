@@ -0,0 +1,95 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// heldFileLock is an advisory file lock held by a local owner.
+type heldFileLock struct {
+	// The locked file.  Holding on to it keeps its node, and so
+	// its ID, alive while it's locked, even if it's renamed.
+	node Node
+	// The file's path within the TLF at the time it was locked,
+	// for errors.
+	name  string
+	owner uint64
+}
+
+// folderFileLocks keeps track of the advisory file locks held in a
+// particular TLF.  Locks are whole-file and exclusive, and are kept
+// by node, so they follow renames.
+//
+// Locks are only kept in memory, so they are only respected between
+// the owners using this KBFS instance, e.g. the clients of one
+// WebDAV server.  Other devices, and other KBFS processes on this
+// device, don't see them.  (The MD server has no file lock RPCs, and
+// the FUSE library can't deliver lock requests, so there's nothing
+// to share them through yet.)
+type folderFileLocks struct {
+	// protects everything below
+	lock       sync.Mutex
+	held       map[NodeID]*heldFileLock
+	isShutdown bool
+}
+
+func newFolderFileLocks() *folderFileLocks {
+	return &folderFileLocks{
+		held: make(map[NodeID]*heldFileLock),
+	}
+}
+
+// lockFile takes the advisory lock for the given file, whose current
+// path within the TLF is name, on behalf of the given owner.  Locking
+// a file already locked by the same owner is a no-op.  Returns
+// FileLockedError if any other owner holds the lock.
+func (fl *folderFileLocks) lockFile(
+	ctx context.Context, file Node, name string, owner uint64) error {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	if fl.isShutdown {
+		return errShutdownHappened
+	}
+	id := file.GetID()
+	if h, ok := fl.held[id]; ok {
+		if h.owner != owner {
+			return FileLockedError{h.name}
+		}
+		return nil
+	}
+	fl.held[id] = &heldFileLock{node: file, name: name, owner: owner}
+	return nil
+}
+
+// unlockFile releases the advisory lock for the given file, if it is
+// held by the given owner.
+func (fl *folderFileLocks) unlockFile(
+	ctx context.Context, file Node, owner uint64) error {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	id := file.GetID()
+	if h, ok := fl.held[id]; ok && h.owner == owner {
+		delete(fl.held, id)
+	}
+	return nil
+}
+
+// numHeld returns the number of locks held in the TLF.
+func (fl *folderFileLocks) numHeld() int {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	return len(fl.held)
+}
+
+// shutdown releases all the held locks.
+func (fl *folderFileLocks) shutdown() {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	fl.isShutdown = true
+	fl.held = make(map[NodeID]*heldFileLock)
+}
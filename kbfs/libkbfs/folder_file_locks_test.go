@@ -0,0 +1,145 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+func TestFileLocksLocalOnly(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+
+	if err := kbfsOps1.LockFile(ctx, fileNode1, 1); err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+	// Locking again as the same owner is fine, but another local
+	// owner is locked out.
+	if err := kbfsOps1.LockFile(ctx, fileNode1, 1); err != nil {
+		t.Fatalf("Couldn't relock file: %v", err)
+	}
+	err = kbfsOps1.LockFile(ctx, fileNode1, 2)
+	if _, ok := err.(FileLockedError); !ok {
+		t.Fatalf("Unexpected local lock error: %v", err)
+	}
+	// Unlocking as the wrong owner does nothing.
+	if err := kbfsOps1.UnlockFile(ctx, fileNode1, 2); err != nil {
+		t.Fatalf("Couldn't unlock file as other owner: %v", err)
+	}
+
+	// Locks are only kept in memory, so the other device isn't
+	// locked out.
+	if err := kbfsOps2.LockFile(ctx, fileNode2, 2); err != nil {
+		t.Fatalf("Other device couldn't lock file: %v", err)
+	}
+
+	// Shutting down releases the lock, and no more can be taken.
+	ops1 := kbfsOps1.(*KBFSOpsStandard).getOpsByNode(ctx, fileNode1)
+	ops1.fileLocks.shutdown()
+	if n := ops1.fileLocks.numHeld(); n != 0 {
+		t.Fatalf("%d locks still held after shutdown", n)
+	}
+	if err := kbfsOps1.LockFile(ctx, fileNode1, 2); err != errShutdownHappened {
+		t.Fatalf("Unexpected lock error after shutdown: %v", err)
+	}
+}
+
+func TestFileLocksNamePath(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	if err := kbfsOps.LockFile(ctx, fileNode, 1); err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+	err = kbfsOps.LockFile(ctx, fileNode, 2)
+	if e, ok := err.(FileLockedError); !ok || e.Name != "a/b" {
+		t.Fatalf("Unexpected lock error: %v", err)
+	}
+	if err := kbfsOps.UnlockFile(ctx, fileNode, 1); err != nil {
+		t.Fatalf("Couldn't unlock file: %v", err)
+	}
+	if err := kbfsOps.LockFile(ctx, fileNode, 2); err != nil {
+		t.Fatalf("Couldn't lock file after unlock: %v", err)
+	}
+
+	// The TLF root itself can't be locked.
+	err = kbfsOps.LockFile(ctx, rootNode, 1)
+	if _, ok := err.(InvalidParentPathError); !ok {
+		t.Fatalf("Unexpected error locking the root: %v", err)
+	}
+}
+
+func TestFileLocksFollowRenames(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.LockFile(ctx, fileNode, 1); err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+
+	if err := kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b"); err != nil {
+		t.Fatalf("Couldn't rename file: %v", err)
+	}
+	renamedNode, _, err := kbfsOps.Lookup(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't look up renamed file: %v", err)
+	}
+	err = kbfsOps.LockFile(ctx, renamedNode, 2)
+	if _, ok := err.(FileLockedError); !ok {
+		t.Fatalf("Unexpected error locking the renamed file: %v", err)
+	}
+
+	if err := kbfsOps.UnlockFile(ctx, renamedNode, 1); err != nil {
+		t.Fatalf("Couldn't unlock file: %v", err)
+	}
+	if err := kbfsOps.LockFile(ctx, renamedNode, 2); err != nil {
+		t.Fatalf("Couldn't lock file after unlock: %v", err)
+	}
+}
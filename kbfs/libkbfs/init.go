@@ -8,6 +8,8 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -17,6 +19,9 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/metricsutil"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
 )
 
 // InitParams contains the initialization parameters for Init(). It is
@@ -48,6 +53,72 @@ type InitParams struct {
 	// before marked for lazy revalidation.
 	TLFValidDuration time.Duration
 
+	// MaxMDsInMemory is the maximum number of MD updates a folder
+	// holds in memory at once while catching up or resolving
+	// conflicts.
+	MaxMDsInMemory int
+
+	// ReadAheadBlocks is the number of indirect file blocks to
+	// prefetch ahead of sequential reads.  0 disables read-ahead.
+	ReadAheadBlocks int
+
+	// PrefetchDirChildren, if true, prefetches the blocks of small
+	// children whenever a directory is listed.
+	PrefetchDirChildren bool
+
+	// MaxParallelBlockPuts is the maximum number of block server
+	// requests a folder may have outstanding at once.
+	MaxParallelBlockPuts int
+
+	// DirtyBytesThreshold is the number of dirty bytes above which
+	// a sync is forced.
+	DirtyBytesThreshold uint64
+
+	// BackgroundFlushPeriod is how often dirty files are flushed if
+	// Sync is never called.
+	BackgroundFlushPeriod time.Duration
+
+	// MaxRetriesOnRecoverableErrors caps the number of times a sync
+	// is retried after a recoverable error.
+	MaxRetriesOnRecoverableErrors int
+
+	// BackgroundTaskTimeout is the timeout for any background task.
+	BackgroundTaskTimeout time.Duration
+
+	// MaxDirtyBytes is the number of dirty bytes, across all
+	// folders, that may be waiting to be put to the block server
+	// before new writes block.
+	MaxDirtyBytes uint64
+
+	// QuotaWarningPercentages is a comma-separated list of the
+	// percentages of the user's quota at which to warn them about
+	// their usage, or "none" to never warn.
+	QuotaWarningPercentages string
+
+	// TrashRetention, if non-zero, turns on the per-folder trash,
+	// and is how long removed files are kept there, in every
+	// folder alike.
+	TrashRetention time.Duration
+
+	// TLFIdleTimeout, if non-zero, is how long a TLF may go
+	// unaccessed before it is shut down to free its resources.
+	TLFIdleTimeout time.Duration
+
+	// EnableChangeFeed, if true, streams the changes to all
+	// folders over a Unix domain socket in the runtime directory
+	// (see ChangeFeed).
+	EnableChangeFeed bool
+
+	// MetricsListenAddr, if non-empty, is the host:port on which
+	// to serve the metrics registry over HTTP, in the Prometheus
+	// text format.  It should usually be a loopback address.
+	MetricsListenAddr string
+
+	// LockContentionProfile, if true, records how long each
+	// level of folder mutex is waited on into the metrics
+	// registry.  It isn't available in production builds.
+	LockContentionProfile bool
+
 	// LogToFile if true, logs to a default file location.
 	LogToFile bool
 
@@ -101,6 +172,10 @@ func GetDefaultMDServer() string {
 	}
 }
 
+func changeFeedSocketPath() string {
+	return filepath.Join(libkb.G.Env.GetRuntimeDir(), ChangeFeedSocketName)
+}
+
 func defaultLogPath() string {
 	// TODO is there a better way to get G here?
 	return filepath.Join(libkb.G.Env.GetLogDir(), libkb.KBFSLogFileName)
@@ -120,6 +195,21 @@ func AddFlags(flags *flag.FlagSet) *InitParams {
 	flags.StringVar(&params.ServerRootDir, "server-root", "", "directory to put local server files (and ignore -bserver and -mdserver)")
 	flags.StringVar(&params.LocalUser, "localuser", "", "fake local user (used only with -server-in-memory or -server-root)")
 	flags.DurationVar(&params.TLFValidDuration, "tlf-valid", tlfValidDurationDefault, "time tlfs are valid before redoing identification")
+	flags.IntVar(&params.MaxMDsInMemory, "max-mds-in-memory", maxMDsInMemoryDefault, "maximum number of MD updates to hold in memory at once per folder")
+	flags.IntVar(&params.ReadAheadBlocks, "read-ahead-blocks", readAheadBlocksDefault, "number of file blocks to prefetch ahead of sequential reads (0 disables)")
+	flags.BoolVar(&params.PrefetchDirChildren, "prefetch-dir-children", false, "prefetch the blocks of small children when listing a directory")
+	flags.IntVar(&params.MaxParallelBlockPuts, "max-parallel-block-puts", maxParallelBlockPutsDefault, "maximum number of block server requests per folder at once")
+	flags.Uint64Var(&params.DirtyBytesThreshold, "dirty-bytes-threshold", dirtyBytesThresholdDefault, "number of dirty bytes above which a sync is forced")
+	flags.DurationVar(&params.BackgroundFlushPeriod, "bg-flush-period", backgroundFlushPeriodDefault, "time between background flushes of dirty files")
+	flags.IntVar(&params.MaxRetriesOnRecoverableErrors, "max-sync-retries", maxRetriesOnRecoverableErrorsDefault, "maximum number of times to retry a sync after a recoverable error")
+	flags.DurationVar(&params.BackgroundTaskTimeout, "bg-task-timeout", backgroundTaskTimeoutDefault, "timeout for any background task")
+	flags.Uint64Var(&params.MaxDirtyBytes, "max-dirty-bytes", maxDirtyBytesDefault, "number of unflushed dirty bytes, across all folders, above which writes block")
+	flags.StringVar(&params.QuotaWarningPercentages, "quota-warning-percentages", formatQuotaWarningPercentages(quotaWarningPercentagesDefault), "comma-separated percentages of your quota at which to warn about your usage, or \"none\"")
+	flags.DurationVar(&params.TrashRetention, "trash-retention", 0, "how long to keep removed files in each folder's trash before purging them, the same for all folders; 0 turns off the trash")
+	flags.DurationVar(&params.TLFIdleTimeout, "tlf-idle-timeout", tlfIdleTimeoutDefault, "how long a folder may go unaccessed before it is shut down, until its next access; 0 keeps folders running")
+	flags.BoolVar(&params.EnableChangeFeed, "change-feed", false, fmt.Sprintf("Stream folder changes over the Unix socket %s", changeFeedSocketPath()))
+	flags.StringVar(&params.MetricsListenAddr, "metrics-listen-addr", "", "host:port on which to serve metrics in the Prometheus format (e.g. localhost:9101)")
+	flags.BoolVar(&params.LockContentionProfile, "lock-contention-profile", false, "record how long each level of folder lock is waited on into the metrics (not available in production builds)")
 	flags.BoolVar(&params.LogToFile, "log-to-file", false, fmt.Sprintf("Log to default file: %s", defaultLogPath()))
 	flags.StringVar(&params.LogFileConfig.Path, "log-file", "", "Path to log file")
 	flags.DurationVar(&params.LogFileConfig.MaxAge, "log-file-max-age", 30*24*time.Hour, "Maximum age of a log file before rotation")
@@ -246,6 +336,33 @@ func makeKeybaseDaemon(config Config, serverInMemory bool, serverRootDir string,
 	return nil, errors.New("Can't user localuser without a local server")
 }
 
+// localStateDir returns the directory under which KBFS keeps state
+// that should survive restarts.
+func localStateDir(serverRootDir string) string {
+	if len(serverRootDir) > 0 {
+		return serverRootDir
+	}
+	return libkb.G.Env.GetDataDir()
+}
+
+func makeRekeyQueue(config Config, serverInMemory bool, serverRootDir string,
+	log logger.Logger) RekeyQueue {
+	if serverInMemory {
+		return NewRekeyQueueStandard(config)
+	}
+
+	rkq, err := NewRekeyQueueStandardDisk(config,
+		filepath.Join(localStateDir(serverRootDir), "kbfs_rekey_queue"))
+	if err != nil {
+		// The database may be in use by another KBFS process; the
+		// queue just won't survive restarts.
+		log.Warning("Couldn't open rekey queue database, "+
+			"keeping the queue in memory: %v", err)
+		return NewRekeyQueueStandard(config)
+	}
+	return rkq
+}
+
 // InitLog sets up logging switching to a log file if necessary.
 // Returns a valid logger even on error, which are non-fatal, thus
 // errors from this function may be ignored.
@@ -340,6 +457,14 @@ func Init(params InitParams, onInterruptFn func(), log logger.Logger) (Config, e
 		keyCache := config.KeyCache()
 		keyCache = NewKeyCacheMeasured(keyCache, registry)
 		config.SetKeyCache(keyCache)
+
+		blockCache := config.BlockCache()
+		blockCache = NewBlockCacheMeasured(blockCache, registry)
+		config.SetBlockCache(blockCache)
+
+		mdCache := config.MDCache()
+		mdCache = NewMDCacheMeasured(mdCache, registry)
+		config.SetMDCache(mdCache)
 	}
 
 	// Set logging
@@ -360,13 +485,58 @@ func Init(params InitParams, onInterruptFn func(), log logger.Logger) (Config, e
 	})
 
 	config.SetTLFValidDuration(params.TLFValidDuration)
+	if params.MaxMDsInMemory > 0 {
+		config.SetMaxMDsInMemory(params.MaxMDsInMemory)
+	}
+	config.SetReadAheadBlocks(params.ReadAheadBlocks)
+	config.SetPrefetchDirChildren(params.PrefetchDirChildren)
+	if params.MaxParallelBlockPuts > 0 {
+		config.SetMaxParallelBlockPuts(params.MaxParallelBlockPuts)
+	}
+	if params.DirtyBytesThreshold > 0 {
+		config.SetDirtyBytesThreshold(params.DirtyBytesThreshold)
+	}
+	if params.BackgroundFlushPeriod > 0 {
+		config.SetBackgroundFlushPeriod(params.BackgroundFlushPeriod)
+	}
+	if params.MaxRetriesOnRecoverableErrors > 0 {
+		config.SetMaxRetriesOnRecoverableErrors(
+			params.MaxRetriesOnRecoverableErrors)
+	}
+	if params.BackgroundTaskTimeout > 0 {
+		config.SetBackgroundTaskTimeout(params.BackgroundTaskTimeout)
+	}
+	if params.MaxDirtyBytes > 0 {
+		config.SetMaxDirtyBytes(params.MaxDirtyBytes)
+	}
+	if params.QuotaWarningPercentages != "" {
+		percentages, err := parseQuotaWarningPercentages(
+			params.QuotaWarningPercentages)
+		if err != nil {
+			return nil, err
+		}
+		config.SetQuotaWarningPercentages(percentages)
+	}
+	if params.TrashRetention > 0 {
+		config.SetTrashRetention(params.TrashRetention)
+	}
+	if params.TLFIdleTimeout > 0 {
+		config.SetTLFIdleTimeout(params.TLFIdleTimeout)
+	}
 
 	kbfsOps := NewKBFSOpsStandard(config)
+	if !params.ServerInMemory {
+		kbfsOps.quotaWarnings.setStatePath(filepath.Join(
+			localStateDir(params.ServerRootDir), "kbfs_quota_warnings"))
+	}
 	config.SetKBFSOps(kbfsOps)
 	config.SetNotifier(kbfsOps)
 	config.SetKeyManager(NewKeyManagerStandard(config))
 	config.SetMDOps(NewMDOpsStandard(config))
 
+	config.SetRekeyQueue(makeRekeyQueue(
+		config, params.ServerInMemory, params.ServerRootDir, log))
+
 	mdServer, err := makeMDServer(
 		config, params.ServerInMemory, params.ServerRootDir, params.MDServerAddr)
 	if err != nil {
@@ -383,6 +553,9 @@ func Init(params InitParams, onInterruptFn func(), log logger.Logger) (Config, e
 
 	if registry := config.MetricsRegistry(); registry != nil {
 		keyServer = NewKeyServerMeasured(keyServer, registry)
+		// Wrap the MD server only now, since makeKeyServer
+		// needs the unwrapped one.
+		config.SetMDServer(NewMDServerMeasured(mdServer, registry))
 	}
 
 	config.SetKeyServer(keyServer)
@@ -398,10 +571,24 @@ func Init(params InitParams, onInterruptFn func(), log logger.Logger) (Config, e
 
 	config.SetKeybaseDaemon(daemon)
 
-	k := NewKBPKIClient(config)
+	var k KBPKI = NewKBPKIClient(config)
+	if registry := config.MetricsRegistry(); registry != nil {
+		k = NewKBPKIMeasured(k, registry)
+	}
 	config.SetKBPKI(k)
 
-	config.SetReporter(NewReporterKBPKI(config, 10, 1000))
+	reporter := NewReporterKBPKI(config, 10, 1000)
+	if !params.ServerInMemory {
+		history, err := NewErrorHistory(filepath.Join(
+			localStateDir(params.ServerRootDir), "kbfs_errors"))
+		if err != nil {
+			log.Warning("Couldn't open error history, "+
+				"keeping errors only in memory: %v", err)
+		} else {
+			reporter.SetErrorHistory(history)
+		}
+	}
+	config.SetReporter(reporter)
 
 	if localUser == "" {
 		c := NewCryptoClient(config, libkb.G)
@@ -423,11 +610,89 @@ func Init(params InitParams, onInterruptFn func(), log logger.Logger) (Config, e
 
 	config.SetBlockServer(bserv)
 
+	if params.MetricsListenAddr != "" {
+		registry := config.MetricsRegistry()
+		if registry == nil {
+			return nil, errors.New(
+				"Can't serve metrics without a metrics registry")
+		}
+		if err := serveMetrics(params.MetricsListenAddr, registry,
+			log); err != nil {
+			return nil, fmt.Errorf("problem serving metrics: %v", err)
+		}
+	}
+
+	if params.LockContentionProfile {
+		registry := config.MetricsRegistry()
+		if registry == nil {
+			return nil, errors.New(
+				"Can't profile lock contention without a metrics registry")
+		}
+		if err := EnableLockContentionProfiling(registry); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.EnableChangeFeed {
+		socketPath := changeFeedSocketPath()
+		if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+			return nil, fmt.Errorf("problem creating runtime dir: %v", err)
+		}
+		changeFeed, err = NewChangeFeed(config, socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("problem starting change feed: %v", err)
+		}
+		kbfsOps.RegisterForAllChanges(changeFeed)
+		log.Debug("Streaming changes on %s", socketPath)
+	}
+
+	// Pick up any rekeys that were still queued when KBFS last
+	// stopped.  This is repeated whenever the MD server connects or
+	// the user logs in, in case there's no session yet.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			config.BackgroundTaskTimeout())
+		defer cancel()
+		config.RekeyQueue().Restore(ctx)
+	}()
+
 	return config, nil
 }
 
+var metricsListener net.Listener
+
+var changeFeed *ChangeFeed
+
+// serveMetrics starts serving the given registry over HTTP, in the
+// Prometheus text format, on the given address until Shutdown is
+// called.
+func serveMetrics(addr string, registry metrics.Registry,
+	log logger.Logger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	metricsListener = l
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsutil.NewPrometheusHandler(registry))
+	log.Debug("Serving metrics on http://%s/metrics", l.Addr())
+	go func() {
+		// Serve returns an error once the listener is closed by
+		// Shutdown.
+		err := http.Serve(l, mux)
+		log.Debug("Stopped serving metrics: %v", err)
+	}()
+	return nil
+}
+
 // Shutdown does any necessary shutdown tasks for libkbfs. Shutdown
 // should be called at the end of main.
 func Shutdown() {
 	pprof.StopCPUProfile()
+	if metricsListener != nil {
+		metricsListener.Close()
+	}
+	if changeFeed != nil {
+		changeFeed.Shutdown()
+	}
 }
@@ -219,6 +219,35 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// GetXattrs returns the extended attributes of the file or
+	// directory represented by the given node, by name.  The TLF
+	// root directory has none.  The returned map may be modified by
+	// the caller.
+	GetXattrs(ctx context.Context, node Node) (map[string][]byte, error)
+	// SetXattr sets an extended attribute on the file or directory
+	// represented by the given node, if the logged-in user has
+	// write permissions to the top-level folder.  This is a
+	// remote-sync operation.
+	SetXattr(ctx context.Context, node Node, name string, value []byte) error
+	// RemoveXattr removes an extended attribute from the file or
+	// directory represented by the given node, if the logged-in
+	// user has write permissions to the top-level folder.  It
+	// returns NoSuchXattrError if no such attribute exists.  This
+	// is a remote-sync operation.
+	RemoveXattr(ctx context.Context, node Node, name string) error
+	// LockFile takes an exclusive advisory lock on the whole file
+	// represented by the given node, on behalf of the given owner
+	// (e.g., a WebDAV lock token).  Locks are only kept in memory,
+	// so they are only respected by other owners using this KBFS
+	// instance -- not by other devices or processes, nor by the
+	// FUSE mount.  The lock follows the file across renames, and is
+	// released when KBFS shuts down.  Locking a file already locked
+	// by the same owner is a no-op.  Returns FileLockedError if
+	// another owner holds the lock.
+	LockFile(ctx context.Context, file Node, owner uint64) error
+	// UnlockFile releases the advisory lock on the given file, if it
+	// is held by the given owner.
+	UnlockFile(ctx context.Context, file Node, owner uint64) error
 	// Sync flushes all outstanding writes and truncates for the given
 	// file to the KBFS servers, if the logged-in user has write
 	// permissions to the top-level folder.  If done through a file
@@ -258,6 +287,51 @@ type KBFSOps interface {
 	// outstanding writes from the local device.
 	GetUpdateHistory(ctx context.Context, folderBranch FolderBranch) (
 		history TLFUpdateHistory, err error)
+	// GetTLFUsage returns the storage used by the given folder: its
+	// live bytes, the bytes that were unreferenced but not yet
+	// reclaimed, and how much each writer referenced and
+	// unreferenced.  Like GetUpdateHistory, it reads the folder's
+	// whole merged history, so it is expensive.
+	GetTLFUsage(ctx context.Context, folderBranch FolderBranch) (
+		usage TLFUsage, err error)
+	// GetActivity returns a page of the activity feed of the given
+	// folder: the changes made by each writer, in a form suitable for
+	// encoding directly into JSON, with the paths of the changed
+	// entries as they are now.  Like GetUpdateHistory, it only
+	// covers merged updates.
+	GetActivity(ctx context.Context, folderBranch FolderBranch,
+		q ActivityQuery) (activity TLFActivity, err error)
+	// RestoreFromTrash moves the entry with the given name, in the
+	// given day's directory of the folder's trash (see
+	// TrashDirName), back to the path it was removed from,
+	// recreating any missing parent directories.  It returns that
+	// path, relative to the root of the folder.  It fails with
+	// NameExistsError if something else is at that path now.
+	RestoreFromTrash(ctx context.Context, folderBranch FolderBranch,
+		date, name string) (origPath string, err error)
+	// MergeConflictedTLF copies the contents of the given conflicted
+	// copy of a folder into the canonical folder it's a copy of (the
+	// one named without the conflict suffix), re-encrypting
+	// everything under the canonical folder's keys.  Directories
+	// that exist in both are merged, identical entries are skipped,
+	// and entries that collide with different ones are copied under
+	// the names conflict resolution would give them.  Afterwards the
+	// conflicted copy is removed from the logged-in user's
+	// favorites.  This is a remote-sync operation.
+	MergeConflictedTLF(ctx context.Context, conflicted *TlfHandle) (
+		result TLFMergeResult, err error)
+	// CloneTLF copies everything in the src folder, except for its
+	// trash, into the dst folder, re-encrypting it under dst's keys.
+	// This is how a folder is re-shared with a different set of
+	// writers and readers.  It keeps mtimes, exec bits and symlinks,
+	// and copies files in parallel.  If a clone into dst was
+	// interrupted, calling it again picks up where it left off.
+	// onProgress, if non-nil, is called once the files to copy are
+	// known and then after each file is copied; calls are never
+	// concurrent.  This is a remote-sync operation.
+	CloneTLF(ctx context.Context, src, dst *TlfHandle,
+		onProgress func(TLFCloneProgress)) (
+		progress TLFCloneProgress, err error)
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
 	Shutdown() error
@@ -452,6 +526,10 @@ type Reporter interface {
 		mode ErrorModeType, err error)
 	// AllKnownErrors returns all errors known to this Reporter.
 	AllKnownErrors() []ReportedError
+	// QueryErrors returns the reported errors that match the given
+	// query, oldest first.  If the Reporter persists errors, this
+	// includes errors reported by earlier KBFS processes.
+	QueryErrors(q ErrorQuery) ([]ErrorRecord, error)
 	// Notify sends the given notification to any sink.
 	Notify(ctx context.Context, notification *keybase1.FSNotification)
 	// Shutdown frees any resources allocated by a Reporter.
@@ -539,6 +617,30 @@ type BlockCache interface {
 	// modifying the size of the dirty blocks outside of the cache
 	// while this is being called.
 	DirtyBytesEstimate() uint64
+	// CleanBytesCapacity returns the total number of bytes allowed
+	// between the transient and permanent clean caches.
+	CleanBytesCapacity() uint64
+}
+
+// DirtyBudget limits the amount of dirty file data, across all
+// folders, that hasn't yet been put to the block server.  Writers
+// wait for room in the budget, which opens up as syncs put their
+// dirty blocks.
+type DirtyBudget interface {
+	// CheckRoom returns true if there is room in the budget for more
+	// dirty data.  If not, it also returns a channel that will be
+	// closed the next time room might have opened up.
+	CheckRoom() (bool, <-chan struct{})
+	// BytesPut records that the given number of dirty bytes have
+	// been put to the block server, even though they may remain in
+	// the dirty cache until their sync finishes.
+	BytesPut(n uint64)
+	// SyncFinished records that a sync, which reported n bytes
+	// through BytesPut, has finished and cleaned up its dirty
+	// blocks.
+	SyncFinished(n uint64)
+	// Status returns the current usage of the budget.
+	Status() DirtyBudgetStatus
 }
 
 // Crypto signs, verifies, encrypts, and decrypts stuff.
@@ -786,6 +888,15 @@ type BlockOps interface {
 	Put(ctx context.Context, md *RootMetadata, blockPtr BlockPointer,
 		readyBlockData ReadyBlockData) error
 
+	// PutBatch is like Put, but stores a batch of readied blocks
+	// (all belonging to the TLF with the given metadata) using as
+	// few round trips to the server as it can.  blockPtrs and
+	// readyBlockDatas must have the same length.  If any of the
+	// blocks couldn't be stored, the returned error is a
+	// BlockBatchError.
+	PutBatch(ctx context.Context, md *RootMetadata, blockPtrs []BlockPointer,
+		readyBlockDatas []ReadyBlockData) error
+
 	// Delete instructs the server to delete the given block references.
 	// It returns the number of not-yet deleted references to
 	// each block reference
@@ -854,6 +965,13 @@ type MDServer interface {
 	RegisterForUpdate(ctx context.Context, id TlfID,
 		currHead MetadataRevision) (<-chan error, error)
 
+	// CancelRegistration tells the MD server that the caller is no
+	// longer waiting on the chan returned by the latest
+	// RegisterForUpdate call for the given top-level folder, if
+	// any, and closes it, so that the caller may register again
+	// later.
+	CancelRegistration(ctx context.Context, id TlfID)
+
 	// CheckForRekeys initiates the rekey checking process on the
 	// server.  The server is allowed to delay this request, and so it
 	// returns a channel for returning the error. Actual rekey
@@ -909,6 +1027,13 @@ type BlockServer interface {
 	Put(ctx context.Context, id BlockID, tlfID TlfID, context BlockContext,
 		buf []byte, serverHalf BlockCryptKeyServerHalf) error
 
+	// PutBlocks is like Put, but stores a batch of new blocks of the
+	// given folder at once.  It's meant for small blocks, since all
+	// of their data is held in memory at once.  If only some of the
+	// blocks couldn't be stored, the returned error is a
+	// BlockBatchError.
+	PutBlocks(ctx context.Context, tlfID TlfID, puts []BlockServerPut) error
+
 	// AddBlockReference adds a new reference to the given block,
 	// defined by the given context (which should contain a non-zero
 	// BlockRefNonce).  (Contexts with a BlockRefNonce of zero should
@@ -918,6 +1043,12 @@ type BlockServer interface {
 	// no-op.
 	AddBlockReference(ctx context.Context, id BlockID, tlfID TlfID,
 		context BlockContext) error
+	// AddBlockReferences is like AddBlockReference, but adds all the
+	// given references to blocks of the given folder at once.  If
+	// only some of the references couldn't be added, the returned
+	// error is a BlockBatchError.
+	AddBlockReferences(ctx context.Context, tlfID TlfID,
+		contexts map[BlockID][]BlockContext) error
 	// RemoveBlockReference removes the reference to the given block
 	// ID defined by the given context.  If no references to the block
 	// remain after this call, the server is allowed to delete the
@@ -1091,6 +1222,8 @@ type Config interface {
 	DataVersion() DataVer
 	RekeyQueue() RekeyQueue
 	SetRekeyQueue(RekeyQueue)
+	DirtyBudget() DirtyBudget
+	SetDirtyBudget(DirtyBudget)
 	// ReqsBufSize indicates the number of read or write operations
 	// that can be buffered per folder
 	ReqsBufSize() int
@@ -1138,6 +1271,78 @@ type Config interface {
 	TLFValidDuration() time.Duration
 	// SetTLFValidDuration sets TLFValidDuration.
 	SetTLFValidDuration(time.Duration)
+	// MaxMDsInMemory is the maximum number of MD updates that a
+	// folder should hold in memory at once while catching up on
+	// updates or resolving conflicts.  Longer histories are
+	// processed in windows of at most this many revisions.
+	MaxMDsInMemory() int
+	// SetMaxMDsInMemory sets MaxMDsInMemory.
+	SetMaxMDsInMemory(int)
+	// ReadAheadBlocks is the maximum number of indirect file blocks
+	// to prefetch ahead of a file that's being read sequentially.
+	// If it is 0, no read-ahead is done.
+	ReadAheadBlocks() int
+	// SetReadAheadBlocks sets ReadAheadBlocks.
+	SetReadAheadBlocks(int)
+	// PrefetchDirChildren says whether the blocks of small children
+	// should be prefetched when a directory is listed.
+	PrefetchDirChildren() bool
+	// SetPrefetchDirChildren sets PrefetchDirChildren.
+	SetPrefetchDirChildren(bool)
+	// MaxParallelBlockPuts is the maximum number of block puts (and
+	// other block server requests) a folder may have outstanding
+	// at once.
+	MaxParallelBlockPuts() int
+	// SetMaxParallelBlockPuts sets MaxParallelBlockPuts.
+	SetMaxParallelBlockPuts(int)
+	// DirtyBytesThreshold is the number of dirty bytes above which
+	// a sync is forced.
+	DirtyBytesThreshold() uint64
+	// SetDirtyBytesThreshold sets DirtyBytesThreshold.
+	SetDirtyBytesThreshold(uint64)
+	// BackgroundFlushPeriod is how often each folder checks for
+	// dirty files to flush, in case Sync is never called.
+	BackgroundFlushPeriod() time.Duration
+	// SetBackgroundFlushPeriod sets BackgroundFlushPeriod.
+	SetBackgroundFlushPeriod(time.Duration)
+	// MaxRetriesOnRecoverableErrors is the maximum number of times a
+	// sync is retried after a recoverable block error.
+	MaxRetriesOnRecoverableErrors() int
+	// SetMaxRetriesOnRecoverableErrors sets MaxRetriesOnRecoverableErrors.
+	SetMaxRetriesOnRecoverableErrors(int)
+	// BackgroundTaskTimeout is the timeout for any single background
+	// task, such as applying updates or a background sync.
+	BackgroundTaskTimeout() time.Duration
+	// SetBackgroundTaskTimeout sets BackgroundTaskTimeout.
+	SetBackgroundTaskTimeout(time.Duration)
+	// MaxDirtyBytes is the number of dirty bytes, across all
+	// folders, that may be waiting to be put to the block server
+	// before new writes block.
+	MaxDirtyBytes() uint64
+	// SetMaxDirtyBytes sets MaxDirtyBytes.
+	SetMaxDirtyBytes(uint64)
+	// QuotaWarningPercentages are the percentages of the user's
+	// quota, in increasing order, at which the user is warned
+	// through the Reporter that their usage is getting high.  If
+	// empty, no warnings are sent.
+	QuotaWarningPercentages() []int
+	// SetQuotaWarningPercentages sets QuotaWarningPercentages.
+	SetQuotaWarningPercentages([]int)
+	// TrashRetention is how long removed files are kept in each
+	// TLF's trash before they are purged.  If 0, removed files are
+	// unreferenced right away, without going through the trash.
+	// The same retention applies to every TLF; it can't be set per
+	// folder.
+	TrashRetention() time.Duration
+	// SetTrashRetention sets TrashRetention.
+	SetTrashRetention(time.Duration)
+	// TLFIdleTimeout is how long a TLF may go without being
+	// accessed before it is shut down to free its resources.  It
+	// is re-created on its next access.  If 0, TLFs are never shut
+	// down for being idle.
+	TLFIdleTimeout() time.Duration
+	// SetTLFIdleTimeout sets TLFIdleTimeout.
+	SetTLFIdleTimeout(time.Duration)
 	// Shutdown is called to free config resources.
 	Shutdown() error
 	// CheckStateOnShutdown tells the caller whether or not it is safe
@@ -1177,6 +1382,9 @@ type NodeCache interface {
 	Unlink(ref blockRef, oldPath path)
 	// PathFromNode creates the path up to a given Node.
 	PathFromNode(node Node) path
+	// NumNodes returns the number of distinct Nodes that are still
+	// referenced by someone.
+	NumNodes() int
 }
 
 // fileBlockDeepCopier fetches a file block, makes a deep copy of it
@@ -1231,8 +1439,10 @@ type crAction interface {
 // RekeyQueue is a managed queue of folders needing some rekey action taken upon them
 // by the current client.
 type RekeyQueue interface {
-	// Enqueue enqueues a folder for rekey action.
-	Enqueue(TlfID) <-chan error
+	// Enqueue enqueues a folder for rekey action, with the given
+	// priority.  If the folder is already queued, its priority is
+	// raised to the given one if that's higher.
+	Enqueue(TlfID, RekeyPriority) <-chan error
 	// IsRekeyPending returns true if the given folder is in the rekey queue.
 	IsRekeyPending(TlfID) bool
 	// GetRekeyChannel will return any rekey completion channel (if pending.)
@@ -1241,4 +1451,14 @@ type RekeyQueue interface {
 	Clear()
 	// Waits for all queued rekeys to finish
 	Wait(ctx context.Context) error
+	// Restore queues again any rekeys that the current user had
+	// queued when the queue was last cleared or shut down, if the
+	// queue is persisted, and starts processing the queue.  Rekeys
+	// queued from then on are persisted for that user.
+	Restore(ctx context.Context)
+	// Status returns the current state of the queue, and a channel
+	// that is closed when the state changes.
+	Status() (RekeyQueueStatus, <-chan StatusUpdate)
+	// Shutdown clears the queue and releases any resources it holds.
+	Shutdown()
 }
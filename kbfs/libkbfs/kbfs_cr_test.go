@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"fmt"
 	"reflect"
 	"sync"
 	"testing"
@@ -516,6 +517,227 @@ func TestBasicCRNoConflict(t *testing.T) {
 	}
 }
 
+// Tests that changes to different extended attributes of the same
+// file on two branches are merged without a conflict, and that
+// changes to the same one conflict.
+func TestCRMergeXattrs(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates two files in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNodeA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	fileNodeB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNodeA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+	fileNodeB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// Different xattrs on a, the same one on b.
+	err = kbfsOps1.SetXattr(ctx, fileNodeA1, "user.1", []byte("1"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps1.SetXattr(ctx, fileNodeB1, "user.x", []byte("1"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps2.SetXattr(ctx, fileNodeA2, "user.2", []byte("2"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps2.SetXattr(ctx, fileNodeB2, "user.x", []byte("2"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	expected := map[string][]byte{
+		"user.1": []byte("1"),
+		"user.2": []byte("2"),
+	}
+	for _, ops := range []KBFSOps{kbfsOps1, kbfsOps2} {
+		rootNode := rootNode1
+		if ops == kbfsOps2 {
+			rootNode = rootNode2
+		}
+		fileNodeA, _, err := ops.Lookup(ctx, rootNode, "a")
+		if err != nil {
+			t.Fatalf("Couldn't lookup file: %v", err)
+		}
+		xattrs, err := ops.GetXattrs(ctx, fileNodeA)
+		if err != nil {
+			t.Fatalf("Couldn't get xattrs: %v", err)
+		}
+		if !reflect.DeepEqual(xattrs, expected) {
+			t.Errorf("Unexpected xattrs %v, expected %v", xattrs, expected)
+		}
+
+		// The conflicting change to b made a conflict copy.
+		children, err := ops.GetDirChildren(ctx, rootNode)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if len(children) != 3 {
+			t.Errorf("Unexpected children: %v", children)
+		}
+	}
+}
+
+// Tests that CR merges two forked branches that each have more
+// updates than can be held in memory at once, so that both the
+// unmerged and the merged MDs have to be processed in several
+// windows of MaxMDsInMemory.  The users create disjoint sets of
+// files, and must end up seeing all of them.
+func TestCRNoConflictManyUpdatesInWindows(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	// process only a single batch of MDs at a time
+	config1.SetMaxMDsInMemory(maxMDsAtATime)
+	config2.SetMaxMDsInMemory(maxMDsAtATime)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// Both users make enough new files to span several windows.
+	numFiles := 2*maxMDsAtATime + 5
+	expectedChildren := []string{"a"}
+	for i := 0; i < numFiles; i++ {
+		bName := fmt.Sprintf("b%d", i)
+		_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, bName, false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		cName := fmt.Sprintf("c%d", i)
+		_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, cName, false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		expectedChildren = append(expectedChildren, bName, cName)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Make sure they both see the same set of children
+	children1, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+
+	children2, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+
+	if g, e := len(children1), len(expectedChildren); g != e {
+		t.Errorf("Wrong number of children: %d vs %d", g, e)
+	}
+
+	for _, child := range expectedChildren {
+		if _, ok := children1[child]; !ok {
+			t.Errorf("Couldn't find child %s", child)
+		}
+	}
+
+	if !reflect.DeepEqual(children1, children2) {
+		t.Fatalf("Users 1 and 2 see different children: %v vs %v",
+			children1, children2)
+	}
+}
+
 // Tests that two users can make independent writes while forked, and
 // conflict resolution will merge them correctly.
 func TestBasicCRFileConflict(t *testing.T) {
@@ -1357,7 +1579,7 @@ func TestCRSyncParallelBlocksErrorCleanup(t *testing.T) {
 
 	// Now user 2 makes a big write where most of the blocks get canceled.
 	// We only need to know the first time we stall.
-	onSyncStalledCh := make(chan struct{}, maxParallelBlockPuts)
+	onSyncStalledCh := make(chan struct{}, config2.MaxParallelBlockPuts())
 	syncUnstallCh := make(chan struct{})
 	stallKey := "requestName"
 	syncValue := "sync"
@@ -1404,7 +1626,7 @@ func TestCRSyncParallelBlocksErrorCleanup(t *testing.T) {
 
 	// Wait for the rest of the puts (this indicates that the first
 	// two succeeded correctly and two more were sent to replace them)
-	for i := 0; i < maxParallelBlockPuts; i++ {
+	for i := 0; i < config2.MaxParallelBlockPuts(); i++ {
 		<-onSyncStalledCh
 	}
 	// Cancel so all other block puts fail
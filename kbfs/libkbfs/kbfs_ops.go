@@ -14,6 +14,11 @@ import (
 	"golang.org/x/net/context"
 )
 
+// idleFolderCheckPeriod is how often KBFSOpsStandard looks for
+// folder-branches that have gone unaccessed for longer than
+// Config.TLFIdleTimeout.
+const idleFolderCheckPeriod = 1 * time.Minute
+
 // KBFSOpsStandard implements the KBFSOps interface, and is go-routine
 // safe by forwarding requests to individual per-folder-branch
 // handlers that are go-routine-safe.
@@ -33,6 +38,24 @@ type KBFSOpsStandard struct {
 
 	favs *Favorites
 
+	quotaWarnings *quotaWarningMonitor
+
+	// allObservers are registered with every folder-branch,
+	// including future ones.  Protected by opsLock.
+	allObservers []Observer
+
+	// closingOps holds a channel for each folder-branch that is
+	// being shut down, which is closed once it's done.  Protected
+	// by opsLock.
+	closingOps map[FolderBranch]chan struct{}
+	// retained holds the state carried over from each
+	// folder-branch that has been shut down to the one that
+	// replaces it, until nothing uses it anymore (see
+	// dropUnusedRetainedState).  Protected by opsLock.
+	retained map[FolderBranch]folderBranchRetainedState
+	// idleControlChan is closed to stop the idle folder checker.
+	idleControlChan chan struct{}
+
 	currentStatus kbfsCurrentStatus
 }
 
@@ -48,10 +71,19 @@ func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 		ops:                   make(map[FolderBranch]*folderBranchOps),
 		opsByFav:              make(map[Favorite]*folderBranchOps),
 		reIdentifyControlChan: make(chan struct{}),
-		favs: NewFavorites(config),
+		closingOps:            make(map[FolderBranch]chan struct{}),
+		retained:              make(map[FolderBranch]folderBranchRetainedState),
+		idleControlChan:       make(chan struct{}),
+		favs:                  NewFavorites(config),
+		quotaWarnings:         newQuotaWarningMonitor(config),
 	}
 	kops.currentStatus.Init()
+	kops.quotaWarnings.onQuotaInfo = func(info *UserQuotaInfo) {
+		kops.noteQuotaInfo(info)
+	}
 	go kops.markForReIdentifyIfNeededLoop()
+	go kops.quotaWarnings.run()
+	go kops.shutdownIdleFoldersLoop()
 	return kops
 }
 
@@ -89,11 +121,149 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeeded(now time.Time, maxValid tim
 	}
 }
 
+// shutdownIdleFoldersLoop periodically shuts down the folder-branches
+// that haven't been accessed within Config.TLFIdleTimeout, if it is
+// set.
+func (fs *KBFSOpsStandard) shutdownIdleFoldersLoop() {
+	ticker := time.NewTicker(idleFolderCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fs.idleControlChan:
+			return
+		}
+		fs.dropUnusedRetainedState()
+		idleTimeout := fs.config.TLFIdleTimeout()
+		if idleTimeout <= 0 {
+			continue
+		}
+		fs.shutdownIdleFolders(fs.config.Clock().Now().Add(-idleTimeout))
+	}
+}
+
+// dropUnusedRetainedState forgets the state retained for each
+// shut-down folder-branch that nobody holds nodes of or observes
+// anymore (other than allObservers).
+func (fs *KBFSOpsStandard) dropUnusedRetainedState() {
+	fs.opsLock.Lock()
+	defer fs.opsLock.Unlock()
+	for fb, state := range fs.retained {
+		if !state.inUse(len(fs.allObservers)) {
+			delete(fs.retained, fb)
+		}
+	}
+}
+
+// shutdownIdleFolders shuts down every folder-branch that hasn't
+// been accessed since idleSince and isn't in use.
+func (fs *KBFSOpsStandard) shutdownIdleFolders(idleSince time.Time) {
+	var idle []FolderBranch
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for fb, ops := range fs.ops {
+			if ops.isIdleSince(idleSince) {
+				idle = append(idle, fb)
+			}
+		}
+	}()
+
+	for _, fb := range idle {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			fs.config.BackgroundTaskTimeout())
+		err := fs.shutdownFolder(ctx, fb, idleSince)
+		cancel()
+		switch err.(type) {
+		case nil:
+		case FolderInUseError:
+			fs.log.CDebugf(ctx, "Not shutting down idle folder: %v", err)
+		default:
+			fs.log.CWarningf(ctx, "Couldn't shut down idle folder %s: %v",
+				fb, err)
+		}
+	}
+}
+
+// shutdownFolder flushes any dirty files in the given folder-branch,
+// and then shuts it down and forgets it, unless it is in use (see
+// folderBranchOps.checkNotInUse) or it has been accessed in the
+// meantime.  If idleSince is non-zero, the folder-branch is also
+// left alone if it has been accessed since then.  The next access
+// re-creates the folder-branch.
+func (fs *KBFSOpsStandard) shutdownFolder(ctx context.Context,
+	fb FolderBranch, idleSince time.Time) error {
+	ops := func() *folderBranchOps {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		return fs.ops[fb]
+	}()
+	if ops == nil {
+		return nil
+	}
+	// Accesses are noted under opsLock, so comparing this to the
+	// count under opsLock below tells whether anyone got hold of
+	// ops in between.
+	accesses := ops.numAccesses()
+
+	if err := ops.flushDirtyFiles(ctx); err != nil {
+		return err
+	}
+
+	closing, err := func() (chan struct{}, error) {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		if fs.ops[fb] != ops || ops.numAccesses() != accesses ||
+			(!idleSince.IsZero() && !ops.isIdleSince(idleSince)) {
+			return nil, nil
+		}
+		lState := makeFBOLockState()
+		if err := ops.checkNotInUse(lState); err != nil {
+			return nil, err
+		}
+		// Even if no nodes are left now, a call that got hold of
+		// ops before the accesses were counted may still make
+		// some, so always carry the state over, and let
+		// dropUnusedRetainedState drop it later.
+		fs.retained[fb] = ops.retainedState(lState)
+		delete(fs.ops, fb)
+		for fav, favOps := range fs.opsByFav {
+			if favOps == ops {
+				delete(fs.opsByFav, fav)
+			}
+		}
+		fs.currentStatus.PushStatusChange()
+		closing := make(chan struct{})
+		fs.closingOps[fb] = closing
+		return closing, nil
+	}()
+	if closing == nil {
+		return err
+	}
+
+	fs.log.CDebugf(ctx, "Shutting down folder %s", fb)
+	// Skip the state check done by folderBranchOps.Shutdown, since
+	// nothing depends on this folder-branch anymore.
+	ops.stopBackgroundWork()
+	if fb.Branch == MasterBranch {
+		// A re-created folder-branch will register again.
+		fs.config.MDServer().CancelRegistration(ctx, fb.Tlf)
+	}
+
+	fs.opsLock.Lock()
+	defer fs.opsLock.Unlock()
+	delete(fs.closingOps, fb)
+	close(closing)
+	return nil
+}
+
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by KBFSOpsStandard.
 func (fs *KBFSOpsStandard) Shutdown() error {
 	close(fs.reIdentifyControlChan)
+	close(fs.idleControlChan)
 	fs.favs.Shutdown()
+	fs.quotaWarnings.shutdown()
 	var errors []error
 	for _, ops := range fs.ops {
 		if err := ops.Shutdown(); err != nil {
@@ -143,26 +313,52 @@ func (fs *KBFSOpsStandard) DeleteFavorite(ctx context.Context,
 		defer fs.opsLock.Unlock()
 		return fs.opsByFav[fav]
 	}()
-	if ops != nil {
-		return ops.deleteFromFavorites(ctx, fs.favs)
-	}
-
-	if isLoggedIn {
-		err := fs.favs.Delete(ctx, fav)
-		if err != nil {
-			return err
+	if ops == nil {
+		if isLoggedIn {
+			return fs.favs.Delete(ctx, fav)
 		}
+		return nil
 	}
 
-	// TODO: Shut down the running folderBranchOps, if one exists?
-	// What about open file handles?
+	if err := ops.deleteFromFavorites(ctx, fs.favs); err != nil {
+		return err
+	}
 
+	// The folder isn't needed anymore, unless it's still in use, in
+	// which case it is left for the idle folder checker.
+	fb := ops.folderBranch
+	err = fs.shutdownFolder(ctx, fb, time.Time{})
+	switch err.(type) {
+	case nil:
+		// Nothing of it needs to carry over either.
+		fs.opsLock.Lock()
+		delete(fs.retained, fb)
+		fs.opsLock.Unlock()
+	case FolderInUseError:
+		fs.log.CDebugf(ctx, "Not shutting down removed folder: %v", err)
+	default:
+		fs.log.CWarningf(ctx, "Couldn't shut down removed folder %s: %v",
+			ops.folderBranch, err)
+	}
 	return nil
 }
 
+// noteAccess records an access to the given ops, for
+// shutdownFolder.  opsLock must be held.
+func (fs *KBFSOpsStandard) noteAccess(ops *folderBranchOps) {
+	// There's no need to track access times if idle
+	// folder-branches are never shut down.
+	var now time.Time
+	if fs.config.TLFIdleTimeout() > 0 {
+		now = fs.config.Clock().Now()
+	}
+	ops.noteAccess(now)
+}
+
 func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 	fs.opsLock.RLock()
 	if ops, ok := fs.ops[fb]; ok {
+		fs.noteAccess(ops)
 		fs.opsLock.RUnlock()
 		return ops
 	}
@@ -170,14 +366,38 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 	fs.opsLock.RUnlock()
 	fs.opsLock.Lock()
 	defer fs.opsLock.Unlock()
+	// If the folder-branch is being shut down, wait for that to
+	// finish before re-creating it.
+	for {
+		closing, ok := fs.closingOps[fb]
+		if !ok {
+			break
+		}
+		fs.opsLock.Unlock()
+		<-closing
+		fs.opsLock.Lock()
+	}
 	// look it up again in case someone else got the lock
 	ops, ok := fs.ops[fb]
 	if !ok {
 		// TODO: add some interface for specifying the type of the
 		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(fs.config, fb, standard)
+		if state, ok := fs.retained[fb]; ok {
+			// The observers, including allObservers, carry over.
+			delete(fs.retained, fb)
+			ops = newFolderBranchOpsWithState(
+				fs.config, fb, standard, state)
+		} else {
+			ops = newFolderBranchOps(fs.config, fb, standard)
+			for _, obs := range fs.allObservers {
+				ops.RegisterForChanges(obs)
+			}
+		}
+		ops.status.setOnChange(fs.currentStatus.PushStatusChange)
 		fs.ops[fb] = ops
+		fs.currentStatus.PushStatusChange()
 	}
+	fs.noteAccess(ops)
 	return ops
 }
 
@@ -382,6 +602,41 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// GetXattrs implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetXattrs(
+	ctx context.Context, node Node) (map[string][]byte, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetXattrs(ctx, node)
+}
+
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetXattr(ctx, node, name, value)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.RemoveXattr(ctx, node, name)
+}
+
+// LockFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) LockFile(
+	ctx context.Context, file Node, owner uint64) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.LockFile(ctx, file, owner)
+}
+
+// UnlockFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) UnlockFile(
+	ctx context.Context, file Node, owner uint64) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.UnlockFile(ctx, file, owner)
+}
+
 // Sync implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) error {
 	ops := fs.getOpsByNode(ctx, file)
@@ -409,24 +664,47 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 	if err == nil && fs.config.MDServer().IsConnected() {
 		quotaInfo, err := fs.config.BlockServer().GetUserQuotaInfo(ctx)
 		if err == nil {
-			limitBytes = quotaInfo.Limit
-			if quotaInfo.Total != nil {
-				usageBytes = quotaInfo.Total.Bytes[UsageWrite]
-			} else {
-				usageBytes = 0
-			}
+			usageBytes, limitBytes = fs.noteQuotaInfo(quotaInfo)
 		}
 	}
-	failures, ch := fs.currentStatus.CurrentStatus()
+	rekeyStatus, rekeyCh := fs.config.RekeyQueue().Status()
+	failures, ch := fs.currentStatus.CurrentStatusWithUpdates(rekeyCh)
 	return KBFSStatus{
 		CurrentUser:     username.String(),
 		IsConnected:     fs.config.MDServer().IsConnected(),
 		UsageBytes:      usageBytes,
 		LimitBytes:      limitBytes,
 		FailingServices: failures,
+		DirtyBudget:     fs.config.DirtyBudget().Status(),
+		RekeyQueue:      rekeyStatus,
+		Folders:         fs.folderSummaries(),
 	}, ch, err
 }
 
+// noteQuotaInfo returns the usage and limit to report in the status
+// for the given quota info, and records them so that a change in
+// them is signalled to status readers.
+func (fs *KBFSOpsStandard) noteQuotaInfo(info *UserQuotaInfo) (
+	usageBytes, limitBytes int64) {
+	usageBytes, limitBytes = usageFromQuotaInfo(info), info.Limit
+	fs.currentStatus.PushQuotaUsage(usageBytes, limitBytes)
+	return usageBytes, limitBytes
+}
+
+// folderSummaries returns a summary of each loaded folder-branch.
+func (fs *KBFSOpsStandard) folderSummaries() []FolderStatusSummary {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	summaries := make([]FolderStatusSummary, 0, len(fs.ops))
+	for _, ops := range fs.ops {
+		if summary, ok := ops.status.getSummary(); ok {
+			summaries = append(summaries, summary)
+		}
+	}
+	sortFolderStatusSummaries(summaries)
+	return summaries
+}
+
 // UnstageForTesting implements the KBFSOps interface for KBFSOpsStandard
 // TODO: remove once we have automatic conflict resolution
 func (fs *KBFSOpsStandard) UnstageForTesting(
@@ -456,6 +734,29 @@ func (fs *KBFSOpsStandard) GetUpdateHistory(ctx context.Context,
 	return ops.GetUpdateHistory(ctx, folderBranch)
 }
 
+// GetTLFUsage implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetTLFUsage(ctx context.Context,
+	folderBranch FolderBranch) (usage TLFUsage, err error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetTLFUsage(ctx, folderBranch)
+}
+
+// GetActivity implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetActivity(ctx context.Context,
+	folderBranch FolderBranch, q ActivityQuery) (
+	activity TLFActivity, err error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetActivity(ctx, folderBranch, q)
+}
+
+// RestoreFromTrash implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RestoreFromTrash(ctx context.Context,
+	folderBranch FolderBranch, date, name string) (string, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.RestoreFromTrash(ctx, folderBranch, date, name)
+}
+
 // Notifier:
 var _ Notifier = (*KBFSOpsStandard)(nil)
 
@@ -470,13 +771,36 @@ func (fs *KBFSOpsStandard) RegisterForChanges(
 	return nil
 }
 
+// RegisterForAllChanges is like RegisterForChanges, but for every
+// folder-branch, including the ones that haven't been accessed yet.
+func (fs *KBFSOpsStandard) RegisterForAllChanges(obs Observer) {
+	fs.opsLock.Lock()
+	defer fs.opsLock.Unlock()
+	fs.allObservers = append(fs.allObservers, obs)
+	for _, ops := range fs.ops {
+		ops.RegisterForChanges(obs)
+	}
+	for _, state := range fs.retained {
+		state.observers.add(obs)
+	}
+}
+
 // UnregisterFromChanges implements the Notifer interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) UnregisterFromChanges(
 	folderBranches []FolderBranch, obs Observer) error {
 	for _, fb := range folderBranches {
 		// TODO: add branch parameter to notifier interface
-		ops := fs.getOpsNoAdd(fb)
-		return ops.UnregisterFromChanges(obs)
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		if ops, ok := fs.ops[fb]; ok {
+			return ops.UnregisterFromChanges(obs)
+		}
+		// Don't re-create a folder-branch that was shut down just
+		// for this.
+		if state, ok := fs.retained[fb]; ok {
+			state.observers.remove(obs)
+		}
+		return nil
 	}
 	return nil
 }
@@ -7,9 +7,11 @@ package libkbfs
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
@@ -989,11 +991,12 @@ func TestKBFSOpsConcurWriteDuringSyncMultiBlocks(t *testing.T) {
 // Test that a write consisting of multiple blocks can be canceled
 // before all blocks have been written.
 func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
+	config, _, ctx := kbfsOpsConcurInit(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	maxParallelBlockPuts := config.MaxParallelBlockPuts()
 	if maxParallelBlockPuts <= 1 {
 		t.Skip("Skipping because we are not putting blocks in parallel.")
 	}
-	config, _, ctx := kbfsOpsConcurInit(t, "test_user")
-	defer CheckConfigAndShutdown(t, config)
 
 	// give it a remote block server with a fake client
 	fc := NewFakeBServerClient(nil, nil, nil)
@@ -1110,6 +1113,45 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 
 // Test that, when writing multiple blocks in parallel, one error will
 // cancel the remaining puts.
+// unbatchingBlockServer splits the batched calls to it into
+// single-block calls to the BlockServer it wraps, so that tests can
+// set up expectations, and failures, for each block.
+type unbatchingBlockServer struct {
+	BlockServer
+}
+
+func (b unbatchingBlockServer) PutBlocks(ctx context.Context, tlfID TlfID,
+	puts []BlockServerPut) error {
+	errs := make(map[BlockBatchRef]error)
+	for _, put := range puts {
+		err := b.Put(ctx, put.ID, tlfID, put.Context, put.Buf, put.ServerHalf)
+		if err != nil {
+			errs[BlockBatchRef{put.ID, put.Context.GetRefNonce()}] = err
+		}
+	}
+	if len(errs) > 0 {
+		return BlockBatchError{errs}
+	}
+	return nil
+}
+
+func (b unbatchingBlockServer) AddBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	errs := make(map[BlockBatchRef]error)
+	for id, idContexts := range contexts {
+		for _, context := range idContexts {
+			err := b.AddBlockReference(ctx, id, tlfID, context)
+			if err != nil {
+				errs[BlockBatchRef{id, context.GetRefNonce()}] = err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return BlockBatchError{errs}
+	}
+	return nil
+}
+
 func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 	config, _, ctx := kbfsOpsConcurInit(t, "test_user")
 	defer CheckConfigAndShutdown(t, config)
@@ -1120,7 +1162,7 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 	defer mockCtrl.Finish()
 	defer ctr.CheckForFailures()
 	b := NewMockBlockServer(mockCtrl)
-	config.SetBlockServer(b)
+	config.SetBlockServer(unbatchingBlockServer{b})
 
 	// from the folder creation, then 2 for file creation
 	c := b.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
@@ -1569,7 +1611,7 @@ func TestKBFSOpsErrorOnBlockedWriteDuringSync(t *testing.T) {
 
 	// Write over the dirty amount of data.  TODO: make this
 	// configurable for a speedier test.
-	data := make([]byte, dirtyBytesThreshold+1)
+	data := make([]byte, config.DirtyBytesThreshold()+1)
 	err = kbfsOps.Write(ctx, fileNode, data, 0)
 	if err != nil {
 		t.Errorf("Couldn't write file: %v", err)
@@ -1638,3 +1680,212 @@ func TestKBFSOpsCancelGetFavorites(t *testing.T) {
 	}
 	testRPCWithCanceledContext(t, serverConn, f)
 }
+
+// Test that a write blocked on the dirty budget is woken up as soon
+// as the dirty blocks of a sync are put, before the sync finishes.
+func TestKBFSOpsConcurWriteUnblockedByBlockPuts(t *testing.T) {
+	config, _, ctx := kbfsOpsConcurInit(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	onPutStalledCh, putUnstallCh, putCtx := setStallingMDOpsForPut(ctx, config)
+
+	// Use the smallest possible block size, so there are many dirty
+	// child blocks.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := make([]byte, 200)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	// Fill up the budget.
+	config.SetMaxDirtyBytes(config.BlockCache().DirtyBytesEstimate() - 1)
+	if hasRoom, _ := config.DirtyBudget().CheckRoom(); hasRoom {
+		t.Fatalf("Dirty budget unexpectedly has room")
+	}
+
+	// Start the sync, and wait until all the blocks have been put,
+	// but the MD hasn't.
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.Sync(putCtx, fileNode)
+	}()
+	select {
+	case <-onPutStalledCh:
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for sync to stall: %v", ctx.Err())
+	}
+
+	// A new write shouldn't have to wait for the sync to finish.
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	status := config.DirtyBudget().Status()
+	if status.OutstandingBytes >= status.MaxBytes {
+		t.Errorf("Budget still full after block puts: %+v", status)
+	}
+
+	close(putUnstallCh)
+	if err := <-syncErrCh; err != nil {
+		t.Fatalf("Couldn't sync: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync: %v", err)
+	}
+	if status := config.DirtyBudget().Status(); status.DirtyBytes != 0 ||
+		status.OutstandingBytes != 0 {
+		t.Errorf("Dirty bytes left after syncing: %+v", status)
+	}
+}
+
+// latencyBlockOps delays every block put, batched or not, to
+// simulate a block server with a high round-trip latency.
+type latencyBlockOps struct {
+	BlockOps
+	putDelay time.Duration
+}
+
+func (lbo *latencyBlockOps) delay(ctx context.Context) error {
+	select {
+	case <-time.After(lbo.putDelay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (lbo *latencyBlockOps) Put(ctx context.Context, md *RootMetadata,
+	blockPtr BlockPointer, readyBlockData ReadyBlockData) error {
+	if err := lbo.delay(ctx); err != nil {
+		return err
+	}
+	return lbo.BlockOps.Put(ctx, md, blockPtr, readyBlockData)
+}
+
+func (lbo *latencyBlockOps) PutBatch(ctx context.Context, md *RootMetadata,
+	blockPtrs []BlockPointer, readyBlockDatas []ReadyBlockData) error {
+	if err := lbo.delay(ctx); err != nil {
+		return err
+	}
+	return lbo.BlockOps.PutBatch(ctx, md, blockPtrs, readyBlockDatas)
+}
+
+const benchmarkPutDelay = 10 * time.Millisecond
+
+// makeDirsOrBust creates the given chain of nested directories under
+// parent, returning the deepest one.
+func makeDirsOrBust(b *testing.B, ctx context.Context, kbfsOps KBFSOps,
+	parent Node, names ...string) Node {
+	for _, name := range names {
+		var err error
+		parent, _, err = kbfsOps.CreateDir(ctx, parent, name)
+		if err != nil {
+			b.Fatalf("Couldn't create dir %s: %v", name, err)
+		}
+	}
+	return parent
+}
+
+// Benchmark renaming a file back and forth between two deep
+// directories, whose paths only share the root, on a block server
+// with high latency.  The number of parallel puts is held constant,
+// and the old path's blocks are either put early, in parallel with
+// readying and putting the new path, or in one batch with the new
+// path's blocks once both are ready.
+func BenchmarkRenameAcrossDirsHighLatency(b *testing.B) {
+	for _, early := range []bool{false, true} {
+		b.Run(fmt.Sprintf("early=%t", early), func(b *testing.B) {
+			config := MakeTestConfigOrBust(b, "test_user")
+			defer CheckConfigAndShutdown(b, config)
+			config.SetMaxParallelBlockPuts(maxParallelBlockPutsDefault)
+			ctx := context.Background()
+
+			rootNode := GetRootNodeOrBust(b, config, "test_user", false)
+			kbfsOps := config.KBFSOps()
+			ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+			ops.batchRenamePutsForTesting = !early
+			dirA := makeDirsOrBust(b, ctx, kbfsOps, rootNode,
+				"a1", "a2", "a3", "a4")
+			dirB := makeDirsOrBust(b, ctx, kbfsOps, rootNode,
+				"b1", "b2", "b3", "b4")
+			if _, _, err := kbfsOps.CreateFile(ctx, dirA, "f", false); err != nil {
+				b.Fatalf("Couldn't create file: %v", err)
+			}
+
+			config.SetBlockOps(&latencyBlockOps{
+				BlockOps: config.BlockOps(),
+				putDelay: benchmarkPutDelay,
+			})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				from, to := dirA, dirB
+				if i%2 == 1 {
+					from, to = dirB, dirA
+				}
+				if err := kbfsOps.Rename(ctx, from, "f", to, "f"); err != nil {
+					b.Fatalf("Couldn't rename: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// Benchmark syncing a multi-block file on a block server with high
+// latency, for different limits on the number of parallel puts.
+func BenchmarkSyncMultiBlockFileHighLatency(b *testing.B) {
+	for _, puts := range []int{1, maxParallelBlockPutsDefault} {
+		b.Run(fmt.Sprintf("puts=%d", puts), func(b *testing.B) {
+			config := MakeTestConfigOrBust(b, "test_user")
+			defer CheckConfigAndShutdown(b, config)
+			config.SetMaxParallelBlockPuts(puts)
+			ctx := context.Background()
+
+			bsplitter, err := NewBlockSplitterSimple(1024, 8*1024,
+				config.Codec())
+			if err != nil {
+				b.Fatalf("Couldn't create block splitter: %v", err)
+			}
+			config.SetBlockSplitter(bsplitter)
+			config.SetBlockOps(&latencyBlockOps{
+				BlockOps: config.BlockOps(),
+				putDelay: benchmarkPutDelay,
+			})
+
+			rootNode := GetRootNodeOrBust(b, config, "test_user", false)
+			kbfsOps := config.KBFSOps()
+			data := make([]byte, 20*1024)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				name := fmt.Sprintf("f%d", i)
+				fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, name,
+					false)
+				if err != nil {
+					b.Fatalf("Couldn't create file: %v", err)
+				}
+				if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+					b.Fatalf("Couldn't write file: %v", err)
+				}
+				b.StartTimer()
+				if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+					b.Fatalf("Couldn't sync file: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
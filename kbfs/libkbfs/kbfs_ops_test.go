@@ -9,6 +9,10 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -50,6 +54,11 @@ func (cbo *CheckBlockOps) Put(ctx context.Context, md *RootMetadata,
 	return cbo.delegate.Put(ctx, md, blockPtr, readyBlockData)
 }
 
+func (cbo *CheckBlockOps) PutBatch(ctx context.Context, md *RootMetadata,
+	blockPtrs []BlockPointer, readyBlockDatas []ReadyBlockData) error {
+	return cbo.delegate.PutBatch(ctx, md, blockPtrs, readyBlockDatas)
+}
+
 func (cbo *CheckBlockOps) Delete(ctx context.Context, md *RootMetadata,
 	ptrs []BlockPointer) (map[BlockID]int, error) {
 	return cbo.delegate.Delete(ctx, md, ptrs)
@@ -5029,6 +5038,16 @@ func (cbs *corruptBlockServer) Put(ctx context.Context, id BlockID, tlfID TlfID,
 		serverHalf)
 }
 
+func (cbs *corruptBlockServer) PutBlocks(ctx context.Context, tlfID TlfID,
+	puts []BlockServerPut) error {
+	corruptPuts := make([]BlockServerPut, len(puts))
+	for i, put := range puts {
+		put.Buf = append(put.Buf, 0)
+		corruptPuts[i] = put
+	}
+	return cbs.BlockServer.PutBlocks(ctx, tlfID, corruptPuts)
+}
+
 func TestKBFSOpsFailToReadUnverifiableBlock(t *testing.T) {
 	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
 	defer CheckConfigAndShutdown(t, config)
@@ -5059,3 +5078,952 @@ func TestKBFSOpsFailToReadUnverifiableBlock(t *testing.T) {
 		t.Fatalf("Could unexpectedly lookup the file: %v", err)
 	}
 }
+
+func TestKBFSOpsXattrs(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// Dirty the file, so the xattrs go through the cached entry.
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.a", []byte("value a"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.b", []byte("value b"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps.Sync(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	expected := map[string][]byte{
+		"user.a": []byte("value a"),
+		"user.b": []byte("value b"),
+	}
+	xattrs, err := kbfsOps.GetXattrs(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't get xattrs: %v", err)
+	}
+	assert.Equal(t, expected, xattrs)
+
+	// Another device sees the same xattrs, and its changes come back.
+	config2 := ConfigAsUser(config.(*ConfigLocal), "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	xattrs, err = kbfsOps2.GetXattrs(ctx, fileNode2)
+	if err != nil {
+		t.Fatalf("Couldn't get xattrs: %v", err)
+	}
+	assert.Equal(t, expected, xattrs)
+	err = kbfsOps2.RemoveXattr(ctx, fileNode2, "user.a")
+	if err != nil {
+		t.Fatalf("Couldn't remove xattr: %v", err)
+	}
+
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	delete(expected, "user.a")
+	xattrs, err = kbfsOps.GetXattrs(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't get xattrs: %v", err)
+	}
+	assert.Equal(t, expected, xattrs)
+
+	// Errors.
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.a")
+	if _, ok := err.(NoSuchXattrError); !ok {
+		t.Errorf("Unexpected error removing a missing xattr: %v", err)
+	}
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.big",
+		make([]byte, maxXattrValueBytes+1))
+	if _, ok := err.(XattrTooBigError); !ok {
+		t.Errorf("Unexpected error setting a big xattr: %v", err)
+	}
+}
+
+func TestKBFSOpsWriteFailsEarlyForReader(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsInitNoMocks(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	name := userName1.String() + ReaderSep + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+
+	// The reader's changes should be rejected before they get
+	// buffered.
+	err = kbfsOps2.Write(ctx, fileNode2, []byte{1, 2, 3}, 0)
+	if _, ok := err.(WriteAccessError); !ok {
+		t.Errorf("Unexpected write error: %v", err)
+	}
+	err = kbfsOps2.Truncate(ctx, fileNode2, 10)
+	if _, ok := err.(WriteAccessError); !ok {
+		t.Errorf("Unexpected truncate error: %v", err)
+	}
+	status, _, err := kbfsOps2.FolderStatus(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if len(status.DirtyPaths) != 0 {
+		t.Errorf("Unexpected dirty paths: %v", status.DirtyPaths)
+	}
+
+	// Modes reflect the permissions.
+	assert.Equal(t, os.FileMode(0444), File.Mode(false, false))
+	assert.Equal(t, os.FileMode(0644), File.Mode(false, true))
+	assert.Equal(t, os.FileMode(0555), Exec.Mode(true, false))
+	assert.Equal(t, os.ModeDir|0500, Dir.Mode(false, false))
+	assert.Equal(t, os.ModeDir|0755, Dir.Mode(true, true))
+	assert.Equal(t, os.ModeSymlink|0777, Sym.Mode(false, false))
+}
+
+func TestKBFSOpsGetTLFUsage(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsInitNoMocks(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3, 4, 5}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	usage, err := kbfsOps1.GetTLFUsage(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get usage: %v", err)
+	}
+
+	ops1 := kbfsOps1.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode1)
+	md, err := ops1.getMDForFBM(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	if usage.LiveBytes != md.DiskUsage {
+		t.Errorf("Live bytes %d, expected %d", usage.LiveBytes, md.DiskUsage)
+	}
+	if usage.Name != md.GetTlfHandle().GetCanonicalPath() {
+		t.Errorf("Unexpected name %s", usage.Name)
+	}
+
+	u1, u2 := usage.Writers[string(userName1)], usage.Writers[string(userName2)]
+	if len(usage.Writers) != 2 || u1.RefBytes == 0 || u2.UnrefBytes == 0 {
+		t.Fatalf("Unexpected writer usage: %v", usage.Writers)
+	}
+	// Nothing has been reclaimed yet, so everything ever
+	// unreferenced is still archived.
+	if usage.ArchivedBytes != u1.UnrefBytes+u2.UnrefBytes {
+		t.Errorf("Archived bytes %d, expected %d", usage.ArchivedBytes,
+			u1.UnrefBytes+u2.UnrefBytes)
+	}
+	if usage.LiveBytes != u1.RefBytes+u2.RefBytes-usage.ArchivedBytes {
+		t.Errorf("Live bytes %d don't match writer totals: %v",
+			usage.LiveBytes, usage.Writers)
+	}
+}
+
+// waitForNoNodes runs the garbage collector until all the nodes of
+// the given ops, which the caller must have dropped, are finalized.
+func waitForNoNodes(t *testing.T, ops *folderBranchOps) {
+	for i := 0; ops.nodeCache.NumNodes() > 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d nodes still cached", ops.nodeCache.NumNodes())
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKBFSOpsShutdownIdleFolder(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetTLFIdleTimeout(time.Hour)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3, 4, 5}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	// The folder isn't shut down while nodes are held, but its
+	// dirty files are flushed.
+	fb := rootNode.GetFolderBranch()
+	ops := kbfsOps.getOpsNoAdd(fb)
+	kbfsOps.shutdownIdleFolders(config.Clock().Now().Add(time.Minute))
+	if kbfsOps.getOpsNoAdd(fb) != ops {
+		t.Fatal("Folder was shut down while in use")
+	}
+	lState := makeFBOLockState()
+	if ops.blocks.GetState(lState) != cleanState {
+		t.Error("Dirty file wasn't flushed")
+	}
+
+	// A recently-accessed folder isn't shut down either.
+	rootNode, fileNode = nil, nil
+	waitForNoNodes(t, ops)
+	kbfsOps.shutdownIdleFolders(config.Clock().Now().Add(-time.Minute))
+	if kbfsOps.getOpsNoAdd(fb) != ops {
+		t.Fatal("Folder was shut down while not idle")
+	}
+
+	kbfsOps.shutdownIdleFolders(config.Clock().Now().Add(time.Minute))
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		if _, ok := kbfsOps.ops[fb]; ok {
+			t.Fatal("Idle folder wasn't shut down")
+		}
+	}()
+
+	// Nothing uses the shut-down folder's state, so it's dropped.
+	kbfsOps.dropUnusedRetainedState()
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		if _, ok := kbfsOps.retained[fb]; ok {
+			t.Fatal("Unused state of idle folder was retained")
+		}
+	}()
+
+	// The folder comes back on the next access, with its data, and
+	// gets updates from other devices again.
+	rootNode = GetRootNodeOrBust(t, config, userName.String(), false)
+	fileNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	buf := make([]byte, 5)
+	if n, err := kbfsOps.Read(ctx, fileNode, buf, 0); err != nil || n != 5 {
+		t.Fatalf("Couldn't read file: n=%d, err=%v", n, err)
+	}
+	if !bytes.Equal(buf, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("Unexpected file contents %v", buf)
+	}
+
+	config2 := ConfigAsUser(config.(*ConfigLocal), userName)
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, userName.String(), false)
+	_, _, err = config2.KBFSOps().CreateFile(ctx, rootNode2, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	if _, _, err := kbfsOps.Lookup(ctx, rootNode, "b"); err != nil {
+		t.Errorf("Couldn't look up other device's file: %v", err)
+	}
+}
+
+func TestKBFSOpsDeleteFavoriteShutsDownFolder(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	fb := rootNode.GetFolderBranch()
+	ops := kbfsOps.getOpsNoAdd(fb)
+
+	rootNode = nil
+	waitForNoNodes(t, ops)
+	err := kbfsOps.DeleteFavorite(ctx, userName.String(), false)
+	if err != nil {
+		t.Fatalf("Couldn't delete favorite: %v", err)
+	}
+	kbfsOps.opsLock.RLock()
+	defer kbfsOps.opsLock.RUnlock()
+	if _, ok := kbfsOps.ops[fb]; ok {
+		t.Error("Removed folder wasn't shut down")
+	}
+	if len(kbfsOps.opsByFav) != 0 {
+		t.Errorf("Removed folder still tracked: %v", kbfsOps.opsByFav)
+	}
+	if _, ok := kbfsOps.retained[fb]; ok {
+		t.Error("State of removed folder was retained")
+	}
+}
+
+// Tests that a folder whose root node is still held, e.g. by a FUSE
+// mount, and that has observers can be shut down, and that both
+// carry over to the re-created folder.
+func TestKBFSOpsShutdownIdleFolderWithRootNode(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetTLFIdleTimeout(time.Hour)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	fb := rootNode.GetFolderBranch()
+	c := make(chan struct{}, 10)
+	obs := &testCRObserver{c: c}
+	err := kbfsOps.RegisterForChanges([]FolderBranch{fb}, obs)
+	if err != nil {
+		t.Fatalf("Couldn't register for changes: %v", err)
+	}
+	defer kbfsOps.UnregisterFromChanges([]FolderBranch{fb}, obs)
+
+	ops := kbfsOps.getOpsNoAdd(fb)
+	kbfsOps.shutdownIdleFolders(config.Clock().Now().Add(time.Minute))
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		if _, ok := kbfsOps.ops[fb]; ok {
+			t.Fatal("Idle folder wasn't shut down")
+		}
+	}()
+	// The state is kept while the root node is held.
+	kbfsOps.dropUnusedRetainedState()
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		if _, ok := kbfsOps.retained[fb]; !ok {
+			t.Fatal("State of idle folder in use wasn't retained")
+		}
+	}()
+
+	// Another device changes the folder while it's shut down.
+	config2 := ConfigAsUser(config.(*ConfigLocal), userName)
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, userName.String(), false)
+	_, _, err = config2.KBFSOps().CreateFile(ctx, rootNode2, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// The held root node leads to the re-created folder, which
+	// catches up with the change and tells the observer.
+	err = kbfsOps.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	if _, _, err := kbfsOps.Lookup(ctx, rootNode, "b"); err != nil {
+		t.Fatalf("Couldn't look up other device's file: %v", err)
+	}
+	if kbfsOps.getOpsNoAdd(fb).nodeCache != ops.nodeCache {
+		t.Error("Re-created folder has a new node cache")
+	}
+	select {
+	case <-c:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Observer wasn't told about the change")
+	}
+	if len(obs.changes) == 0 ||
+		obs.changes[0].Node.GetID() != rootNode.GetID() ||
+		!reflect.DeepEqual(obs.changes[0].DirUpdated, []string{"b"}) {
+		t.Errorf("Unexpected changes %+v", obs.changes)
+	}
+}
+
+// waitForStatusChange waits for the given status update channel to be
+// closed, which happens asynchronously for the top-level status.
+func waitForStatusChange(t *testing.T, c <-chan StatusUpdate) {
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Status should have signalled a change")
+	}
+}
+
+func TestKBFSOpsStatusUpdates(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	status, c, err := kbfsOps.Status(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if len(status.Folders) != 1 {
+		t.Fatalf("Unexpected folders in status: %+v", status.Folders)
+	}
+	folder := status.Folders[0]
+	if folder.Folder != "/keybase/private/u1" || folder.DirtyBytes != 0 ||
+		folder.LastSync.IsZero() {
+		t.Errorf("Unexpected folder status: %+v", folder)
+	}
+
+	// A write changes the status, and shows up as dirty bytes.
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3, 4, 5}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	waitForStatusChange(t, c)
+	status, c, err = kbfsOps.Status(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if status.Folders[0].DirtyBytes != 5 {
+		t.Errorf("Unexpected folder status: %+v", status.Folders[0])
+	}
+
+	// So does a sync, which clears the dirty bytes.
+	lastSync := status.Folders[0].LastSync
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	waitForStatusChange(t, c)
+	status, c, err = kbfsOps.Status(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	folder = status.Folders[0]
+	if folder.DirtyBytes != 0 || folder.PendingUploads != 0 ||
+		folder.LastSync.Before(lastSync) {
+		t.Errorf("Unexpected folder status: %+v", folder)
+	}
+
+	// No change, no signal.
+	select {
+	case <-c:
+		t.Fatal("Status should not have signalled a change")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// bserverArchivedQuota is a BlockServer that reports the given live
+// and archived usage, and limit, for every GetUserQuotaInfo call.
+type bserverArchivedQuota struct {
+	BlockServer
+	writeBytes, archiveBytes, limit int64
+}
+
+func (b bserverArchivedQuota) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	total := NewUsageStat()
+	total.Bytes[UsageWrite] = b.writeBytes
+	total.Bytes[UsageArchive] = b.archiveBytes
+	return &UserQuotaInfo{Total: total, Limit: b.limit}, nil
+}
+
+// Test that the status counts archived bytes that haven't been
+// reclaimed yet as part of the usage.
+func TestKBFSOpsStatusQuotaUsage(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetBlockServer(
+		bserverArchivedQuota{config.BlockServer(), 10, 5, 100})
+
+	status, _, err := config.KBFSOps().Status(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if status.UsageBytes != 15 || status.LimitBytes != 100 {
+		t.Errorf("Unexpected quota usage in status: %d/%d",
+			status.UsageBytes, status.LimitBytes)
+	}
+}
+
+func TestKBFSOpsGetActivity(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsInitNoMocks(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+	clock, t0 := newTestClockAndTimeNow()
+	config1.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, dirNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	t1 := t0.Add(time.Minute)
+	clock.Set(t1)
+	for i := 0; i < 2; i++ {
+		err = kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3}, int64(3*i))
+		if err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		err = kbfsOps1.Sync(ctx, fileNode1)
+		if err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+	}
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// The other writer renames the directory and removes b.
+	t2 := t1.Add(time.Minute)
+	clock.Set(t2)
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.Rename(ctx, rootNode2, "d", rootNode2, "e")
+	if err != nil {
+		t.Fatalf("Couldn't rename dir: %v", err)
+	}
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+
+	fb := rootNode1.GetFolderBranch()
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	activity, err := kbfsOps1.GetActivity(ctx, fb, ActivityQuery{})
+	if err != nil {
+		t.Fatalf("Couldn't get activity: %v", err)
+	}
+	if activity.Name != "/keybase/private/"+name || activity.NextBefore != 0 {
+		t.Errorf("Unexpected activity %+v", activity)
+	}
+
+	type edit struct {
+		writer  string
+		action  ActivityAction
+		path    string
+		oldPath string
+		deleted bool
+		count   int
+	}
+	expected := []edit{
+		{"u2", ActivityDeleted, "b", "", true, 1},
+		{"u2", ActivityRenamed, "e", "d", false, 1},
+		{"u1", ActivityCreated, "b", "", true, 1},
+		// Creating and writing a are aggregated, and a is shown
+		// under its new directory.
+		{"u1", ActivityCreated, "e/a", "", false, 3},
+		{"u1", ActivityCreated, "e", "", false, 1},
+	}
+	var got []edit
+	for _, e := range activity.Edits {
+		got = append(got, edit{e.Writer, e.Action, e.Path, e.OldPath,
+			e.Deleted, e.Count})
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected edits %+v", got)
+	}
+
+	// Each edit has the time its most recent revision was put,
+	// whether it was put by this device or not.
+	expectedTimes := []time.Time{t2, t2, t1, t1, t0}
+	for i, e := range activity.Edits {
+		if i < len(expectedTimes) && !e.Time.Equal(expectedTimes[i]) {
+			t.Errorf("Edit %+v has time %s, expected %s",
+				e, e.Time, expectedTimes[i])
+		}
+	}
+
+	// A page of only the oldest revisions still shows the current
+	// paths.
+	last := activity.Edits[0].Revision
+	activity, err = kbfsOps1.GetActivity(ctx, fb,
+		ActivityQuery{Before: last - 2, Revisions: 2})
+	if err != nil {
+		t.Fatalf("Couldn't get activity: %v", err)
+	}
+	if activity.NextBefore != last-4 {
+		t.Errorf("Unexpected next page %d", activity.NextBefore)
+	}
+	for _, e := range activity.Edits {
+		if e.Revision >= last-2 || e.Revision < last-4 {
+			t.Errorf("Edit %+v out of page", e)
+		}
+		if e.Path == "d" || strings.HasPrefix(e.Path, "d/") {
+			t.Errorf("Edit %+v has an old path", e)
+		}
+	}
+}
+
+func writeFileForMergeTest(ctx context.Context, t *testing.T,
+	kbfsOps KBFSOps, dir Node, name string, data []byte) {
+	n, _, err := kbfsOps.CreateFile(ctx, dir, name, false)
+	if err != nil {
+		t.Fatalf("Couldn't create file %s: %v", name, err)
+	}
+	err = kbfsOps.Write(ctx, n, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file %s: %v", name, err)
+	}
+	err = kbfsOps.Sync(ctx, n)
+	if err != nil {
+		t.Fatalf("Couldn't sync file %s: %v", name, err)
+	}
+}
+
+func checkFileForMergeTest(ctx context.Context, t *testing.T,
+	kbfsOps KBFSOps, dir Node, name string, expected []byte) {
+	n, _, err := kbfsOps.Lookup(ctx, dir, name)
+	if err != nil {
+		t.Fatalf("Couldn't look up %s: %v", name, err)
+	}
+	buf := make([]byte, len(expected)+1)
+	nr, err := kbfsOps.Read(ctx, n, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", name, err)
+	}
+	if !bytes.Equal(buf[:nr], expected) {
+		t.Errorf("Unexpected contents of %s: %v vs %v",
+			name, buf[:nr], expected)
+	}
+}
+
+func TestKBFSOpsMergeConflictedTLF(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	kbfsOps := config.KBFSOps()
+
+	name := userName.String()
+	rootNode := GetRootNodeOrBust(t, config, name, false)
+	writeFileForMergeTest(ctx, t, kbfsOps, rootNode, "a", []byte{1, 2, 3})
+	writeFileForMergeTest(ctx, t, kbfsOps, rootNode, "same", []byte{5})
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	writeFileForMergeTest(ctx, t, kbfsOps, dirNode, "x", []byte{1})
+
+	conflictedName := name + ConflictSuffixSep +
+		"(conflicted copy 2016-03-14)"
+	conflictedRoot := GetRootNodeOrBust(t, config, conflictedName, false)
+	writeFileForMergeTest(
+		ctx, t, kbfsOps, conflictedRoot, "a", []byte{4, 5})
+	writeFileForMergeTest(ctx, t, kbfsOps, conflictedRoot, "same", []byte{5})
+	writeFileForMergeTest(ctx, t, kbfsOps, conflictedRoot, "b", []byte{6})
+	_, err = kbfsOps.CreateLink(ctx, conflictedRoot, "l", "b")
+	if err != nil {
+		t.Fatalf("Couldn't create link: %v", err)
+	}
+	conflictedDir, _, err := kbfsOps.CreateDir(ctx, conflictedRoot, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	writeFileForMergeTest(ctx, t, kbfsOps, conflictedDir, "y", []byte{2})
+
+	// Merging a folder that isn't a conflicted copy fails.
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), name, false,
+		config.SharingBeforeSignupEnabled())
+	if err != nil {
+		t.Fatalf("Couldn't parse handle: %v", err)
+	}
+	_, err = kbfsOps.MergeConflictedTLF(ctx, h)
+	if _, ok := err.(TlfNotConflictedError); !ok {
+		t.Fatalf("Unexpected error merging a canonical folder: %v", err)
+	}
+
+	conflictedH, err := ParseTlfHandle(ctx, config.KBPKI(), conflictedName,
+		false, config.SharingBeforeSignupEnabled())
+	if err != nil {
+		t.Fatalf("Couldn't parse conflicted handle: %v", err)
+	}
+	renamedA := WriterDeviceDateConflictRenamer{}.ConflictRenameHelper(
+		config.Clock().Now(), name, "dev1", "a")
+	result, err := kbfsOps.MergeConflictedTLF(ctx, conflictedH)
+	if err != nil {
+		t.Fatalf("Couldn't merge: %v", err)
+	}
+	expectedResult := TLFMergeResult{
+		Target:  CanonicalTlfName(name),
+		Copied:  4,
+		Renamed: map[string]string{"a": renamedA},
+	}
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("Unexpected merge result: %+v vs %+v",
+			result, expectedResult)
+	}
+
+	checkFileForMergeTest(ctx, t, kbfsOps, rootNode, "a", []byte{1, 2, 3})
+	checkFileForMergeTest(ctx, t, kbfsOps, rootNode, renamedA, []byte{4, 5})
+	checkFileForMergeTest(ctx, t, kbfsOps, rootNode, "same", []byte{5})
+	checkFileForMergeTest(ctx, t, kbfsOps, rootNode, "b", []byte{6})
+	checkFileForMergeTest(ctx, t, kbfsOps, dirNode, "x", []byte{1})
+	checkFileForMergeTest(ctx, t, kbfsOps, dirNode, "y", []byte{2})
+	_, ei, err := kbfsOps.Lookup(ctx, rootNode, "l")
+	if err != nil {
+		t.Fatalf("Couldn't look up link: %v", err)
+	}
+	if ei.Type != Sym || ei.SymPath != "b" {
+		t.Errorf("Unexpected link entry: %+v", ei)
+	}
+
+	// The conflicted copy is no longer a favorite.
+	favorites, err := kbfsOps.GetFavorites(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get favorites: %v", err)
+	}
+	for _, f := range favorites {
+		if f.Name == conflictedName {
+			t.Errorf("Conflicted copy is still a favorite")
+		}
+	}
+}
+
+// cancelingCopyKBFSOps pretends to copy empty files, and cancels the
+// copy once the first file is done.
+type cancelingCopyKBFSOps struct {
+	KBFSOps
+	cancel context.CancelFunc
+}
+
+func (k cancelingCopyKBFSOps) Read(
+	ctx context.Context, file Node, dest []byte, off int64) (int64, error) {
+	return 0, nil
+}
+
+func (k cancelingCopyKBFSOps) Sync(ctx context.Context, file Node) error {
+	return nil
+}
+
+func (k cancelingCopyKBFSOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) error {
+	k.cancel()
+	return nil
+}
+
+func TestKBFSOpsCloneTLFCanceledBetweenFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &tlfCloner{
+		kbfsOps: cancelingCopyKBFSOps{cancel: cancel},
+		files:   make([]tlfCloneFile, 5),
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.copyFiles(ctx, 1)
+	}()
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Copying files didn't stop after being canceled")
+	}
+}
+
+func TestKBFSOpsCloneTLF(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config)
+	kbfsOps := config.KBFSOps()
+
+	srcName := userName1.String()
+	srcRoot := GetRootNodeOrBust(t, config, srcName, false)
+	aNode, _, err := kbfsOps.CreateFile(ctx, srcRoot, "a", true)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.Write(ctx, aNode, []byte{1, 2, 3}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps.Sync(ctx, aNode)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	mtime := time.Unix(1, 0)
+	err = kbfsOps.SetMtime(ctx, aNode, &mtime)
+	if err != nil {
+		t.Fatalf("Couldn't set mtime: %v", err)
+	}
+	dirNode, _, err := kbfsOps.CreateDir(ctx, srcRoot, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	writeFileForMergeTest(ctx, t, kbfsOps, dirNode, "x", []byte{4})
+	_, err = kbfsOps.CreateLink(ctx, srcRoot, "l", "a")
+	if err != nil {
+		t.Fatalf("Couldn't create link: %v", err)
+	}
+
+	srcH, err := ParseTlfHandle(ctx, config.KBPKI(), srcName, false,
+		config.SharingBeforeSignupEnabled())
+	if err != nil {
+		t.Fatalf("Couldn't parse handle: %v", err)
+	}
+	_, err = kbfsOps.CloneTLF(ctx, srcH, srcH, nil)
+	if _, ok := err.(CloneToSameTlfError); !ok {
+		t.Fatalf("Unexpected error cloning into the same folder: %v", err)
+	}
+
+	dstName := userName1.String() + "," + userName2.String()
+	dstH, err := ParseTlfHandle(ctx, config.KBPKI(), dstName, false,
+		config.SharingBeforeSignupEnabled())
+	if err != nil {
+		t.Fatalf("Couldn't parse handle: %v", err)
+	}
+	var updates []TLFCloneProgress
+	progress, err := kbfsOps.CloneTLF(ctx, srcH, dstH,
+		func(p TLFCloneProgress) { updates = append(updates, p) })
+	if err != nil {
+		t.Fatalf("Couldn't clone: %v", err)
+	}
+	expectedProgress := TLFCloneProgress{
+		Files:       2,
+		Bytes:       4,
+		CopiedFiles: 2,
+		CopiedBytes: 4,
+	}
+	if progress != expectedProgress {
+		t.Errorf("Unexpected progress: %+v vs %+v", progress, expectedProgress)
+	}
+	if len(updates) != 3 || updates[0].CopiedFiles != 0 ||
+		updates[2] != expectedProgress {
+		t.Errorf("Unexpected progress updates: %+v", updates)
+	}
+
+	// The other writer sees everything in the new folder.
+	config2 := ConfigAsUser(config.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	dstRoot2 := GetRootNodeOrBust(t, config2, dstName, false)
+	checkFileForMergeTest(ctx, t, kbfsOps2, dstRoot2, "a", []byte{1, 2, 3})
+	_, ei, err := kbfsOps2.Lookup(ctx, dstRoot2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	if ei.Type != Exec || ei.Mtime != mtime.UnixNano() {
+		t.Errorf("Unexpected cloned file entry: %+v", ei)
+	}
+	dstDir2, _, err := kbfsOps2.Lookup(ctx, dstRoot2, "d")
+	if err != nil {
+		t.Fatalf("Couldn't look up dir: %v", err)
+	}
+	checkFileForMergeTest(ctx, t, kbfsOps2, dstDir2, "x", []byte{4})
+	_, ei, err = kbfsOps2.Lookup(ctx, dstRoot2, "l")
+	if err != nil {
+		t.Fatalf("Couldn't look up link: %v", err)
+	}
+	if ei.Type != Sym || ei.SymPath != "a" {
+		t.Errorf("Unexpected cloned link entry: %+v", ei)
+	}
+
+	// Cloning again only copies what's new or partially copied.
+	writeFileForMergeTest(ctx, t, kbfsOps, srcRoot, "c", []byte{5, 6})
+	dstRoot := GetRootNodeOrBust(t, config, dstName, false)
+	writeFileForMergeTest(ctx, t, kbfsOps, dstRoot, "c", []byte{7})
+	progress, err = kbfsOps.CloneTLF(ctx, srcH, dstH, nil)
+	if err != nil {
+		t.Fatalf("Couldn't clone again: %v", err)
+	}
+	expectedProgress = TLFCloneProgress{
+		Files:        1,
+		Bytes:        2,
+		CopiedFiles:  1,
+		CopiedBytes:  2,
+		SkippedFiles: 2,
+	}
+	if progress != expectedProgress {
+		t.Errorf("Unexpected progress: %+v vs %+v", progress, expectedProgress)
+	}
+	checkFileForMergeTest(ctx, t, kbfsOps, dstRoot, "c", []byte{5, 6})
+}
+
+// Test that block puts are grouped into batches of new references
+// and of small blocks, while big blocks are put on their own.
+func TestBatchBlockPuts(t *testing.T) {
+	nonce := BlockRefNonce([8]byte{1})
+	var blockStates []blockState
+	for i := 0; i < maxBlocksPerPutBatch+1; i++ {
+		blockStates = append(blockStates, blockState{
+			blockPtr: BlockPointer{ID: fakeBlockID(1), RefNonce: nonce},
+		})
+	}
+	smallData := ReadyBlockData{buf: make([]byte, maxBatchedBlockPutBytes)}
+	for i := 0; i < maxBytesPerPutBatch/maxBatchedBlockPutBytes+1; i++ {
+		blockStates = append(blockStates, blockState{
+			blockPtr:       BlockPointer{ID: fakeBlockID(2)},
+			readyBlockData: smallData,
+		})
+	}
+	bigData := ReadyBlockData{buf: make([]byte, maxBatchedBlockPutBytes+1)}
+	blockStates = append(blockStates, blockState{
+		blockPtr:       BlockPointer{ID: fakeBlockID(3)},
+		readyBlockData: bigData,
+	})
+
+	var sizes []int
+	for _, batch := range batchBlockPuts(blockStates) {
+		sizes = append(sizes, len(batch))
+	}
+	// The full batches go first, then the big block, then the
+	// leftover references and small blocks.
+	expectedSizes := []int{
+		maxBlocksPerPutBatch,
+		maxBytesPerPutBatch / maxBatchedBlockPutBytes,
+		1, 1, 1,
+	}
+	require.Equal(t, expectedSizes, sizes)
+}
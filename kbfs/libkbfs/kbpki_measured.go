@@ -0,0 +1,192 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// KBPKIMeasured delegates to another KBPKI instance but also keeps
+// track of stats.  Unlike KeybaseDaemonMeasured, it includes the
+// time spent in any local caching and retries, i.e. what the rest of
+// KBFS actually waits for.
+type KBPKIMeasured struct {
+	delegate                      KBPKI
+	getCurrentTokenTimer          metrics.Timer
+	getCurrentUserInfoTimer       metrics.Timer
+	getCurrentCryptPublicKeyTimer metrics.Timer
+	getCurrentVerifyingKeyTimer   metrics.Timer
+	resolveTimer                  metrics.Timer
+	identifyTimer                 metrics.Timer
+	getNormalizedUsernameTimer    metrics.Timer
+	hasVerifyingKeyTimer          metrics.Timer
+	getCryptPublicKeysTimer       metrics.Timer
+	favoriteAddTimer              metrics.Timer
+	favoriteDeleteTimer           metrics.Timer
+	favoriteListTimer             metrics.Timer
+	notifyTimer                   metrics.Timer
+}
+
+var _ KBPKI = KBPKIMeasured{}
+
+// NewKBPKIMeasured creates and returns a new KBPKIMeasured instance
+// with the given delegate and registry.
+func NewKBPKIMeasured(delegate KBPKI, r metrics.Registry) KBPKIMeasured {
+	getCurrentTokenTimer := metrics.GetOrRegisterTimer("KBPKI.GetCurrentToken", r)
+	getCurrentUserInfoTimer := metrics.GetOrRegisterTimer("KBPKI.GetCurrentUserInfo", r)
+	getCurrentCryptPublicKeyTimer := metrics.GetOrRegisterTimer("KBPKI.GetCurrentCryptPublicKey", r)
+	getCurrentVerifyingKeyTimer := metrics.GetOrRegisterTimer("KBPKI.GetCurrentVerifyingKey", r)
+	resolveTimer := metrics.GetOrRegisterTimer("KBPKI.Resolve", r)
+	identifyTimer := metrics.GetOrRegisterTimer("KBPKI.Identify", r)
+	getNormalizedUsernameTimer := metrics.GetOrRegisterTimer("KBPKI.GetNormalizedUsername", r)
+	hasVerifyingKeyTimer := metrics.GetOrRegisterTimer("KBPKI.HasVerifyingKey", r)
+	getCryptPublicKeysTimer := metrics.GetOrRegisterTimer("KBPKI.GetCryptPublicKeys", r)
+	favoriteAddTimer := metrics.GetOrRegisterTimer("KBPKI.FavoriteAdd", r)
+	favoriteDeleteTimer := metrics.GetOrRegisterTimer("KBPKI.FavoriteDelete", r)
+	favoriteListTimer := metrics.GetOrRegisterTimer("KBPKI.FavoriteList", r)
+	notifyTimer := metrics.GetOrRegisterTimer("KBPKI.Notify", r)
+	return KBPKIMeasured{
+		delegate:                      delegate,
+		getCurrentTokenTimer:          getCurrentTokenTimer,
+		getCurrentUserInfoTimer:       getCurrentUserInfoTimer,
+		getCurrentCryptPublicKeyTimer: getCurrentCryptPublicKeyTimer,
+		getCurrentVerifyingKeyTimer:   getCurrentVerifyingKeyTimer,
+		resolveTimer:                  resolveTimer,
+		identifyTimer:                 identifyTimer,
+		getNormalizedUsernameTimer:    getNormalizedUsernameTimer,
+		hasVerifyingKeyTimer:          hasVerifyingKeyTimer,
+		getCryptPublicKeysTimer:       getCryptPublicKeysTimer,
+		favoriteAddTimer:              favoriteAddTimer,
+		favoriteDeleteTimer:           favoriteDeleteTimer,
+		favoriteListTimer:             favoriteListTimer,
+		notifyTimer:                   notifyTimer,
+	}
+}
+
+// GetCurrentToken implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) GetCurrentToken(ctx context.Context) (
+	token string, err error) {
+	k.getCurrentTokenTimer.Time(func() {
+		token, err = k.delegate.GetCurrentToken(ctx)
+	})
+	return token, err
+}
+
+// GetCurrentUserInfo implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) GetCurrentUserInfo(ctx context.Context) (
+	name libkb.NormalizedUsername, uid keybase1.UID, err error) {
+	k.getCurrentUserInfoTimer.Time(func() {
+		name, uid, err = k.delegate.GetCurrentUserInfo(ctx)
+	})
+	return name, uid, err
+}
+
+// GetCurrentCryptPublicKey implements the KBPKI interface for
+// KBPKIMeasured.
+func (k KBPKIMeasured) GetCurrentCryptPublicKey(ctx context.Context) (
+	key CryptPublicKey, err error) {
+	k.getCurrentCryptPublicKeyTimer.Time(func() {
+		key, err = k.delegate.GetCurrentCryptPublicKey(ctx)
+	})
+	return key, err
+}
+
+// GetCurrentVerifyingKey implements the KBPKI interface for
+// KBPKIMeasured.
+func (k KBPKIMeasured) GetCurrentVerifyingKey(ctx context.Context) (
+	key VerifyingKey, err error) {
+	k.getCurrentVerifyingKeyTimer.Time(func() {
+		key, err = k.delegate.GetCurrentVerifyingKey(ctx)
+	})
+	return key, err
+}
+
+// Resolve implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) Resolve(ctx context.Context, assertion string) (
+	name libkb.NormalizedUsername, uid keybase1.UID, err error) {
+	k.resolveTimer.Time(func() {
+		name, uid, err = k.delegate.Resolve(ctx, assertion)
+	})
+	return name, uid, err
+}
+
+// Identify implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) Identify(ctx context.Context, assertion, reason string) (
+	userInfo UserInfo, err error) {
+	k.identifyTimer.Time(func() {
+		userInfo, err = k.delegate.Identify(ctx, assertion, reason)
+	})
+	return userInfo, err
+}
+
+// GetNormalizedUsername implements the KBPKI interface for
+// KBPKIMeasured.
+func (k KBPKIMeasured) GetNormalizedUsername(ctx context.Context,
+	uid keybase1.UID) (name libkb.NormalizedUsername, err error) {
+	k.getNormalizedUsernameTimer.Time(func() {
+		name, err = k.delegate.GetNormalizedUsername(ctx, uid)
+	})
+	return name, err
+}
+
+// HasVerifyingKey implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) HasVerifyingKey(ctx context.Context, uid keybase1.UID,
+	verifyingKey VerifyingKey, atServerTime time.Time) (err error) {
+	k.hasVerifyingKeyTimer.Time(func() {
+		err = k.delegate.HasVerifyingKey(
+			ctx, uid, verifyingKey, atServerTime)
+	})
+	return err
+}
+
+// GetCryptPublicKeys implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) GetCryptPublicKeys(ctx context.Context,
+	uid keybase1.UID) (keys []CryptPublicKey, err error) {
+	k.getCryptPublicKeysTimer.Time(func() {
+		keys, err = k.delegate.GetCryptPublicKeys(ctx, uid)
+	})
+	return keys, err
+}
+
+// FavoriteAdd implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) FavoriteAdd(ctx context.Context,
+	folder keybase1.Folder) (err error) {
+	k.favoriteAddTimer.Time(func() {
+		err = k.delegate.FavoriteAdd(ctx, folder)
+	})
+	return err
+}
+
+// FavoriteDelete implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) FavoriteDelete(ctx context.Context,
+	folder keybase1.Folder) (err error) {
+	k.favoriteDeleteTimer.Time(func() {
+		err = k.delegate.FavoriteDelete(ctx, folder)
+	})
+	return err
+}
+
+// FavoriteList implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) FavoriteList(ctx context.Context) (
+	folders []keybase1.Folder, err error) {
+	k.favoriteListTimer.Time(func() {
+		folders, err = k.delegate.FavoriteList(ctx)
+	})
+	return folders, err
+}
+
+// Notify implements the KBPKI interface for KBPKIMeasured.
+func (k KBPKIMeasured) Notify(ctx context.Context,
+	notification *keybase1.FSNotification) (err error) {
+	k.notifyTimer.Time(func() {
+		err = k.delegate.Notify(ctx, notification)
+	})
+	return err
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+func TestKBPKIMeasuredTimers(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	registry := metrics.NewRegistry()
+	kbpki := NewKBPKIMeasured(config.KBPKI(), registry)
+
+	ctx := context.Background()
+	name, uid, err := kbpki.GetCurrentUserInfo(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get current user info: %v", err)
+	}
+	if name != "test_user" {
+		t.Errorf("Unexpected name %s", name)
+	}
+	if _, err := kbpki.GetCryptPublicKeys(ctx, uid); err != nil {
+		t.Fatalf("Couldn't get crypt public keys: %v", err)
+	}
+
+	for name, expected := range map[string]int64{
+		"KBPKI.GetCurrentUserInfo": 1,
+		"KBPKI.GetCryptPublicKeys": 1,
+		"KBPKI.Identify":           0,
+	} {
+		timer, ok := registry.Get(name).(metrics.Timer)
+		if !ok {
+			t.Errorf("No timer registered for %s", name)
+			continue
+		}
+		if c := timer.Count(); c != expected {
+			t.Errorf("%s count: expected %d, got %d", name, expected, c)
+		}
+	}
+}
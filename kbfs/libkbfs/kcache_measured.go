@@ -4,7 +4,10 @@
 
 package libkbfs
 
-import metrics "github.com/rcrowley/go-metrics"
+import (
+	"github.com/keybase/kbfs/metricsutil"
+	metrics "github.com/rcrowley/go-metrics"
+)
 
 // KeyCacheMeasured delegates to another KeyCache instance but
 // also keeps track of stats.
@@ -22,10 +25,9 @@ var _ KeyCache = KeyCacheMeasured{}
 func NewKeyCacheMeasured(delegate KeyCache, r metrics.Registry) KeyCacheMeasured {
 	getTimer := metrics.GetOrRegisterTimer("KeyCache.GetTLFCryptKey", r)
 	putTimer := metrics.GetOrRegisterTimer("KeyCache.PutTLFCryptKey", r)
-	// TODO: Implement RatioGauge (
-	// http://metrics.dropwizard.io/3.1.0/manual/core/#ratio-gauges
-	// ) so we can actually display a hit ratio.
 	hitCountMeter := metrics.GetOrRegisterMeter("KeyCache.HitCount", r)
+	metricsutil.GetOrRegisterRatioGauge(
+		"KeyCache.HitRatio", hitCountMeter, getTimer, r)
 	return KeyCacheMeasured{
 		delegate:      delegate,
 		getTimer:      getTimer,
@@ -214,6 +214,7 @@ func (k *KeybaseDaemonRPC) LoggedIn(ctx context.Context, name string) error {
 		k.config.MDServer().RefreshAuthToken(ctx)
 		k.config.BlockServer().RefreshAuthToken(ctx)
 		k.config.KBFSOps().RefreshCachedFavorites(ctx)
+		k.config.RekeyQueue().Restore(ctx)
 	}
 	return nil
 }
@@ -2,11 +2,14 @@
 // Use of this source code is governed by a BSD
 // license that can be found in the LICENSE file.
 
+// +build !production
+
 package libkbfs
 
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 // The leveledMutex, leveledRWMutex, and lockState types enables a
@@ -17,8 +20,11 @@ import (
 // by creating a new lockState at the start of an execution flow and
 // passing it to the (r-)lock/(r-)unlock methods of each (rw-)mutex.
 //
-// TODO: Once this becomes a bottleneck, add a +build production
-// version that stubs everything out.
+// This is the checked implementation. Production builds use the
+// stubbed-out one in leveled_mutex_production.go instead, which
+// just does the locking. The checked implementation can also record
+// how long each mutex level is waited on; see
+// EnableLockContentionProfiling.
 
 // An exclusiveLock is a lock around something that is expected to be
 // accessed exclusively. It immediately panics upon any lock
@@ -147,7 +153,13 @@ func (state *lockState) doLock(
 		}
 	}
 
-	lock.Lock()
+	if registry := lockContentionRegistry(); registry != nil {
+		start := time.Now()
+		lock.Lock()
+		recordLockWait(registry, state.levelToString(level), start)
+	} else {
+		lock.Lock()
+	}
 
 	state.exclusionStates = append(state.exclusionStates, exclusionState{
 		level:         level,
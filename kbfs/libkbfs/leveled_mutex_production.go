@@ -0,0 +1,119 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build production
+
+package libkbfs
+
+import (
+	"errors"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// This is the production implementation of leveledMutex,
+// leveledRWMutex, and lockState (see leveled_mutex.go for the checked
+// one). It doesn't keep track of which levels are held, so the lock
+// hierarchy isn't checked and the Assert* methods do nothing; the
+// mutexes just lock and unlock the underlying lockers.
+
+// mutexLevel is the level for a mutex, which must be unique to that
+// mutex.
+type mutexLevel int
+
+// lockState holds nothing in production builds. It's kept only so
+// that the checked and production implementations have the same
+// signatures.
+type lockState struct{}
+
+// makeLevelState returns a nil lockState, since production builds
+// don't keep track of held mutexes.
+func makeLevelState(levelToString func(mutexLevel) string) *lockState {
+	return nil
+}
+
+// EnableLockContentionProfiling implements lock contention profiling
+// for production builds, which don't support it.
+func EnableLockContentionProfiling(registry metrics.Registry) error {
+	return errors.New(
+		"Lock contention profiling isn't available in production builds")
+}
+
+// leveledMutex is a mutex with an associated level, which is ignored
+// in production builds.
+type leveledMutex struct {
+	locker sync.Locker
+}
+
+func makeLeveledMutex(level mutexLevel, locker sync.Locker) leveledMutex {
+	return leveledMutex{locker: locker}
+}
+
+func (m leveledMutex) Lock(lockState *lockState) {
+	m.locker.Lock()
+}
+
+func (m leveledMutex) Unlock(lockState *lockState) {
+	m.locker.Unlock()
+}
+
+func (m leveledMutex) AssertUnlocked(lockState *lockState) {}
+
+func (m leveledMutex) AssertLocked(lockState *lockState) {}
+
+// leveledLocker represents an object that can be locked and unlocked
+// with a lockState.
+type leveledLocker interface {
+	Lock(*lockState)
+	Unlock(*lockState)
+}
+
+// leveledRWMutex is a reader-writer mutex with an associated level,
+// which is ignored in production builds.
+type leveledRWMutex struct {
+	rwLocker rwLocker
+}
+
+func makeLeveledRWMutex(level mutexLevel, rwLocker rwLocker) leveledRWMutex {
+	return leveledRWMutex{rwLocker: rwLocker}
+}
+
+func (rw leveledRWMutex) Lock(lockState *lockState) {
+	rw.rwLocker.Lock()
+}
+
+func (rw leveledRWMutex) Unlock(lockState *lockState) {
+	rw.rwLocker.Unlock()
+}
+
+func (rw leveledRWMutex) RLock(lockState *lockState) {
+	rw.rwLocker.RLock()
+}
+
+func (rw leveledRWMutex) RUnlock(lockState *lockState) {
+	rw.rwLocker.RUnlock()
+}
+
+func (rw leveledRWMutex) AssertUnlocked(lockState *lockState) {}
+
+func (rw leveledRWMutex) AssertLocked(lockState *lockState) {}
+
+func (rw leveledRWMutex) AssertRLocked(lockState *lockState) {}
+
+func (rw leveledRWMutex) AssertAnyLocked(lockState *lockState) {}
+
+func (rw leveledRWMutex) RLocker() leveledLocker {
+	return (leveledRLocker)(rw)
+}
+
+type leveledRLocker leveledRWMutex
+
+func (r leveledRLocker) Lock(lockState *lockState) {
+	(leveledRWMutex)(r).RLock(lockState)
+}
+
+func (r leveledRLocker) Unlock(lockState *lockState) {
+	(leveledRWMutex)(r).RUnlock(lockState)
+}
@@ -2,6 +2,8 @@
 // Use of this source code is governed by a BSD
 // license that can be found in the LICENSE file.
 
+// +build !production
+
 package libkbfs
 
 import (
@@ -9,6 +11,7 @@ import (
 	"sync"
 	"testing"
 
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
 )
 
@@ -312,3 +315,33 @@ func TestLeveledRWMutexMultiFlow(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestLeveledMutexContentionProfiling(t *testing.T) {
+	registry := metrics.NewRegistry()
+	err := EnableLockContentionProfiling(registry)
+	require.NoError(t, err)
+	defer func() {
+		err := EnableLockContentionProfiling(nil)
+		require.NoError(t, err)
+	}()
+
+	mu1 := makeLeveledMutex(mutexLevel(testFirst), &sync.Mutex{})
+	mu2 := makeLeveledRWMutex(mutexLevel(testSecond), &sync.RWMutex{})
+
+	state := makeLevelState(testMutexLevelToString)
+	mu1.Lock(state)
+	mu2.RLock(state)
+	mu2.RUnlock(state)
+	mu2.Lock(state)
+	mu2.Unlock(state)
+	mu1.Unlock(state)
+
+	timer1, ok := registry.Get(
+		lockWaitMetricPrefix + testFirst.String()).(metrics.Timer)
+	require.True(t, ok)
+	require.Equal(t, int64(1), timer1.Count())
+	timer2, ok := registry.Get(
+		lockWaitMetricPrefix + testMutexLevel(testSecond).String()).(metrics.Timer)
+	require.True(t, ok)
+	require.Equal(t, int64(2), timer2.Count())
+}
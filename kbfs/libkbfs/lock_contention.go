@@ -0,0 +1,57 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !production
+
+package libkbfs
+
+import (
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// lockWaitMetricPrefix is the prefix of the names of the per-level
+// timers that lock wait times are recorded into.
+const lockWaitMetricPrefix = "LockWait."
+
+// lockContentionState is what's stored in lockContention; it wraps
+// the registry, since an atomic.Value can't hold a nil interface or
+// values of different concrete types.
+type lockContentionState struct {
+	registry metrics.Registry
+}
+
+// lockContention holds the lockContentionState for the whole
+// process.
+var lockContention atomic.Value
+
+// EnableLockContentionProfiling makes every leveled mutex record how
+// long each lock waited to be acquired, in a timer per mutex level
+// named "LockWait.<level>" in the given registry. Passing a nil
+// registry turns the recording back off. It returns an error in
+// production builds, which don't check or profile leveled mutexes.
+func EnableLockContentionProfiling(registry metrics.Registry) error {
+	lockContention.Store(lockContentionState{registry})
+	return nil
+}
+
+// lockContentionRegistry returns the registry that lock wait times
+// should be recorded into, or nil if profiling is off.
+func lockContentionRegistry() metrics.Registry {
+	state, ok := lockContention.Load().(lockContentionState)
+	if !ok {
+		return nil
+	}
+	return state.registry
+}
+
+// recordLockWait records the time since start as a wait for the
+// mutex at the given level.
+func recordLockWait(
+	registry metrics.Registry, levelName string, start time.Time) {
+	metrics.GetOrRegisterTimer(
+		lockWaitMetricPrefix+levelName, registry).UpdateSince(start)
+}
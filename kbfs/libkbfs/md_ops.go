@@ -123,6 +123,7 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 	// Otherwise, verify signatures and deserialize private data.
 
 	rmds.MD.tlfHandle = handle
+	rmds.MD.untrustedServerTimestamp = rmds.untrustedServerTimestamp
 
 	// Make sure the last writer is really a valid writer
 	writer := rmds.MD.LastModifyingWriter
@@ -525,6 +526,9 @@ func (md *MDOpsStandard) put(ctx context.Context, rmd *RootMetadata) error {
 	if err != nil {
 		return err
 	}
+	// The server doesn't return its timestamp, so use ours for the
+	// copy of this MD that stays in the cache.
+	rmd.untrustedServerTimestamp = md.config.Clock().Now()
 	return nil
 }
 
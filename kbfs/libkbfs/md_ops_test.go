@@ -8,6 +8,7 @@ import (
 	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
@@ -119,6 +120,7 @@ func putMDForPrivate(config *ConfigMock, rmds *RootMetadataSigned) {
 	config.mockCodec.EXPECT().Decode([]byte{}, gomock.Any()).Return(nil)
 
 	config.mockMdserv.EXPECT().Put(gomock.Any(), gomock.Any()).Return(nil)
+	config.mockClock.EXPECT().Now().Return(time.Now())
 }
 
 func TestMDOpsGetForHandlePublicSuccess(t *testing.T) {
@@ -103,60 +103,141 @@ func getMDRange(ctx context.Context, config Config, id TlfID, bid BranchID,
 	return rmds, nil
 }
 
-func getMergedMDUpdates(ctx context.Context, config Config, id TlfID,
-	startRev MetadataRevision) (mergedRmds []*RootMetadata, err error) {
+// mdWindowSize returns the number of MD updates that may be held in
+// memory at once while processing a range of updates.  It is never
+// smaller than the number of MDs fetched from the server at a time.
+func mdWindowSize(config Config) int {
+	size := config.MaxMDsInMemory()
+	if size < maxMDsAtATime {
+		size = maxMDsAtATime
+	}
+	return size
+}
+
+// mdWindowFunc processes one window of consecutive MD updates, in
+// increasing revision order.
+type mdWindowFunc func(rmds []*RootMetadata) error
+
+// makeMergedMDsReadable makes sure that the private data in each of
+// the given merged MDs is readable.  Because rekeys can append a MD
+// revision with the new key, older revisions might not be readable
+// until the newer revision, containing the key for this device, is
+// processed.  If the given window isn't the last one in its range and
+// its own most recent MD doesn't have the needed key, the current
+// merged head is used as the source of keys instead.
+func makeMergedMDsReadable(ctx context.Context, config Config, id TlfID,
+	rmds []*RootMetadata, isLastWindow bool) error {
+	var head *RootMetadata
+	for _, rmd := range rmds {
+		if err := rmd.isReadableOrError(ctx, config); err == nil {
+			continue
+		}
+		// The right secret key for the given rmd's key generation
+		// may only be present in the most recent rmd.
+		latestRmd := rmds[len(rmds)-1]
+		err := decryptMDPrivateData(ctx, config, rmd, latestRmd)
+		if isLastWindow {
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err == nil && rmd.isReadableOrError(ctx, config) == nil {
+			continue
+		}
+
+		if head == nil {
+			head, err = config.MDOps().GetForTLF(ctx, id)
+			if err != nil {
+				return err
+			}
+			if head == nil {
+				return fmt.Errorf("No merged head found for %s", id)
+			}
+		}
+		if err := decryptMDPrivateData(ctx, config, rmd, head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachMergedMDWindow fetches all the merged MD updates starting at
+// startRev, and passes them to fn in order, in windows of at most
+// mdWindowSize(config) revisions.  Only one window is held in memory
+// at a time.  Each window has been made readable before fn is called.
+func forEachMergedMDWindow(ctx context.Context, config Config, id TlfID,
+	startRev MetadataRevision, fn mdWindowFunc) error {
 	// We don't yet know about any revisions yet, so there's no range
 	// to get.
 	if startRev < MetadataRevisionInitial {
-		return nil, nil
+		return nil
 	}
 
+	windowSize := mdWindowSize(config)
+	var window []*RootMetadata
 	start := startRev
 	for {
 		end := start + maxMDsAtATime - 1 // range is inclusive
 		rmds, err := getMDRange(ctx, config, id, NullBranchID, start, end,
 			Merged)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		mergedRmds = append(mergedRmds, rmds...)
+		window = append(window, rmds...)
+		isLastWindow := len(rmds) < maxMDsAtATime
+		if len(window) > 0 && (isLastWindow || len(window) >= windowSize) {
+			err := makeMergedMDsReadable(ctx, config, id, window, isLastWindow)
+			if err != nil {
+				return err
+			}
+			if err := fn(window); err != nil {
+				return err
+			}
+			window = nil
+		}
 
-		// TODO: limit the number of MDs we're allowed to hold in
-		// memory at any one time?
-		if len(rmds) < maxMDsAtATime {
+		if isLastWindow {
 			break
 		}
 		start = end + 1
 	}
+	return nil
+}
 
-	// Check the readability of each MD.  Because rekeys can append a
-	// MD revision with the new key, older revisions might not be
-	// readable until the newer revision, containing the key for this
-	// device, is processed.
-	for _, rmd := range mergedRmds {
-		if err := rmd.isReadableOrError(ctx, config); err != nil {
-			// The right secret key for the given rmd's key generation
-			// may only be present in the most recent rmd.
-			latestRmd := mergedRmds[len(mergedRmds)-1]
-			if err := decryptMDPrivateData(ctx, config,
-				rmd, latestRmd); err != nil {
-				return nil, err
-			}
-		}
+// getMergedMDUpdates returns all the merged MD updates starting at
+// startRev.  Callers that might process a very long history should
+// use forEachMergedMDWindow instead, to bound memory usage.
+func getMergedMDUpdates(ctx context.Context, config Config, id TlfID,
+	startRev MetadataRevision) (mergedRmds []*RootMetadata, err error) {
+	err = forEachMergedMDWindow(ctx, config, id, startRev,
+		func(rmds []*RootMetadata) error {
+			mergedRmds = append(mergedRmds, rmds...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
 	}
 	return mergedRmds, nil
 }
 
-func getUnmergedMDUpdates(ctx context.Context, config Config, id TlfID,
-	bid BranchID, startRev MetadataRevision) (
-	currHead MetadataRevision, unmergedRmds []*RootMetadata, err error) {
+// forEachUnmergedMDWindowBackwards walks backwards from startRev
+// through the unmerged MD updates on the given branch, until it finds
+// the branch point.  It passes the updates to fn in windows of at
+// most mdWindowSize(config) revisions, newest window first; the MDs
+// within each window are in increasing revision order.  It returns
+// the revision of the branch point.
+func forEachUnmergedMDWindowBackwards(ctx context.Context, config Config,
+	id TlfID, bid BranchID, startRev MetadataRevision, fn mdWindowFunc) (
+	currHead MetadataRevision, err error) {
 	// We don't yet know about any revisions yet, so there's no range
 	// to get.
 	if startRev < MetadataRevisionInitial {
-		return MetadataRevisionUninitialized, nil, nil
+		return MetadataRevisionUninitialized, nil
 	}
 
+	windowSize := mdWindowSize(config)
+	var window []*RootMetadata
 	// walk backwards until we find one that is merged
 	currHead = startRev
 	for {
@@ -169,28 +250,93 @@ func getUnmergedMDUpdates(ctx context.Context, config Config, id TlfID,
 		rmds, err := getMDRange(ctx, config, id, bid, startRev, currHead,
 			Unmerged)
 		if err != nil {
-			return MetadataRevisionUninitialized, nil, err
+			return MetadataRevisionUninitialized, err
 		}
 
 		numNew := len(rmds)
 		// prepend to keep the ordering correct
-		unmergedRmds = append(rmds, unmergedRmds...)
+		window = append(rmds, window...)
 
 		// on the next iteration, start apply the previous root
 		if numNew > 0 {
 			currHead = rmds[0].Revision - 1
 		}
 		if currHead < MetadataRevisionInitial {
-			return MetadataRevisionUninitialized, nil,
+			return MetadataRevisionUninitialized,
 				errors.New("Ran out of MD updates to unstage!")
 		}
-		// TODO: limit the number of MDs we're allowed to hold in
-		// memory at any one time?
-		if numNew < maxMDsAtATime {
+		isLastWindow := numNew < maxMDsAtATime
+		if len(window) > 0 && (isLastWindow || len(window) >= windowSize) {
+			if err := fn(window); err != nil {
+				return MetadataRevisionUninitialized, err
+			}
+			window = nil
+		}
+		if isLastWindow {
 			break
 		}
 	}
-	return currHead, unmergedRmds, nil
+	return currHead, nil
+}
+
+// forEachUnmergedMDWindow passes all the unmerged MD updates on the
+// given branch, up to and including startRev, to fn in increasing
+// revision order, in windows of at most mdWindowSize(config)
+// revisions.  It returns the revision of the branch point.
+//
+// Finding the branch point requires walking backwards through the
+// branch first.  Only the oldest window from that walk is kept in
+// memory; any newer windows are fetched again (usually from the MD
+// cache) on the way forward.
+func forEachUnmergedMDWindow(ctx context.Context, config Config, id TlfID,
+	bid BranchID, startRev MetadataRevision, fn mdWindowFunc) (
+	branchPoint MetadataRevision, err error) {
+	var oldest []*RootMetadata
+	branchPoint, err = forEachUnmergedMDWindowBackwards(
+		ctx, config, id, bid, startRev, func(rmds []*RootMetadata) error {
+			oldest = rmds
+			return nil
+		})
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	if len(oldest) == 0 {
+		return branchPoint, nil
+	}
+
+	start := oldest[len(oldest)-1].Revision + 1
+	if err := fn(oldest); err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	oldest = nil
+
+	windowSize := mdWindowSize(config)
+	var window []*RootMetadata
+	for start <= startRev {
+		end := start + maxMDsAtATime - 1 // range is inclusive
+		if end > startRev {
+			end = startRev
+		}
+		rmds, err := getMDRange(ctx, config, id, bid, start, end, Unmerged)
+		if err != nil {
+			return MetadataRevisionUninitialized, err
+		}
+		if len(rmds) != int(end-start)+1 || rmds[0].Revision != start {
+			return MetadataRevisionUninitialized, fmt.Errorf(
+				"Couldn't refetch unmerged MDs %d-%d for branch %s",
+				start, end, bid)
+		}
+
+		window = append(window, rmds...)
+		start = end + 1
+		if len(window) >= windowSize || start > startRev {
+			if err := fn(window); err != nil {
+				return MetadataRevisionUninitialized, err
+			}
+			window = nil
+		}
+	}
+	return branchPoint, nil
 }
 
 func decryptMDPrivateData(ctx context.Context, config Config,
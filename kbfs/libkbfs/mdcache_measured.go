@@ -0,0 +1,50 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/metricsutil"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// MDCacheMeasured delegates to another MDCache instance but also
+// keeps track of stats.
+type MDCacheMeasured struct {
+	delegate      MDCache
+	getCountMeter metrics.Meter
+	hitCountMeter metrics.Meter
+}
+
+var _ MDCache = MDCacheMeasured{}
+
+// NewMDCacheMeasured creates and returns a new MDCacheMeasured
+// instance with the given delegate and registry.
+func NewMDCacheMeasured(delegate MDCache, r metrics.Registry) MDCacheMeasured {
+	getCountMeter := metrics.GetOrRegisterMeter("MDCache.GetCount", r)
+	hitCountMeter := metrics.GetOrRegisterMeter("MDCache.HitCount", r)
+	metricsutil.GetOrRegisterRatioGauge(
+		"MDCache.HitRatio", hitCountMeter, getCountMeter, r)
+	return MDCacheMeasured{
+		delegate:      delegate,
+		getCountMeter: getCountMeter,
+		hitCountMeter: hitCountMeter,
+	}
+}
+
+// Get implements the MDCache interface for MDCacheMeasured.
+func (m MDCacheMeasured) Get(tlf TlfID, rev MetadataRevision, bid BranchID) (
+	*RootMetadata, error) {
+	md, err := m.delegate.Get(tlf, rev, bid)
+	m.getCountMeter.Mark(1)
+	if err == nil {
+		m.hitCountMeter.Mark(1)
+	}
+	return md, err
+}
+
+// Put implements the MDCache interface for MDCacheMeasured.
+func (m MDCacheMeasured) Put(md *RootMetadata) error {
+	return m.delegate.Put(md)
+}
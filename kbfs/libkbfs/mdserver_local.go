@@ -659,6 +659,22 @@ func (md *MDServerLocal) RegisterForUpdate(ctx context.Context, id TlfID,
 	return c, nil
 }
 
+// CancelRegistration implements the MDServer interface for
+// MDServerLocal.
+func (md *MDServerLocal) CancelRegistration(_ context.Context, id TlfID) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	c, ok := md.observers[id][md]
+	if !ok {
+		return
+	}
+	close(c)
+	delete(md.observers[id], md)
+	if len(md.observers[id]) == 0 {
+		delete(md.observers, id)
+	}
+}
+
 func getTruncateLockKey(id TlfID) ([]byte, error) {
 	buf := &bytes.Buffer{}
 	// add folder id
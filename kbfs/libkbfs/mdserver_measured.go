@@ -0,0 +1,175 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// MDServerMeasured delegates to another MDServer instance but also
+// keeps track of stats.
+type MDServerMeasured struct {
+	delegate                   MDServer
+	getForHandleTimer          metrics.Timer
+	getForTLFTimer             metrics.Timer
+	getRangeTimer              metrics.Timer
+	putTimer                   metrics.Timer
+	pruneBranchTimer           metrics.Timer
+	registerForUpdateTimer     metrics.Timer
+	truncateLockTimer          metrics.Timer
+	truncateUnlockTimer        metrics.Timer
+	getLatestHandleForTLFTimer metrics.Timer
+}
+
+var _ MDServer = MDServerMeasured{}
+
+// NewMDServerMeasured creates and returns a new MDServerMeasured
+// instance with the given delegate and registry.
+func NewMDServerMeasured(delegate MDServer, r metrics.Registry) MDServerMeasured {
+	getForHandleTimer := metrics.GetOrRegisterTimer("MDServer.GetForHandle", r)
+	getForTLFTimer := metrics.GetOrRegisterTimer("MDServer.GetForTLF", r)
+	getRangeTimer := metrics.GetOrRegisterTimer("MDServer.GetRange", r)
+	putTimer := metrics.GetOrRegisterTimer("MDServer.Put", r)
+	pruneBranchTimer := metrics.GetOrRegisterTimer("MDServer.PruneBranch", r)
+	registerForUpdateTimer := metrics.GetOrRegisterTimer("MDServer.RegisterForUpdate", r)
+	truncateLockTimer := metrics.GetOrRegisterTimer("MDServer.TruncateLock", r)
+	truncateUnlockTimer := metrics.GetOrRegisterTimer("MDServer.TruncateUnlock", r)
+	getLatestHandleForTLFTimer := metrics.GetOrRegisterTimer("MDServer.GetLatestHandleForTLF", r)
+	return MDServerMeasured{
+		delegate:                   delegate,
+		getForHandleTimer:          getForHandleTimer,
+		getForTLFTimer:             getForTLFTimer,
+		getRangeTimer:              getRangeTimer,
+		putTimer:                   putTimer,
+		pruneBranchTimer:           pruneBranchTimer,
+		registerForUpdateTimer:     registerForUpdateTimer,
+		truncateLockTimer:          truncateLockTimer,
+		truncateUnlockTimer:        truncateUnlockTimer,
+		getLatestHandleForTLFTimer: getLatestHandleForTLFTimer,
+	}
+}
+
+// RefreshAuthToken implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) RefreshAuthToken(ctx context.Context) {
+	m.delegate.RefreshAuthToken(ctx)
+}
+
+// GetForHandle implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	tlfID TlfID, rmds *RootMetadataSigned, err error) {
+	m.getForHandleTimer.Time(func() {
+		tlfID, rmds, err = m.delegate.GetForHandle(ctx, handle, mStatus)
+	})
+	return tlfID, rmds, err
+}
+
+// GetForTLF implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (rmds *RootMetadataSigned, err error) {
+	m.getForTLFTimer.Time(func() {
+		rmds, err = m.delegate.GetForTLF(ctx, id, bid, mStatus)
+	})
+	return rmds, err
+}
+
+// GetRange implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	rmdses []*RootMetadataSigned, err error) {
+	m.getRangeTimer.Time(func() {
+		rmdses, err = m.delegate.GetRange(
+			ctx, id, bid, mStatus, start, stop)
+	})
+	return rmdses, err
+}
+
+// Put implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) Put(ctx context.Context,
+	rmds *RootMetadataSigned) (err error) {
+	m.putTimer.Time(func() {
+		err = m.delegate.Put(ctx, rmds)
+	})
+	return err
+}
+
+// PruneBranch implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) PruneBranch(ctx context.Context, id TlfID,
+	bid BranchID) (err error) {
+	m.pruneBranchTimer.Time(func() {
+		err = m.delegate.PruneBranch(ctx, id, bid)
+	})
+	return err
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// MDServerMeasured.  Only the registration itself is timed, not the
+// wait for an update.
+func (m MDServerMeasured) RegisterForUpdate(ctx context.Context, id TlfID,
+	currHead MetadataRevision) (c <-chan error, err error) {
+	m.registerForUpdateTimer.Time(func() {
+		c, err = m.delegate.RegisterForUpdate(ctx, id, currHead)
+	})
+	return c, err
+}
+
+// CancelRegistration implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) CancelRegistration(ctx context.Context, id TlfID) {
+	m.delegate.CancelRegistration(ctx, id)
+}
+
+// CheckForRekeys implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) CheckForRekeys(ctx context.Context) <-chan error {
+	return m.delegate.CheckForRekeys(ctx)
+}
+
+// TruncateLock implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) TruncateLock(ctx context.Context, id TlfID) (
+	locked bool, err error) {
+	m.truncateLockTimer.Time(func() {
+		locked, err = m.delegate.TruncateLock(ctx, id)
+	})
+	return locked, err
+}
+
+// TruncateUnlock implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) TruncateUnlock(ctx context.Context, id TlfID) (
+	unlocked bool, err error) {
+	m.truncateUnlockTimer.Time(func() {
+		unlocked, err = m.delegate.TruncateUnlock(ctx, id)
+	})
+	return unlocked, err
+}
+
+// DisableRekeyUpdatesForTesting implements the MDServer interface
+// for MDServerMeasured.
+func (m MDServerMeasured) DisableRekeyUpdatesForTesting() {
+	m.delegate.DisableRekeyUpdatesForTesting()
+}
+
+// Shutdown implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) Shutdown() {
+	m.delegate.Shutdown()
+}
+
+// IsConnected implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) IsConnected() bool {
+	return m.delegate.IsConnected()
+}
+
+// GetLatestHandleForTLF implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) GetLatestHandleForTLF(ctx context.Context,
+	id TlfID) (handle *BareTlfHandle, err error) {
+	m.getLatestHandleForTLFTimer.Time(func() {
+		handle, err = m.delegate.GetLatestHandleForTLF(ctx, id)
+	})
+	return handle, err
+}
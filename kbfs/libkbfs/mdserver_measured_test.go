@@ -0,0 +1,42 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+func TestMDServerMeasuredTimers(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	registry := metrics.NewRegistry()
+	mdServer := NewMDServerMeasured(config.MDServer(), registry)
+
+	ctx := context.Background()
+	id := FakeTlfID(1, false)
+	if _, err := mdServer.GetForTLF(
+		ctx, id, NullBranchID, Merged); err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	_, _ = mdServer.GetRange(ctx, id, NullBranchID, Merged, 1, 2)
+
+	for name, expected := range map[string]int64{
+		"MDServer.GetForTLF": 1,
+		"MDServer.GetRange":  1,
+		"MDServer.Put":       0,
+	} {
+		timer, ok := registry.Get(name).(metrics.Timer)
+		if !ok {
+			t.Errorf("No timer registered for %s", name)
+			continue
+		}
+		if c := timer.Count(); c != expected {
+			t.Errorf("%s count: expected %d, got %d", name, expected, c)
+		}
+	}
+}
@@ -42,8 +42,11 @@ type MDServerRemote struct {
 	authenticatedMtx sync.Mutex
 	isAuthenticated  bool
 
-	observerMu sync.Mutex // protects observers
+	observerMu sync.Mutex // protects observers and canceledObservers
 	observers  map[TlfID]chan<- error
+	// canceledObservers holds the folders whose registrations were
+	// canceled locally, but are still held by the server.
+	canceledObservers map[TlfID]bool
 
 	tickerCancel context.CancelFunc
 	tickerMu     sync.Mutex // protects the ticker cancel function
@@ -67,10 +70,11 @@ var _ rpc.ConnectionHandler = (*MDServerRemote)(nil)
 // NewMDServerRemote returns a new instance of MDServerRemote.
 func NewMDServerRemote(config Config, srvAddr string) *MDServerRemote {
 	mdServer := &MDServerRemote{
-		config:     config,
-		observers:  make(map[TlfID]chan<- error),
-		log:        config.MakeLogger(""),
-		rekeyTimer: time.NewTimer(MdServerBackgroundRekeyPeriod),
+		config:            config,
+		observers:         make(map[TlfID]chan<- error),
+		canceledObservers: make(map[TlfID]bool),
+		log:               config.MakeLogger(""),
+		rekeyTimer:        time.NewTimer(MdServerBackgroundRekeyPeriod),
 	}
 	mdServer.authToken = NewAuthToken(config,
 		MdServerTokenServer, MdServerTokenExpireIn,
@@ -123,6 +127,8 @@ func (md *MDServerRemote) OnConnect(ctx context.Context,
 	pingIntervalSeconds, err := md.resetAuth(ctx, c)
 	switch err.(type) {
 	case nil:
+		// The queue was cleared on the last disconnect.
+		md.config.RekeyQueue().Restore(ctx)
 	case NoCurrentSessionError:
 	default:
 		return err
@@ -309,6 +315,8 @@ func (md *MDServerRemote) cancelObservers() {
 	for id, observerChan := range md.observers {
 		md.signalObserverLocked(observerChan, id, MDServerDisconnected{})
 	}
+	// The server drops its registrations along with the connection.
+	md.canceledObservers = make(map[TlfID]bool)
 }
 
 // Signal an observer. The observer lock must be held.
@@ -455,7 +463,9 @@ func (md *MDServerRemote) MetadataUpdate(_ context.Context, arg keybase1.Metadat
 	defer md.observerMu.Unlock()
 	observerChan, ok := md.observers[id]
 	if !ok {
-		// not registered
+		// Not registered, or canceled, in which case the server
+		// is done with the registration now.
+		delete(md.canceledObservers, id)
 		return nil
 	}
 
@@ -476,7 +486,7 @@ func (md *MDServerRemote) FolderNeedsRekey(_ context.Context, arg keybase1.Folde
 		return nil
 	}
 	// queue the folder for rekeying
-	errChan := md.config.RekeyQueue().Enqueue(id)
+	errChan := md.config.RekeyQueue().Enqueue(id, RekeyPriorityBackground)
 	select {
 	case err := <-errChan:
 		md.log.Warning("MDServerRemote: error queueing %s for rekey: %v", id, err)
@@ -497,6 +507,23 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id TlfID,
 		LogTags:      LogTagsFromContextToMap(ctx),
 	}
 
+	// If the server still holds a canceled registration for this
+	// folder, take it over rather than registering twice.  At
+	// worst, it fires for an update the caller already has.
+	if c := func() chan error {
+		md.observerMu.Lock()
+		defer md.observerMu.Unlock()
+		if !md.canceledObservers[id] {
+			return nil
+		}
+		delete(md.canceledObservers, id)
+		c := make(chan error, 1)
+		md.observers[id] = c
+		return c
+	}(); c != nil {
+		return c, nil
+	}
+
 	// register
 	var c chan error
 	err := md.conn.DoCommand(ctx, "register", func(rawClient rpc.GenericClient) error {
@@ -550,6 +577,22 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id TlfID,
 	return c, err
 }
 
+// CancelRegistration implements the MDServer interface for
+// MDServerRemote.  The protocol has no way to cancel a registration
+// on the server, which keeps it until it sends the next update for
+// the folder, or the connection drops.  Until then, the next
+// RegisterForUpdate call for the folder takes the registration
+// over, and otherwise the update is ignored.
+func (md *MDServerRemote) CancelRegistration(_ context.Context, id TlfID) {
+	md.observerMu.Lock()
+	defer md.observerMu.Unlock()
+	if observerChan, ok := md.observers[id]; ok {
+		close(observerChan)
+		delete(md.observers, id)
+		md.canceledObservers[id] = true
+	}
+}
+
 // TruncateLock implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) TruncateLock(ctx context.Context, id TlfID) (
 	bool, error) {
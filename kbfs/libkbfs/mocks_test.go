@@ -431,6 +431,57 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetXattrs(_param0 context.Context, _param1 Node) (map[string][]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetXattrs", _param0, _param1)
+	ret0, _ := ret[0].(map[string][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetXattrs(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetXattrs", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetXattr(_param0 context.Context, _param1 Node, _param2 string, _param3 []byte) error {
+	ret := _m.ctrl.Call(_m, "SetXattr", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetXattr(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetXattr", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) RemoveXattr(_param0 context.Context, _param1 Node, _param2 string) error {
+	ret := _m.ctrl.Call(_m, "RemoveXattr", _param0, _param1, _param2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) LockFile(_param0 context.Context, _param1 Node, _param2 uint64) error {
+	ret := _m.ctrl.Call(_m, "LockFile", _param0, _param1, _param2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) LockFile(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockFile", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) UnlockFile(_param0 context.Context, _param1 Node, _param2 uint64) error {
+	ret := _m.ctrl.Call(_m, "UnlockFile", _param0, _param1, _param2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) UnlockFile(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnlockFile", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Sync(ctx context.Context, file Node) error {
 	ret := _m.ctrl.Call(_m, "Sync", ctx, file)
 	ret0, _ := ret[0].(error)
@@ -506,6 +557,61 @@ func (_mr *_MockKBFSOpsRecorder) GetUpdateHistory(arg0, arg1 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUpdateHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetTLFUsage(_param0 context.Context, _param1 FolderBranch) (TLFUsage, error) {
+	ret := _m.ctrl.Call(_m, "GetTLFUsage", _param0, _param1)
+	ret0, _ := ret[0].(TLFUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetTLFUsage(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFUsage", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) GetActivity(_param0 context.Context, _param1 FolderBranch, _param2 ActivityQuery) (TLFActivity, error) {
+	ret := _m.ctrl.Call(_m, "GetActivity", _param0, _param1, _param2)
+	ret0, _ := ret[0].(TLFActivity)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetActivity(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetActivity", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) RestoreFromTrash(_param0 context.Context, _param1 FolderBranch, _param2 string, _param3 string) (string, error) {
+	ret := _m.ctrl.Call(_m, "RestoreFromTrash", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) RestoreFromTrash(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RestoreFromTrash", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) MergeConflictedTLF(_param0 context.Context, _param1 *TlfHandle) (TLFMergeResult, error) {
+	ret := _m.ctrl.Call(_m, "MergeConflictedTLF", _param0, _param1)
+	ret0, _ := ret[0].(TLFMergeResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) MergeConflictedTLF(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MergeConflictedTLF", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) CloneTLF(_param0 context.Context, _param1 *TlfHandle, _param2 *TlfHandle, _param3 func(TLFCloneProgress)) (TLFCloneProgress, error) {
+	ret := _m.ctrl.Call(_m, "CloneTLF", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].(TLFCloneProgress)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CloneTLF(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CloneTLF", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -1011,6 +1117,17 @@ func (_mr *_MockReporterRecorder) AllKnownErrors() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "AllKnownErrors")
 }
 
+func (_m *MockReporter) QueryErrors(_param0 ErrorQuery) ([]ErrorRecord, error) {
+	ret := _m.ctrl.Call(_m, "QueryErrors", _param0)
+	ret0, _ := ret[0].([]ErrorRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockReporterRecorder) QueryErrors(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "QueryErrors", arg0)
+}
+
 func (_m *MockReporter) Notify(ctx context.Context, notification *protocol.FSNotification) {
 	_m.ctrl.Call(_m, "Notify", ctx, notification)
 }
@@ -1234,6 +1351,74 @@ func (_mr *_MockBlockCacheRecorder) DirtyBytesEstimate() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DirtyBytesEstimate")
 }
 
+func (_m *MockBlockCache) CleanBytesCapacity() uint64 {
+	ret := _m.ctrl.Call(_m, "CleanBytesCapacity")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockBlockCacheRecorder) CleanBytesCapacity() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CleanBytesCapacity")
+}
+
+// Mock of DirtyBudget interface
+type MockDirtyBudget struct {
+	ctrl     *gomock.Controller
+	recorder *_MockDirtyBudgetRecorder
+}
+
+// Recorder for MockDirtyBudget (not exported)
+type _MockDirtyBudgetRecorder struct {
+	mock *MockDirtyBudget
+}
+
+func NewMockDirtyBudget(ctrl *gomock.Controller) *MockDirtyBudget {
+	mock := &MockDirtyBudget{ctrl: ctrl}
+	mock.recorder = &_MockDirtyBudgetRecorder{mock}
+	return mock
+}
+
+func (_m *MockDirtyBudget) EXPECT() *_MockDirtyBudgetRecorder {
+	return _m.recorder
+}
+
+func (_m *MockDirtyBudget) CheckRoom() (bool, <-chan struct{}) {
+	ret := _m.ctrl.Call(_m, "CheckRoom")
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(<-chan struct{})
+	return ret0, ret1
+}
+
+func (_mr *_MockDirtyBudgetRecorder) CheckRoom() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CheckRoom")
+}
+
+func (_m *MockDirtyBudget) BytesPut(_param0 uint64) {
+	_m.ctrl.Call(_m, "BytesPut", _param0)
+}
+
+func (_mr *_MockDirtyBudgetRecorder) BytesPut(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BytesPut", arg0)
+}
+
+func (_m *MockDirtyBudget) SyncFinished(_param0 uint64) {
+	_m.ctrl.Call(_m, "SyncFinished", _param0)
+}
+
+func (_mr *_MockDirtyBudgetRecorder) SyncFinished(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SyncFinished", arg0)
+}
+
+func (_m *MockDirtyBudget) Status() DirtyBudgetStatus {
+	ret := _m.ctrl.Call(_m, "Status")
+	ret0, _ := ret[0].(DirtyBudgetStatus)
+	return ret0
+}
+
+func (_mr *_MockDirtyBudgetRecorder) Status() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Status")
+}
+
 // Mock of Crypto interface
 type MockCrypto struct {
 	ctrl     *gomock.Controller
@@ -1855,6 +2040,16 @@ func (_mr *_MockBlockOpsRecorder) Put(arg0, arg1, arg2, arg3 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockBlockOps) PutBatch(_param0 context.Context, _param1 *RootMetadata, _param2 []BlockPointer, _param3 []ReadyBlockData) error {
+	ret := _m.ctrl.Call(_m, "PutBatch", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBlockOpsRecorder) PutBatch(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutBatch", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockBlockOps) Delete(ctx context.Context, md *RootMetadata, ptrs []BlockPointer) (map[BlockID]int, error) {
 	ret := _m.ctrl.Call(_m, "Delete", ctx, md, ptrs)
 	ret0, _ := ret[0].(map[BlockID]int)
@@ -1970,6 +2165,14 @@ func (_mr *_MockMDServerRecorder) RegisterForUpdate(arg0, arg1, arg2 interface{}
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForUpdate", arg0, arg1, arg2)
 }
 
+func (_m *MockMDServer) CancelRegistration(_param0 context.Context, _param1 TlfID) {
+	_m.ctrl.Call(_m, "CancelRegistration", _param0, _param1)
+}
+
+func (_mr *_MockMDServerRecorder) CancelRegistration(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CancelRegistration", arg0, arg1)
+}
+
 func (_m *MockMDServer) CheckForRekeys(ctx context.Context) <-chan error {
 	ret := _m.ctrl.Call(_m, "CheckForRekeys", ctx)
 	ret0, _ := ret[0].(<-chan error)
@@ -2090,6 +2293,16 @@ func (_mr *_MockBlockServerRecorder) Put(arg0, arg1, arg2, arg3, arg4, arg5 inte
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockBlockServer) PutBlocks(_param0 context.Context, _param1 TlfID, _param2 []BlockServerPut) error {
+	ret := _m.ctrl.Call(_m, "PutBlocks", _param0, _param1, _param2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBlockServerRecorder) PutBlocks(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutBlocks", arg0, arg1, arg2)
+}
+
 func (_m *MockBlockServer) AddBlockReference(ctx context.Context, id BlockID, tlfID TlfID, context BlockContext) error {
 	ret := _m.ctrl.Call(_m, "AddBlockReference", ctx, id, tlfID, context)
 	ret0, _ := ret[0].(error)
@@ -2100,6 +2313,16 @@ func (_mr *_MockBlockServerRecorder) AddBlockReference(arg0, arg1, arg2, arg3 in
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddBlockReference", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockBlockServer) AddBlockReferences(_param0 context.Context, _param1 TlfID, _param2 map[BlockID][]BlockContext) error {
+	ret := _m.ctrl.Call(_m, "AddBlockReferences", _param0, _param1, _param2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBlockServerRecorder) AddBlockReferences(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddBlockReferences", arg0, arg1, arg2)
+}
+
 func (_m *MockBlockServer) RemoveBlockReference(ctx context.Context, tlfID TlfID, contexts map[BlockID][]BlockContext) (map[BlockID]int, error) {
 	ret := _m.ctrl.Call(_m, "RemoveBlockReference", ctx, tlfID, contexts)
 	ret0, _ := ret[0].(map[BlockID]int)
@@ -2818,6 +3041,24 @@ func (_mr *_MockConfigRecorder) SetRekeyQueue(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetRekeyQueue", arg0)
 }
 
+func (_m *MockConfig) DirtyBudget() DirtyBudget {
+	ret := _m.ctrl.Call(_m, "DirtyBudget")
+	ret0, _ := ret[0].(DirtyBudget)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DirtyBudget() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DirtyBudget")
+}
+
+func (_m *MockConfig) SetDirtyBudget(_param0 DirtyBudget) {
+	_m.ctrl.Call(_m, "SetDirtyBudget", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDirtyBudget(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDirtyBudget", arg0)
+}
+
 func (_m *MockConfig) ReqsBufSize() int {
 	ret := _m.ctrl.Call(_m, "ReqsBufSize")
 	ret0, _ := ret[0].(int)
@@ -2970,6 +3211,168 @@ func (_mr *_MockConfigRecorder) SetTLFValidDuration(arg0 interface{}) *gomock.Ca
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTLFValidDuration", arg0)
 }
 
+func (_m *MockConfig) MaxMDsInMemory() int {
+	ret := _m.ctrl.Call(_m, "MaxMDsInMemory")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxMDsInMemory() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxMDsInMemory")
+}
+
+func (_m *MockConfig) SetMaxMDsInMemory(_param0 int) {
+	_m.ctrl.Call(_m, "SetMaxMDsInMemory", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMaxMDsInMemory(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMaxMDsInMemory", arg0)
+}
+
+func (_m *MockConfig) ReadAheadBlocks() int {
+	ret := _m.ctrl.Call(_m, "ReadAheadBlocks")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ReadAheadBlocks() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReadAheadBlocks")
+}
+
+func (_m *MockConfig) SetReadAheadBlocks(_param0 int) {
+	_m.ctrl.Call(_m, "SetReadAheadBlocks", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetReadAheadBlocks(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetReadAheadBlocks", arg0)
+}
+
+func (_m *MockConfig) PrefetchDirChildren() bool {
+	ret := _m.ctrl.Call(_m, "PrefetchDirChildren")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) PrefetchDirChildren() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PrefetchDirChildren")
+}
+
+func (_m *MockConfig) SetPrefetchDirChildren(_param0 bool) {
+	_m.ctrl.Call(_m, "SetPrefetchDirChildren", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetPrefetchDirChildren(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPrefetchDirChildren", arg0)
+}
+
+func (_m *MockConfig) MaxParallelBlockPuts() int {
+	ret := _m.ctrl.Call(_m, "MaxParallelBlockPuts")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxParallelBlockPuts() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxParallelBlockPuts")
+}
+
+func (_m *MockConfig) SetMaxParallelBlockPuts(_param0 int) {
+	_m.ctrl.Call(_m, "SetMaxParallelBlockPuts", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMaxParallelBlockPuts(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMaxParallelBlockPuts", arg0)
+}
+
+func (_m *MockConfig) DirtyBytesThreshold() uint64 {
+	ret := _m.ctrl.Call(_m, "DirtyBytesThreshold")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DirtyBytesThreshold() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DirtyBytesThreshold")
+}
+
+func (_m *MockConfig) SetDirtyBytesThreshold(_param0 uint64) {
+	_m.ctrl.Call(_m, "SetDirtyBytesThreshold", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDirtyBytesThreshold(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDirtyBytesThreshold", arg0)
+}
+
+func (_m *MockConfig) BackgroundFlushPeriod() time.Duration {
+	ret := _m.ctrl.Call(_m, "BackgroundFlushPeriod")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BackgroundFlushPeriod() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BackgroundFlushPeriod")
+}
+
+func (_m *MockConfig) SetBackgroundFlushPeriod(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetBackgroundFlushPeriod", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBackgroundFlushPeriod(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBackgroundFlushPeriod", arg0)
+}
+
+func (_m *MockConfig) MaxRetriesOnRecoverableErrors() int {
+	ret := _m.ctrl.Call(_m, "MaxRetriesOnRecoverableErrors")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxRetriesOnRecoverableErrors() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxRetriesOnRecoverableErrors")
+}
+
+func (_m *MockConfig) SetMaxRetriesOnRecoverableErrors(_param0 int) {
+	_m.ctrl.Call(_m, "SetMaxRetriesOnRecoverableErrors", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMaxRetriesOnRecoverableErrors(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMaxRetriesOnRecoverableErrors", arg0)
+}
+
+func (_m *MockConfig) BackgroundTaskTimeout() time.Duration {
+	ret := _m.ctrl.Call(_m, "BackgroundTaskTimeout")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BackgroundTaskTimeout() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BackgroundTaskTimeout")
+}
+
+func (_m *MockConfig) SetBackgroundTaskTimeout(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetBackgroundTaskTimeout", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBackgroundTaskTimeout(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBackgroundTaskTimeout", arg0)
+}
+
+func (_m *MockConfig) MaxDirtyBytes() uint64 {
+	ret := _m.ctrl.Call(_m, "MaxDirtyBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxDirtyBytes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirtyBytes")
+}
+
+func (_m *MockConfig) SetMaxDirtyBytes(_param0 uint64) {
+	_m.ctrl.Call(_m, "SetMaxDirtyBytes", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMaxDirtyBytes(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMaxDirtyBytes", arg0)
+}
+
 func (_m *MockConfig) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -3068,6 +3471,16 @@ func (_mr *_MockNodeCacheRecorder) PathFromNode(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PathFromNode", arg0)
 }
 
+func (_m *MockNodeCache) NumNodes() int {
+	ret := _m.ctrl.Call(_m, "NumNodes")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockNodeCacheRecorder) NumNodes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NumNodes")
+}
+
 // Mock of crAction interface
 type MockcrAction struct {
 	ctrl     *gomock.Controller
@@ -3152,14 +3565,14 @@ func (_m *MockRekeyQueue) EXPECT() *_MockRekeyQueueRecorder {
 	return _m.recorder
 }
 
-func (_m *MockRekeyQueue) Enqueue(_param0 TlfID) <-chan error {
-	ret := _m.ctrl.Call(_m, "Enqueue", _param0)
+func (_m *MockRekeyQueue) Enqueue(_param0 TlfID, _param1 RekeyPriority) <-chan error {
+	ret := _m.ctrl.Call(_m, "Enqueue", _param0, _param1)
 	ret0, _ := ret[0].(<-chan error)
 	return ret0
 }
 
-func (_mr *_MockRekeyQueueRecorder) Enqueue(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Enqueue", arg0)
+func (_mr *_MockRekeyQueueRecorder) Enqueue(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Enqueue", arg0, arg1)
 }
 
 func (_m *MockRekeyQueue) IsRekeyPending(_param0 TlfID) bool {
@@ -3199,3 +3612,30 @@ func (_m *MockRekeyQueue) Wait(ctx context.Context) error {
 func (_mr *_MockRekeyQueueRecorder) Wait(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Wait", arg0)
 }
+
+func (_m *MockRekeyQueue) Status() (RekeyQueueStatus, <-chan StatusUpdate) {
+	ret := _m.ctrl.Call(_m, "Status")
+	ret0, _ := ret[0].(RekeyQueueStatus)
+	ret1, _ := ret[1].(<-chan StatusUpdate)
+	return ret0, ret1
+}
+
+func (_mr *_MockRekeyQueueRecorder) Status() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Status")
+}
+
+func (_m *MockRekeyQueue) Shutdown() {
+	_m.ctrl.Call(_m, "Shutdown")
+}
+
+func (_mr *_MockRekeyQueueRecorder) Shutdown() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
+}
+
+func (_m *MockRekeyQueue) Restore(_param0 context.Context) {
+	_m.ctrl.Call(_m, "Restore", _param0)
+}
+
+func (_mr *_MockRekeyQueueRecorder) Restore(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Restore", arg0)
+}
@@ -4,7 +4,10 @@
 
 package libkbfs
 
-import "runtime"
+import (
+	"runtime"
+	"sync/atomic"
+)
 
 // nodeCore holds info shared among one or more nodeStandard objects.
 type nodeCore struct {
@@ -13,6 +16,16 @@ type nodeCore struct {
 	cache    *nodeCacheStandard
 	// used only when parent is nil (the object has been unlinked)
 	cachedPath path
+	// pathMemo holds the nodePathMemo for the last path constructed
+	// for this node.
+	pathMemo atomic.Value
+}
+
+// nodePathMemo is a path constructed for a node, which is valid only
+// as long as the node cache's path generation hasn't changed.
+type nodePathMemo struct {
+	gen  uint64
+	path []pathNode
 }
 
 func newNodeCore(ptr BlockPointer, name string, parent *nodeStandard,
@@ -27,6 +40,21 @@ func newNodeCore(ptr BlockPointer, name string, parent *nodeStandard,
 	}
 }
 
+// memoizedPath returns the path memoized for this node during the
+// given path generation, or nil if there is none.  The returned slice
+// must not be modified.
+func (c *nodeCore) memoizedPath(gen uint64) []pathNode {
+	memo, ok := c.pathMemo.Load().(nodePathMemo)
+	if !ok || memo.gen != gen {
+		return nil
+	}
+	return memo.path
+}
+
+func (c *nodeCore) memoizePath(gen uint64, p []pathNode) {
+	c.pathMemo.Store(nodePathMemo{gen, p})
+}
+
 func (c *nodeCore) ParentID() NodeID {
 	if c.parent == nil {
 		return nil
@@ -17,10 +17,25 @@ type nodeCacheEntry struct {
 // nodeCacheStandard implements the NodeCache interface by tracking
 // the reference counts of nodeStandard Nodes, and using their member
 // fields to construct paths.
+//
+// Constructed paths are memoized in the node cores.  Since a change
+// to any node's name, parent or pointer changes the paths of all the
+// nodes under it, every such change bumps pathGen, which invalidates
+// all the memoized paths at once.  Invalidating just the subtree
+// under the changed node wouldn't keep any more paths: every write
+// ends by updating the pointers all the way up to the root, whose
+// pointer is in every path.  So memoization helps runs of reads
+// (e.g. lookups and stats of a deep tree), not writes.
 type nodeCacheStandard struct {
 	folderBranch FolderBranch
 	nodes        map[blockRef]*nodeCacheEntry
 	lock         sync.RWMutex
+	// pathGen is protected by lock.
+	pathGen uint64
+	// forgetHook, if set, is called with the ID of each node that is
+	// dropped from the cache because nothing references it anymore.
+	// Protected by lock.
+	forgetHook func(NodeID)
 }
 
 var _ NodeCache = (*nodeCacheStandard)(nil)
@@ -33,28 +48,43 @@ func newNodeCacheStandard(fb FolderBranch) *nodeCacheStandard {
 }
 
 // lock must be locked for writing by the caller
-func (ncs *nodeCacheStandard) forgetLocked(core *nodeCore) {
+// forgetLocked returns true if the node was dropped from the cache.
+func (ncs *nodeCacheStandard) forgetLocked(core *nodeCore) bool {
 	ref := core.pathNode.ref()
 
 	entry, ok := ncs.nodes[ref]
 	if !ok {
-		return
+		return false
 	}
 	if entry.core != core {
-		return
+		return false
 	}
 
 	entry.refCount--
 	if entry.refCount <= 0 {
 		delete(ncs.nodes, ref)
+		return true
 	}
+	return false
 }
 
 // should be called only by nodeStandardFinalizer().
 func (ncs *nodeCacheStandard) forget(core *nodeCore) {
+	ncs.lock.Lock()
+	forgotten := ncs.forgetLocked(core)
+	hook := ncs.forgetHook
+	ncs.lock.Unlock()
+	if forgotten && hook != nil {
+		hook(core)
+	}
+}
+
+// setForgetHook sets the function to call with the ID of each node
+// that is dropped from the cache, replacing any previous one.
+func (ncs *nodeCacheStandard) setForgetHook(hook func(NodeID)) {
 	ncs.lock.Lock()
 	defer ncs.lock.Unlock()
-	ncs.forgetLocked(core)
+	ncs.forgetHook = hook
 }
 
 // lock must be held for writing by the caller
@@ -174,6 +204,7 @@ func (ncs *nodeCacheStandard) UpdatePointer(
 	}
 
 	entry.core.pathNode.BlockPointer = newPtr
+	ncs.pathGen++
 	delete(ncs.nodes, oldRef)
 	ncs.nodes[newPtr.ref()] = entry
 }
@@ -209,6 +240,7 @@ func (ncs *nodeCacheStandard) Move(
 
 	entry.core.parent = newParentNS
 	entry.core.pathNode.Name = newName
+	ncs.pathGen++
 	return nil
 }
 
@@ -234,6 +266,7 @@ func (ncs *nodeCacheStandard) Unlink(ref blockRef, oldPath path) {
 	entry.core.cachedPath = oldPath
 	entry.core.parent = nil
 	entry.core.pathNode.Name = ""
+	ncs.pathGen++
 	return
 }
 
@@ -248,34 +281,55 @@ func (ncs *nodeCacheStandard) PathFromNode(node Node) (p path) {
 		return
 	}
 
-	for ns != nil {
-		core := ns.core
+	p.FolderBranch = ncs.folderBranch
+	// Callers are free to modify the paths they get, so always hand
+	// out copies of the memoized ones.
+	if memo := ns.core.memoizedPath(ncs.pathGen); memo != nil {
+		p.path = make([]pathNode, len(memo))
+		copy(p.path, memo)
+		return p
+	}
+
+	// Walk up until the closest ancestor with a memoized path, and
+	// build this node's path on top of it.
+	var prefix []pathNode
+	var reversed []pathNode
+	for curr := ns; curr != nil; curr = curr.core.parent {
+		core := curr.core
 		if core.parent == nil && len(core.cachedPath.path) > 0 {
 			// The node was unlinked, but is still in use, so use its
-			// cached path.  The path is already reversed, so append
-			// it backwards one-by-one to the existing path.  If this
-			// is the first node, we can just optimize by returning
-			// the complete cached path.
-			if len(p.path) == 0 {
+			// cached path.  If this is the first node, we can just
+			// optimize by returning the complete cached path.
+			if len(reversed) == 0 {
 				return core.cachedPath
 			}
-			for i := len(core.cachedPath.path) - 1; i >= 0; i-- {
-				p.path = append(p.path, core.cachedPath.path[i])
-			}
+			prefix = core.cachedPath.path
 			break
 		}
-
-		p.path = append(p.path, *core.pathNode)
-		ns = core.parent
+		if curr != ns {
+			if memo := core.memoizedPath(ncs.pathGen); memo != nil {
+				prefix = memo
+				break
+			}
+		}
+		reversed = append(reversed, *core.pathNode)
 	}
 
-	// need to reverse the path nodes
-	for i := len(p.path)/2 - 1; i >= 0; i-- {
-		opp := len(p.path) - 1 - i
-		p.path[i], p.path[opp] = p.path[opp], p.path[i]
+	memo := make([]pathNode, len(prefix), len(prefix)+len(reversed))
+	copy(memo, prefix)
+	for i := len(reversed) - 1; i >= 0; i-- {
+		memo = append(memo, reversed[i])
 	}
+	ns.core.memoizePath(ncs.pathGen, memo)
 
-	// TODO: would it make any sense to cache the constructed path?
-	p.FolderBranch = ncs.folderBranch
-	return
+	p.path = make([]pathNode, len(memo))
+	copy(p.path, memo)
+	return p
+}
+
+// NumNodes implements the NodeCache interface for nodeCacheStandard.
+func (ncs *nodeCacheStandard) NumNodes() int {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+	return len(ncs.nodes)
 }
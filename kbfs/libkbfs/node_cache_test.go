@@ -5,8 +5,12 @@
 package libkbfs
 
 import (
+	"encoding/binary"
+	"fmt"
 	"runtime"
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 func setupNodeCache(t *testing.T, id TlfID, branch BranchName, flat bool) (
@@ -439,3 +443,244 @@ func TestNodeCacheGCReal(t *testing.T) {
 	// Make sure childNode2 isn't GCed until after this point.
 	func(interface{}) {}(childNode2)
 }
+
+// Tests that memoized paths are invalidated by changes to any
+// ancestor, and aren't affected by changes to returned paths.
+func TestNodeCachePathMemoInvalidation(t *testing.T) {
+	id := FakeTlfID(42, false)
+	branch := BranchName("testBranch")
+	ncs, parentNode, childNode1, childNode2, _, path2 :=
+		setupNodeCache(t, id, branch, false)
+
+	path := ncs.PathFromNode(childNode2)
+	checkNodeCachePath(t, id, branch, path, path2)
+	// Changing the returned path doesn't change the memoized one.
+	path.path[1].Name = "changed"
+	path = ncs.PathFromNode(childNode2)
+	checkNodeCachePath(t, id, branch, path, path2)
+
+	// Renaming an ancestor changes the path.
+	err := ncs.Move(path2[1].BlockPointer.ref(), parentNode, "child1B")
+	if err != nil {
+		t.Fatalf("Couldn't move: %v", err)
+	}
+	path2[1].Name = "child1B"
+	path = ncs.PathFromNode(childNode2)
+	checkNodeCachePath(t, id, branch, path, path2)
+
+	// So does updating an ancestor's pointer.
+	newParentPtr := BlockPointer{ID: fakeBlockID(10)}
+	ncs.UpdatePointer(path2[0].BlockPointer.ref(), newParentPtr)
+	path2[0].BlockPointer = newParentPtr
+	path = ncs.PathFromNode(childNode2)
+	checkNodeCachePath(t, id, branch, path, path2)
+	path = ncs.PathFromNode(childNode1)
+	checkNodeCachePath(t, id, branch, path, path2[:2])
+}
+
+// Tests that SearchForNodes only returns cached nodes whose paths it
+// could find in the given MD through the given new pointers.
+func TestSearchForNodesCachedNodes(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "f", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	fb := rootNode.GetFolderBranch()
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(fb)
+	md := ops.getHead(makeFBOLockState())
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	newPtrs := make(map[BlockPointer]bool)
+	for _, pn := range filePath.path {
+		newPtrs[pn.BlockPointer] = true
+	}
+	filePtr := filePath.tailPointer()
+
+	nodeMap, err := ops.blocks.SearchForNodes(
+		ctx, ops.nodeCache, []BlockPointer{filePtr}, newPtrs, md)
+	if err != nil {
+		t.Fatalf("Couldn't search: %v", err)
+	}
+	if n := nodeMap[filePtr]; n == nil || n.GetID() != fileNode.GetID() {
+		t.Errorf("Found %v instead of the file node", n)
+	}
+
+	// Without d among the new pointers, a walk wouldn't find f, and
+	// neither does the cache.
+	nodeMap, err = ops.blocks.SearchForNodes(ctx, ops.nodeCache,
+		[]BlockPointer{filePtr}, map[BlockPointer]bool{}, md)
+	if err != nil {
+		t.Fatalf("Couldn't search: %v", err)
+	}
+	if nodeMap[filePtr] != nil {
+		t.Errorf("Found file node %v outside the new pointers",
+			nodeMap[filePtr])
+	}
+
+	// A cached node for a pointer that isn't in the MD isn't found.
+	ncs := newNodeCacheStandard(fb)
+	cacheRoot, err := ncs.GetOrCreate(md.data.Dir.BlockPointer, "test_user", nil)
+	if err != nil {
+		t.Fatalf("Couldn't create root node: %v", err)
+	}
+	missingPtr := fakeDeepBlockPointer(1)
+	missingNode, err := ncs.GetOrCreate(missingPtr, "x", cacheRoot)
+	if err != nil {
+		t.Fatalf("Couldn't create node: %v", err)
+	}
+	nodeMap, err = ops.blocks.SearchForNodes(
+		ctx, ncs, []BlockPointer{missingPtr}, newPtrs, md)
+	if err != nil {
+		t.Fatalf("Couldn't search: %v", err)
+	}
+	if nodeMap[missingPtr] != nil {
+		t.Errorf("Found node %v that isn't in the MD", nodeMap[missingPtr])
+	}
+	runtime.KeepAlive(missingNode)
+}
+
+// fakeDeepBlockPointer returns a distinct block pointer for each
+// positive i, for hierarchies too big for fakeBlockID.
+func fakeDeepBlockPointer(i int) BlockPointer {
+	var dh RawDefaultHash
+	binary.BigEndian.PutUint32(dh[:], uint32(i))
+	h, err := HashFromRaw(DefaultHashType, dh[:])
+	if err != nil {
+		panic(err)
+	}
+	return BlockPointer{ID: BlockID{h}}
+}
+
+// makeDeepNodeCache returns a node cache holding a chain of depth
+// nested nodes, ordered from the root down.
+func makeDeepNodeCache(b *testing.B, depth int) (
+	*nodeCacheStandard, []Node) {
+	ncs := newNodeCacheStandard(FolderBranch{FakeTlfID(0, false), ""})
+	nodes := make([]Node, 0, depth)
+	var parent Node
+	for i := 0; i < depth; i++ {
+		n, err := ncs.GetOrCreate(fakeDeepBlockPointer(i+1),
+			fmt.Sprintf("dir%d", i), parent)
+		if err != nil {
+			b.Fatalf("Couldn't create node: %v", err)
+		}
+		nodes = append(nodes, n)
+		parent = n
+	}
+	return ncs, nodes
+}
+
+// Benchmark constructing the path of the deepest node in deep
+// hierarchies, when its path is memoized, when only its own pointer
+// changes between lookups, and when the root's pointer changes
+// between lookups, which invalidates every memoized path.
+func BenchmarkNodeCachePathFromNodeDeep(b *testing.B) {
+	for _, depth := range []int{10, 100, 1000} {
+		for _, changed := range []string{"none", "leaf", "root"} {
+			b.Run(fmt.Sprintf("depth=%d/changed=%s", depth, changed),
+				func(b *testing.B) {
+					ncs, nodes := makeDeepNodeCache(b, depth)
+					leaf := nodes[len(nodes)-1]
+					var changedNode Node
+					switch changed {
+					case "leaf":
+						changedNode = leaf
+					case "root":
+						changedNode = nodes[0]
+					}
+					// Memoize the path of every node, as if each
+					// directory had been looked up.
+					for _, n := range nodes {
+						ncs.PathFromNode(n)
+					}
+
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						if changedNode != nil {
+							ref := changedNode.(*nodeStandard).core.pathNode.ref()
+							newPtr := fakeDeepBlockPointer(depth + 1 + i)
+							ncs.UpdatePointer(ref, newPtr)
+						}
+						if p := ncs.PathFromNode(leaf); len(p.path) != depth {
+							b.Fatalf("Bad path length %d", len(p.path))
+						}
+					}
+					b.StopTimer()
+				})
+		}
+	}
+}
+
+// Benchmark finding the node for a file at the bottom of a deep
+// hierarchy, both by walking the tree into a fresh node cache (as
+// conflict resolution does) and in the folder's own node cache,
+// which already has the node.
+func BenchmarkSearchForNodesDeep(b *testing.B) {
+	for _, depth := range []int{10, 50} {
+		for _, fresh := range []bool{true, false} {
+			b.Run(fmt.Sprintf("depth=%d/fresh=%t", depth, fresh),
+				func(b *testing.B) {
+					config := MakeTestConfigOrBust(b, "test_user")
+					defer CheckConfigAndShutdown(b, config)
+					ctx := context.Background()
+
+					rootNode := GetRootNodeOrBust(b, config, "test_user", false)
+					kbfsOps := config.KBFSOps()
+					names := make([]string, depth)
+					for i := range names {
+						names[i] = fmt.Sprintf("d%d", i)
+					}
+					dir := makeDirsOrBust(b, ctx, kbfsOps, rootNode, names...)
+					fileNode, _, err := kbfsOps.CreateFile(ctx, dir, "f", false)
+					if err != nil {
+						b.Fatalf("Couldn't create file: %v", err)
+					}
+
+					fb := rootNode.GetFolderBranch()
+					ops := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(fb)
+					md := ops.getHead(makeFBOLockState())
+					filePath := ops.nodeCache.PathFromNode(fileNode)
+					newPtrs := make(map[BlockPointer]bool)
+					for _, pn := range filePath.path {
+						newPtrs[pn.BlockPointer] = true
+					}
+					ptr := filePath.tailPointer()
+
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						cache := NodeCache(ops.nodeCache)
+						if fresh {
+							b.StopTimer()
+							ncs := newNodeCacheStandard(fb)
+							_, err := ncs.GetOrCreate(
+								md.data.Dir.BlockPointer, "test_user", nil)
+							if err != nil {
+								b.Fatalf("Couldn't create root node: %v", err)
+							}
+							cache = ncs
+							b.StartTimer()
+						}
+						nodeMap, err := ops.blocks.SearchForNodes(
+							ctx, cache, []BlockPointer{ptr}, newPtrs, md)
+						if err != nil {
+							b.Fatalf("Couldn't search: %v", err)
+						}
+						if nodeMap[ptr] == nil {
+							b.Fatalf("Couldn't find the file node")
+						}
+					}
+					b.StopTimer()
+				})
+		}
+	}
+}
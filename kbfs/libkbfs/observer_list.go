@@ -39,6 +39,12 @@ func (ol *observerList) remove(o Observer) {
 	}
 }
 
+func (ol *observerList) len() int {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	return len(ol.observers)
+}
+
 func (ol *observerList) localChange(
 	ctx context.Context, node Node, write WriteRange) {
 	ol.lock.RLock()
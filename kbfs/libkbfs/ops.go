@@ -649,6 +649,7 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	xattrAttr
 )
 
 func (ac attrChange) String() string {
@@ -659,6 +660,8 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
 	}
 	return "<invalid attrChange>"
 }
@@ -671,6 +674,9 @@ type setAttrOp struct {
 	Dir  blockUpdate  `codec:"d"`
 	Attr attrChange   `codec:"a"`
 	File BlockPointer `codec:"f"`
+	// XattrName is the name of the changed extended attribute,
+	// when Attr is xattrAttr.
+	XattrName string `codec:"x,omitempty"`
 }
 
 func newSetAttrOp(name string, oldDir BlockPointer,
@@ -693,7 +699,7 @@ func (sao *setAttrOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
 }
 
 func (sao *setAttrOp) SizeExceptUpdates() uint64 {
-	return uint64(len(sao.Name))
+	return uint64(len(sao.Name) + len(sao.XattrName))
 }
 
 func (sao *setAttrOp) AllUpdates() []blockUpdate {
@@ -703,6 +709,10 @@ func (sao *setAttrOp) AllUpdates() []blockUpdate {
 }
 
 func (sao *setAttrOp) String() string {
+	if sao.Attr == xattrAttr {
+		return fmt.Sprintf("setAttr %s (%s %s)", sao.Name, sao.Attr,
+			sao.XattrName)
+	}
 	return fmt.Sprintf("setAttr %s (%s)", sao.Name, sao.Attr)
 }
 
@@ -710,7 +720,10 @@ func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
 	crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *setAttrOp:
-		if realMergedOp.Attr == sao.Attr {
+		// Different extended attributes on the same file can be
+		// merged.
+		if realMergedOp.Attr == sao.Attr && (sao.Attr != xattrAttr ||
+			realMergedOp.XattrName == sao.XattrName) {
 			// A set attr for the same attribute on the same file is a
 			// conflict.
 			return &renameUnmergedAction{
@@ -728,11 +741,15 @@ func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
 }
 
 func (sao *setAttrOp) GetDefaultAction(mergedPath path) crAction {
-	return &copyUnmergedAttrAction{
+	action := &copyUnmergedAttrAction{
 		fromName: sao.getFinalPath().tailName(),
 		toName:   mergedPath.tailName(),
 		attr:     []attrChange{sao.Attr},
 	}
+	if sao.Attr == xattrAttr {
+		action.xattrs = []string{sao.XattrName}
+	}
+	return action
 }
 
 // resolutionOp is an op that represents the block changes that took
@@ -868,6 +885,7 @@ func invertOpForLocalNotifications(oldOp op) op {
 		copy(newOp.(*syncOp).Writes, op.Writes)
 	case *setAttrOp:
 		newOp = newSetAttrOp(op.Name, op.Dir.Ref, op.Attr, op.File)
+		newOp.(*setAttrOp).XattrName = op.XattrName
 	case *gcOp:
 		newOp = op
 	}
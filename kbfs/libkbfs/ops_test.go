@@ -364,8 +364,9 @@ func makeFakeSetAttrOpFuture(t *testing.T) setAttrOpFuture {
 			makeFakeOpCommon(t, true),
 			"name",
 			makeFakeBlockUpdate(t),
-			mtimeAttr,
+			xattrAttr,
 			makeFakeBlockPointer(t),
+			"user.fake",
 		},
 		makeExtraOrBust("setAttrOp", t),
 	}
@@ -0,0 +1,315 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// How many blocks a single folder may be prefetching at once.
+	maxParallelPrefetches = 10
+	// How many prefetch requests may be queued up for a folder
+	// before new requests are dropped.
+	prefetchQueueSize = 100
+	// How many reads in a row must continue exactly where the
+	// previous one left off before a file is considered to be read
+	// sequentially.
+	prefetchSequentialReadsThreshold = 2
+	// Read-ahead for a single file, and prefetching for the children
+	// of a single directory, may fill at most 1/prefetchCacheFraction
+	// of the clean block cache.
+	prefetchCacheFraction = 4
+	// When a directory is listed, only prefetch the blocks of children
+	// that are at most this big.
+	prefetchDirChildMaxBytes = 64 * 1024
+)
+
+// CtxPrefetchTagKey is the type used for unique context tags within
+// blockPrefetcher
+type CtxPrefetchTagKey int
+
+const (
+	// CtxPrefetchIDKey is the type of the tag for unique operation
+	// IDs within blockPrefetcher.
+	CtxPrefetchIDKey CtxPrefetchTagKey = iota
+)
+
+// CtxPrefetchOpID is the display name for the unique operation
+// blockPrefetcher ID tag.
+const CtxPrefetchOpID = "PFID"
+
+type prefetchRequest struct {
+	ctx      context.Context
+	md       *RootMetadata
+	ptr      BlockPointer
+	branch   BranchName
+	newBlock makeNewBlock
+}
+
+// filePrefetchState tracks the recent reads of a single file, to
+// detect sequential access.
+type filePrefetchState struct {
+	// The offset right after the end of the last read.
+	nextOff int64
+	// How many reads in a row have been sequential.
+	seqReads int
+	// Offset of the first indirect block that hasn't yet been
+	// requested.
+	prefetchedOff int64
+	// Cancels all outstanding prefetches for this file.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// blockPrefetcher fetches blocks for a particular TLF into the block
+// cache in the background, before they are needed.  It reads ahead
+// of files that are being read sequentially, and optionally fetches
+// the small children of listed directories.
+type blockPrefetcher struct {
+	config Config
+	log    logger.Logger
+	id     TlfID
+
+	reqs         chan prefetchRequest
+	shutdownChan chan struct{}
+	workers      sync.WaitGroup
+	// Tracks requests that are queued or in progress.
+	prefetchGroup RepeatedWaitGroup
+
+	// All prefetch contexts are derived from ctx, which is canceled
+	// on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// protects files
+	lock sync.Mutex
+	// Read patterns of the files being read, which are dropped once
+	// the file's node is dropped from the node cache.
+	files map[NodeID]*filePrefetchState
+}
+
+func newBlockPrefetcher(config Config, fb FolderBranch) *blockPrefetcher {
+	tlfStringFull := fb.Tlf.String()
+	log := config.MakeLogger(fmt.Sprintf("PF %s", tlfStringFull[:8]))
+	bp := &blockPrefetcher{
+		config:       config,
+		log:          log,
+		id:           fb.Tlf,
+		reqs:         make(chan prefetchRequest, prefetchQueueSize),
+		shutdownChan: make(chan struct{}),
+		files:        make(map[NodeID]*filePrefetchState),
+	}
+	bp.ctx, bp.cancel = context.WithCancel(context.Background())
+	bp.workers.Add(maxParallelPrefetches)
+	for i := 0; i < maxParallelPrefetches; i++ {
+		go bp.prefetchInBackground()
+	}
+	return bp
+}
+
+func (bp *blockPrefetcher) ctxWithPrefetchID(
+	ctx context.Context) context.Context {
+	return ctxWithRandomID(ctx, CtxPrefetchIDKey, CtxPrefetchOpID, bp.log)
+}
+
+// maxPrefetchBytes returns the most bytes that may be prefetched
+// ahead of a single file or for a single directory.
+func (bp *blockPrefetcher) maxPrefetchBytes() int64 {
+	return int64(bp.config.BlockCache().CleanBytesCapacity() /
+		prefetchCacheFraction)
+}
+
+func (bp *blockPrefetcher) prefetchInBackground() {
+	defer bp.workers.Done()
+	for {
+		select {
+		case req := <-bp.reqs:
+			bp.prefetchOne(req)
+			bp.prefetchGroup.Done()
+		case <-bp.shutdownChan:
+			return
+		}
+	}
+}
+
+func (bp *blockPrefetcher) prefetchOne(req prefetchRequest) {
+	if req.ctx.Err() != nil {
+		// The prefetch was canceled while it was queued.
+		return
+	}
+
+	bcache := bp.config.BlockCache()
+	if _, err := bcache.Get(req.ptr, req.branch); err == nil {
+		// Already cached.
+		return
+	}
+
+	block := req.newBlock()
+	err := bp.config.BlockOps().Get(req.ctx, req.md, req.ptr, block)
+	if err != nil {
+		bp.log.CDebugf(req.ctx, "Couldn't prefetch block %v: %v", req.ptr, err)
+		return
+	}
+	if err := bcache.Put(req.ptr, bp.id, block, TransientEntry); err != nil {
+		bp.log.CDebugf(req.ctx, "Couldn't cache prefetched block %v: %v",
+			req.ptr, err)
+	}
+}
+
+// request queues up a prefetch for the given block.  It returns false
+// if the request couldn't be queued, because the queue is full or
+// the prefetcher is shutting down.
+func (bp *blockPrefetcher) request(req prefetchRequest) bool {
+	select {
+	case <-bp.shutdownChan:
+		return false
+	default:
+	}
+
+	bp.prefetchGroup.Add(1)
+	select {
+	case bp.reqs <- req:
+		return true
+	default:
+		bp.prefetchGroup.Done()
+		return false
+	}
+}
+
+// waitForPrefetches waits until all queued prefetches have finished.
+func (bp *blockPrefetcher) waitForPrefetches(ctx context.Context) error {
+	return bp.prefetchGroup.Wait(ctx)
+}
+
+// getFileStateLocked returns the prefetch state for the given file,
+// creating it if necessary.
+func (bp *blockPrefetcher) getFileStateLocked(
+	file NodeID) *filePrefetchState {
+	state, ok := bp.files[file]
+	if !ok {
+		ctx, cancel := context.WithCancel(bp.ctxWithPrefetchID(bp.ctx))
+		state = &filePrefetchState{ctx: ctx, cancel: cancel}
+		bp.files[file] = state
+	}
+	return state
+}
+
+// onFileRead records a read of n bytes at offset off in the given
+// file, which has the given top-level block.  If the file is being
+// read sequentially, it prefetches the next indirect blocks following
+// the read.
+func (bp *blockPrefetcher) onFileRead(file NodeID, md *RootMetadata,
+	branch BranchName, iptrs []IndirectFilePtr, off int64, n int64) {
+	readAhead := bp.config.ReadAheadBlocks()
+	if readAhead <= 0 || len(iptrs) == 0 {
+		return
+	}
+
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	state, ok := bp.files[file]
+	if ok && off == state.nextOff {
+		state.seqReads++
+	} else {
+		if ok {
+			// A seek; anything we prefetched ahead of the old
+			// position is probably useless now.
+			state.cancel()
+			delete(bp.files, file)
+		}
+		state = bp.getFileStateLocked(file)
+	}
+	end := off + n
+	state.nextOff = end
+	if state.seqReads < prefetchSequentialReadsThreshold {
+		return
+	}
+
+	// Find the block containing the end of the read, and request the
+	// blocks after it, stopping once we're too far ahead.
+	maxOff := end + bp.maxPrefetchBytes()
+	numRequested := 0
+	for i := 0; i < len(iptrs) && numRequested < readAhead; i++ {
+		iptr := iptrs[i]
+		if iptr.Off < end {
+			continue
+		}
+		if iptr.Off > maxOff {
+			break
+		}
+		numRequested++
+		if iptr.Off < state.prefetchedOff {
+			continue
+		}
+		if !bp.request(prefetchRequest{state.ctx, md, iptr.BlockPointer,
+			branch, NewFileBlock}) {
+			// Try again on the next read.
+			break
+		}
+		state.prefetchedOff = iptr.Off + 1
+	}
+}
+
+// cancelFile cancels all the outstanding prefetches for the given
+// file, and forgets its read pattern.  It's called once the file's
+// node is dropped from the node cache, since nothing can read the
+// file through that node anymore.
+func (bp *blockPrefetcher) cancelFile(file NodeID) {
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	if state, ok := bp.files[file]; ok {
+		state.cancel()
+		delete(bp.files, file)
+	}
+}
+
+// prefetchDirChildren prefetches the blocks of the small, non-symlink
+// children in the given directory block.
+func (bp *blockPrefetcher) prefetchDirChildren(ctx context.Context,
+	md *RootMetadata, branch BranchName, dblock *DirBlock) {
+	if !bp.config.PrefetchDirChildren() {
+		return
+	}
+
+	// Prefetches for a directory aren't tied to the listing request,
+	// which may finish long before they do.
+	pctx := bp.ctxWithPrefetchID(bp.ctx)
+	budget := bp.maxPrefetchBytes()
+	for _, de := range dblock.Children {
+		var newBlock makeNewBlock
+		switch de.Type {
+		case File, Exec:
+			newBlock = NewFileBlock
+		case Dir:
+			newBlock = NewDirBlock
+		default:
+			continue
+		}
+		size := int64(de.EncodedSize)
+		if size > prefetchDirChildMaxBytes || size > budget {
+			continue
+		}
+		if !bp.request(prefetchRequest{pctx, md, de.BlockPointer, branch,
+			newBlock}) {
+			bp.log.CDebugf(ctx, "Prefetch queue is full; not prefetching "+
+				"the rest of the directory")
+			return
+		}
+		budget -= size
+	}
+}
+
+// shutdown cancels all outstanding prefetches, and waits for the
+// background goroutines to exit.
+func (bp *blockPrefetcher) shutdown() {
+	bp.cancel()
+	close(bp.shutdownChan)
+	bp.workers.Wait()
+}
@@ -0,0 +1,389 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/net/context"
+)
+
+// prefetchTestFile makes a file made up of many small blocks as
+// userName, and returns the indirect pointers of the synced file.
+func prefetchTestFile(t *testing.T, ctx context.Context, config Config,
+	userName libkb.NormalizedUsername, nBlocks int) []IndirectFilePtr {
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := make([]byte, 20*nBlocks)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, fileNode)
+	lState := makeFBOLockState()
+	md, err := ops.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	iptrs, err := ops.blocks.GetIndirectFilePtrsForPrefetch(
+		ctx, lState, md, ops.nodeCache.PathFromNode(fileNode))
+	if err != nil {
+		t.Fatalf("Couldn't get indirect pointers: %v", err)
+	}
+	if len(iptrs) < nBlocks {
+		t.Fatalf("Expected at least %d blocks, got %d", nBlocks, len(iptrs))
+	}
+	return iptrs
+}
+
+// readAndWaitForPrefetches reads len(buf) bytes at off from the file
+// "a" as the given config's user, and then waits for the prefetcher
+// of the file's folder to go idle.
+func readAndWaitForPrefetches(t *testing.T, ctx context.Context,
+	config Config, userName libkb.NormalizedUsername, buf []byte,
+	off int64) {
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	if _, err := kbfsOps.Read(ctx, fileNode, buf, off); err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, fileNode)
+	if err := ops.prefetcher.waitForPrefetches(ctx); err != nil {
+		t.Fatalf("Couldn't wait for prefetches: %v", err)
+	}
+}
+
+func countCachedBlocks(config Config, iptrs []IndirectFilePtr) int {
+	n := 0
+	for _, iptr := range iptrs {
+		if _, err := config.BlockCache().Get(
+			iptr.BlockPointer, MasterBranch); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Test that reading a file sequentially prefetches the blocks that
+// follow the read, but only once the reads look sequential.
+func TestPrefetchSequentialReadAhead(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	iptrs := prefetchTestFile(t, ctx, config, userName, 30)
+
+	// Read with a fresh block cache.
+	config2 := ConfigAsUser(config.(*ConfigLocal), userName)
+	defer CheckConfigAndShutdown(t, config2)
+	readAhead := 4
+	config2.SetReadAheadBlocks(readAhead)
+
+	// Read exactly one block at a time.
+	buf := make([]byte, iptrs[1].Off-iptrs[0].Off)
+	readAndWaitForPrefetches(t, ctx, config2, userName, buf, 0)
+	if n := countCachedBlocks(config2, iptrs); n != 1 {
+		t.Fatalf("Expected only the read block to be cached, got %d", n)
+	}
+
+	// After enough sequential reads, the next readAhead blocks
+	// should be cached.
+	off := int64(len(buf))
+	for i := 1; i < prefetchSequentialReadsThreshold+1; i++ {
+		readAndWaitForPrefetches(t, ctx, config2, userName, buf, off)
+		off += int64(len(buf))
+	}
+	nRead := prefetchSequentialReadsThreshold + 1
+	if n := countCachedBlocks(config2, iptrs); n != nRead+readAhead {
+		t.Fatalf("Expected %d cached blocks, got %d", nRead+readAhead, n)
+	}
+	for _, iptr := range iptrs[nRead : nRead+readAhead] {
+		if _, err := config2.BlockCache().Get(
+			iptr.BlockPointer, MasterBranch); err != nil {
+			t.Errorf("Block at offset %d wasn't prefetched: %v", iptr.Off, err)
+		}
+	}
+}
+
+// Test that a seek resets the sequential read detection, and that a
+// file's read pattern is forgotten once its node is dropped from the
+// node cache.
+func TestPrefetchSeekAndForget(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	iptrs := prefetchTestFile(t, ctx, config, userName, 30)
+
+	config2 := ConfigAsUser(config.(*ConfigLocal), userName)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetReadAheadBlocks(4)
+
+	// Sequential reads, broken up by a seek right before the
+	// threshold would have been reached.
+	buf := make([]byte, iptrs[1].Off-iptrs[0].Off)
+	var off int64
+	for i := 0; i < prefetchSequentialReadsThreshold; i++ {
+		readAndWaitForPrefetches(t, ctx, config2, userName, buf, off)
+		off += int64(len(buf))
+	}
+	off = 20 * int64(len(buf))
+	readAndWaitForPrefetches(t, ctx, config2, userName, buf, off)
+	expected := prefetchSequentialReadsThreshold + 1
+	if n := countCachedBlocks(config2, iptrs); n != expected {
+		t.Fatalf("Expected %d cached blocks after a seek, got %d", expected, n)
+	}
+
+	// Dropping the last reference to the file's node forgets the
+	// reads so far.  Simulate the garbage collector finalizing it,
+	// rather than waiting for a real collection.
+	rootNode := GetRootNodeOrBust(t, config2, userName.String(), false)
+	fileNode, _, err := config2.KBFSOps().Lookup(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	ops := config2.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, fileNode)
+	ncs := ops.nodeCache.(*nodeCacheStandard)
+	fileNS := fileNode.(*nodeStandard)
+	runtime.SetFinalizer(fileNS, nil)
+	ncs.lock.Lock()
+	ncs.nodes[fileNS.core.pathNode.ref()].refCount = 1
+	ncs.lock.Unlock()
+	nodeStandardFinalizer(fileNS)
+	ops.prefetcher.lock.Lock()
+	_, ok := ops.prefetcher.files[fileNode.GetID()]
+	ops.prefetcher.lock.Unlock()
+	if ok {
+		t.Fatalf("File prefetch state not cleared after the node was dropped")
+	}
+
+	off += int64(len(buf))
+	readAndWaitForPrefetches(t, ctx, config2, userName, buf, off)
+	expected++
+	if n := countCachedBlocks(config2, iptrs); n != expected {
+		t.Fatalf("Expected %d cached blocks after the node was dropped, "+
+			"got %d", expected, n)
+	}
+}
+
+// Test that listing a directory prefetches the blocks of its small
+// children, but only when directory prefetching is turned on.
+func TestPrefetchDirChildren(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Keep the big file in a single block.
+	bsplitter, err := NewBlockSplitterSimple(
+		4*prefetchDirChildMaxBytes, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	smallNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "small", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.Write(ctx, smallNode, []byte("small"), 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	bigNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "big", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := make([]byte, 2*prefetchDirChildMaxBytes)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := kbfsOps.Write(ctx, bigNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if _, _, err := kbfsOps.CreateDir(ctx, rootNode, "dir"); err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	if _, err := kbfsOps.CreateLink(ctx, rootNode, "link", "small"); err != nil {
+		t.Fatalf("Couldn't create link: %v", err)
+	}
+	for _, n := range []Node{smallNode, bigNode} {
+		if err := kbfsOps.Sync(ctx, n); err != nil {
+			t.Fatalf("Couldn't sync: %v", err)
+		}
+	}
+
+	// List with a fresh block cache.
+	config2 := ConfigAsUser(config.(*ConfigLocal), userName)
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, userName.String(), false)
+	ops := config2.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode2)
+	lState := makeFBOLockState()
+	md, err := ops.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	rootPath := ops.nodeCache.PathFromNode(rootNode2)
+	dblock, err := ops.blocks.GetDirBlockForReading(ctx, lState, md,
+		rootPath.tailPointer(), rootPath.Branch, rootPath)
+	if err != nil {
+		t.Fatalf("Couldn't get root block: %v", err)
+	}
+	if size := dblock.Children["big"].EncodedSize; size <=
+		prefetchDirChildMaxBytes {
+		t.Fatalf("Big file is only %d bytes", size)
+	}
+
+	listAndCheck := func(expectCached map[string]bool) {
+		if _, err := config2.KBFSOps().GetDirChildren(
+			ctx, rootNode2); err != nil {
+			t.Fatalf("Couldn't list dir: %v", err)
+		}
+		if err := ops.prefetcher.waitForPrefetches(ctx); err != nil {
+			t.Fatalf("Couldn't wait for prefetches: %v", err)
+		}
+		for name, de := range dblock.Children {
+			if de.Type == Sym {
+				continue
+			}
+			_, err := config2.BlockCache().Get(de.BlockPointer, MasterBranch)
+			if cached := err == nil; cached != expectCached[name] {
+				t.Errorf("Block of %s cached: %t, expected %t",
+					name, cached, expectCached[name])
+			}
+		}
+	}
+
+	// Nothing is prefetched by default.
+	listAndCheck(nil)
+
+	config2.SetPrefetchDirChildren(true)
+	listAndCheck(map[string]bool{"small": true, "dir": true})
+}
+
+// blockCacheGetLimiter is a BlockCache that misses on every Get of
+// ptr after the first allowed ones, while counting them.
+type blockCacheGetLimiter struct {
+	BlockCache
+	ptr     BlockPointer
+	allowed int
+	gets    int
+}
+
+func (b *blockCacheGetLimiter) Get(
+	ptr BlockPointer, branch BranchName) (Block, error) {
+	if ptr == b.ptr {
+		b.gets++
+		if b.gets > b.allowed {
+			return nil, NoSuchBlockError{ptr.ID}
+		}
+	}
+	return b.BlockCache.Get(ptr, branch)
+}
+
+// bserverFailGet is a BlockServer that fails every Get of id.
+type bserverFailGet struct {
+	BlockServer
+	id BlockID
+}
+
+func (b bserverFailGet) Get(ctx context.Context, id BlockID, tlfID TlfID,
+	context BlockContext) ([]byte, BlockCryptKeyServerHalf, error) {
+	if id == b.id {
+		return nil, BlockCryptKeyServerHalf{}, NoSuchBlockError{id}
+	}
+	return b.BlockServer.Get(ctx, id, tlfID, context)
+}
+
+// failPrefetchLookups makes the lookups of ptr after the ones f makes
+// fail, and returns a function that returns how many were made.
+func failPrefetchLookups(t *testing.T, config Config, ptr BlockPointer,
+	f func()) func() int {
+	limiter := &blockCacheGetLimiter{BlockCache: config.BlockCache(), ptr: ptr}
+	config.SetBlockCache(limiter)
+	f()
+	limiter.allowed = limiter.gets
+	limiter.gets = 0
+	config.SetBlockServer(bserverFailGet{config.BlockServer(), ptr.ID})
+	return func() int { return limiter.gets }
+}
+
+// Test that a failed lookup made only for prefetching doesn't fail
+// the read or the listing that triggered it.
+func TestPrefetchLookupErrorsIgnored(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	prefetchTestFile(t, ctx, config, userName, 4)
+	// Put the real cache and server back for the state check at
+	// shutdown.
+	bcache, bserver := config.BlockCache(), config.BlockServer()
+	defer func() {
+		config.SetBlockCache(bcache)
+		config.SetBlockServer(bserver)
+	}()
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, fileNode)
+	filePtr := ops.nodeCache.PathFromNode(fileNode).tailPointer()
+	rootPtr := ops.nodeCache.PathFromNode(rootNode).tailPointer()
+	buf := make([]byte, 10)
+
+	// Count the lookups the read itself makes, with read-ahead
+	// off, and then fail any more.
+	lookups := failPrefetchLookups(t, config, filePtr, func() {
+		if _, err := kbfsOps.Read(ctx, fileNode, buf, 0); err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+	})
+	config.SetReadAheadBlocks(4)
+	if _, err := kbfsOps.Read(ctx, fileNode, buf, 0); err != nil {
+		t.Errorf("Read failed with a failed prefetch lookup: %v", err)
+	}
+	if n := lookups(); n == 0 {
+		t.Error("No prefetch lookup was made for the read")
+	}
+
+	lookups = failPrefetchLookups(t, config, rootPtr, func() {
+		if _, err := kbfsOps.GetDirChildren(ctx, rootNode); err != nil {
+			t.Fatalf("Couldn't list dir: %v", err)
+		}
+	})
+	config.SetPrefetchDirChildren(true)
+	if _, err := kbfsOps.GetDirChildren(ctx, rootNode); err != nil {
+		t.Errorf("Listing failed with a failed prefetch lookup: %v", err)
+	}
+	if n := lookups(); n == 0 {
+		t.Error("No prefetch lookup was made for the listing")
+	}
+}
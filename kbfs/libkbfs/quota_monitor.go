@@ -0,0 +1,227 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+const (
+	// How often the quota warning monitor checks the user's usage.
+	quotaWarningCheckPeriod = 5 * time.Minute
+	// How soon the monitor first checks the usage after KBFS
+	// starts, and how often it retries until a check gets through
+	// (e.g., until the user is logged in and the servers are
+	// connected).
+	quotaWarningRetryPeriod = 30 * time.Second
+)
+
+// parseQuotaWarningPercentages parses a comma-separated list of
+// percentages, or "none" for an empty list.
+func parseQuotaWarningPercentages(s string) ([]int, error) {
+	if s == "none" {
+		return nil, nil
+	}
+	var percentages []int
+	for _, field := range strings.Split(s, ",") {
+		p, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf(
+				"Invalid quota warning percentage %q", field)
+		}
+		percentages = append(percentages, p)
+	}
+	sort.Ints(percentages)
+	return percentages, nil
+}
+
+// formatQuotaWarningPercentages is the inverse of
+// parseQuotaWarningPercentages.
+func formatQuotaWarningPercentages(percentages []int) string {
+	if len(percentages) == 0 {
+		return "none"
+	}
+	fields := make([]string, 0, len(percentages))
+	for _, p := range percentages {
+		fields = append(fields, strconv.Itoa(p))
+	}
+	return strings.Join(fields, ",")
+}
+
+// quotaWarningMonitor periodically checks the current user's quota
+// usage, and reports a QuotaUsageWarningError through the Reporter
+// each time it crosses one of the configured warning percentages on
+// the way up.  Once usage drops back below a percentage, crossing it
+// again warns again.  The last percentage warned about for each user
+// can be kept in a file, so that restarting KBFS doesn't repeat the
+// warning.
+type quotaWarningMonitor struct {
+	config       Config
+	log          logger.Logger
+	shutdownChan chan struct{}
+	// onQuotaInfo, if set, is called with each quota info fetched,
+	// even if there are no warning percentages.
+	onQuotaInfo func(info *UserQuotaInfo)
+
+	lock sync.Mutex // protects the fields below
+	// statePath is the file lastPercentages is kept in, or empty
+	// to keep it only in memory.
+	statePath string
+	// lastPercentages is, for each user, the highest percentage
+	// their usage was last seen at or above, if not 0.  It's nil
+	// until it's loaded from statePath.
+	lastPercentages map[keybase1.UID]int
+}
+
+func newQuotaWarningMonitor(config Config) *quotaWarningMonitor {
+	return &quotaWarningMonitor{
+		config:       config,
+		log:          config.MakeLogger("QWM"),
+		shutdownChan: make(chan struct{}),
+	}
+}
+
+// setStatePath makes the monitor keep the last percentage warned
+// about for each user in the given file.
+func (qwm *quotaWarningMonitor) setStatePath(statePath string) {
+	qwm.lock.Lock()
+	defer qwm.lock.Unlock()
+	qwm.statePath = statePath
+	qwm.lastPercentages = nil
+}
+
+// loadLocked reads lastPercentages from statePath, if it hasn't been
+// loaded yet.  qwm.lock must be held by the caller.
+func (qwm *quotaWarningMonitor) loadLocked(ctx context.Context) {
+	if qwm.lastPercentages != nil {
+		return
+	}
+	qwm.lastPercentages = make(map[keybase1.UID]int)
+	if qwm.statePath == "" {
+		return
+	}
+	buf, err := ioutil.ReadFile(qwm.statePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = qwm.config.Codec().Decode(buf, &qwm.lastPercentages)
+	}
+	if err != nil {
+		qwm.log.CDebugf(ctx, "Couldn't load quota warning state: %v", err)
+		qwm.lastPercentages = make(map[keybase1.UID]int)
+	}
+}
+
+// saveLocked writes lastPercentages to statePath, if it's set.
+// qwm.lock must be held by the caller.
+func (qwm *quotaWarningMonitor) saveLocked(ctx context.Context) {
+	if qwm.statePath == "" {
+		return
+	}
+	buf, err := qwm.config.Codec().Encode(qwm.lastPercentages)
+	if err == nil {
+		err = ioutil.WriteFile(qwm.statePath, buf, 0600)
+	}
+	if err != nil {
+		// The warning may just be repeated after a restart.
+		qwm.log.CDebugf(ctx, "Couldn't save quota warning state: %v", err)
+	}
+}
+
+func (qwm *quotaWarningMonitor) run() {
+	timer := time.NewTimer(quotaWarningRetryPeriod)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			ctx, cancel := context.WithTimeout(context.Background(),
+				qwm.config.BackgroundTaskTimeout())
+			period := quotaWarningRetryPeriod
+			if qwm.check(ctx) {
+				period = quotaWarningCheckPeriod
+			}
+			cancel()
+			timer.Reset(period)
+		case <-qwm.shutdownChan:
+			return
+		}
+	}
+}
+
+// check fetches the user's current usage, and sends a warning if
+// needed.  It returns false if it couldn't get the usage, and should
+// be retried soon.
+func (qwm *quotaWarningMonitor) check(ctx context.Context) bool {
+	percentages := qwm.config.QuotaWarningPercentages()
+	if len(percentages) == 0 && qwm.onQuotaInfo == nil {
+		return true
+	}
+
+	// Like Status, don't ask for the quota info until we've
+	// authenticated.
+	_, uid, err := qwm.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return false
+	}
+	if !qwm.config.MDServer().IsConnected() {
+		return false
+	}
+	info, err := qwm.config.BlockServer().GetUserQuotaInfo(ctx)
+	if err != nil {
+		qwm.log.CDebugf(ctx, "Couldn't get quota info: %v", err)
+		return false
+	}
+	if qwm.onQuotaInfo != nil {
+		qwm.onQuotaInfo(info)
+	}
+	if len(percentages) == 0 || info.Limit <= 0 {
+		return true
+	}
+
+	usage := usageFromQuotaInfo(info)
+	usagePercentage := 100 * float64(usage) / float64(info.Limit)
+	crossed := 0
+	for _, p := range percentages {
+		if usagePercentage >= float64(p) {
+			crossed = p
+		}
+	}
+
+	qwm.lock.Lock()
+	defer qwm.lock.Unlock()
+	qwm.loadLocked(ctx)
+	last := qwm.lastPercentages[uid]
+	if crossed > last {
+		qwm.log.CDebugf(ctx, "Usage of %d/%d bytes crossed %d%% of quota",
+			usage, info.Limit, crossed)
+		qwm.config.Reporter().ReportErr(ctx, "", false, WriteMode,
+			QuotaUsageWarningError{usage, info.Limit, crossed})
+	}
+	if crossed != last {
+		if crossed == 0 {
+			delete(qwm.lastPercentages, uid)
+		} else {
+			qwm.lastPercentages[uid] = crossed
+		}
+		qwm.saveLocked(ctx)
+	}
+	return true
+}
+
+func (qwm *quotaWarningMonitor) shutdown() {
+	close(qwm.shutdownChan)
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseQuotaWarningPercentages(t *testing.T) {
+	percentages, err := parseQuotaWarningPercentages("90, 80,100")
+	if err != nil {
+		t.Fatalf("Couldn't parse percentages: %v", err)
+	}
+	if !reflect.DeepEqual(percentages, []int{80, 90, 100}) {
+		t.Errorf("Unexpected percentages: %v", percentages)
+	}
+	if s := formatQuotaWarningPercentages(percentages); s != "80,90,100" {
+		t.Errorf("Unexpected formatted percentages: %s", s)
+	}
+
+	percentages, err = parseQuotaWarningPercentages("none")
+	if err != nil || len(percentages) != 0 {
+		t.Errorf("Unexpected result for none: %v, %v", percentages, err)
+	}
+	if s := formatQuotaWarningPercentages(nil); s != "none" {
+		t.Errorf("Unexpected formatted percentages: %s", s)
+	}
+
+	for _, s := range []string{"", "0", "101", "80,x"} {
+		if _, err := parseQuotaWarningPercentages(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+// bserverFixedQuota is a BlockServer that reports a fixed usage out
+// of a limit of 100 bytes.
+type bserverFixedQuota struct {
+	BlockServer
+	usage *int64
+}
+
+func (b bserverFixedQuota) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	total := NewUsageStat()
+	total.Bytes[UsageWrite] = *b.usage
+	return &UserQuotaInfo{Total: total, Limit: 100}, nil
+}
+
+// reporterErrRecorder is a Reporter that remembers every error
+// reported.
+type reporterErrRecorder struct {
+	Reporter
+	errs []error
+}
+
+func (r *reporterErrRecorder) ReportErr(ctx context.Context,
+	tlfName CanonicalTlfName, public bool, mode ErrorModeType, err error) {
+	r.errs = append(r.errs, err)
+}
+
+func checkQuotaWarnings(t *testing.T, qwm *quotaWarningMonitor,
+	reporter *reporterErrRecorder, usage *int64, newUsage int64,
+	expectedPercentages ...int) {
+	*usage = newUsage
+	reporter.errs = nil
+	if !qwm.check(context.Background()) {
+		t.Fatalf("Usage %d: check failed", newUsage)
+	}
+	if len(reporter.errs) != len(expectedPercentages) {
+		t.Fatalf("Usage %d: unexpected errors %v", newUsage, reporter.errs)
+	}
+	for i, err := range reporter.errs {
+		qe, ok := err.(QuotaUsageWarningError)
+		if !ok {
+			t.Errorf("Unexpected error %v", err)
+			continue
+		}
+		if qe.Percent != expectedPercentages[i] ||
+			qe.UsageBytes != newUsage || qe.LimitBytes != 100 {
+			t.Errorf("Usage %d: unexpected warning %+v", newUsage, qe)
+		}
+	}
+}
+
+func TestQuotaWarningMonitor(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetQuotaWarningPercentages([]int{90, 50})
+	var usage int64
+	config.SetBlockServer(bserverFixedQuota{config.BlockServer(), &usage})
+	reporter := &reporterErrRecorder{Reporter: config.Reporter()}
+	config.SetReporter(reporter)
+	ctx := context.Background()
+
+	qwm := newQuotaWarningMonitor(config)
+	checkWarnings := func(newUsage int64, expectedPercentages ...int) {
+		checkQuotaWarnings(
+			t, qwm, reporter, &usage, newUsage, expectedPercentages...)
+	}
+
+	checkWarnings(10)
+	checkWarnings(50, 50)
+	// No repeated warnings while the usage stays put.
+	checkWarnings(60)
+	// Skipping a threshold only warns about the highest one.
+	usage = 10
+	qwm.check(ctx)
+	checkWarnings(95, 90)
+	checkWarnings(99)
+	// Dropping below a threshold and crossing it again warns again.
+	checkWarnings(70)
+	checkWarnings(91, 90)
+
+	// No percentages, no warnings.
+	config.SetQuotaWarningPercentages(nil)
+	checkWarnings(10)
+	checkWarnings(100)
+}
+
+// Test that the last percentage warned about survives a restart,
+// and is kept separately for each user.
+func TestQuotaWarningMonitorPersisted(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "quota_monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	statePath := filepath.Join(tempdir, "kbfs_quota_warnings")
+
+	config := MakeTestConfigOrBust(t, "u1", "u2")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetQuotaWarningPercentages([]int{50, 90})
+	var usage int64
+	config.SetBlockServer(bserverFixedQuota{config.BlockServer(), &usage})
+	reporter := &reporterErrRecorder{Reporter: config.Reporter()}
+	config.SetReporter(reporter)
+
+	qwm := newQuotaWarningMonitor(config)
+	qwm.setStatePath(statePath)
+	checkQuotaWarnings(t, qwm, reporter, &usage, 60, 50)
+
+	// A new monitor, as after a restart, doesn't warn again.
+	qwm = newQuotaWarningMonitor(config)
+	qwm.setStatePath(statePath)
+	checkQuotaWarnings(t, qwm, reporter, &usage, 60)
+	checkQuotaWarnings(t, qwm, reporter, &usage, 95, 90)
+
+	// But another user gets their own warning.
+	config2 := ConfigAsUser(config, "u2")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetQuotaWarningPercentages([]int{50, 90})
+	config2.SetBlockServer(bserverFixedQuota{config2.BlockServer(), &usage})
+	reporter2 := &reporterErrRecorder{Reporter: config2.Reporter()}
+	config2.SetReporter(reporter2)
+	qwm2 := newQuotaWarningMonitor(config2)
+	qwm2.setStatePath(statePath)
+	checkQuotaWarnings(t, qwm2, reporter2, &usage, 60, 50)
+
+	qwm = newQuotaWarningMonitor(config)
+	qwm.setStatePath(statePath)
+	checkQuotaWarnings(t, qwm, reporter, &usage, 95)
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// How long a background quota fetch may take.
+const quotaUsageFetchTimeout = 10 * time.Second
+
+// EventuallyConsistentQuotaUsage keeps a cached copy of the current
+// user's quota usage and limit, as reported by the block server, so
+// that frequent callers (like the file system's statfs handler)
+// don't each have to wait for a server round-trip.
+type EventuallyConsistentQuotaUsage struct {
+	config Config
+	log    logger.Logger
+
+	// protects everything below
+	lock sync.RWMutex
+	// Closed and replaced whenever a fetch finishes, to wake up
+	// anyone waiting on it.
+	fetchDone   chan struct{}
+	fetching    bool
+	usageBytes  int64
+	limitBytes  int64
+	lastUpdated time.Time
+	lastErr     error
+}
+
+// NewEventuallyConsistentQuotaUsage creates a new
+// EventuallyConsistentQuotaUsage object.
+func NewEventuallyConsistentQuotaUsage(
+	config Config, loggerSuffix string) *EventuallyConsistentQuotaUsage {
+	return &EventuallyConsistentQuotaUsage{
+		config:    config,
+		log:       config.MakeLogger("ECQU-" + loggerSuffix),
+		fetchDone: make(chan struct{}),
+	}
+}
+
+// usageFromQuotaInfo returns the number of bytes charged against
+// the user's quota: both live bytes and archived bytes that haven't
+// been reclaimed yet.
+func usageFromQuotaInfo(info *UserQuotaInfo) int64 {
+	if info.Total == nil {
+		return 0
+	}
+	return info.Total.Bytes[UsageWrite] + info.Total.Bytes[UsageArchive]
+}
+
+func (q *EventuallyConsistentQuotaUsage) fetch(ctx context.Context) {
+	info, err := q.config.BlockServer().GetUserQuotaInfo(ctx)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.lastErr = err
+	if err != nil {
+		q.log.CDebugf(ctx, "Couldn't get quota info: %v", err)
+	} else {
+		q.usageBytes = usageFromQuotaInfo(info)
+		q.limitBytes = info.Limit
+		q.lastUpdated = q.config.Clock().Now()
+	}
+	q.fetching = false
+	close(q.fetchDone)
+	q.fetchDone = make(chan struct{})
+}
+
+// startFetchLocked starts a background fetch if one isn't already in
+// progress, and returns a channel that is closed when it finishes.
+func (q *EventuallyConsistentQuotaUsage) startFetchLocked() <-chan struct{} {
+	if !q.fetching {
+		q.fetching = true
+		go func() {
+			ctx, cancel := context.WithTimeout(
+				context.Background(), quotaUsageFetchTimeout)
+			defer cancel()
+			q.fetch(ctx)
+		}()
+	}
+	return q.fetchDone
+}
+
+// Get returns the user's quota usage and limit, in bytes.  If the
+// cached values are older than bgTolerance, a refresh is started in
+// the background, and the cached values are returned anyway.  If
+// they are older than blockTolerance, or if nothing has been fetched
+// yet, Get waits for the refresh to finish.
+func (q *EventuallyConsistentQuotaUsage) Get(
+	ctx context.Context, bgTolerance, blockTolerance time.Duration) (
+	usageBytes, limitBytes int64, err error) {
+	now := q.config.Clock().Now()
+	waitChan := func() <-chan struct{} {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		age := now.Sub(q.lastUpdated)
+		switch {
+		case q.lastUpdated.IsZero() || age > blockTolerance:
+			return q.startFetchLocked()
+		case age > bgTolerance:
+			q.startFetchLocked()
+		}
+		return nil
+	}()
+
+	if waitChan != nil {
+		select {
+		case <-waitChan:
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		}
+	}
+
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.lastUpdated.IsZero() {
+		return 0, 0, q.lastErr
+	}
+	return q.usageBytes, q.limitBytes, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// bserverQuotaSetter is a BlockServer whose quota usage is sent on a
+// channel for every GetUserQuotaInfo call.
+type bserverQuotaSetter struct {
+	BlockServer
+	usage chan int64
+}
+
+func (b bserverQuotaSetter) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	select {
+	case usage := <-b.usage:
+		total := NewUsageStat()
+		total.Bytes[UsageWrite] = usage
+		total.Bytes[UsageArchive] = 1
+		return &UserQuotaInfo{Total: total, Limit: 1000}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestEventuallyConsistentQuotaUsage(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	bserver := bserverQuotaSetter{config.BlockServer(), make(chan int64)}
+	config.SetBlockServer(bserver)
+	ctx := context.Background()
+
+	q := NewEventuallyConsistentQuotaUsage(config, "test")
+	bgTolerance, blockTolerance := time.Second, time.Minute
+
+	checkGet := func(expectedUsage int64) {
+		usage, limit, err := q.Get(ctx, bgTolerance, blockTolerance)
+		if err != nil {
+			t.Fatalf("Couldn't get usage: %v", err)
+		}
+		if usage != expectedUsage || limit != 1000 {
+			t.Fatalf("Unexpected usage %d/%d, expected %d/1000",
+				usage, limit, expectedUsage)
+		}
+	}
+
+	// The first call waits for a fetch.  Archived bytes count
+	// against the quota too.
+	go func() { bserver.usage <- 10 }()
+	checkGet(11)
+
+	// Fresh values are served from the cache, without a fetch
+	// (which would block forever).
+	checkGet(11)
+
+	// Stale values are still served, while a refresh happens in
+	// the background.
+	clock.Add(2 * bgTolerance)
+	checkGet(11)
+	q.lock.RLock()
+	fetchDone := q.fetchDone
+	q.lock.RUnlock()
+	bserver.usage <- 20
+	<-fetchDone
+	checkGet(21)
+
+	// Values that are too old wait for a refresh.
+	clock.Add(2 * blockTolerance)
+	go func() { bserver.usage <- 30 }()
+	checkGet(31)
+}
@@ -5,86 +5,426 @@
 package libkbfs
 
 import (
+	"net"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/keybase/backoff"
+	"github.com/keybase/client/go/logger"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/net/context"
 )
 
+const (
+	// rekeyQueueParallelism is the number of TLFs that are rekeyed
+	// at once.
+	rekeyQueueParallelism = 4
+	// How long to wait before the first retry of a rekey that
+	// failed with a retriable error.
+	rekeyRetryInitialInterval = 1 * time.Second
+	// The longest time to wait between retries of a rekey.
+	rekeyRetryMaxInterval = 5 * time.Minute
+	// How long to keep retrying a rekey before giving up on it.
+	rekeyRetryMaxElapsedTime = 1 * time.Hour
+)
+
+// RekeyPriority orders the TLFs waiting in a RekeyQueue.  TLFs with
+// higher priorities are rekeyed first, and TLFs with equal
+// priorities are rekeyed in the order they were enqueued.
+type RekeyPriority int
+
+const (
+	// RekeyPriorityBackground is for TLFs that the user isn't
+	// known to care about, such as the ones the MD server asks us
+	// to rekey.  If such a TLF turns out to be one of the user's
+	// favorites, it is bumped up to RekeyPriorityFavorite.
+	RekeyPriorityBackground RekeyPriority = iota
+	// RekeyPriorityFavorite is for TLFs in the user's favorites.
+	RekeyPriorityFavorite
+	// RekeyPriorityAccessed is for TLFs that are being accessed on
+	// this device.
+	RekeyPriorityAccessed
+)
+
+func (p RekeyPriority) String() string {
+	switch p {
+	case RekeyPriorityBackground:
+		return "background"
+	case RekeyPriorityFavorite:
+		return "favorite"
+	case RekeyPriorityAccessed:
+		return "accessed"
+	default:
+		return "unknown"
+	}
+}
+
+// RekeyQueueEntryStatus describes a TLF waiting in a RekeyQueue.
+type RekeyQueueEntryStatus struct {
+	Tlf        string
+	Priority   string
+	InProgress bool
+	// Attempts is the number of times the rekey has failed with a
+	// retriable error so far.
+	Attempts    int
+	LastError   string    `json:",omitempty"`
+	NextAttempt time.Time `json:",omitempty"`
+}
+
+// RekeyQueueStatus describes the state of a RekeyQueue.  It is
+// suitable for encoding directly as JSON.
+type RekeyQueueStatus struct {
+	// Entries are ordered the way they will next be picked up.
+	Entries []RekeyQueueEntryStatus
+}
+
 type rekeyQueueEntry struct {
-	id TlfID
-	ch chan error
+	id       TlfID
+	priority RekeyPriority
+	// uid is the user who queued the rekey, if known.  The entry is
+	// only persisted if it's set.
+	uid keybase1.UID
+	// seq orders entries of equal priority.
+	seq uint64
+	// favoriteChecked is set once a background entry has been
+	// looked up in the user's favorites.
+	favoriteChecked bool
+	// The channels waiting on the outcome of the rekey.
+	chs        []chan error
+	inProgress bool
+
+	attempts    int
+	lastErr     error
+	nextAttempt time.Time
+	backOff     backoff.BackOff
+}
+
+// persistedRekey is what RekeyQueueStandard stores on disk for each
+// queued TLF, under the key made by persistedRekeyKey.
+type persistedRekey struct {
+	Priority RekeyPriority
+}
+
+// persistedRekeyPrefix returns the prefix of the database keys for
+// the rekeys queued by the given user, so that each user only
+// restores their own rekeys.
+func persistedRekeyPrefix(uid keybase1.UID) []byte {
+	return []byte(uid.String() + "/")
+}
+
+// persistedRekeyKey returns the database key for a rekey of the
+// given TLF queued by the given user.
+func persistedRekeyKey(uid keybase1.UID, id TlfID) []byte {
+	return append(persistedRekeyPrefix(uid), id.String()...)
 }
 
-// RekeyQueueStandard implements the RekeyQueue interface.
+type rekeyResult struct {
+	entry *rekeyQueueEntry
+	err   error
+}
+
+// RekeyQueueStandard implements the RekeyQueue interface.  Queued
+// TLFs are rekeyed in priority order, a few at a time.  Rekeys that
+// fail with a retriable error, such as a network error or a server
+// throttle, are retried with an exponential backoff.
+//
+// If it is given a database (see NewRekeyQueueStandardDisk), the
+// queue is persisted there, and TLFs that a user had queued when KBFS
+// last stopped (or when the queue was last cleared) are queued again
+// the next time Restore is called while that user is logged in.
+// Only the rekeys queued after Restore has found a logged-in user
+// are persisted.
 type RekeyQueueStandard struct {
-	config    Config
-	queueMu   sync.RWMutex // protects all of the below
-	queue     []rekeyQueueEntry
+	config Config
+	// log is made when the queue first starts, since the queue may
+	// be constructed before the config's logger maker is set.
+	log logger.Logger
+	// db persists the IDs of queued TLFs.  It's nil if the queue
+	// isn't persisted.
+	db *leveldb.DB
+	// newBackOff makes the backoff policy for retrying a rekey.
+	newBackOff func() backoff.BackOff
+
+	queueMu sync.RWMutex // protects all of the below
+	// uid is the current user as of the last Restore, under whom
+	// newly-queued rekeys are persisted.  It's kept here so that
+	// Enqueue, which is called with folder locks held, doesn't
+	// have to look the user up.
+	uid       keybase1.UID
+	queue     map[TlfID]*rekeyQueueEntry
+	nextSeq   uint64
 	hasWorkCh chan struct{}
 	cancel    context.CancelFunc
-	wg        RepeatedWaitGroup
+	// stopped is closed once the processRekeys goroutine started
+	// along with cancel has returned.
+	stopped chan struct{}
+	wg      RepeatedWaitGroup
+	// updateChan is closed, and replaced, whenever the status of
+	// the queue changes.
+	updateChan chan StatusUpdate
 }
 
 // Test that RekeyQueueStandard fully implements the RekeyQueue interface.
 var _ RekeyQueue = (*RekeyQueueStandard)(nil)
 
-// NewRekeyQueueStandard instantiates a new rekey worker.
+func newRekeyBackOff() backoff.BackOff {
+	expBackoff := backoff.NewExponentialBackOff()
+	expBackoff.InitialInterval = rekeyRetryInitialInterval
+	expBackoff.MaxInterval = rekeyRetryMaxInterval
+	expBackoff.MaxElapsedTime = rekeyRetryMaxElapsedTime
+	return expBackoff
+}
+
+// NewRekeyQueueStandard instantiates a new rekey worker, which keeps
+// its queue only in memory.
 func NewRekeyQueueStandard(config Config) *RekeyQueueStandard {
 	rkq := &RekeyQueueStandard{
-		config: config,
+		config:     config,
+		newBackOff: newRekeyBackOff,
+		queue:      make(map[TlfID]*rekeyQueueEntry),
+		updateChan: make(chan StatusUpdate, 1),
 	}
 	return rkq
 }
 
-// Enqueue implements the RekeyQueue interface for RekeyQueueStandard.
-func (rkq *RekeyQueueStandard) Enqueue(id TlfID) <-chan error {
-	c := make(chan error, 1)
-	err := func() error {
-		rkq.queueMu.Lock()
-		defer rkq.queueMu.Unlock()
-		if rkq.cancel == nil {
-			// create a new channel
-			rkq.hasWorkCh = make(chan struct{}, 1)
-			// spawn goroutine if needed
-			var ctx context.Context
-			ctx, rkq.cancel = context.WithCancel(context.Background())
-			go rkq.processRekeys(ctx, rkq.hasWorkCh)
-		}
-		rkq.queue = append(rkq.queue, rekeyQueueEntry{id, c})
-		return nil
-	}()
+// NewRekeyQueueStandardDisk instantiates a new rekey worker, which
+// persists its queue in a database at the given path.
+func NewRekeyQueueStandardDisk(config Config, dbPath string) (
+	*RekeyQueueStandard, error) {
+	db, err := leveldb.OpenFile(dbPath, leveldbOptions)
 	if err != nil {
-		c <- err
-		close(c)
-		return c
+		return nil, err
+	}
+	rkq := NewRekeyQueueStandard(config)
+	rkq.db = db
+	return rkq, nil
+}
+
+// signalChangeLocked signals a change in the status of the queue.
+// rkq.queueMu must be held by the caller.
+func (rkq *RekeyQueueStandard) signalChangeLocked() {
+	close(rkq.updateChan)
+	rkq.updateChan = make(chan StatusUpdate, 1)
+}
+
+// persistLocked saves the given entry in the database, if there is
+// one.  rkq.queueMu must be held by the caller.
+func (rkq *RekeyQueueStandard) persistLocked(e *rekeyQueueEntry) {
+	if rkq.db == nil || e.uid == "" {
+		return
+	}
+	buf, err := rkq.config.Codec().Encode(persistedRekey{e.priority})
+	if err == nil {
+		err = rkq.db.Put(persistedRekeyKey(e.uid, e.id), buf, nil)
+	}
+	if err != nil {
+		// The rekey still happens; it just won't survive a restart.
+		rkq.log.Warning("Couldn't persist rekey of %s: %v", e.id, err)
+	}
+}
+
+// unpersistLocked removes the given entry from the database, if
+// there is one.  rkq.queueMu must be held by the caller.
+func (rkq *RekeyQueueStandard) unpersistLocked(e *rekeyQueueEntry) {
+	if rkq.db == nil || e.uid == "" {
+		return
+	}
+	err := rkq.db.Delete(persistedRekeyKey(e.uid, e.id), nil)
+	if err != nil {
+		rkq.log.Warning("Couldn't unpersist rekey of %s: %v", e.id, err)
+	}
+}
+
+// addLocked queues the given TLF for the given user with the given
+// priority, or raises the priority of an existing entry for it.  If c
+// is non-nil, it receives the outcome of the rekey.  rkq.queueMu must
+// be held by the caller.
+func (rkq *RekeyQueueStandard) addLocked(id TlfID, uid keybase1.UID,
+	priority RekeyPriority, c chan error, persist bool) {
+	e, ok := rkq.queue[id]
+	if !ok {
+		e = &rekeyQueueEntry{
+			id:       id,
+			priority: priority,
+			uid:      uid,
+			seq:      rkq.nextSeq,
+		}
+		rkq.nextSeq++
+		rkq.queue[id] = e
+		rkq.wg.Add(1)
+		rkq.signalChangeLocked()
+	} else {
+		changed := false
+		if priority > e.priority {
+			e.priority = priority
+			rkq.signalChangeLocked()
+			changed = true
+		}
+		if e.uid == "" && uid != "" {
+			e.uid = uid
+			changed = true
+		}
+		persist = persist && changed
+	}
+	if c != nil {
+		e.chs = append(e.chs, c)
+	}
+	if persist {
+		rkq.persistLocked(e)
+	}
+}
+
+// restoreLocked queues all the TLFs persisted in the database for
+// the given user.  rkq.queueMu must be held by the caller.
+func (rkq *RekeyQueueStandard) restoreLocked(uid keybase1.UID) {
+	if rkq.db == nil {
+		return
+	}
+	prefix := persistedRekeyPrefix(uid)
+	iter := rkq.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		id := ParseTlfID(string(iter.Key()[len(prefix):]))
+		var pr persistedRekey
+		err := rkq.config.Codec().Decode(iter.Value(), &pr)
+		if id == NullTlfID || err != nil {
+			rkq.log.Warning("Skipping bad persisted rekey %q: %v",
+				iter.Key(), err)
+			continue
+		}
+		rkq.addLocked(id, uid, pr.Priority, nil, false)
+	}
+	if err := iter.Error(); err != nil {
+		rkq.log.Warning("Couldn't restore persisted rekeys: %v", err)
+	}
+}
+
+// startLocked starts processing rekeys, if that isn't happening
+// already.  rkq.queueMu must be held by the caller.
+func (rkq *RekeyQueueStandard) startLocked() {
+	if rkq.cancel != nil {
+		return
+	}
+	if rkq.log == nil {
+		rkq.log = rkq.config.MakeLogger("RKQ")
 	}
-	rkq.wg.Add(1)
-	// poke the channel
+	// create a new channel
+	rkq.hasWorkCh = make(chan struct{}, 1)
+	// spawn goroutine
+	var ctx context.Context
+	ctx, rkq.cancel = context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	rkq.stopped = stopped
+	go func(hasWorkCh chan struct{}) {
+		defer close(stopped)
+		rkq.processRekeys(ctx, hasWorkCh)
+	}(rkq.hasWorkCh)
+}
+
+func (rkq *RekeyQueueStandard) poke() {
+	rkq.queueMu.RLock()
+	defer rkq.queueMu.RUnlock()
 	select {
 	case rkq.hasWorkCh <- struct{}{}:
 	default:
 	}
+}
+
+// Restore implements the RekeyQueue interface for RekeyQueueStandard.
+func (rkq *RekeyQueueStandard) Restore(ctx context.Context) {
+	_, uid, err := rkq.config.KBPKI().GetCurrentUserInfo(ctx)
+	func() {
+		rkq.queueMu.Lock()
+		defer rkq.queueMu.Unlock()
+		rkq.startLocked()
+		if err != nil {
+			rkq.log.CDebugf(ctx, "Not restoring rekeys without a "+
+				"logged-in user: %v", err)
+			rkq.uid = ""
+			return
+		}
+		rkq.uid = uid
+		rkq.restoreLocked(uid)
+	}()
+	rkq.poke()
+}
+
+// Enqueue implements the RekeyQueue interface for RekeyQueueStandard.
+func (rkq *RekeyQueueStandard) Enqueue(
+	id TlfID, priority RekeyPriority) <-chan error {
+	c := make(chan error, 1)
+	func() {
+		rkq.queueMu.Lock()
+		defer rkq.queueMu.Unlock()
+		rkq.startLocked()
+		// Only the current user can do the rekey, so only they
+		// should restore it.
+		rkq.addLocked(id, rkq.uid, priority, c, true)
+	}()
+	rkq.poke()
 	return c
 }
 
 // IsRekeyPending implements the RekeyQueue interface for RekeyQueueStandard.
 func (rkq *RekeyQueueStandard) IsRekeyPending(id TlfID) bool {
-	return rkq.GetRekeyChannel(id) != nil
+	rkq.queueMu.RLock()
+	defer rkq.queueMu.RUnlock()
+	_, ok := rkq.queue[id]
+	return ok
 }
 
 // GetRekeyChannel implements the RekeyQueue interface for RekeyQueueStandard.
 func (rkq *RekeyQueueStandard) GetRekeyChannel(id TlfID) <-chan error {
+	rkq.queueMu.Lock()
+	defer rkq.queueMu.Unlock()
+	e, ok := rkq.queue[id]
+	if !ok {
+		return nil
+	}
+	c := make(chan error, 1)
+	e.chs = append(e.chs, c)
+	return c
+}
+
+// sortedEntriesLocked returns the queued entries in the order they
+// should be processed.  rkq.queueMu must be held by the caller.
+func (rkq *RekeyQueueStandard) sortedEntriesLocked() []*rekeyQueueEntry {
+	entries := make([]*rekeyQueueEntry, 0, len(rkq.queue))
+	for _, e := range rkq.queue {
+		entries = append(entries, e)
+	}
+	sort.Sort(rekeyQueueEntriesByPriority(entries))
+	return entries
+}
+
+// Status implements the RekeyQueue interface for RekeyQueueStandard.
+func (rkq *RekeyQueueStandard) Status() (
+	RekeyQueueStatus, <-chan StatusUpdate) {
 	rkq.queueMu.RLock()
 	defer rkq.queueMu.RUnlock()
-	for _, e := range rkq.queue {
-		if e.id == id {
-			return e.ch
+	var status RekeyQueueStatus
+	for _, e := range rkq.sortedEntriesLocked() {
+		es := RekeyQueueEntryStatus{
+			Tlf:         e.id.String(),
+			Priority:    e.priority.String(),
+			InProgress:  e.inProgress,
+			Attempts:    e.attempts,
+			NextAttempt: e.nextAttempt,
 		}
+		if e.lastErr != nil {
+			es.LastError = e.lastErr.Error()
+		}
+		status.Entries = append(status.Entries, es)
 	}
-	return nil
+	return status, rkq.updateChan
 }
 
 // Clear implements the RekeyQueue interface for RekeyQueueStandard.
+// Persisted TLFs stay in the database, and are queued again the next
+// time Restore is called.
 func (rkq *RekeyQueueStandard) Clear() {
 	channels := func() []chan error {
 		rkq.queueMu.Lock()
@@ -97,9 +437,15 @@ func (rkq *RekeyQueueStandard) Clear() {
 		// collect channels and clear queue
 		var channels []chan error
 		for _, e := range rkq.queue {
-			channels = append(channels, e.ch)
+			channels = append(channels, e.chs...)
+			// Rekeys in progress are marked done once they
+			// return.
+			if !e.inProgress {
+				rkq.wg.Done()
+			}
 		}
-		rkq.queue = make([]rekeyQueueEntry, 0)
+		rkq.queue = make(map[TlfID]*rekeyQueueEntry)
+		rkq.signalChangeLocked()
 		return channels
 	}()
 	for _, c := range channels {
@@ -113,6 +459,24 @@ func (rkq *RekeyQueueStandard) Wait(ctx context.Context) error {
 	return rkq.wg.Wait(ctx)
 }
 
+// Shutdown implements the RekeyQueue interface for RekeyQueueStandard.
+func (rkq *RekeyQueueStandard) Shutdown() {
+	rkq.Clear()
+	rkq.queueMu.Lock()
+	stopped := rkq.stopped
+	rkq.queueMu.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+
+	rkq.queueMu.Lock()
+	defer rkq.queueMu.Unlock()
+	if rkq.db != nil {
+		rkq.db.Close()
+		rkq.db = nil
+	}
+}
+
 // CtxRekeyTagKey is the type used for unique context tags within an
 // enqueued Rekey.
 type CtxRekeyTagKey int
@@ -127,55 +491,208 @@ const (
 // enqueued rekey ID tag.
 const CtxRekeyOpID = "REKEYID"
 
-// Dedicated goroutine to process the rekey queue.
-func (rkq *RekeyQueueStandard) processRekeys(ctx context.Context, hasWorkCh chan struct{}) {
-	for {
-		select {
-		case <-hasWorkCh:
-			for {
-				id := rkq.peek()
-				if id == NullTlfID {
-					break
-				}
-				func() {
-					defer rkq.wg.Done()
-					// Assign an ID to this rekey operation so we can track it.
-					newCtx := ctxWithRandomID(ctx, CtxRekeyIDKey,
-						CtxRekeyOpID, nil)
-					err := rkq.config.KBFSOps().Rekey(newCtx, id)
-					if ch := rkq.dequeue(); ch != nil {
-						ch <- err
-						close(ch)
-					}
-				}()
-				if ctx.Err() != nil {
-					close(hasWorkCh)
-					return
-				}
-			}
-		case <-ctx.Done():
-			close(hasWorkCh)
-			return
-		}
+type rekeyQueueEntriesByPriority []*rekeyQueueEntry
+
+func (r rekeyQueueEntriesByPriority) Len() int      { return len(r) }
+func (r rekeyQueueEntriesByPriority) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rekeyQueueEntriesByPriority) Less(i, j int) bool {
+	if r[i].priority != r[j].priority {
+		return r[i].priority > r[j].priority
 	}
+	return r[i].seq < r[j].seq
 }
 
-func (rkq *RekeyQueueStandard) peek() TlfID {
+// isRetriableRekeyError returns whether a rekey that failed with the
+// given error might succeed if tried again later.
+func isRetriableRekeyError(err error) bool {
+	switch err.(type) {
+	case MDServerErrorThrottle, BServerErrorThrottle, MDServerErrorLocked,
+		MDServerErrorConditionFailed, MDServerErrorConflictRevision,
+		MDServerErrorConflictPrevRoot, MDServerErrorConflictDiskUsage,
+		errDisconnected, net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+// takeUncheckedBackground returns the background entries that
+// haven't been looked up in the user's favorites yet, and marks them
+// as checked.
+func (rkq *RekeyQueueStandard) takeUncheckedBackground() []TlfID {
 	rkq.queueMu.Lock()
 	defer rkq.queueMu.Unlock()
-	if len(rkq.queue) != 0 {
-		return rkq.queue[0].id
+	var unchecked []TlfID
+	for id, e := range rkq.queue {
+		if e.priority == RekeyPriorityBackground && !e.favoriteChecked {
+			e.favoriteChecked = true
+			unchecked = append(unchecked, id)
+		}
 	}
-	return NullTlfID
+	return unchecked
 }
 
-func (rkq *RekeyQueueStandard) dequeue() chan<- error {
+// checkFavorites bumps any of the given background entries for TLFs
+// in the user's favorites up to RekeyPriorityFavorite.  It fetches
+// the MD of each TLF, so processRekeys runs it in the background.
+func (rkq *RekeyQueueStandard) checkFavorites(
+	ctx context.Context, unchecked []TlfID) {
+	favs, err := rkq.config.KBFSOps().GetFavorites(ctx)
+	if err != nil {
+		rkq.log.CDebugf(ctx, "Couldn't get favorites: %v", err)
+		return
+	} else if len(favs) == 0 {
+		return
+	}
+	favSet := make(map[Favorite]bool, len(favs))
+	for _, fav := range favs {
+		fav.created = false
+		favSet[fav] = true
+	}
+	for _, id := range unchecked {
+		md, err := rkq.config.MDOps().GetForTLF(ctx, id)
+		if err != nil || md == nil {
+			rkq.log.CDebugf(ctx, "Couldn't get MD for %s: %v", id, err)
+			continue
+		}
+		if !favSet[md.GetTlfHandle().ToFavorite()] {
+			continue
+		}
+		func() {
+			rkq.queueMu.Lock()
+			defer rkq.queueMu.Unlock()
+			if e, ok := rkq.queue[id]; ok {
+				rkq.addLocked(id, e.uid, RekeyPriorityFavorite, nil, true)
+				e.favoriteChecked = true
+			}
+		}()
+	}
+}
+
+// next marks the highest-priority entry that's ready to be tried as
+// in progress, and returns it.  If there is no such entry, it
+// returns nil, and the time at which the next entry will be ready,
+// if any.
+func (rkq *RekeyQueueStandard) next(now time.Time) (
+	*rekeyQueueEntry, time.Time) {
 	rkq.queueMu.Lock()
 	defer rkq.queueMu.Unlock()
-	if len(rkq.queue) == 0 {
-		return nil
+	var wakeTime time.Time
+	for _, e := range rkq.sortedEntriesLocked() {
+		if e.inProgress {
+			continue
+		}
+		if now.Before(e.nextAttempt) {
+			if wakeTime.IsZero() || e.nextAttempt.Before(wakeTime) {
+				wakeTime = e.nextAttempt
+			}
+			continue
+		}
+		e.inProgress = true
+		rkq.signalChangeLocked()
+		return e, time.Time{}
+	}
+	return nil, wakeTime
+}
+
+// finish records the outcome of a rekey attempt.  Unless the rekey
+// will be retried, the waiting channels get the error.
+func (rkq *RekeyQueueStandard) finish(
+	ctx context.Context, e *rekeyQueueEntry, err error) {
+	channels := func() []chan error {
+		rkq.queueMu.Lock()
+		defer rkq.queueMu.Unlock()
+		e.inProgress = false
+		if rkq.queue[e.id] != e {
+			// The queue was cleared while the rekey was running.
+			rkq.wg.Done()
+			return nil
+		}
+		rkq.signalChangeLocked()
+
+		if err != nil && isRetriableRekeyError(err) {
+			if e.backOff == nil {
+				e.backOff = rkq.newBackOff()
+			}
+			if delay := e.backOff.NextBackOff(); delay != backoff.Stop {
+				e.attempts++
+				e.lastErr = err
+				e.nextAttempt = rkq.config.Clock().Now().Add(delay)
+				rkq.log.CDebugf(ctx, "Retrying rekey of %s in %s "+
+					"after error: %v", e.id, delay, err)
+				return nil
+			}
+		}
+
+		delete(rkq.queue, e.id)
+		rkq.unpersistLocked(e)
+		rkq.wg.Done()
+		return e.chs
+	}()
+	for _, c := range channels {
+		c <- err
+		close(c)
+	}
+}
+
+// Dedicated goroutine to process the rekey queue.
+func (rkq *RekeyQueueStandard) processRekeys(ctx context.Context, hasWorkCh chan struct{}) {
+	doneCh := make(chan rekeyResult, rekeyQueueParallelism)
+	running := 0
+	// favCheckDoneCh is non-nil while checkFavorites is running.
+	var favCheckDoneCh chan struct{}
+	// Wait for the rekeys still running before returning, so they
+	// get marked as done.
+	defer func() {
+		for ; running > 0; running-- {
+			res := <-doneCh
+			rkq.finish(ctx, res.entry, res.err)
+		}
+		if favCheckDoneCh != nil {
+			<-favCheckDoneCh
+		}
+	}()
+
+	var retryTimer <-chan time.Time
+	for {
+		select {
+		case <-hasWorkCh:
+		case <-retryTimer:
+			retryTimer = nil
+		case res := <-doneCh:
+			running--
+			rkq.finish(ctx, res.entry, res.err)
+		case <-favCheckDoneCh:
+			favCheckDoneCh = nil
+		case <-ctx.Done():
+			return
+		}
+
+		if favCheckDoneCh == nil {
+			if unchecked := rkq.takeUncheckedBackground(); len(unchecked) > 0 {
+				favCheckDoneCh = make(chan struct{})
+				go func(done chan<- struct{}) {
+					defer close(done)
+					rkq.checkFavorites(ctx, unchecked)
+				}(favCheckDoneCh)
+			}
+		}
+		for running < rekeyQueueParallelism {
+			e, wakeTime := rkq.next(rkq.config.Clock().Now())
+			if e == nil {
+				if !wakeTime.IsZero() {
+					retryTimer = time.After(
+						wakeTime.Sub(rkq.config.Clock().Now()))
+				}
+				break
+			}
+			running++
+			go func() {
+				// Assign an ID to this rekey operation so we can track it.
+				newCtx := ctxWithRandomID(ctx, CtxRekeyIDKey,
+					CtxRekeyOpID, nil)
+				err := rkq.config.KBFSOps().Rekey(newCtx, e.id)
+				doneCh <- rekeyResult{e, err}
+			}()
+		}
 	}
-	ch := rkq.queue[0].ch
-	rkq.queue = rkq.queue[1:]
-	return ch
 }
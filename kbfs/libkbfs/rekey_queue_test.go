@@ -5,10 +5,18 @@
 package libkbfs
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
+	"github.com/keybase/backoff"
 	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
 	"golang.org/x/net/context"
 )
 
@@ -84,7 +92,8 @@ func TestRekeyQueueBasic(t *testing.T) {
 	for _, name := range names {
 		rootNode1 := GetRootNodeOrBust(t, config1, name, false)
 		// queue it for rekey
-		c := config1.RekeyQueue().Enqueue(rootNode1.GetFolderBranch().Tlf)
+		c := config1.RekeyQueue().Enqueue(
+			rootNode1.GetFolderBranch().Tlf, RekeyPriorityAccessed)
 		rekeyChannels = append(rekeyChannels, c)
 	}
 
@@ -100,3 +109,294 @@ func TestRekeyQueueBasic(t *testing.T) {
 		_ = GetRootNodeOrBust(t, config2Dev2, name, false)
 	}
 }
+
+func rekeyQueueInit(t *testing.T) (
+	mockCtrl *gomock.Controller, config *ConfigMock) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl = gomock.NewController(ctr)
+	config = NewConfigMock(mockCtrl, ctr)
+	config.SetCodec(NewCodecMsgpack())
+	config.mockClock.EXPECT().Now().AnyTimes().Return(time.Now())
+	// Background entries get checked against the favorites.
+	config.mockKbfs.EXPECT().GetFavorites(gomock.Any()).AnyTimes().
+		Return(nil, nil)
+	config.SetKBPKI(&currentUserKBPKI{config.mockKbpki, "u1"})
+	return mockCtrl, config
+}
+
+// currentUserKBPKI is a KBPKI whose current user can be switched.
+type currentUserKBPKI struct {
+	KBPKI
+	uid keybase1.UID
+}
+
+func (k *currentUserKBPKI) GetCurrentUserInfo(context.Context) (
+	libkb.NormalizedUsername, keybase1.UID, error) {
+	return libkb.NormalizedUsername(k.uid), k.uid, nil
+}
+
+func rekeyQueueShutdown(mockCtrl *gomock.Controller, config *ConfigMock,
+	rkq *RekeyQueueStandard) {
+	rkq.Clear()
+	rkq.Wait(context.Background())
+	rkq.Shutdown()
+	config.ctr.CheckForFailures()
+	mockCtrl.Finish()
+}
+
+// orderedRekeyKBFSOps records the order of the rekeys it's asked to
+// do, and blocks the ones in blockIDs until a value is sent on
+// releaseCh.
+type orderedRekeyKBFSOps struct {
+	KBFSOps
+	blockIDs  map[TlfID]bool
+	releaseCh chan struct{}
+
+	lock  sync.Mutex
+	order []TlfID
+}
+
+func (k *orderedRekeyKBFSOps) Rekey(_ context.Context, id TlfID) error {
+	if k.blockIDs[id] {
+		<-k.releaseCh
+		return nil
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.order = append(k.order, id)
+	return nil
+}
+
+func (k *orderedRekeyKBFSOps) GetFavorites(context.Context) (
+	[]Favorite, error) {
+	return nil, nil
+}
+
+func TestRekeyQueuePriority(t *testing.T) {
+	mockCtrl, config := rekeyQueueInit(t)
+	kbfsOps := &orderedRekeyKBFSOps{
+		KBFSOps:   config.mockKbfs,
+		blockIDs:  make(map[TlfID]bool),
+		releaseCh: make(chan struct{}),
+	}
+	config.SetKBFSOps(kbfsOps)
+	rkq := NewRekeyQueueStandard(config)
+	defer rekeyQueueShutdown(mockCtrl, config, rkq)
+
+	// Fill up all the rekey slots with rekeys that block until
+	// released.
+	var blocked []<-chan error
+	for i := 0; i < rekeyQueueParallelism; i++ {
+		id := FakeTlfID(byte(i+1), false)
+		kbfsOps.blockIDs[id] = true
+		blocked = append(blocked, rkq.Enqueue(id, RekeyPriorityAccessed))
+	}
+
+	bgID := FakeTlfID(100, false)
+	accessedID := FakeTlfID(101, false)
+	bgCh := rkq.Enqueue(bgID, RekeyPriorityBackground)
+	accessedCh := rkq.Enqueue(accessedID, RekeyPriorityAccessed)
+
+	status, statusCh := rkq.Status()
+	if len(status.Entries) != rekeyQueueParallelism+2 {
+		t.Fatalf("Unexpected number of queue entries: %d",
+			len(status.Entries))
+	}
+	last := status.Entries[len(status.Entries)-1]
+	if last.Tlf != bgID.String() ||
+		last.Priority != RekeyPriorityBackground.String() {
+		t.Errorf("Unexpected last entry: %+v", last)
+	}
+
+	// Free up a single slot, which the accessed TLF should get
+	// first.
+	kbfsOps.releaseCh <- struct{}{}
+	for _, c := range []<-chan error{accessedCh, bgCh} {
+		if err := <-c; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The finished rekeys changed the status.
+	select {
+	case <-statusCh:
+	default:
+		t.Errorf("Status should have signalled a change")
+	}
+	close(kbfsOps.releaseCh)
+	for _, c := range blocked {
+		if err := <-c; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kbfsOps.lock.Lock()
+	defer kbfsOps.lock.Unlock()
+	if len(kbfsOps.order) != 2 || kbfsOps.order[0] != accessedID ||
+		kbfsOps.order[1] != bgID {
+		t.Errorf("Unexpected rekey order: %v", kbfsOps.order)
+	}
+	if rkq.IsRekeyPending(bgID) || rkq.IsRekeyPending(accessedID) {
+		t.Errorf("Rekeys still pending after finishing")
+	}
+}
+
+func TestRekeyQueueRetry(t *testing.T) {
+	mockCtrl, config := rekeyQueueInit(t)
+	rkq := NewRekeyQueueStandard(config)
+	rkq.newBackOff = func() backoff.BackOff { return &backoff.ZeroBackOff{} }
+	defer rekeyQueueShutdown(mockCtrl, config, rkq)
+
+	// A retriable error is retried until the rekey succeeds.
+	id := FakeTlfID(1, false)
+	gomock.InOrder(
+		config.mockKbfs.EXPECT().Rekey(gomock.Any(), id).
+			Return(MDServerErrorThrottle{}),
+		config.mockKbfs.EXPECT().Rekey(gomock.Any(), id).
+			Return(MDServerErrorThrottle{}),
+		config.mockKbfs.EXPECT().Rekey(gomock.Any(), id).Return(nil),
+	)
+	if err := <-rkq.Enqueue(id, RekeyPriorityAccessed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any other error is returned right away.
+	id2 := FakeTlfID(2, false)
+	expectedErr := NoSuchNameError{"a"}
+	config.mockKbfs.EXPECT().Rekey(gomock.Any(), id2).Return(expectedErr)
+	if err := <-rkq.Enqueue(id2, RekeyPriorityAccessed); err != expectedErr {
+		t.Errorf("Got unexpected error %v", err)
+	}
+}
+
+func TestRekeyQueuePersistence(t *testing.T) {
+	mockCtrl, config := rekeyQueueInit(t)
+	tempdir, err := ioutil.TempDir(os.TempDir(), "rekey_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	dbPath := filepath.Join(tempdir, "kbfs_rekey_queue")
+
+	rkq, err := NewRekeyQueueStandardDisk(config, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// This rekey doesn't finish before the queue is shut down.
+	id := FakeTlfID(1, false)
+	startedCh := make(chan struct{})
+	config.mockKbfs.EXPECT().Rekey(gomock.Any(), id).Do(
+		func(ctx context.Context, _ TlfID) {
+			close(startedCh)
+			<-ctx.Done()
+		}).Return(context.Canceled)
+	rkq.Restore(context.Background())
+	// Enqueue persists the rekey for the user found by Restore,
+	// without looking the current user up again.
+	kbpki := config.KBPKI().(*currentUserKBPKI)
+	kbpki.uid = "u2"
+	c := rkq.Enqueue(id, RekeyPriorityFavorite)
+	<-startedCh
+	rkq.Clear()
+	if err := <-c; err != context.Canceled {
+		t.Errorf("Got unexpected error %v", err)
+	}
+	if err := rkq.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rkq.Shutdown()
+
+	// The next queue doesn't pick the rekey back up for another
+	// user.
+	rkq, err = NewRekeyQueueStandardDisk(config, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rekeyQueueShutdown(mockCtrl, config, rkq)
+	rkq.Restore(context.Background())
+	if rkq.IsRekeyPending(id) {
+		t.Errorf("Rekey of %s restored for the wrong user", id)
+	}
+
+	// But it does for the same user, without anything else being
+	// queued.
+	kbpki.uid = "u1"
+	config.mockKbfs.EXPECT().Rekey(gomock.Any(), id).Return(nil)
+	rkq.Restore(context.Background())
+	if err := rkq.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rkq.IsRekeyPending(id) {
+		t.Errorf("Restored rekey of %s still pending", id)
+	}
+	id2 := FakeTlfID(2, false)
+	config.mockKbfs.EXPECT().Rekey(gomock.Any(), id2).Return(nil)
+	if err := <-rkq.Enqueue(id2, RekeyPriorityAccessed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Finished rekeys aren't restored again.
+	rkq.Clear()
+	rkq.Restore(context.Background())
+	if err := rkq.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// favoritesRekeyKBFSOps has a single favorite, and records the rekeys
+// it's asked to do.
+type favoritesRekeyKBFSOps struct {
+	KBFSOps
+	rekeyCh chan TlfID
+}
+
+func (k *favoritesRekeyKBFSOps) Rekey(_ context.Context, id TlfID) error {
+	k.rekeyCh <- id
+	return nil
+}
+
+func (k *favoritesRekeyKBFSOps) GetFavorites(context.Context) (
+	[]Favorite, error) {
+	return []Favorite{{Name: "u1", Public: false}}, nil
+}
+
+// Test that looking up a background TLF in the favorites doesn't hold
+// up other rekeys.
+func TestRekeyQueueFavoriteCheckInBackground(t *testing.T) {
+	mockCtrl, config := rekeyQueueInit(t)
+	kbfsOps := &favoritesRekeyKBFSOps{
+		KBFSOps: config.mockKbfs,
+		rekeyCh: make(chan TlfID, 2),
+	}
+	config.SetKBFSOps(kbfsOps)
+	rkq := NewRekeyQueueStandard(config)
+	defer rekeyQueueShutdown(mockCtrl, config, rkq)
+
+	bgID := FakeTlfID(1, false)
+	startedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	config.mockMdops.EXPECT().GetForTLF(gomock.Any(), bgID).Do(
+		func(context.Context, TlfID) {
+			close(startedCh)
+			<-releaseCh
+		}).Return(nil, nil)
+	defer close(releaseCh)
+	bgCh := rkq.Enqueue(bgID, RekeyPriorityBackground)
+	<-startedCh
+
+	accessedID := FakeTlfID(2, false)
+	accessedCh := rkq.Enqueue(accessedID, RekeyPriorityAccessed)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, c := range []<-chan error{bgCh, accessedCh} {
+		select {
+		case err := <-c:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Rekeys blocked by the favorites check: %v",
+				ctx.Err())
+		}
+	}
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/keybase/client/go/logger"
@@ -21,6 +22,9 @@ const (
 	errorParamUsername  = "username"
 	errorParamExternal  = "external"
 	errorParamRekeySelf = "rekeyself"
+	errorParamUsage     = "usage"
+	errorParamLimit     = "limit"
+	errorParamPercent   = "percent"
 
 	// error operation modes
 	errorModeRead  = "read"
@@ -29,6 +33,10 @@ const (
 	// features that aren't ready yet
 	errorFeatureFileLimit = "2gbFileLimit"
 	errorFeatureDirLimit  = "512kbDirLimit"
+
+	// warnings sent as NOT_IMPLEMENTED errors, since there are no
+	// error types for them yet
+	errorFeatureQuotaWarning = "quotaWarning"
 )
 
 const connectionStatusConnected keybase1.FSStatusCode = keybase1.FSStatusCode_START
@@ -119,6 +127,12 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 	case DirTooBigError:
 		code = keybase1.FSErrorType_NOT_IMPLEMENTED
 		params[errorParamFeature] = errorFeatureDirLimit
+	case QuotaUsageWarningError:
+		code = keybase1.FSErrorType_NOT_IMPLEMENTED
+		params[errorParamFeature] = errorFeatureQuotaWarning
+		params[errorParamUsage] = strconv.FormatInt(e.UsageBytes, 10)
+		params[errorParamLimit] = strconv.FormatInt(e.LimitBytes, 10)
+		params[errorParamPercent] = strconv.Itoa(e.Percent)
 	case NewMetadataVersionError:
 		code = keybase1.FSErrorType_OLD_VERSION
 		err = OutdatedVersionError{}
@@ -155,6 +169,7 @@ func (r *ReporterKBPKI) Notify(ctx context.Context, notification *keybase1.FSNot
 func (r *ReporterKBPKI) Shutdown() {
 	r.canceler()
 	close(r.notifyBuffer)
+	r.ReporterSimple.Shutdown()
 }
 
 // send takes notifications out of notifyBuffer and sends them to
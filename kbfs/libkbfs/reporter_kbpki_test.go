@@ -0,0 +1,62 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// daemonNotifyRecorder is a KeybaseDaemon that passes along every
+// notification sent to it.
+type daemonNotifyRecorder struct {
+	KeybaseDaemon
+	notifications chan *keybase1.FSNotification
+}
+
+func (d daemonNotifyRecorder) Notify(ctx context.Context,
+	notification *keybase1.FSNotification) error {
+	d.notifications <- notification
+	return nil
+}
+
+func TestReporterKBPKIQuotaUsageWarning(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+	daemon := daemonNotifyRecorder{
+		config.KeybaseDaemon(), make(chan *keybase1.FSNotification, 1)}
+	config.SetKeybaseDaemon(daemon)
+
+	r := NewReporterKBPKI(config, 10, 10)
+	defer r.Shutdown()
+	err := QuotaUsageWarningError{UsageBytes: 95, LimitBytes: 100, Percent: 90}
+	r.ReportErr(context.Background(), "", false, WriteMode, err)
+
+	var n *keybase1.FSNotification
+	select {
+	case n = <-daemon.notifications:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the notification")
+	}
+	if n.StatusCode != keybase1.FSStatusCode_ERROR ||
+		n.ErrorType != keybase1.FSErrorType_NOT_IMPLEMENTED ||
+		n.Status != err.Error() {
+		t.Errorf("Unexpected notification %+v", n)
+	}
+	for k, v := range map[string]string{
+		errorParamFeature: errorFeatureQuotaWarning,
+		errorParamUsage:   "95",
+		errorParamLimit:   "100",
+		errorParamPercent: "90",
+		errorParamMode:    errorModeWrite,
+	} {
+		if n.Params[k] != v {
+			t.Errorf("Param %s = %q, expected %q", k, n.Params[k], v)
+		}
+	}
+}
@@ -14,15 +14,17 @@ import (
 )
 
 // ReporterSimple remembers the last maxErrors errors, or all errors
-// if maxErrors < 1.
+// if maxErrors < 1.  If it has an ErrorHistory, it also persists all
+// errors there.
 type ReporterSimple struct {
 	clock          Clock
 	maxErrors      int
 	currErrorIndex int
 	filledOnce     bool
 	// errors is a circular buffer when maxErrors >= 1
-	errors []ReportedError
-	lock   sync.RWMutex // protects everything
+	errors  []ReportedError
+	history *ErrorHistory
+	lock    sync.RWMutex // protects everything
 }
 
 // NewReporterSimple creates a new ReporterSimple.
@@ -40,30 +42,53 @@ func NewReporterSimple(clock Clock, maxErrors int) *ReporterSimple {
 	return rs
 }
 
-// ReportErr implements the Reporter interface for ReporterSimple.
-func (r *ReporterSimple) ReportErr(ctx context.Context,
-	_ CanonicalTlfName, _ bool, _ ErrorModeType, err error) {
+// SetErrorHistory makes r persist all reported errors to the given
+// history, and answer queries from it.  r takes ownership of the
+// history, and closes it on Shutdown.
+func (r *ReporterSimple) SetErrorHistory(history *ErrorHistory) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	r.history = history
+}
 
+// ReportErr implements the Reporter interface for ReporterSimple.
+func (r *ReporterSimple) ReportErr(ctx context.Context,
+	tlfName CanonicalTlfName, public bool, mode ErrorModeType, err error) {
 	stack := make([]uintptr, 20)
 	n := runtime.Callers(2, stack)
 	re := ReportedError{
-		Time:  r.clock.Now(),
-		Error: err,
-		Stack: stack[:n],
+		Time:   r.clock.Now(),
+		Error:  err,
+		Stack:  stack[:n],
+		Tlf:    tlfName,
+		Public: public,
+		Mode:   mode,
+		Tags:   LogTagsFromContextToMap(ctx),
 	}
-	r.currErrorIndex++
-	if r.maxErrors < 1 {
-		r.errors = append(r.errors, re)
-	} else {
-		if r.currErrorIndex == r.maxErrors {
-			r.currErrorIndex = 0
-			r.filledOnce = true
+
+	history := func() *ErrorHistory {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.currErrorIndex++
+		if r.maxErrors < 1 {
+			r.errors = append(r.errors, re)
+		} else {
+			if r.currErrorIndex == r.maxErrors {
+				r.currErrorIndex = 0
+				r.filledOnce = true
+			}
+			r.errors[r.currErrorIndex] = re
 		}
-		r.errors[r.currErrorIndex] = re
+		return r.history
+	}()
+
+	// Write to disk without holding r.lock, so that slow disks don't
+	// hold up other reporters and readers.
+	if history != nil {
+		// There's nowhere to report a failure to persist an
+		// error; it's still kept in memory above.
+		_ = history.Add(re.Record())
 	}
-
 }
 
 // AllKnownErrors implements the Reporter interface for ReporterSimple.
@@ -86,6 +111,23 @@ func (r *ReporterSimple) AllKnownErrors() []ReportedError {
 	return errors
 }
 
+// QueryErrors implements the Reporter interface for ReporterSimple.
+func (r *ReporterSimple) QueryErrors(q ErrorQuery) ([]ErrorRecord, error) {
+	r.lock.RLock()
+	history := r.history
+	r.lock.RUnlock()
+	if history != nil {
+		return history.Query(q)
+	}
+
+	errors := r.AllKnownErrors()
+	recs := make([]ErrorRecord, len(errors))
+	for i, e := range errors {
+		recs[i] = e.Record()
+	}
+	return q.filter(recs), nil
+}
+
 // Notify implements the Reporter interface for ReporterSimple.
 func (r *ReporterSimple) Notify(_ context.Context, _ *keybase1.FSNotification) {
 	// ignore notifications
@@ -93,5 +135,10 @@ func (r *ReporterSimple) Notify(_ context.Context, _ *keybase1.FSNotification) {
 
 // Shutdown implements the Reporter interface for ReporterSimple.
 func (r *ReporterSimple) Shutdown() {
-
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.history != nil {
+		r.history.Close()
+		r.history = nil
+	}
 }
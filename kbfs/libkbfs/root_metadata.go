@@ -164,6 +164,11 @@ type RootMetadata struct {
 	// deserialized (more common on the server side).
 	tlfHandle *TlfHandle
 
+	// When the server says this MD update was received, or the zero
+	// time if unknown.  (This is not necessarily trustworthy, just
+	// for informational purposes.)
+	untrustedServerTimestamp time.Time
+
 	// The cached ID for this MD structure (hash)
 	mdIDLock sync.RWMutex
 	mdID     MdID
@@ -9,6 +9,7 @@ import (
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol"
@@ -443,6 +444,7 @@ func makeFakeRootMetadataFuture(t *testing.T) *rootMetadataFuture {
 				codec.UnknownFieldSetHandler{},
 				PrivateMetadata{},
 				nil,
+				time.Time{},
 				sync.RWMutex{},
 				MdID{},
 			},
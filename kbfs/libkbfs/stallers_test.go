@@ -4,7 +4,11 @@
 
 package libkbfs
 
-import "golang.org/x/net/context"
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
 
 // staller is a pair of channels. Whenever something is to be
 // stalled, a value is sent on stalled (if not blocked), and then
@@ -82,6 +86,35 @@ func (f *stallingBlockOps) Put(
 	return err
 }
 
+// PutBatch stalls each block in the batch as if it were being put on
+// its own, in parallel with the others, so that tests can count the
+// blocks put regardless of how they're batched.
+func (f *stallingBlockOps) PutBatch(
+	ctx context.Context, md *RootMetadata, blockPtrs []BlockPointer,
+	readyBlockDatas []ReadyBlockData) error {
+	var wg sync.WaitGroup
+	wg.Add(len(blockPtrs))
+	for range blockPtrs {
+		go func() {
+			defer wg.Done()
+			f.maybeStall(ctx, "Put")
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	err := f.delegate.PutBatch(ctx, md, blockPtrs, readyBlockDatas)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return err
+}
+
 func (f *stallingBlockOps) Delete(
 	ctx context.Context, md *RootMetadata,
 	ptrs []BlockPointer) (map[BlockID]int, error) {
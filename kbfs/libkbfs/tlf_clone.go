@@ -0,0 +1,304 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TLFCloneProgress reports how far along a CloneTLF call is.
+type TLFCloneProgress struct {
+	// Files and Bytes are the number of files that the call needs
+	// to copy, and their total size.  Files that an earlier,
+	// interrupted call already copied aren't included.
+	Files int
+	Bytes uint64
+	// CopiedFiles and CopiedBytes are how much of that has been
+	// copied so far.
+	CopiedFiles int
+	CopiedBytes uint64
+	// SkippedFiles is the number of files that an earlier call
+	// already copied.
+	SkippedFiles int
+}
+
+// tlfCloneFile is a file that needs its data copied.
+type tlfCloneFile struct {
+	src, dst Node
+	ei       EntryInfo
+	// dstEI is the existing destination entry left behind by an
+	// interrupted clone, if exists is set.
+	dstEI  EntryInfo
+	exists bool
+}
+
+// tlfCloneDir is a destination directory whose mtime is set once
+// everything under it has been copied.
+type tlfCloneDir struct {
+	node  Node
+	mtime int64
+}
+
+// tlfCloner copies a whole folder into another one through KBFSOps,
+// so that everything is re-encrypted under the keys of the
+// destination.  It first walks the source, creating the directories
+// and symlinks and collecting the files that need copying, and then
+// copies the files in parallel.
+type tlfCloner struct {
+	kbfsOps    KBFSOps
+	onProgress func(TLFCloneProgress)
+	files      []tlfCloneFile
+	// dirs is in pre-order, so going through it backwards sets the
+	// mtimes of directories after those of their subdirectories.
+	dirs []tlfCloneDir
+
+	progressLock sync.Mutex
+	progress     TLFCloneProgress
+}
+
+func (c *tlfCloner) reportProgressLocked() {
+	if c.onProgress != nil {
+		c.onProgress(c.progress)
+	}
+}
+
+// sameCloneType returns whether an existing destination entry of
+// type dstType can hold a copy of a source entry of type srcType.
+func sameCloneType(srcType, dstType EntryType) bool {
+	switch srcType {
+	case File, Exec:
+		return dstType == File || dstType == Exec
+	default:
+		return srcType == dstType
+	}
+}
+
+// walkDir prepares the copy of everything under src into dst.
+// Entries that are already in dst, from an earlier interrupted
+// clone, are reused; a file counts as copied once its size and mtime
+// match, since the mtime is set only after the data is sync'd.
+func (c *tlfCloner) walkDir(ctx context.Context, src, dst Node,
+	isRoot bool) error {
+	srcChildren, err := c.kbfsOps.GetDirChildren(ctx, src)
+	if err != nil {
+		return err
+	}
+	dstChildren, err := c.kbfsOps.GetDirChildren(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(srcChildren))
+	for name := range srcChildren {
+		// The trash stays behind with the source folder.
+		if isRoot && name == TrashDirName {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ei := srcChildren[name]
+		dstEI, exists := dstChildren[name]
+		if exists && !sameCloneType(ei.Type, dstEI.Type) {
+			return NameExistsError{name}
+		}
+
+		switch ei.Type {
+		case Sym:
+			if exists {
+				if dstEI.SymPath != ei.SymPath {
+					return NameExistsError{name}
+				}
+				continue
+			}
+			_, err := c.kbfsOps.CreateLink(ctx, dst, name, ei.SymPath)
+			if err != nil {
+				return err
+			}
+		case Dir:
+			srcDir, _, err := c.kbfsOps.Lookup(ctx, src, name)
+			if err != nil {
+				return err
+			}
+			var dstDir Node
+			if exists {
+				dstDir, _, err = c.kbfsOps.Lookup(ctx, dst, name)
+			} else {
+				dstDir, _, err = c.kbfsOps.CreateDir(ctx, dst, name)
+			}
+			if err != nil {
+				return err
+			}
+			c.dirs = append(c.dirs, tlfCloneDir{dstDir, ei.Mtime})
+			err = c.walkDir(ctx, srcDir, dstDir, false)
+			if err != nil {
+				return err
+			}
+		default:
+			if exists && dstEI.Type == ei.Type && dstEI.Size == ei.Size &&
+				dstEI.Mtime == ei.Mtime {
+				c.progress.SkippedFiles++
+				continue
+			}
+			srcFile, _, err := c.kbfsOps.Lookup(ctx, src, name)
+			if err != nil {
+				return err
+			}
+			var dstFile Node
+			if exists {
+				dstFile, _, err = c.kbfsOps.Lookup(ctx, dst, name)
+			} else {
+				dstFile, _, err = c.kbfsOps.CreateFile(
+					ctx, dst, name, ei.Type == Exec)
+			}
+			if err != nil {
+				return err
+			}
+			c.files = append(c.files, tlfCloneFile{
+				src:    srcFile,
+				dst:    dstFile,
+				ei:     ei,
+				dstEI:  dstEI,
+				exists: exists,
+			})
+			c.progress.Files++
+			c.progress.Bytes += ei.Size
+		}
+	}
+	return nil
+}
+
+func (c *tlfCloner) copyFile(ctx context.Context, f tlfCloneFile) error {
+	if f.exists {
+		// Start over on a file left partially copied.
+		err := c.kbfsOps.Truncate(ctx, f.dst, 0)
+		if err != nil {
+			return err
+		}
+		if f.dstEI.Type != f.ei.Type {
+			err = c.kbfsOps.SetEx(ctx, f.dst, f.ei.Type == Exec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := copyFileContents(ctx, c.kbfsOps, f.src, f.dst, f.ei.Mtime)
+	if err != nil {
+		return err
+	}
+
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	c.progress.CopiedFiles++
+	c.progress.CopiedBytes += f.ei.Size
+	c.reportProgressLocked()
+	return nil
+}
+
+// copyFiles copies the data of all the collected files, using at
+// most numWorkers files at a time.
+func (c *tlfCloner) copyFiles(ctx context.Context, numWorkers int) error {
+	if numWorkers > len(c.files) {
+		numWorkers = len(c.files)
+	}
+	files := make(chan tlfCloneFile, len(c.files))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errChan := make(chan error, len(c.files))
+	worker := func() {
+		defer wg.Done()
+		for f := range files {
+			select {
+			// return early if the context has been canceled
+			case <-ctx.Done():
+				return
+			default:
+			}
+			errChan <- c.copyFile(ctx, f)
+		}
+	}
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go worker()
+	}
+
+	for _, f := range c.files {
+		files <- f
+	}
+	close(files)
+
+	for range c.files {
+		select {
+		case err := <-errChan:
+			if err != nil {
+				// deferred cancel will stop the other workers.
+				return err
+			}
+		case <-ctx.Done():
+			// The workers stop without copying the rest of the
+			// files, so don't wait for their results.
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// CloneTLF implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) CloneTLF(ctx context.Context, src, dst *TlfHandle,
+	onProgress func(TLFCloneProgress)) (progress TLFCloneProgress, err error) {
+	srcRoot, _, err := fs.GetOrCreateRootNode(ctx, src, MasterBranch)
+	if err != nil {
+		return TLFCloneProgress{}, err
+	}
+	dstRoot, _, err := fs.GetOrCreateRootNode(ctx, dst, MasterBranch)
+	if err != nil {
+		return TLFCloneProgress{}, err
+	}
+	if srcRoot.GetFolderBranch() == dstRoot.GetFolderBranch() {
+		return TLFCloneProgress{}, CloneToSameTlfError{src.GetCanonicalName()}
+	}
+
+	fs.log.CDebugf(ctx, "Cloning %s into %s",
+		src.GetCanonicalName(), dst.GetCanonicalName())
+	c := &tlfCloner{
+		kbfsOps:    fs.config.KBFSOps(),
+		onProgress: onProgress,
+	}
+	err = c.walkDir(ctx, srcRoot, dstRoot, true)
+	if err != nil {
+		return TLFCloneProgress{}, err
+	}
+	c.progressLock.Lock()
+	c.reportProgressLocked()
+	c.progressLock.Unlock()
+
+	err = c.copyFiles(ctx, fs.config.MaxParallelBlockPuts())
+	if err != nil {
+		return TLFCloneProgress{}, err
+	}
+
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		mtime := time.Unix(0, c.dirs[i].mtime)
+		err := c.kbfsOps.SetMtime(ctx, c.dirs[i].node, &mtime)
+		if err != nil {
+			return TLFCloneProgress{}, err
+		}
+	}
+
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	return c.progress, nil
+}
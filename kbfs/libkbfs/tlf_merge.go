@@ -0,0 +1,346 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// tlfMergeChunkSize is how much file data is read and written at a
+// time when copying and comparing files between folders.
+const tlfMergeChunkSize = 512 * 1024
+
+// TLFMergeResult describes what MergeConflictedTLF copied into the
+// canonical folder.
+type TLFMergeResult struct {
+	// Target is the canonical name of the folder that was merged
+	// into.
+	Target CanonicalTlfName
+	// Copied is the number of files, symlinks and directories that
+	// were copied.
+	Copied int
+	// Renamed maps the slash-separated paths, relative to the
+	// folder root, of the entries that collided with different
+	// entries in the target to the paths they were copied to
+	// instead.
+	Renamed map[string]string
+}
+
+// CanonicalHandleForConflicted returns the handle of the folder that
+// the given conflicted folder is a copy of, i.e. the one with the
+// same name but without the conflict suffix.
+func CanonicalHandleForConflicted(ctx context.Context, config Config,
+	conflicted *TlfHandle) (*TlfHandle, error) {
+	if conflicted.ConflictInfo == nil {
+		return nil, TlfNotConflictedError{conflicted.GetCanonicalName()}
+	}
+	name := strings.SplitN(
+		string(conflicted.GetCanonicalName()), ConflictSuffixSep, 2)[0]
+	return ParseTlfHandle(ctx, config.KBPKI(), name, conflicted.IsPublic(),
+		config.SharingBeforeSignupEnabled())
+}
+
+// tlfMerger copies the contents of one folder into another through
+// KBFSOps, so that everything copied is re-encrypted under the keys
+// of the target folder.
+type tlfMerger struct {
+	kbfsOps KBFSOps
+	winfo   writerInfo
+	now     time.Time
+	result  *TLFMergeResult
+}
+
+func mergePath(dirPath, name string) string {
+	if dirPath == "" {
+		return name
+	}
+	return dirPath + "/" + name
+}
+
+// conflictName returns the name, unused in the given directory
+// entries, that a colliding entry called name is copied to.
+func (m *tlfMerger) conflictName(
+	name string, taken map[string]EntryInfo) string {
+	newName := WriterDeviceDateConflictRenamer{}.ConflictRenameHelper(
+		m.now, string(m.winfo.name), m.winfo.deviceName, name)
+	base, ext := splitExtension(newName)
+	for i := 2; ; i++ {
+		if _, ok := taken[newName]; !ok {
+			return newName
+		}
+		newName = fmt.Sprintf("%s #%d%s", base, i, ext)
+	}
+}
+
+// sameFile returns whether the two files have identical contents.
+func (m *tlfMerger) sameFile(ctx context.Context, src, dst Node) (
+	bool, error) {
+	srcBuf := make([]byte, tlfMergeChunkSize)
+	dstBuf := make([]byte, tlfMergeChunkSize)
+	for off := int64(0); ; {
+		n, err := m.kbfsOps.Read(ctx, src, srcBuf, off)
+		if err != nil {
+			return false, err
+		}
+		// Reads may be short, so fill in as much of the
+		// destination chunk as the source one had.
+		var dstN int64
+		for dstN < n {
+			read, err := m.kbfsOps.Read(ctx, dst, dstBuf[dstN:n], off+dstN)
+			if err != nil {
+				return false, err
+			}
+			if read == 0 {
+				return false, nil
+			}
+			dstN += read
+		}
+		if n == 0 {
+			// Make sure the destination ends here too.
+			read, err := m.kbfsOps.Read(ctx, dst, dstBuf[:1], off)
+			if err != nil {
+				return false, err
+			}
+			return read == 0, nil
+		}
+		if !bytes.Equal(srcBuf[:n], dstBuf[:n]) {
+			return false, nil
+		}
+		off += n
+	}
+}
+
+// sameEntry returns whether the entry named name in src is identical
+// to the one named name in dst, in which case it doesn't need to be
+// copied.  Directories are never the same, since they get merged.
+func (m *tlfMerger) sameEntry(ctx context.Context, src, dst Node,
+	name string, srcEI, dstEI EntryInfo) (bool, error) {
+	if srcEI.Type != dstEI.Type {
+		return false, nil
+	}
+	switch srcEI.Type {
+	case Sym:
+		return srcEI.SymPath == dstEI.SymPath, nil
+	case File, Exec:
+		if srcEI.Size != dstEI.Size {
+			return false, nil
+		}
+		srcFile, _, err := m.kbfsOps.Lookup(ctx, src, name)
+		if err != nil {
+			return false, err
+		}
+		dstFile, _, err := m.kbfsOps.Lookup(ctx, dst, name)
+		if err != nil {
+			return false, err
+		}
+		return m.sameFile(ctx, srcFile, dstFile)
+	default:
+		return false, nil
+	}
+}
+
+// copyFileContents copies the data and mtime of src into dst, which
+// must be empty, through the given KBFSOps.
+func copyFileContents(ctx context.Context, kbfsOps KBFSOps, src, dst Node,
+	mtime int64) error {
+	buf := make([]byte, tlfMergeChunkSize)
+	for off := int64(0); ; {
+		n, err := kbfsOps.Read(ctx, src, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		err = kbfsOps.Write(ctx, dst, buf[:n], off)
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+	err := kbfsOps.Sync(ctx, dst)
+	if err != nil {
+		return err
+	}
+	t := time.Unix(0, mtime)
+	return kbfsOps.SetMtime(ctx, dst, &t)
+}
+
+// copyEntry copies the entry srcName in src, along with everything
+// under it, to the new entry dstName in dst.
+func (m *tlfMerger) copyEntry(ctx context.Context, src Node, srcName string,
+	ei EntryInfo, dst Node, dstName, srcPath, dstPath string) error {
+	switch ei.Type {
+	case Sym:
+		_, err := m.kbfsOps.CreateLink(ctx, dst, dstName, ei.SymPath)
+		if err != nil {
+			return err
+		}
+	case Dir:
+		srcDir, _, err := m.kbfsOps.Lookup(ctx, src, srcName)
+		if err != nil {
+			return err
+		}
+		dstDir, _, err := m.kbfsOps.CreateDir(ctx, dst, dstName)
+		if err != nil {
+			return err
+		}
+		err = m.mergeDir(ctx, srcDir, dstDir, srcPath, dstPath)
+		if err != nil {
+			return err
+		}
+	default:
+		srcFile, _, err := m.kbfsOps.Lookup(ctx, src, srcName)
+		if err != nil {
+			return err
+		}
+		dstFile, _, err := m.kbfsOps.CreateFile(
+			ctx, dst, dstName, ei.Type == Exec)
+		if err != nil {
+			return err
+		}
+		err = copyFileContents(ctx, m.kbfsOps, srcFile, dstFile, ei.Mtime)
+		if err != nil {
+			return err
+		}
+	}
+	m.result.Copied++
+	return nil
+}
+
+// mergeDir copies everything in src that isn't already in dst into
+// dst, recursing into directories that exist in both, and copying
+// entries that collide with different ones under conflict names.
+func (m *tlfMerger) mergeDir(ctx context.Context, src, dst Node,
+	srcPath, dstPath string) error {
+	srcChildren, err := m.kbfsOps.GetDirChildren(ctx, src)
+	if err != nil {
+		return err
+	}
+	dstChildren, err := m.kbfsOps.GetDirChildren(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	// Go in order, so that the conflict names are predictable.
+	names := make([]string, 0, len(srcChildren))
+	for name := range srcChildren {
+		// The trash of the conflicted copy stays behind.
+		if srcPath == "" && name == TrashDirName {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		srcEI := srcChildren[name]
+		childSrcPath := mergePath(srcPath, name)
+		dstName := name
+		if dstEI, ok := dstChildren[name]; ok {
+			if srcEI.Type == Dir && dstEI.Type == Dir {
+				srcDir, _, err := m.kbfsOps.Lookup(ctx, src, name)
+				if err != nil {
+					return err
+				}
+				dstDir, _, err := m.kbfsOps.Lookup(ctx, dst, name)
+				if err != nil {
+					return err
+				}
+				err = m.mergeDir(ctx, srcDir, dstDir, childSrcPath,
+					mergePath(dstPath, name))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			same, err := m.sameEntry(ctx, src, dst, name, srcEI, dstEI)
+			if err != nil {
+				return err
+			}
+			if same {
+				continue
+			}
+			dstName = m.conflictName(name, dstChildren)
+			m.result.Renamed[childSrcPath] = mergePath(dstPath, dstName)
+		}
+
+		err := m.copyEntry(ctx, src, name, srcEI, dst, dstName,
+			childSrcPath, mergePath(dstPath, dstName))
+		if err != nil {
+			return err
+		}
+		dstChildren[dstName] = srcEI
+	}
+	return nil
+}
+
+// MergeConflictedTLF implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) MergeConflictedTLF(ctx context.Context,
+	conflicted *TlfHandle) (result TLFMergeResult, err error) {
+	target, err := CanonicalHandleForConflicted(ctx, fs.config, conflicted)
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+
+	srcRoot, _, err := fs.GetOrCreateRootNode(ctx, conflicted, MasterBranch)
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+	dstRoot, _, err := fs.GetOrCreateRootNode(ctx, target, MasterBranch)
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+
+	// Colliding entries are named after the current user's device,
+	// like the ones conflict resolution makes.
+	kbpki := fs.config.KBPKI()
+	_, uid, err := kbpki.GetCurrentUserInfo(ctx)
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+	key, err := kbpki.GetCurrentVerifyingKey(ctx)
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+	winfo, err := newWriterInfo(ctx, fs.config, uid, key.KID())
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+
+	fs.log.CDebugf(ctx, "Merging %s into %s",
+		conflicted.GetCanonicalName(), target.GetCanonicalName())
+	result = TLFMergeResult{
+		Target:  target.GetCanonicalName(),
+		Renamed: make(map[string]string),
+	}
+	m := &tlfMerger{
+		kbfsOps: fs.config.KBFSOps(),
+		winfo:   winfo,
+		now:     fs.config.Clock().Now(),
+		result:  &result,
+	}
+	err = m.mergeDir(ctx, srcRoot, dstRoot, "", "")
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+
+	// Now that everything is in the canonical folder, hide the
+	// conflicted copy from the user's folder list.
+	err = fs.DeleteFavorite(ctx, string(conflicted.GetCanonicalName()),
+		conflicted.IsPublic())
+	if err != nil {
+		return TLFMergeResult{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TrashDirName is the name of the hidden directory, at the root of
+// each top-level folder, that holds removed entries while the trash
+// is on (see Config.TrashRetention).  Within it, entries are grouped
+// into directories named by the UTC date of their removal, in
+// TrashDateFormat.
+const TrashDirName = ".kbfs_trash"
+
+// TrashDateFormat is the time format of the per-day directories
+// within TrashDirName.
+const TrashDateFormat = "2006-01-02"
+
+// Entries in the trash are named after their original path within
+// the folder.  Path separators are escaped so the whole path fits in
+// one name, and "~" is escaped so that the ".~N~" suffix used to
+// tell apart entries with the same path is unambiguous.
+var trashNameEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "~", "%7E")
+var trashNameUnescaper = strings.NewReplacer(
+	"%25", "%", "%2F", "/", "%7E", "~")
+var trashNameSuffixRegexp = regexp.MustCompile(`\.~[0-9]+~$`)
+
+// trashEntryName returns the name of the trash entry for the given
+// path, which is relative to the root of the folder.  If n > 0, a
+// suffix is added to avoid a clash with an existing entry.
+func trashEntryName(origPath string, n int) string {
+	name := trashNameEscaper.Replace(origPath)
+	if n > 0 {
+		name += fmt.Sprintf(".~%d~", n)
+	}
+	return name
+}
+
+// origPathFromTrashEntryName is the inverse of trashEntryName.
+func origPathFromTrashEntryName(date, name string) (string, error) {
+	origPath := trashNameUnescaper.Replace(
+		trashNameSuffixRegexp.ReplaceAllString(name, ""))
+	for _, component := range strings.Split(origPath, "/") {
+		if component == "" || component == "." || component == ".." {
+			return "", InvalidTrashEntryError{date, name}
+		}
+	}
+	return origPath, nil
+}
+
+// parseTrashDate returns the start of the day named by a directory
+// in the trash.
+func parseTrashDate(date string) (time.Time, error) {
+	return time.Parse(TrashDateFormat, date)
+}
+
+// isTrashPath returns whether p is in, or is, the folder's trash.
+func isTrashPath(p path) bool {
+	return len(p.path) > 1 && p.path[1].Name == TrashDirName
+}
@@ -0,0 +1,362 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+func TestTrashEntryNames(t *testing.T) {
+	for _, origPath := range []string{
+		"a", "a/b/c", "100%/done~", "a.~1~", "a%2F~b",
+	} {
+		for _, n := range []int{0, 1, 12} {
+			name := trashEntryName(origPath, n)
+			p, err := origPathFromTrashEntryName("2016-01-02", name)
+			if err != nil {
+				t.Fatalf("Couldn't parse %q: %v", name, err)
+			}
+			if p != origPath {
+				t.Errorf("%q (%d) was named %q and parsed as %q",
+					origPath, n, name, p)
+			}
+		}
+	}
+
+	if name := trashEntryName("a/b~", 2); name != "a%2Fb%7E.~2~" {
+		t.Errorf("Unexpected trash name %q", name)
+	}
+
+	for _, name := range []string{"%2Fa", "a%2F", "a%2F..%2Fb", ".~1~"} {
+		_, err := origPathFromTrashEntryName("2016-01-02", name)
+		if _, ok := err.(InvalidTrashEntryError); !ok {
+			t.Errorf("Unexpected error parsing %q: %v", name, err)
+		}
+	}
+}
+
+func TestTrashRemoveAndRestore(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetTrashRetention(24 * time.Hour)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	date := clock.Now().UTC().Format(TrashDateFormat)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	dirB, _, err := kbfsOps.CreateDir(ctx, dirA, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	data := []byte{1, 2, 3, 4, 5}
+	writeFile := func() {
+		fileNode, _, err := kbfsOps.CreateFile(ctx, dirB, "c", false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+	}
+	writeFile()
+
+	// Removing the file moves it to the trash, and removing its
+	// (now empty) parents really removes them.
+	if err := kbfsOps.RemoveEntry(ctx, dirB, "c"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	if err := kbfsOps.RemoveDir(ctx, dirA, "b"); err != nil {
+		t.Fatalf("Couldn't remove dir: %v", err)
+	}
+	if err := kbfsOps.RemoveDir(ctx, rootNode, "a"); err != nil {
+		t.Fatalf("Couldn't remove dir: %v", err)
+	}
+
+	lookupTrashDay := func() Node {
+		trashNode, _, err := kbfsOps.Lookup(ctx, rootNode, TrashDirName)
+		if err != nil {
+			t.Fatalf("Couldn't look up trash: %v", err)
+		}
+		dateNode, _, err := kbfsOps.Lookup(ctx, trashNode, date)
+		if err != nil {
+			t.Fatalf("Couldn't look up trash day: %v", err)
+		}
+		return dateNode
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, lookupTrashDay())
+	if err != nil {
+		t.Fatalf("Couldn't get trash children: %v", err)
+	}
+	if _, ok := children["a%2Fb%2Fc"]; !ok || len(children) != 1 {
+		t.Fatalf("Unexpected trash children: %v", children)
+	}
+
+	// Restoring puts it back, along with its parents.
+	fb := rootNode.GetFolderBranch()
+	origPath, err := kbfsOps.RestoreFromTrash(ctx, fb, date, "a%2Fb%2Fc")
+	if err != nil {
+		t.Fatalf("Couldn't restore: %v", err)
+	}
+	if origPath != "a/b/c" {
+		t.Errorf("Unexpected restored path %s", origPath)
+	}
+	dirA, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up restored dir: %v", err)
+	}
+	dirB, _, err = kbfsOps.Lookup(ctx, dirA, "b")
+	if err != nil {
+		t.Fatalf("Couldn't look up restored dir: %v", err)
+	}
+	fileNode, _, err := kbfsOps.Lookup(ctx, dirB, "c")
+	if err != nil {
+		t.Fatalf("Couldn't look up restored file: %v", err)
+	}
+	gotData := make([]byte, len(data))
+	if _, err := kbfsOps.Read(ctx, fileNode, gotData, 0); err != nil {
+		t.Fatalf("Couldn't read restored file: %v", err)
+	}
+	if !bytes.Equal(data, gotData) {
+		t.Errorf("Restored data %v, expected %v", gotData, data)
+	}
+
+	// Removing the same path twice in a day keeps both copies, and
+	// a restore doesn't clobber anything.
+	if err := kbfsOps.RemoveEntry(ctx, dirB, "c"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	writeFile()
+	if err := kbfsOps.RemoveEntry(ctx, dirB, "c"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	writeFile()
+	_, err = kbfsOps.RestoreFromTrash(ctx, fb, date, "a%2Fb%2Fc.~1~")
+	if _, ok := err.(NameExistsError); !ok {
+		t.Fatalf("Unexpected error restoring over a file: %v", err)
+	}
+	dateNode := lookupTrashDay()
+	children, err = kbfsOps.GetDirChildren(ctx, dateNode)
+	if err != nil {
+		t.Fatalf("Couldn't get trash children: %v", err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("Unexpected trash children: %v", children)
+	}
+
+	// Removing from the trash is permanent.
+	if err := kbfsOps.RemoveEntry(ctx, dateNode, "a%2Fb%2Fc"); err != nil {
+		t.Fatalf("Couldn't remove from trash: %v", err)
+	}
+	children, err = kbfsOps.GetDirChildren(ctx, dateNode)
+	if err != nil {
+		t.Fatalf("Couldn't get trash children: %v", err)
+	}
+	if len(children) != 1 {
+		t.Fatalf("Unexpected trash children: %v", children)
+	}
+
+	_, err = kbfsOps.RestoreFromTrash(ctx, fb, "yesterday", "a")
+	if _, ok := err.(InvalidTrashEntryError); !ok {
+		t.Errorf("Unexpected error restoring a bad date: %v", err)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetTrashRetention(24 * time.Hour)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "a"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	md, err := ops.getMDForFBM(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	usageBefore := md.DiskUsage
+
+	checkTrashDays := func(expected int) {
+		trashNode, _, err := kbfsOps.Lookup(ctx, rootNode, TrashDirName)
+		if err != nil {
+			t.Fatalf("Couldn't look up trash: %v", err)
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, trashNode)
+		if err != nil {
+			t.Fatalf("Couldn't get trash children: %v", err)
+		}
+		if len(children) != expected {
+			t.Fatalf("Unexpected trash days: %v", children)
+		}
+	}
+
+	// Nothing is old enough yet.
+	if err := ops.fbm.purgeExpiredTrash(ctx); err != nil {
+		t.Fatalf("Couldn't purge trash: %v", err)
+	}
+	checkTrashDays(1)
+
+	clock.Add(49 * time.Hour)
+	if err := ops.fbm.purgeExpiredTrash(ctx); err != nil {
+		t.Fatalf("Couldn't purge trash: %v", err)
+	}
+	checkTrashDays(0)
+
+	md, err = ops.getMDForFBM(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	if md.DiskUsage >= usageBefore {
+		t.Errorf("Purging didn't reduce the disk usage: %d -> %d",
+			usageBefore, md.DiskUsage)
+	}
+}
+
+// Test that quota reclamation works from the head made by purging
+// the trash, rather than the one from before.
+func TestTrashPurgeDuringReclamation(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetTrashRetention(24 * time.Hour)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "a"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	md, err := ops.getMDForFBM(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	revBefore := md.Revision
+
+	clock.Add(49 * time.Hour)
+	ops.fbm.forceQuotaReclamation()
+	if err := ops.fbm.waitForQuotaReclamations(ctx); err != nil {
+		t.Fatalf("Couldn't wait for quota reclamation: %v", err)
+	}
+	if rev := ops.fbm.lastQRHeadRev; rev <= revBefore {
+		t.Errorf("Reclamation used head %d, from before the purge", rev)
+	}
+}
+
+func TestTrashPurgeNestedDirs(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetTrashRetention(24 * time.Hour)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirNode := rootNode
+	for _, name := range []string{"a", "b", "c"} {
+		var err error
+		dirNode, _, err = kbfsOps.CreateDir(ctx, dirNode, name)
+		if err != nil {
+			t.Fatalf("Couldn't create dir %s: %v", name, err)
+		}
+	}
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "d", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	// Only files are moved to the trash when they're removed, so
+	// put the whole tree in there by hand, next to a removed file.
+	otherNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "e", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, otherNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "e"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	trashNode, _, err := kbfsOps.Lookup(ctx, rootNode, TrashDirName)
+	if err != nil {
+		t.Fatalf("Couldn't look up trash: %v", err)
+	}
+	dateNode, _, err := kbfsOps.Lookup(
+		ctx, trashNode, clock.Now().UTC().Format(TrashDateFormat))
+	if err != nil {
+		t.Fatalf("Couldn't look up trash day: %v", err)
+	}
+	if err := kbfsOps.Rename(ctx, rootNode, "a", dateNode, "a"); err != nil {
+		t.Fatalf("Couldn't move dir to the trash: %v", err)
+	}
+
+	clock.Add(49 * time.Hour)
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	if err := ops.fbm.purgeExpiredTrash(ctx); err != nil {
+		t.Fatalf("Couldn't purge trash: %v", err)
+	}
+
+	md, err := ops.getMDForFBM(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	unrefs := make(map[BlockPointer]bool)
+	for _, op := range md.data.Changes.Ops {
+		for _, ptr := range op.Unrefs() {
+			if unrefs[ptr] {
+				t.Errorf("Block %v was unreferenced more than once", ptr)
+			}
+			unrefs[ptr] = true
+		}
+	}
+	// The three directories and the file, at least.
+	if len(unrefs) < 4 {
+		t.Errorf("Only %d blocks were unreferenced", len(unrefs))
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package metricsutil
+
+import "sync"
+
+// OverflowLabelValue is the label value LabelValueLimiter returns
+// for any value past its limit.
+const OverflowLabelValue = "other"
+
+// LabelValueLimiter bounds the number of distinct values used for a
+// metric label, so that a label keyed by e.g. a TLF ID can't grow
+// the registry without bound.  The first values seen are kept as
+// is, and all later ones are aggregated under OverflowLabelValue.
+type LabelValueLimiter struct {
+	max int
+
+	lock   sync.Mutex
+	values map[string]bool
+}
+
+// NewLabelValueLimiter returns a LabelValueLimiter that keeps at
+// most max distinct label values.
+func NewLabelValueLimiter(max int) *LabelValueLimiter {
+	return &LabelValueLimiter{
+		max:    max,
+		values: make(map[string]bool),
+	}
+}
+
+// Value returns the label value to use for v: v itself if it has
+// been seen before or there is still room for it, and
+// OverflowLabelValue otherwise.
+func (l *LabelValueLimiter) Value(v string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.values[v] {
+		return v
+	}
+	if len(l.values) >= l.max {
+		return OverflowLabelValue
+	}
+	l.values[v] = true
+	return v
+}
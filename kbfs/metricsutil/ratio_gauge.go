@@ -0,0 +1,62 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package metricsutil
+
+import "github.com/rcrowley/go-metrics"
+
+// Countable is anything that counts events, e.g. a metrics.Counter,
+// metrics.Meter or metrics.Timer.
+type Countable interface {
+	Count() int64
+}
+
+// RatioGauge is a GaugeFloat64 whose value is computed on demand as
+// the ratio of two counts, e.g. cache hits over cache lookups. See
+// http://metrics.dropwizard.io/3.1.0/manual/core/#ratio-gauges .
+type RatioGauge struct {
+	numerator   Countable
+	denominator Countable
+}
+
+var _ metrics.GaugeFloat64 = RatioGauge{}
+
+// NewRatioGauge constructs a new RatioGauge from the given counts.
+func NewRatioGauge(numerator, denominator Countable) RatioGauge {
+	return RatioGauge{numerator, denominator}
+}
+
+// GetOrRegisterRatioGauge returns an existing GaugeFloat64 with the
+// given name, or constructs and registers a new RatioGauge from the
+// given counts.
+func GetOrRegisterRatioGauge(name string, numerator,
+	denominator Countable, r metrics.Registry) metrics.GaugeFloat64 {
+	if r == nil {
+		r = metrics.DefaultRegistry
+	}
+	return r.GetOrRegister(
+		name, NewRatioGauge(numerator, denominator)).(metrics.GaugeFloat64)
+}
+
+// Snapshot implements the metrics.GaugeFloat64 interface for
+// RatioGauge.
+func (g RatioGauge) Snapshot() metrics.GaugeFloat64 {
+	return metrics.GaugeFloat64Snapshot(g.Value())
+}
+
+// Update implements the metrics.GaugeFloat64 interface for
+// RatioGauge. It panics, since the value is always computed.
+func (g RatioGauge) Update(float64) {
+	panic("Update called on a RatioGauge")
+}
+
+// Value implements the metrics.GaugeFloat64 interface for
+// RatioGauge. It returns 0 if the denominator is 0.
+func (g RatioGauge) Value() float64 {
+	d := g.denominator.Count()
+	if d == 0 {
+		return 0
+	}
+	return float64(g.numerator.Count()) / float64(d)
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package metricsutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// PrometheusPrefix is prepended to every metric name written by
+// WritePrometheus.
+const PrometheusPrefix = "kbfs_"
+
+// PrometheusContentType is the content type of the output of
+// WritePrometheus.
+const PrometheusContentType = "text/plain; version=0.0.4"
+
+var prometheusQuantiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// NameWithLabels returns a metric name with the given label
+// key/value pairs attached, e.g. NameWithLabels("BlockServer.Get",
+// "tlf", id) returns `BlockServer.Get{tlf="<id>"}`. WritePrometheus
+// exports all metrics sharing a base name as a single labeled
+// family. labelPairs must have an even length.
+func NameWithLabels(name string, labelPairs ...string) string {
+	if len(labelPairs) == 0 {
+		return name
+	}
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", sanitizePrometheusName(labelPairs[i]),
+			escapePrometheusLabelValue(labelPairs[i+1]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func sanitizePrometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+var prometheusLabelValueReplacer = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePrometheusLabelValue(value string) string {
+	return prometheusLabelValueReplacer.Replace(value)
+}
+
+// splitLabels splits a name built by NameWithLabels into its
+// sanitized, prefixed base name and its labels, without braces.
+func splitLabels(name string) (base, labels string) {
+	if i := strings.IndexByte(name, '{'); i >= 0 &&
+		strings.HasSuffix(name, "}") {
+		base, labels = name[:i], name[i+1:len(name)-1]
+	} else {
+		base = name
+	}
+	return PrometheusPrefix + sanitizePrometheusName(base), labels
+}
+
+type prometheusSample struct {
+	base   string
+	labels string
+	m      interface{}
+}
+
+type prometheusSampleSlice []prometheusSample
+
+func (s prometheusSampleSlice) Len() int { return len(s) }
+
+func (s prometheusSampleSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less keeps all samples of one family together, as Prometheus
+// requires.
+func (s prometheusSampleSlice) Less(i, j int) bool {
+	if s[i].base != s[j].base {
+		return s[i].base < s[j].base
+	}
+	return s[i].labels < s[j].labels
+}
+
+func writePrometheusValue(w io.Writer, name, labels, extraLabel string,
+	value float64) {
+	switch {
+	case labels != "" && extraLabel != "":
+		fmt.Fprintf(w, "%s{%s,%s} %g\n", name, labels, extraLabel, value)
+	case labels != "" || extraLabel != "":
+		fmt.Fprintf(w, "%s{%s%s} %g\n", name, labels, extraLabel, value)
+	default:
+		fmt.Fprintf(w, "%s %g\n", name, value)
+	}
+}
+
+// writePrometheusSummary writes the quantiles, sum and count of a
+// histogram or timer.  go-metrics only keeps a sample of the
+// observed values, so the sum is estimated from the sample mean.
+func writePrometheusSummary(w io.Writer, name, labels string, count int64,
+	mean float64, ps []float64, scale float64) {
+	for i, q := range prometheusQuantiles {
+		writePrometheusValue(w, name, labels,
+			fmt.Sprintf("quantile=\"%g\"", q), ps[i]/scale)
+	}
+	writePrometheusValue(w, name+"_sum", labels, "",
+		mean*float64(count)/scale)
+	writePrometheusValue(w, name+"_count", labels, "", float64(count))
+}
+
+// WritePrometheus writes the metrics in the given registry to the
+// given io.Writer, in the Prometheus text exposition format.  Metric
+// names are prefixed with PrometheusPrefix, and any characters not
+// allowed by Prometheus are replaced with underscores.  Histograms
+// and timers are exported as summaries, with timers in seconds.
+func WritePrometheus(r metrics.Registry, w io.Writer) {
+	var samples prometheusSampleSlice
+	r.Each(func(name string, i interface{}) {
+		base, labels := splitLabels(name)
+		samples = append(samples, prometheusSample{base, labels, i})
+	})
+	sort.Sort(samples)
+
+	lastBase := ""
+	writeType := func(name, typ string) {
+		if name != lastBase {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			lastBase = name
+		}
+	}
+	for _, s := range samples {
+		switch metric := s.m.(type) {
+		case metrics.Counter:
+			writeType(s.base, "counter")
+			writePrometheusValue(w, s.base, s.labels, "",
+				float64(metric.Count()))
+		case metrics.Gauge:
+			writeType(s.base, "gauge")
+			writePrometheusValue(w, s.base, s.labels, "",
+				float64(metric.Value()))
+		case metrics.GaugeFloat64:
+			writeType(s.base, "gauge")
+			writePrometheusValue(w, s.base, s.labels, "", metric.Value())
+		case metrics.Healthcheck:
+			metric.Check()
+			writeType(s.base, "gauge")
+			healthy := 1.0
+			if metric.Error() != nil {
+				healthy = 0
+			}
+			writePrometheusValue(w, s.base, s.labels, "", healthy)
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			writeType(s.base, "summary")
+			writePrometheusSummary(w, s.base, s.labels, h.Count(), h.Mean(),
+				h.Percentiles(prometheusQuantiles), 1)
+		case metrics.Meter:
+			m := metric.Snapshot()
+			name := s.base + "_total"
+			writeType(name, "counter")
+			writePrometheusValue(w, name, s.labels, "", float64(m.Count()))
+		case metrics.Timer:
+			t := metric.Snapshot()
+			name := s.base + "_seconds"
+			writeType(name, "summary")
+			writePrometheusSummary(w, name, s.labels, t.Count(), t.Mean(),
+				t.Percentiles(prometheusQuantiles), float64(time.Second))
+		}
+	}
+}
+
+// NewPrometheusHandler returns an http.Handler that serves the
+// metrics in the given registry in the Prometheus text exposition
+// format.
+func NewPrometheusHandler(r metrics.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", PrometheusContentType)
+		WritePrometheus(r, w)
+	})
+}
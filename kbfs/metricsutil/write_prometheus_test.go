@@ -0,0 +1,112 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package metricsutil
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestNameWithLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		labelPairs []string
+		expected   string
+	}{
+		{"A.B", nil, "A.B"},
+		{"A.B", []string{"tlf", "1"}, `A.B{tlf="1"}`},
+		{"A.B", []string{"tlf", "1", "op", "get"}, `A.B{tlf="1",op="get"}`},
+		// Label keys are sanitized, and values are escaped.
+		{"A.B", []string{"a-b.c", "x"}, `A.B{a_b_c="x"}`},
+		{"A.B", []string{"v", `q"b\n` + "\n"}, `A.B{v="q\"b\\n\n"}`},
+	} {
+		if name := NameWithLabels(tc.name, tc.labelPairs...); name != tc.expected {
+			t.Errorf("NameWithLabels(%q, %q) = %q, expected %q",
+				tc.name, tc.labelPairs, name, tc.expected)
+		}
+	}
+}
+
+func TestSplitLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name, base, labels string
+	}{
+		{"A.B", "kbfs_A_B", ""},
+		{`A.B{tlf="1"}`, "kbfs_A_B", `tlf="1"`},
+		{`A-B{tlf="1",op="get"}`, "kbfs_A_B", `tlf="1",op="get"`},
+		// An unterminated brace isn't treated as labels.
+		{"A{B", "kbfs_A_B", ""},
+	} {
+		base, labels := splitLabels(tc.name)
+		if base != tc.base || labels != tc.labels {
+			t.Errorf("splitLabels(%q) = (%q, %q), expected (%q, %q)",
+				tc.name, base, labels, tc.base, tc.labels)
+		}
+	}
+}
+
+// Test that all metrics sharing a base name are written as a single
+// family: one TYPE line, with all the samples right after it.
+func TestWritePrometheusGroupsFamilies(t *testing.T) {
+	r := metrics.NewRegistry()
+	// Register in an order that interleaves the families.
+	metrics.GetOrRegisterCounter(NameWithLabels("Ops", "tlf", "b"), r).Inc(2)
+	metrics.GetOrRegisterCounter("Other", r).Inc(5)
+	metrics.GetOrRegisterCounter(NameWithLabels("Ops", "tlf", "a"), r).Inc(1)
+	metrics.GetOrRegisterCounter(NameWithLabels("Ops", "tlf", `"c"`), r).Inc(3)
+
+	var buf bytes.Buffer
+	WritePrometheus(r, &buf)
+	expected := "# TYPE kbfs_Ops counter\n" +
+		`kbfs_Ops{tlf="\"c\""} 3` + "\n" +
+		`kbfs_Ops{tlf="a"} 1` + "\n" +
+		`kbfs_Ops{tlf="b"} 2` + "\n" +
+		"# TYPE kbfs_Other counter\n" +
+		"kbfs_Other 5\n"
+	if output := buf.String(); output != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", output, expected)
+	}
+}
+
+func TestWritePrometheusTimerFamily(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterTimer(NameWithLabels("Get", "tlf", "a"), r)
+	metrics.GetOrRegisterTimer(NameWithLabels("Get", "tlf", "b"), r)
+
+	var buf bytes.Buffer
+	WritePrometheus(r, &buf)
+	output := buf.String()
+	if n := strings.Count(output, "# TYPE "); n != 1 {
+		t.Errorf("Expected one TYPE line, got %d:\n%s", n, output)
+	}
+	for _, expected := range []string{
+		"# TYPE kbfs_Get_seconds summary\n",
+		`kbfs_Get_seconds{tlf="a",quantile="0.5"} 0` + "\n",
+		`kbfs_Get_seconds_count{tlf="b"} 0` + "\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("%q missing from output:\n%s", expected, output)
+		}
+	}
+}
+
+func TestLabelValueLimiter(t *testing.T) {
+	l := NewLabelValueLimiter(2)
+	for _, tc := range []struct{ v, expected string }{
+		{"a", "a"},
+		{"b", "b"},
+		{"c", OverflowLabelValue},
+		// Values seen before the limit was hit are still kept.
+		{"a", "a"},
+		{"c", OverflowLabelValue},
+	} {
+		if v := l.Value(tc.v); v != tc.expected {
+			t.Errorf("Value(%q) = %q, expected %q", tc.v, v, tc.expected)
+		}
+	}
+}